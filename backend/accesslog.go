@@ -0,0 +1,220 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	DEFAULT_ACCESS_LOG_BUFFER = 1024
+)
+
+// AccessEntry 访问日志的一行
+type AccessEntry struct {
+	Time         time.Time `json:"time"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	DB           string    `json:"db"`
+	Measurements []string  `json:"measurements"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	Status       int       `json:"status"`
+	Duration     float64   `json:"duration_ms"`
+	Backends     []string  `json:"backends"`
+}
+
+// AccessLog 以 JSON lines 写访问日志, 写入在后台进行, 缓冲满时丢弃
+type AccessLog struct {
+	w       io.Writer
+	closer  io.Closer
+	ch      chan []byte
+	done    chan struct{}
+	dropped int64
+}
+
+// NewAccessLog 打开访问日志文件, "-" 表示标准输出
+func NewAccessLog(filename string, size int) (al *AccessLog, err error) {
+	if filename == "-" {
+		return NewAccessLogWriter(os.Stdout, size), nil
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	al = NewAccessLogWriter(file, size)
+	al.closer = file
+	return
+}
+
+func NewAccessLogWriter(w io.Writer, size int) (al *AccessLog) {
+	if size <= 0 {
+		size = DEFAULT_ACCESS_LOG_BUFFER
+	}
+	al = &AccessLog{
+		w:    w,
+		ch:   make(chan []byte, size),
+		done: make(chan struct{}),
+	}
+	go al.run()
+	return
+}
+
+func (al *AccessLog) run() {
+	defer close(al.done)
+	for line := range al.ch {
+		_, err := al.w.Write(line)
+		if err != nil {
+			logs.Errorf("write access log error: %s", err)
+		}
+	}
+}
+
+// Log 记录一行, 不会阻塞
+func (al *AccessLog) Log(entry *AccessEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	select {
+	case al.ch <- append(line, '\n'):
+	default:
+		atomic.AddInt64(&al.dropped, 1)
+	}
+}
+
+// Dropped 缓冲满时丢弃的行数
+func (al *AccessLog) Dropped() int64 {
+	return atomic.LoadInt64(&al.dropped)
+}
+
+// Close 写完缓冲中的日志后关闭
+func (al *AccessLog) Close() {
+	close(al.ch)
+	<-al.done
+	if al.closer != nil {
+		al.closer.Close()
+	}
+}
+
+type accessKey struct{}
+
+// accessRecord 在处理请求的过程中收集 measurement 和后端
+type accessRecord struct {
+	lock         sync.Mutex
+	measurements []string
+	backends     []string
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// recordAccess 把 measurement 和选中的后端记到 ctx 的访问日志中, 没有开启时忽略
+func recordAccess(ctx context.Context, measurement string, apis ...BackendAPI) {
+	rec, ok := ctx.Value(accessKey{}).(*accessRecord)
+	if !ok {
+		return
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if measurement != "" {
+		rec.measurements = appendUnique(rec.measurements, measurement)
+	}
+	for _, api := range apis {
+		rec.backends = appendUnique(rec.backends, api.GetName())
+	}
+}
+
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessWriter) Write(p []byte) (n int, err error) {
+	if aw.status == 0 {
+		aw.status = 200
+	}
+	n, err = aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return
+}
+
+func (aw *accessWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type accessReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (ar *accessReader) Read(p []byte) (n int, err error) {
+	n, err = ar.ReadCloser.Read(p)
+	ar.bytes += int64(n)
+	return
+}
+
+// AccessLogHandler 给 handler 加上访问日志, 没有开启时直接返回 handler
+func (ic *InfluxCluster) AccessLogHandler(handler http.HandlerFunc) http.HandlerFunc {
+	if ic.accessLog == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &accessRecord{}
+		aw := &accessWriter{ResponseWriter: w}
+		ar := &accessReader{ReadCloser: req.Body}
+		req.Body = ar
+		req = req.WithContext(context.WithValue(req.Context(), accessKey{}, rec))
+
+		handler(aw, req)
+
+		if aw.status == 0 {
+			aw.status = 200
+		}
+		rec.lock.Lock()
+		entry := &AccessEntry{
+			Time:         start,
+			RemoteAddr:   req.RemoteAddr,
+			Method:       req.Method,
+			Path:         req.URL.Path,
+			DB:           req.FormValue("db"),
+			Measurements: append([]string{}, rec.measurements...),
+			BytesIn:      ar.bytes,
+			BytesOut:     aw.bytes,
+			Status:       aw.status,
+			Duration:     float64(time.Since(start).Microseconds()) / 1000,
+			Backends:     append([]string{}, rec.backends...),
+		}
+		rec.lock.Unlock()
+		ic.accessLog.Log(entry)
+	}
+}
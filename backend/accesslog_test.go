@@ -0,0 +1,77 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	ic.accessLog = NewAccessLogWriter(&buf, 16)
+
+	write := ic.AccessLogHandler(func(w http.ResponseWriter, req *http.Request) {
+		p, _ := ioutil.ReadAll(req.Body)
+		err := ic.WriteContext(req.Context(), p, "ns", req.FormValue("db"))
+		if err == nil {
+			w.WriteHeader(204)
+		}
+	})
+	query := ic.AccessLogHandler(func(w http.ResponseWriter, req *http.Request) {
+		ic.Query(w, req)
+	})
+
+	body := "cpu value=1 1434055562000000000\n"
+	req := httptest.NewRequest("POST", "/write?db=test", strings.NewReader(body))
+	write(httptest.NewRecorder(), req)
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "GRANT ALL PRIVILEGES TO bob")
+	req = httptest.NewRequest("GET", "/query?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	query(w, req)
+	if w.Code != 400 {
+		t.Errorf("query should be forbidden: %d", w.Code)
+	}
+
+	ic.accessLog.Close()
+	var entries []AccessEntry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry AccessEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("access log should be json lines: %s", scanner.Bytes())
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("access log should have 2 lines: %s", buf.Bytes())
+	}
+
+	e := entries[0]
+	if e.Method != "POST" || e.Path != "/write" || e.DB != "test" || e.Status != 204 || e.BytesIn != int64(len(body)) ||
+		len(e.Measurements) != 1 || e.Measurements[0] != "cpu" || len(e.Backends) != 2 || e.Time.IsZero() || e.RemoteAddr == "" {
+		t.Errorf("write entry wrong: %+v", e)
+	}
+	e = entries[1]
+	if e.Method != "GET" || e.Path != "/query" || e.DB != "test" || e.Status != 400 || e.BytesOut != int64(len("query forbidden\n")) ||
+		len(e.Measurements) != 0 || len(e.Backends) != 0 {
+		t.Errorf("query entry wrong: %+v", e)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+var (
+	ErrUnsupportedAggregation = errors.New("unsupported aggregation across shards")
+	ErrShardUnavailable       = errors.New("shard unavailable")
+)
+
+// aggregations that can be merged across shards.
+var shardAggs = map[string]bool{
+	"sum":   true,
+	"count": true,
+	"mean":  true,
+	"min":   true,
+	"max":   true,
+}
+
+func loadShardedMeasurements(nodecfg *NodeConfig) (sharded map[string]bool) {
+	sharded = make(map[string]bool, len(nodecfg.ShardedMeasurements))
+	for _, measurement := range nodecfg.ShardedMeasurements {
+		sharded[measurement] = true
+	}
+	return
+}
+
+func (ic *InfluxCluster) isSharded(key string) bool {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.sharded[key]
+}
+
+// shardColumn 发给分片的查询中的一列, mean 拆成 sum 和 count 两列
+type shardColumn struct {
+	name string
+	// how to merge values of shards: sum, count, min or max.
+	op string
+}
+
+// shardPlan 合并分片查询结果的计划
+type shardPlan struct {
+	query   string
+	columns []string
+	shard   []shardColumn
+	// index of shard columns for each output column (without time).
+	outputs [][]int
+	fill    interface{}
+	desc    bool
+}
+
+func unsupported(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedAggregation, fmt.Sprintf(format, a...))
+}
+
+// planShardQuery 检查 SELECT 能否在分片之间合并, 把 mean 改写成 sum 和 count
+func planShardQuery(q string) (plan *shardPlan, err error) {
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return
+	}
+	if len(query.Statements) != 1 {
+		return nil, unsupported("only one statement is allowed")
+	}
+	stmt, ok := query.Statements[0].(*influxql.SelectStatement)
+	if !ok {
+		return nil, unsupported("not a select statement")
+	}
+	switch {
+	case stmt.Target != nil:
+		return nil, unsupported("INTO")
+	case stmt.Limit != 0 || stmt.Offset != 0 || stmt.SLimit != 0 || stmt.SOffset != 0:
+		return nil, unsupported("LIMIT and OFFSET")
+	case stmt.Fill == influxql.PreviousFill || stmt.Fill == influxql.LinearFill:
+		return nil, unsupported("fill(previous) and fill(linear)")
+	}
+	for _, source := range stmt.Sources {
+		if _, ok := source.(*influxql.Measurement); !ok {
+			return nil, unsupported("subquery")
+		}
+	}
+
+	plan = &shardPlan{
+		columns: stmt.ColumnNames(),
+		desc:    !stmt.TimeAscending(),
+	}
+	if stmt.Fill == influxql.NumberFill {
+		plan.fill = stmt.FillValue
+	}
+	rewritten := stmt.Clone()
+	rewritten.Fields = nil
+	for i, field := range stmt.Fields {
+		call, ok := field.Expr.(*influxql.Call)
+		if !ok {
+			return nil, unsupported("%s is not an aggregation", field.Expr)
+		}
+		name := strings.ToLower(call.Name)
+		if !shardAggs[name] {
+			return nil, unsupported("%s()", call.Name)
+		}
+		if len(call.Args) != 1 {
+			return nil, unsupported("%s", call)
+		}
+		if _, ok := call.Args[0].(*influxql.VarRef); !ok {
+			return nil, unsupported("%s", call)
+		}
+
+		var output []int
+		ops := []string{name}
+		if name == "mean" {
+			ops = []string{"sum", "count"}
+		}
+		for _, op := range ops {
+			col := fmt.Sprintf("__%s_%d", op, i)
+			rewritten.Fields = append(rewritten.Fields, &influxql.Field{
+				Expr:  &influxql.Call{Name: op, Args: call.Args},
+				Alias: col,
+			})
+			output = append(output, len(plan.shard))
+			plan.shard = append(plan.shard, shardColumn{name: col, op: op})
+		}
+		plan.outputs = append(plan.outputs, output)
+	}
+	// empty buckets are filled after merged.
+	if rewritten.Fill == influxql.NumberFill {
+		rewritten.Fill = influxql.NullFill
+		rewritten.FillValue = nil
+	}
+	plan.query = rewritten.String()
+	return
+}
+
+type shardResp struct {
+	Results []struct {
+		Series []shardSeries `json:"series"`
+		Error  string        `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+type shardSeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+type mergedRow struct {
+	time   interface{}
+	order  int64
+	values []interface{}
+}
+
+type mergedSeries struct {
+	key  string
+	name string
+	tags map[string]string
+	rows map[string]*mergedRow
+}
+
+func shardSeriesKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, ",%s=%s", k, tags[k])
+	}
+	return buf.String()
+}
+
+// timeOrder 时间列可能是 epoch 数字或者 RFC3339 字符串
+func timeOrder(t interface{}) int64 {
+	switch t := t.(type) {
+	case json.Number:
+		n, _ := t.Int64()
+		return n
+	case string:
+		tm, _ := time.Parse(time.RFC3339Nano, t)
+		return tm.UnixNano()
+	}
+	return 0
+}
+
+// mergeValue 按 op 合并两个分片的值, 忽略 null, 都是整数时结果也是整数
+func mergeValue(op string, a, b interface{}) interface{} {
+	x, ok := a.(json.Number)
+	if !ok {
+		return b
+	}
+	y, ok := b.(json.Number)
+	if !ok {
+		return a
+	}
+	if op == "sum" || op == "count" {
+		i, err1 := x.Int64()
+		j, err2 := y.Int64()
+		if err1 == nil && err2 == nil {
+			return json.Number(strconv.FormatInt(i+j, 10))
+		}
+	}
+	f, _ := x.Float64()
+	g, _ := y.Float64()
+	switch op {
+	case "min":
+		if g < f {
+			return y
+		}
+		return x
+	case "max":
+		if g > f {
+			return y
+		}
+		return x
+	}
+	return json.Number(strconv.FormatFloat(f+g, 'f', -1, 64))
+}
+
+func (plan *shardPlan) merge(merged map[string]*mergedSeries, body []byte) (err error) {
+	var resp shardResp
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err = dec.Decode(&resp)
+	if err != nil {
+		return
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	for _, result := range resp.Results {
+		if result.Error != "" {
+			return errors.New(result.Error)
+		}
+		for _, series := range result.Series {
+			idx := make([]int, len(plan.shard))
+			for i, col := range plan.shard {
+				idx[i] = -1
+				for j, name := range series.Columns {
+					if name == col.name {
+						idx[i] = j
+					}
+				}
+			}
+
+			key := shardSeriesKey(series.Name, series.Tags)
+			ms, ok := merged[key]
+			if !ok {
+				ms = &mergedSeries{key: key, name: series.Name, tags: series.Tags, rows: make(map[string]*mergedRow)}
+				merged[key] = ms
+			}
+			for _, value := range series.Values {
+				if len(value) == 0 {
+					continue
+				}
+				t := fmt.Sprint(value[0])
+				row, ok := ms.rows[t]
+				if !ok {
+					row = &mergedRow{time: value[0], order: timeOrder(value[0]), values: make([]interface{}, len(plan.shard))}
+					ms.rows[t] = row
+				}
+				for i, col := range plan.shard {
+					if idx[i] < 0 || idx[i] >= len(value) {
+						continue
+					}
+					row.values[i] = mergeValue(col.op, row.values[i], value[idx[i]])
+				}
+			}
+		}
+	}
+	return
+}
+
+// output 合并后的值, mean 由 sum 和 count 算出
+func (plan *shardPlan) output(row *mergedRow) (values []interface{}) {
+	values = append(values, row.time)
+	for _, output := range plan.outputs {
+		var v interface{}
+		if len(output) == 1 {
+			v = row.values[output[0]]
+		} else {
+			sum, ok1 := row.values[output[0]].(json.Number)
+			count, ok2 := row.values[output[1]].(json.Number)
+			if ok1 && ok2 {
+				s, _ := sum.Float64()
+				c, _ := count.Float64()
+				if c > 0 {
+					v = s / c
+				}
+			}
+		}
+		if v == nil {
+			v = plan.fill
+		}
+		values = append(values, v)
+	}
+	return
+}
+
+func (plan *shardPlan) series(merged map[string]*mergedSeries) (series []shardSeries) {
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ms := merged[key]
+		rows := make([]*mergedRow, 0, len(ms.rows))
+		for _, row := range ms.rows {
+			rows = append(rows, row)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if plan.desc {
+				return rows[i].order > rows[j].order
+			}
+			return rows[i].order < rows[j].order
+		})
+		s := shardSeries{Name: ms.name, Tags: ms.tags, Columns: plan.columns}
+		for _, row := range rows {
+			s.Values = append(s.Values, plan.output(row))
+		}
+		series = append(series, s)
+	}
+	return
+}
+
+// aggregateQuery 把 SELECT 发给分片的 measurement 的每个后端, 按时间合并结果再重新聚合
+func (ic *InfluxCluster) aggregateQuery(w http.ResponseWriter, req *http.Request, apis []BackendAPI) (err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	plan, err := planShardQuery(q)
+	if err != nil {
+		writeError(w, 400, err)
+		return
+	}
+
+	form := url.Values{}
+	for k, v := range req.Form {
+		form[k] = append([]string(nil), v...)
+	}
+	form.Set("q", plan.query)
+	form.Del("chunked")
+	form.Del("chunk_size")
+	r, err := http.NewRequestWithContext(req.Context(), "GET", "/query?"+form.Encode(), nil)
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+	r.Form = form
+
+	merged := make(map[string]*mergedSeries)
+	var served []BackendAPI
+	for _, api := range apis {
+		if api.IsWriteOnly() {
+			continue
+		}
+		served = append(served, api)
+		// results without a shard are wrong, not partial.
+		if !api.IsActive() {
+			err = ErrShardUnavailable
+			writeError(w, 503, fmt.Errorf("%w: %s", err, api.GetName()))
+			return
+		}
+		recordAccess(req.Context(), "", api)
+		_, status, body, Err := api.QueryResp(r)
+		if Err == nil && status/100 != 2 {
+			Err = fmt.Errorf("status %d: %s", status, bytes.TrimSpace(body))
+		}
+		if Err == nil {
+			Err = plan.merge(merged, body)
+		}
+		if Err != nil {
+			logs.Errorf("shard query (%s) failed on %s: %s", plan.query, api.GetName(), Err)
+			err = Err
+			writeError(w, 502, fmt.Errorf("%w: %s: %s", ErrShardUnavailable, api.GetName(), Err))
+			return
+		}
+	}
+
+	result := map[string]interface{}{"statement_id": 0}
+	if series := plan.series(merged); len(series) > 0 {
+		result["series"] = series
+	}
+	body, _ := json.Marshal(map[string]interface{}{"results": []interface{}{result}})
+	ic.servedBy(w, req, served...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+	return
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
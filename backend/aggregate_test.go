@@ -0,0 +1,119 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPlanShardQuery(t *testing.T) {
+	plan, err := planShardQuery("SELECT mean(value), max(value) AS top FROM cpu WHERE time > now() - 1h GROUP BY time(1m), host fill(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.query != "SELECT sum(value) AS __sum_0, count(value) AS __count_0, max(value) AS __max_1 FROM cpu WHERE time > now() - 1h GROUP BY time(1m), host" {
+		t.Errorf("rewritten query wrong: %s", plan.query)
+	}
+	if len(plan.columns) != 3 || plan.columns[1] != "mean" || plan.columns[2] != "top" || plan.fill != int64(0) {
+		t.Errorf("plan wrong: %+v", plan)
+	}
+
+	for _, q := range []string{
+		"SELECT percentile(value, 95) FROM cpu GROUP BY time(1m)",
+		"SELECT value FROM cpu",
+		"SELECT count(distinct(value)) FROM cpu",
+		"SELECT mean(value) FROM cpu GROUP BY time(1m) LIMIT 10",
+		"SELECT mean(value) FROM cpu GROUP BY time(1m) fill(previous)",
+		"SELECT mean(value) INTO cpu_1m FROM cpu GROUP BY time(1m)",
+		"SELECT mean(value) FROM (SELECT value FROM cpu) GROUP BY time(1m)",
+	} {
+		_, err = planShardQuery(q)
+		if !errors.Is(err, ErrUnsupportedAggregation) {
+			t.Errorf("%s should be unsupported: %v", q, err)
+		}
+	}
+}
+
+func TestAggregateQuery(t *testing.T) {
+	// buckets 0 and 60 on shard1, 0 and 120 on shard2.
+	a := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__sum_1"],"values":[[0,10,2,10],[60,6,3,6]]}]}]}`)
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__sum_1"],"values":[[0,20,2,20],[120,4.5,1,4.5]]}]}]}`)
+	ts1 := CreateReplicaServer(a, false)
+	defer ts1.Close()
+	ts2 := CreateReplicaServer(b, true)
+	defer ts2.Close()
+
+	newBackends := func(url, name string) *Backends {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = url
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	bs1 := newBackends(ts1.URL, "shard1")
+	defer bs1.Close()
+	bs2 := newBackends(ts2.URL, "shard2")
+	defer bs2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ShardedMeasurements: []string{"cpu"}}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs1, bs2}}}
+
+	query := func(q string) *DummyResponseWriter {
+		form := url.Values{}
+		form.Set("db", "test")
+		form.Set("epoch", "s")
+		form.Set("q", q)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+form.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	w := query("SELECT mean(value), sum(value) FROM cpu WHERE time >= 0 GROUP BY time(1m)")
+	if w.status != 200 {
+		t.Fatalf("query wrong: %d %s", w.status, w.buffer.Bytes())
+	}
+	var resp shardResp
+	err := json.Unmarshal(w.buffer.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || len(resp.Results[0].Series) != 1 {
+		t.Fatalf("merged result wrong: %s", w.buffer.Bytes())
+	}
+	series := resp.Results[0].Series[0]
+	if series.Name != "cpu" || len(series.Columns) != 3 || series.Columns[1] != "mean" || series.Columns[2] != "sum" {
+		t.Errorf("merged columns wrong: %+v", series)
+	}
+	expected := [][]float64{{0, 7.5, 30}, {60, 2, 6}, {120, 4.5, 4.5}}
+	if len(series.Values) != len(expected) {
+		t.Fatalf("merged values wrong: %v", series.Values)
+	}
+	for i, row := range expected {
+		for j, v := range row {
+			if series.Values[i][j] != v {
+				t.Errorf("merged value [%d][%d] wrong: %v != %v", i, j, series.Values[i][j], v)
+			}
+		}
+	}
+
+	w = query("SELECT percentile(value, 95) FROM cpu GROUP BY time(1m)")
+	if w.status != 400 {
+		t.Errorf("unsupported aggregation should be rejected: %d %s", w.status, w.buffer.Bytes())
+	}
+
+	atomic.StoreInt32(&bs2.disabled, 1)
+	w = query("SELECT sum(value) FROM cpu GROUP BY time(1m)")
+	if w.status != 503 {
+		t.Errorf("inactive shard should fail: %d %s", w.status, w.buffer.Bytes())
+	}
+}
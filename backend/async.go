@@ -0,0 +1,57 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// discardWriter 丢弃后台查询的响应
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (dw *discardWriter) Header() http.Header {
+	if dw.header == nil {
+		dw.header = make(http.Header)
+	}
+	return dw.header
+}
+
+func (dw *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (dw *discardWriter) WriteHeader(status int) {
+	dw.status = status
+}
+
+// asyncQuery 马上返回 204, 由 run 在后台执行语句, 错误只记日志和 AsyncQueriesFail.
+// 后台执行不受客户端断开和查询超时的影响.
+func (ic *InfluxCluster) asyncQuery(w http.ResponseWriter, req *http.Request, run func(http.ResponseWriter, *http.Request) error) {
+	atomic.AddInt64(&ic.stats.AsyncQueries, 1)
+	bg := req.Clone(context.Background())
+	bg.Form.Del("async")
+	q := strings.TrimSpace(req.FormValue("q"))
+	go func() {
+		dw := &discardWriter{}
+		err := run(dw, bg)
+		if err == nil && dw.status/100 != 2 && dw.status != 0 {
+			err = fmt.Errorf("status %d", dw.status)
+		}
+		if err != nil {
+			atomic.AddInt64(&ic.stats.AsyncQueriesFail, 1)
+			logs.Errorf("async query (%s) error: %s", q, err)
+		}
+	}()
+	w.WriteHeader(204)
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	PERM_READ = 1 << iota
+	PERM_WRITE
+	// statements changing the schema or deleting data, e.g. DROP MEASUREMENT.
+	PERM_ADMIN
+)
+
+// authPermissions 配置中的权限名, admin 包含 read 和 write
+var authPermissions = map[string]int{
+	"read":  PERM_READ,
+	"write": PERM_WRITE,
+	"admin": PERM_READ | PERM_WRITE | PERM_ADMIN,
+}
+
+// statements of every query needing PERM_ADMIN, checked after each ; as well.
+var adminQuery = regexp.MustCompile(`(?i:(^|;)\s*((create|alter|drop|delete|grant|revoke|kill|set\s+password)\s|show\s+queries\b))`)
+
+// SELECT ... INTO writes the result, needing PERM_WRITE.
+var intoQuery = regexp.MustCompile(`(?i:(^|;)\s*select\s[^;]*\sinto[\s"])`)
+
+// authTokens token 到权限的映射, 为 nil 时不校验
+type authTokens struct {
+	tokens map[string]int
+}
+
+// newAuthTokens 加载 AuthTokens, token 中的 $VAR 和 ${VAR} 从环境变量展开
+func newAuthTokens(nodecfg *NodeConfig) (auth *authTokens, err error) {
+	if len(nodecfg.AuthTokens) == 0 {
+		return nil, nil
+	}
+	auth = &authTokens{tokens: make(map[string]int, len(nodecfg.AuthTokens))}
+	for token, perms := range nodecfg.AuthTokens {
+		var perm int
+		for _, name := range strings.Split(perms, ",") {
+			p, ok := authPermissions[strings.TrimSpace(name)]
+			if !ok {
+				logs.Errorf("unknown permission %s of auth token", name)
+				return nil, ErrIllegalConfig
+			}
+			perm |= p
+		}
+		token = os.ExpandEnv(token)
+		if token == "" {
+			logs.Errorf("empty auth token")
+			return nil, ErrIllegalConfig
+		}
+		auth.tokens[token] = perm
+	}
+	return
+}
+
+// requestToken 返回请求的 token, 支持 Authorization: Token <token>,
+// 以及 Basic 和 p 参数, 同 InfluxDB 2 的 v1 兼容接口, 密码即 token
+func requestToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if i := strings.IndexByte(h, ' '); i > 0 && strings.EqualFold(h[:i], "Token") {
+		return strings.TrimSpace(h[i+1:])
+	}
+	if _, password, ok := req.BasicAuth(); ok {
+		return password
+	}
+	return req.URL.Query().Get("p")
+}
+
+// stripCredentials 去掉请求中的 token, 不转发给后端. 后端的认证用 BackendConfig 的 BasicAuth,
+// InfluxDB 1.x 中 u 和 p 参数优先于 Authorization.
+func stripCredentials(req *http.Request) {
+	req.ParseForm()
+	for _, k := range []string{"u", "p"} {
+		req.Form.Del(k)
+		req.PostForm.Del(k)
+	}
+	query := req.URL.Query()
+	if query.Has("u") || query.Has("p") {
+		query.Del("u")
+		query.Del("p")
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Del("Authorization")
+}
+
+// permission 返回 token 的权限, 未知的 token 返回 0
+func (auth *authTokens) permission(token string) (perm int) {
+	if token == "" {
+		return 0
+	}
+	// compare with all of them, the time doesn't tell which one is close.
+	for t, p := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			perm = p
+		}
+	}
+	return
+}
+
+// QueryPermission 返回执行 q 需要的权限
+func QueryPermission(q string) int {
+	if adminQuery.MatchString(q) {
+		return PERM_ADMIN
+	}
+	if intoQuery.MatchString(q) {
+		return PERM_READ | PERM_WRITE
+	}
+	return PERM_READ
+}
+
+// Authorize 校验请求的 token 有 perm 的权限, 没有配置 AuthTokens 时都允许, 请求原样转发.
+// 校验通过后去掉请求中的 token. token 无效时返回 401, 权限不足时返回 403, 返回 false 表示已经应答.
+func (ic *InfluxCluster) Authorize(w http.ResponseWriter, req *http.Request, perm int) bool {
+	if ic.auth == nil {
+		return true
+	}
+	granted := ic.auth.permission(requestToken(req))
+	if granted&perm == perm {
+		stripCredentials(req)
+		return true
+	}
+	atomic.AddInt64(&ic.stats.AuthFailures, 1)
+	w.Header().Set("Content-Type", "application/json")
+	if granted == 0 {
+		w.Header().Set("WWW-Authenticate", `Token realm="influx-proxy"`)
+		w.WriteHeader(401)
+		w.Write([]byte("{\"error\":\"authorization failed\"}\n"))
+		return false
+	}
+	w.WriteHeader(403)
+	w.Write([]byte("{\"error\":\"permission denied\"}\n"))
+	return false
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInfluxdbClusterAuthorize(t *testing.T) {
+	t.Setenv("INFLUX_WRITE_TOKEN", "w-secret")
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{AuthTokens: map[string]string{
+		"$INFLUX_WRITE_TOKEN": "write",
+		"r-secret":            "read",
+		"rw-secret":           "read, write",
+		"a-secret":            "admin",
+	}}, ".")
+
+	authorize := func(auth, q string, perm int) int {
+		req := httptest.NewRequest("POST", "/query?q="+url.QueryEscape(q), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if q != "" {
+			perm = QueryPermission(q)
+		}
+		w := httptest.NewRecorder()
+		if ic.Authorize(w, req, perm) {
+			return 200
+		}
+		return w.Code
+	}
+
+	tests := []struct {
+		auth string
+		q    string
+		perm int
+		code int
+	}{
+		{"Token w-secret", "", PERM_WRITE, 200},
+		{"token w-secret", "", PERM_WRITE, 200},
+		{"Token w-secret", "DROP MEASUREMENT cpu", 0, 403},
+		{"Token w-secret", "select * from cpu; delete from cpu", 0, 403},
+		{"Token w-secret", "select * from cpu", 0, 403},
+		{"Token r-secret", "select * from cpu", 0, 200},
+		{"Token r-secret", "", PERM_WRITE, 403},
+		{"Token rw-secret", "", PERM_WRITE, 200},
+		{"Token r-secret", "SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h)", 0, 403},
+		{"Token r-secret", "select * from cpu; select * into \"cpu2\" from cpu", 0, 403},
+		{"Token r-secret", `select "into" from cpu`, 0, 200},
+		{"Token rw-secret", "select * into cpu2 from cpu", 0, 200},
+		{"Token rw-secret", "drop measurement cpu", 0, 403},
+		{"Token a-secret", "drop measurement cpu", 0, 200},
+		{"Token a-secret", "", PERM_WRITE, 200},
+		{"Token wrong", "", PERM_WRITE, 401},
+		{"Token ", "", PERM_WRITE, 401},
+		{"Bearer w-secret", "", PERM_WRITE, 401},
+		{"", "", PERM_WRITE, 401},
+	}
+	for _, tt := range tests {
+		if code := authorize(tt.auth, tt.q, tt.perm); code != tt.code {
+			t.Errorf("%q %q: %d, want %d", tt.auth, tt.q, code, tt.code)
+		}
+	}
+
+	// the password of v1 clients is the token.
+	req := httptest.NewRequest("POST", "/write", nil)
+	req.SetBasicAuth("any", "w-secret")
+	if !ic.Authorize(httptest.NewRecorder(), req, PERM_WRITE) {
+		t.Errorf("basic auth should be accepted")
+	}
+	req = httptest.NewRequest("POST", "/write?u=any&p=w-secret", nil)
+	if !ic.Authorize(httptest.NewRecorder(), req, PERM_WRITE) {
+		t.Errorf("token in p should be accepted")
+	}
+
+	w := httptest.NewRecorder()
+	ic.Authorize(w, httptest.NewRequest("POST", "/write", nil), PERM_WRITE)
+	if w.Header().Get("WWW-Authenticate") == "" || w.Body.String() != "{\"error\":\"authorization failed\"}\n" {
+		t.Errorf("401 wrong: %v %s", w.Header(), w.Body.String())
+	}
+	if ic.stats.AuthFailures == 0 {
+		t.Errorf("failures should be counted")
+	}
+
+	// not checked without tokens.
+	open := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	if !open.Authorize(httptest.NewRecorder(), httptest.NewRequest("POST", "/query", nil), PERM_ADMIN) {
+		t.Errorf("requests should be allowed without tokens")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("unknown permission should be rejected")
+		}
+	}()
+	NewInfluxCluster(&FileConfigSource{}, &NodeConfig{AuthTokens: map[string]string{"x": "delete"}}, ".")
+}
+
+func TestInfluxdbClusterAuthorizeStripToken(t *testing.T) {
+	var lock sync.Mutex
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			lock.Lock()
+			seen = append(seen, req.Header.Get("Authorization")+" "+req.URL.RawQuery)
+			lock.Unlock()
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("db1")
+	cfg.URL = ts.URL
+
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBackends(cfg, "secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.backends["secret"] = bs
+	ic.m2bs["test"]["secret"] = []BackendAPI{bs}
+	ic.auth, _ = newAuthTokens(&NodeConfig{AuthTokens: map[string]string{"r-secret": "read"}})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/query?db=test&q=select+*+from+secret", nil),
+		httptest.NewRequest("GET", "/query?db=test&q=select+*+from+secret&u=any&p=r-secret", nil),
+		httptest.NewRequest("POST", "/query?u=any&p=r-secret", strings.NewReader("db=test&q=select+*+from+secret")),
+	} {
+		if req.Method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else if req.URL.Query().Get("p") == "" {
+			req.Header.Set("Authorization", "Token r-secret")
+		}
+		if !ic.Authorize(httptest.NewRecorder(), req, QueryPermission(req.FormValue("q"))) {
+			t.Fatalf("%s should be authorized", req.URL)
+		}
+		w := NewDummyResponseWriter()
+		if err = ic.Query(w, req); err != nil || w.status != 200 {
+			t.Fatalf("query failed: %d %v", w.status, err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(seen) != 3 {
+		t.Fatalf("queries should reach the backend: %v", seen)
+	}
+	for _, s := range seen {
+		if strings.Contains(s, "r-secret") || strings.Contains(s, "u=") || !strings.HasPrefix(s, " ") {
+			t.Errorf("the token should not reach the backend: %s", s)
+		}
+	}
+}
@@ -6,52 +6,163 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
+	"net/url"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zxf0089216/influx-proxy/logs"
 )
 
 const (
-	WRITE_QUEUE = 16
+	WRITE_QUEUE               = 16
+	DEFAULT_FLUSH_CONCURRENCY = 4
+	DEFAULT_WRITE_RETRIES     = 2
+	DEFAULT_RETRY_BACKOFF     = 250
+	DEFAULT_DRAIN_TIMEOUT     = 60000
 )
 
+// reasons of Flush
+const (
+	FLUSH_COUNT = "count"
+	FLUSH_TIMER = "timer"
+	FLUSH_CLOSE = "close"
+	// precision of the row differs from the buffered ones.
+	FLUSH_PRECISION = "precision"
+	// buffer is larger than MaxBufferBytes.
+	FLUSH_BYTES = "bytes"
+)
+
+// bufferPool 复用各后端的写入缓冲, sendBatch 压缩后就不再使用
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+type writeItem struct {
+	p         []byte
+	precision string
+	// flush the buffer and close it, instead of writing p.
+	flushed chan struct{}
+	// spool p instead of writing it, e.g. beyond the replication cap.
+	spool bool
+}
+
 type Backends struct {
 	*HttpBackend
+	Name            string
 	fb              *FileBackend
 	Interval        int
 	RewriteInterval int
 	MaxRowLimit     int32
+	MinRowLimit     int32
+	MaxBufferAge    time.Duration
+	MaxBufferBytes  int
+	SlowWrite       time.Duration
+	WriteRetries    int
+	RetryBackoff    time.Duration
+	// drop the whole batch on 400, instead of looking for the bad lines.
+	DropBadBatch bool
+	// spool failed batches of a shadow backend, dropped by default.
+	ShadowSpool bool
+	// merge points of the same series and timestamp in a batch, and log them if DedupWarn.
+	DedupPoints bool
+	DedupWarn   bool
+	// timestamps are converted to the precision before forwarded.
+	ForcePrecision string
+	// false to refuse writes while inactive, so clients get 503 instead of the data being spooled.
+	SpoolOnFailure bool
+	// notified when writes start or stop being spooled.
+	hook *failoverHook
+	// nil if dead letter is disabled.
+	dl *DeadLetter
+
+	// current batch size, within [MinRowLimit, MaxRowLimit].
+	rowLimit int32
+
+	// rate limit of the bad line logs.
+	badLogSecond int64
+	badLogs      int32
 
 	running          bool
 	ticker           *time.Ticker
-	ch_write         chan []byte
+	ch_write         chan writeItem
 	buffer           *bytes.Buffer
+	precision        string
 	ch_timer         <-chan time.Time
+	flush_sem        chan struct{}
 	write_counter    int32
-	rewriter_running bool
+	rewriter_running int32
 	wg               sync.WaitGroup
+	// rewrite loop, waited before draining the spool.
+	rewriter sync.WaitGroup
+	// held by a rewrite, a purge of the spool is refused meanwhile.
+	rewriting sync.Mutex
+	// frames replayed at the same time, 1 to replay one by one.
+	RewriteConcurrency int
+	// replay the spool up to drain_timeout after closed.
+	drain_timeout time.Duration
+	// closed when the worker exits.
+	done chan struct{}
+	// lines to spool, written to the spool file with the buffer.
+	spooled          bytes.Buffer
+	spooledPrecision string
 }
 
 // maybe ch_timer is not the best way.
 // NewBackends 新建一个Backends对象
 func NewBackends(cfg *BackendConfig, name string, storedir string) (bs *Backends, err error) {
 	bs = &Backends{
-		HttpBackend: NewHttpBackend(cfg),
+		HttpBackend: newHttpBackend(cfg, name),
+		Name:        name,
 		// FIXME: path...
-		Interval:         cfg.Interval,
-		RewriteInterval:  cfg.RewriteInterval,
-		running:          true,
-		ticker:           time.NewTicker(time.Millisecond * time.Duration(cfg.RewriteInterval)),
-		ch_write:         make(chan []byte, 16),
-		rewriter_running: false,
-		MaxRowLimit:      int32(cfg.MaxRowLimit),
-	}
-	bs.fb, err = NewFileBackend(name, storedir)
+		Interval:           cfg.Interval,
+		RewriteInterval:    cfg.RewriteInterval,
+		running:            true,
+		ticker:             time.NewTicker(time.Millisecond * time.Duration(cfg.RewriteInterval)),
+		ch_write:           make(chan writeItem, 16),
+		MaxRowLimit:        int32(cfg.MaxRowLimit),
+		MinRowLimit:        int32(cfg.MinRowLimit),
+		rowLimit:           int32(cfg.MaxRowLimit),
+		SlowWrite:          time.Millisecond * time.Duration(cfg.SlowWrite),
+		MaxBufferAge:       time.Millisecond * time.Duration(cfg.MaxBufferAge),
+		MaxBufferBytes:     cfg.MaxBufferBytes,
+		WriteRetries:       cfg.WriteRetries,
+		RetryBackoff:       time.Millisecond * time.Duration(cfg.RetryBackoff),
+		DropBadBatch:       cfg.DropBadBatch == 1,
+		ShadowSpool:        cfg.ShadowSpool == 1,
+		DedupPoints:        cfg.DedupPoints == 1,
+		DedupWarn:          cfg.DedupWarn == 1,
+		ForcePrecision:     cfg.ForcePrecision,
+		SpoolOnFailure:     cfg.SpoolOnFailure >= 0,
+		RewriteConcurrency: cfg.RewriteConcurrency,
+		done:               make(chan struct{}),
+	}
+	if cfg.FailoverWebhook != "" {
+		bs.hook = newFailoverHook(cfg.FailoverWebhook)
+	}
+	if cfg.FlushConcurrency > 0 {
+		bs.flush_sem = make(chan struct{}, cfg.FlushConcurrency)
+	} else {
+		bs.flush_sem = make(chan struct{}, DEFAULT_FLUSH_CONCURRENCY)
+	}
+	bs.fb, err = NewFileBackend(cfg, name, storedir)
 	if err != nil {
 		return
 	}
+	if cfg.DeadLetter == 1 {
+		size := int64(cfg.DeadLetterSize)
+		if size <= 0 {
+			size = DEFAULT_DEAD_LETTER_SIZE
+		}
+		bs.dl, err = NewDeadLetter(filepath.Join(storedir, name+".dead"), size)
+		if err != nil {
+			return
+		}
+	}
 
 	go bs.worker()
 	return
@@ -61,29 +172,45 @@ func (bs *Backends) GetDB() (db string) {
 	return bs.DB
 }
 
+func (bs *Backends) GetName() (name string) {
+	return bs.Name
+}
+
 // worker 新建Backends对象时，启动作为守护协程
 func (bs *Backends) worker() {
-	for bs.running {
+	defer close(bs.done)
+	// exit only when ch_write is closed, so the buffer is always flushed.
+	for {
 		select {
-		case p, ok := <-bs.ch_write:
+		case item, ok := <-bs.ch_write:
 			if !ok {
 				// closed
-				bs.Flush()
+				bs.Flush(FLUSH_CLOSE)
 				bs.wg.Wait()
+				bs.ticker.Stop()
+				if bs.drain_timeout > 0 {
+					bs.drainSpool(time.Now().Add(bs.drain_timeout))
+				}
 				bs.HttpBackend.Close()
 				bs.fb.Close()
+				if bs.dl != nil {
+					bs.dl.Close()
+				}
 				return
 			}
-			bs.WriteBuffer(p)
+			if item.flushed != nil {
+				bs.Flush(FLUSH_CLOSE)
+				close(item.flushed)
+				continue
+			}
+			if item.spool {
+				bs.SpoolBuffer(item.p, item.precision)
+				continue
+			}
+			bs.WriteBuffer(item.p, item.precision)
 
 		case <-bs.ch_timer:
-			bs.Flush()
-			if !bs.running {
-				bs.wg.Wait()
-				bs.HttpBackend.Close()
-				bs.fb.Close()
-				return
-			}
+			bs.Flush(FLUSH_TIMER)
 
 		case <-bs.ticker.C:
 			bs.Idle()
@@ -93,11 +220,82 @@ func (bs *Backends) worker() {
 
 // Write 把[]byte类型p发送到ch_write管道中
 func (bs *Backends) Write(p []byte) (err error) {
+	return bs.WritePrecision(p, "")
+}
+
+// WritePrecision 同 Write, p 的时间戳精度为 precision, 空表示纳秒
+func (bs *Backends) WritePrecision(p []byte, precision string) (err error) {
+	if !bs.running {
+		return io.ErrClosedPipe
+	}
+	if bs.ForcePrecision != "" {
+		p = convertPrecision(p, precision, bs.ForcePrecision)
+		precision, _ = normalPrecision(bs.ForcePrecision)
+	}
+
+	// a shadow backend never blocks the primary writes.
+	if bs.IsShadow() {
+		select {
+		case bs.ch_write <- writeItem{p: p, precision: precision}:
+		default:
+			atomic.AddInt64(&bs.stats.ShadowDropped, 1)
+		}
+		return
+	}
+	bs.ch_write <- writeItem{p: p, precision: precision}
+	return
+}
+
+// refuses 关闭了 SpoolOnFailure 并且后端不可用时不接受写入
+func (bs *Backends) refuses() bool {
+	return !bs.SpoolOnFailure && !bs.IsActive()
+}
+
+// Spool 同 WritePrecision, p 不发送, 和缓冲一起写到备份文件, 由重放协程补发
+func (bs *Backends) Spool(p []byte, precision string) (err error) {
 	if !bs.running {
 		return io.ErrClosedPipe
 	}
+	if bs.ForcePrecision != "" {
+		p = convertPrecision(p, precision, bs.ForcePrecision)
+		precision, _ = normalPrecision(bs.ForcePrecision)
+	}
+	atomic.AddInt64(&bs.stats.CappedPoints, 1)
+	bs.ch_write <- writeItem{p: p, precision: precision, spool: true}
+	return
+}
+
+// WriteSync 不经过管道和缓冲, 马上压缩发送 p, 返回后端的状态码和错误响应.
+// 后端不可用时 status 为 0. fallback 时失败的数据写到备份文件, 由重放协程补发, 不返回错误
+func (bs *Backends) WriteSync(p []byte, precision string, fallback bool) (status int, body []byte, err error) {
+	if !bs.running {
+		return 0, nil, io.ErrClosedPipe
+	}
+	if bs.ForcePrecision != "" {
+		p = convertPrecision(p, precision, bs.ForcePrecision)
+		precision, _ = normalPrecision(bs.ForcePrecision)
+	}
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		return
+	}
 
-	bs.ch_write <- p
+	if bs.HttpBackend.IsActive() {
+		status, body, err = bs.HttpBackend.post(bytes.NewReader(buf.Bytes()), true, precision)
+		if err == nil && status == 204 {
+			bs.setFailover(false)
+			return
+		}
+	} else {
+		err = ErrUnavailable
+	}
+	if !fallback {
+		return
+	}
+	logs.Errorf("sync write of backend %s failed, status %d, error %v, spooled", bs.name, status, err)
+	status, body = 0, nil
+	err = bs.fb.WritePrecision(buf.Bytes(), precision)
 	return
 }
 
@@ -108,12 +306,62 @@ func (bs *Backends) Close() (err error) {
 	return
 }
 
-// WriteBuffer 对象p写进bs.buffer
-func (bs *Backends) WriteBuffer(p []byte) {
+// FlushBuffer 等 worker 处理完管道中已有的数据后清空缓冲
+func (bs *Backends) FlushBuffer() {
+	if !bs.running {
+		return
+	}
+	flushed := make(chan struct{})
+	bs.ch_write <- writeItem{flushed: flushed}
+	<-flushed
+}
+
+// Pending 管道中还没有处理的数据和正在发送的 batch 数
+func (bs *Backends) Pending() int {
+	return len(bs.ch_write) + int(atomic.LoadInt64(&bs.stats.FlushInflight))
+}
+
+// Drain 关闭写入, 清空缓冲, 在 timeout 内继续重放备份文件, 然后关闭.
+// 超时后剩下的数据留在备份文件中, 返回 ErrSpoolNotDrained.
+func (bs *Backends) Drain(timeout time.Duration) (err error) {
+	bs.drain_timeout = timeout
+	bs.Close()
+	<-bs.done
+	if bs.fb.IsData() {
+		return ErrSpoolNotDrained
+	}
+	return
+}
+
+// drainSpool 等待重放协程退出后, 在 deadline 前重放备份文件
+func (bs *Backends) drainSpool(deadline time.Time) {
+	bs.rewriter.Wait()
+	for bs.fb.IsData() && time.Now().Before(deadline) {
+		if bs.HttpBackend.IsActive() && bs.Rewrite() == nil {
+			continue
+		}
+		wait := time.Millisecond * time.Duration(bs.RewriteInterval)
+		if left := time.Until(deadline); wait > left {
+			wait = left
+		}
+		time.Sleep(wait)
+	}
+	if bs.fb.IsData() {
+		logs.Warningf("backend %s closed before the spool is drained", bs.Name)
+	}
+}
+
+// WriteBuffer 对象p写进bs.buffer, 同一个buffer里的数据精度相同
+func (bs *Backends) WriteBuffer(p []byte, precision string) {
+	if bs.buffer != nil && bs.buffer.Len() > 0 && bs.precision != precision {
+		bs.Flush(FLUSH_PRECISION)
+	}
+	bs.precision = precision
 	bs.write_counter++
 
 	if bs.buffer == nil {
-		bs.buffer = &bytes.Buffer{}
+		bs.buffer = bufferPool.Get().(*bytes.Buffer)
+		bs.buffer.Reset()
 	}
 
 	n, err := bs.buffer.Write(p)
@@ -136,8 +384,10 @@ func (bs *Backends) WriteBuffer(p []byte) {
 	}
 
 	switch {
-	case bs.write_counter >= bs.MaxRowLimit:
-		bs.Flush()
+	case bs.write_counter >= atomic.LoadInt32(&bs.rowLimit):
+		bs.Flush(FLUSH_COUNT)
+	case bs.MaxBufferBytes > 0 && bs.buffer.Len() >= bs.MaxBufferBytes:
+		bs.Flush(FLUSH_BYTES)
 	case bs.ch_timer == nil:
 		bs.ch_timer = time.After(
 			time.Millisecond * time.Duration(bs.Interval))
@@ -146,75 +396,223 @@ func (bs *Backends) WriteBuffer(p []byte) {
 	return
 }
 
-// Flush 清空管道中的数据到备份文件中
-func (bs *Backends) Flush() {
+// SpoolBuffer 同 WriteBuffer, p 写进要写到备份文件的缓冲
+func (bs *Backends) SpoolBuffer(p []byte, precision string) {
+	if bs.spooled.Len() > 0 && bs.spooledPrecision != precision {
+		bs.flushSpooled()
+	}
+	bs.spooledPrecision = precision
+	bs.spooled.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		bs.spooled.WriteByte('\n')
+	}
+	switch {
+	case bs.MaxBufferBytes > 0 && bs.spooled.Len() >= bs.MaxBufferBytes:
+		bs.flushSpooled()
+	case bs.ch_timer == nil:
+		bs.ch_timer = time.After(
+			time.Millisecond * time.Duration(bs.Interval))
+	}
+}
+
+// flushSpooled 把要写到备份文件的缓冲写为一帧
+func (bs *Backends) flushSpooled() {
+	if bs.spooled.Len() == 0 {
+		return
+	}
+	bs.sendBatch(bs.spooled.Bytes(), bs.spooledPrecision, false)
+	bs.spooled.Reset()
+}
+
+// Flush 清空管道中的数据到备份文件中, reason为触发原因
+func (bs *Backends) Flush(reason string) {
+	bs.flushSpooled()
 	if bs.buffer == nil {
+		// the timer of the spooled lines.
+		bs.ch_timer = nil
 		return
 	}
 
-	p := bs.buffer.Bytes()
+	buffer := bs.buffer
+	p := buffer.Bytes()
+	precision := bs.precision
+	rows := bs.write_counter
 	bs.buffer = nil
 	bs.ch_timer = nil
 	bs.write_counter = 0
 
 	if len(p) == 0 {
+		bufferPool.Put(buffer)
+		return
+	}
+	p = bs.dedup(p)
+
+	switch reason {
+	case FLUSH_COUNT:
+		atomic.AddInt64(&bs.stats.FlushByCount, 1)
+	case FLUSH_TIMER:
+		atomic.AddInt64(&bs.stats.FlushByTimer, 1)
+	case FLUSH_CLOSE:
+		atomic.AddInt64(&bs.stats.FlushByClose, 1)
+	case FLUSH_PRECISION:
+		atomic.AddInt64(&bs.stats.FlushByPrecision, 1)
+	case FLUSH_BYTES:
+		atomic.AddInt64(&bs.stats.FlushByBytes, 1)
+	}
+	atomic.AddInt64(&bs.stats.FlushRows, int64(rows))
+	atomic.AddInt64(&bs.stats.FlushBytes, int64(len(p)))
+
+	select {
+	case bs.flush_sem <- struct{}{}:
+	default:
+		// too many batches in flight, spool it and let the rewrite loop send it.
+		atomic.AddInt64(&bs.stats.FlushSaturated, 1)
+		bs.sendBatch(p, precision, false)
+		bufferPool.Put(buffer)
 		return
 	}
 
-	// TODO: limitation
+	atomic.AddInt64(&bs.stats.FlushInflight, 1)
 	bs.wg.Add(1)
 	go func() {
 		defer bs.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
-		if err != nil {
-			logs.Errorf("write file error: %s\n", err)
-			return
-		}
+		defer func() {
+			atomic.AddInt64(&bs.stats.FlushInflight, -1)
+			<-bs.flush_sem
+		}()
+		bs.sendBatch(p, precision, true)
+		bufferPool.Put(buffer)
+	}()
 
-		p = buf.Bytes()
+	return
+}
 
-		// maybe blocked here, run in another goroutine
-		if bs.HttpBackend.IsActive() {
-			err = bs.HttpBackend.WriteCompressed(p)
-			switch err {
-			case nil:
-				return
-			case ErrBadRequest:
-				logs.Errorf("bad request, drop all data.")
-				return
-			case ErrNotFound:
-				logs.Errorf("bad backend, drop all data.")
+// sendBatch 压缩并发送一批数据, 失败或者不发送时写到备份文件中
+func (bs *Backends) sendBatch(p []byte, precision string, send bool) {
+	var buf bytes.Buffer
+	err := Compress(&buf, p)
+	if err != nil {
+		logs.Errorf("write file error: %s\n", err)
+		return
+	}
+
+	p = buf.Bytes()
+
+	// maybe blocked here, run in another goroutine
+	if send && bs.HttpBackend.IsActive() {
+		start := time.Now()
+		err = bs.HttpBackend.WriteCompressedPrecision(p, precision)
+		bs.adaptRowLimit(err, time.Since(start))
+		// transient error, retry in place instead of waiting for the rewrite loop.
+		for i := 0; i < bs.WriteRetries && retryable(err); i++ {
+			time.Sleep(bs.RetryBackoff)
+			atomic.AddInt64(&bs.stats.WriteRetries, 1)
+			err = bs.HttpBackend.WriteCompressedPrecision(p, precision)
+			if err == nil {
+				atomic.AddInt64(&bs.stats.WriteRetrySuccess, 1)
+			}
+		}
+		if err == ErrBadRequest && !bs.DropBadBatch || err == ErrTooLarge {
+			err = bs.splitBatch(p, precision, err)
+			if err == nil {
+				bs.setFailover(false)
 				return
-			default:
-				logs.Errorf("unknown error %s, maybe overloaded.", err)
 			}
-			logs.Errorf("write http error: %s\n", err)
 		}
+		switch err {
+		case nil:
+			bs.setFailover(false)
+			return
+		case ErrBadRequest:
+			logs.Errorf("bad request, drop all data.")
+			bs.setFailover(false)
+			bs.deadLetter(DEAD_BAD_REQUEST, precision, p)
+			return
+		case ErrNotFound:
+			logs.Errorf("bad backend, drop all data.")
+			bs.setFailover(false)
+			bs.deadLetter(DEAD_NOT_FOUND, precision, p)
+			return
+		default:
+			logs.Errorf("unknown error %s, maybe overloaded.", err)
+		}
+		logs.Errorf("write http error: %s\n", err)
+	}
 
-		err = bs.fb.Write(p)
-		if err != nil {
-			logs.Errorf("write file error: %s\n", err)
+	if bs.IsShadow() {
+		atomic.AddInt64(&bs.stats.ShadowWriteFail, 1)
+		if !bs.ShadowSpool {
+			return
 		}
-		// don't try to run rewrite loop directly.
-		// that need a lock.
-	}()
+	}
+	// the backend is unavailable, not just too many flushes in flight.
+	if send {
+		bs.setFailover(true)
+	}
 
-	return
+	err = bs.fb.WritePrecision(p, precision)
+	if err != nil {
+		logs.Errorf("write file error: %s\n", err)
+	}
+	// don't try to run rewrite loop directly.
+	// that need a lock.
+}
+
+// retryable 判断写入错误是否值得立即重试: 连接错误和 502/503/504
+func retryable(err error) bool {
+	if err == ErrUnavailable {
+		return true
+	}
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
+
+// deadLetter 把丢弃的压缩数据 p 保存到 dead letter 文件, 没有开启时忽略
+func (bs *Backends) deadLetter(reason, precision string, p []byte) {
+	if bs.dl == nil {
+		return
+	}
+	err := bs.dl.WriteCompressed(reason, precision, p)
+	if err != nil {
+		logs.Errorf("write dead letter of backend %s error: %s", bs.Name, err)
+	}
+}
+
+// DeadLetter 返回 dead letter 文件, 没有开启时为 nil
+func (bs *Backends) DeadLetter() *DeadLetter {
+	return bs.dl
 }
 
 // Idle 数据写入influxdb
 func (bs *Backends) Idle() {
-	if !bs.rewriter_running && bs.fb.IsData() {
-		bs.rewriter_running = true
+	// RewriteLoop 退出时在自己的协程里清零, 用原子操作.
+	if atomic.LoadInt32(&bs.rewriter_running) == 0 && bs.fb.IsData() {
+		atomic.StoreInt32(&bs.rewriter_running, 1)
+		bs.rewriter.Add(1)
 		go bs.RewriteLoop()
 	}
 
-	// TODO: report counter
+	// the buffer is only touched by the worker, sampled here instead of locked.
+	var size, rows int64
+	if bs.buffer != nil {
+		size, rows = int64(bs.buffer.Len()), int64(bs.write_counter)
+	}
+	atomic.StoreInt64(&bs.stats.BufferBytes, size)
+	atomic.StoreInt64(&bs.stats.BufferRows, rows)
 }
 
 // RewriteLoop
 func (bs *Backends) RewriteLoop() {
+	defer bs.rewriter.Done()
+	expired := bs.GetStats()
+	defer func() {
+		stats := bs.GetStats()
+		if n := stats.ExpiredBatches - expired.ExpiredBatches; n > 0 {
+			logs.Warningf("backend %s dropped %d expired batches, %d points, %d bytes", bs.Name, n,
+				stats.ExpiredPoints-expired.ExpiredPoints, stats.ExpiredBytes-expired.ExpiredBytes)
+		}
+	}()
+
 	for bs.fb.IsData() {
 		if !bs.running {
 			return
@@ -229,11 +627,16 @@ func (bs *Backends) RewriteLoop() {
 			continue
 		}
 	}
-	bs.rewriter_running = false
+	atomic.StoreInt32(&bs.rewriter_running, 0)
 }
 
 func (bs *Backends) Rewrite() (err error) {
-	p, err := bs.fb.Read()
+	bs.rewriting.Lock()
+	defer bs.rewriting.Unlock()
+	if bs.RewriteConcurrency > 1 {
+		return bs.rewriteFrames()
+	}
+	p, enqueued, precision, err := bs.fb.ReadFrame()
 	if err != nil {
 		return
 	}
@@ -241,30 +644,176 @@ func (bs *Backends) Rewrite() (err error) {
 		return
 	}
 
-	err = bs.HttpBackend.WriteCompressed(p)
+	err = bs.replayFrame(p, enqueued, precision)
+	if err != nil {
+		// keep err, let the caller wait before retry.
+		rerr := bs.fb.RollbackMeta()
+		if rerr != nil {
+			logs.Errorf("rollback meta error: %s\n", rerr)
+		}
+		return
+	}
+
+	err = bs.fb.UpdateMeta()
+	if err != nil {
+		logs.Errorf("update meta error: %s\n", err)
+		return
+	}
+	return
+}
+
+// replayFrame 发送备份文件中的一帧, 过期和后端不接受的数据写到 dead letter, 返回错误时需要重试
+func (bs *Backends) replayFrame(p []byte, enqueued time.Time, precision string) (err error) {
+	// age of the old frames without timestamp is unknown, replay them.
+	if bs.MaxBufferAge > 0 && !enqueued.IsZero() && time.Since(enqueued) > bs.MaxBufferAge {
+		atomic.AddInt64(&bs.stats.ExpiredBatches, 1)
+		atomic.AddInt64(&bs.stats.ExpiredPoints, int64(CountLines(p)))
+		atomic.AddInt64(&bs.stats.ExpiredBytes, int64(len(p)))
+		bs.deadLetter(DEAD_EXPIRED, precision, p)
+		return nil
+	}
+
+	start := time.Now()
+	err = bs.HttpBackend.WriteCompressedPrecision(p, precision)
+	bs.adaptRowLimit(err, time.Since(start))
+	if err == ErrBadRequest && !bs.DropBadBatch || err == ErrTooLarge {
+		err = bs.splitBatch(p, precision, err)
+	}
 
 	switch err {
 	case nil:
+		bs.setFailover(false)
 	case ErrBadRequest:
 		logs.Errorf("bad request, drop all data.")
+		bs.setFailover(false)
+		bs.deadLetter(DEAD_BAD_REQUEST, precision, p)
 		err = nil
 	case ErrNotFound:
 		logs.Errorf("bad backend, drop all data.")
+		bs.setFailover(false)
+		bs.deadLetter(DEAD_NOT_FOUND, precision, p)
 		err = nil
 	default:
 		logs.Errorf("unknown error %s, maybe overloaded.", err)
+		bs.setFailover(true)
+	}
+	return
+}
 
-		err = bs.fb.RollbackMeta()
-		if err != nil {
-			logs.Errorf("rollback meta error: %s\n", err)
-		}
+// adaptRowLimit 根据写入结果调整 batch 大小, 失败或者慢时减半, 成功时线性增长.
+// 只有 MinRowLimit 小于 MaxRowLimit 时生效.
+func (bs *Backends) adaptRowLimit(err error, latency time.Duration) {
+	if bs.MinRowLimit <= 0 || bs.MinRowLimit >= bs.MaxRowLimit {
+		return
+	}
+	// bad data, nothing to do with the health of backend.
+	if err == ErrBadRequest || err == ErrNotFound {
 		return
 	}
 
-	err = bs.fb.UpdateMeta()
+	congested := err != nil || (bs.SlowWrite > 0 && latency > bs.SlowWrite)
+	step := (bs.MaxRowLimit - bs.MinRowLimit) / 10
+	if step < 1 {
+		step = 1
+	}
+	for {
+		old := atomic.LoadInt32(&bs.rowLimit)
+		limit := old + step
+		if congested {
+			limit = old / 2
+		}
+		if limit < bs.MinRowLimit {
+			limit = bs.MinRowLimit
+		}
+		if limit > bs.MaxRowLimit {
+			limit = bs.MaxRowLimit
+		}
+		if limit == old || atomic.CompareAndSwapInt32(&bs.rowLimit, old, limit) {
+			if limit != old && congested {
+				logs.Warningf("backend %s congested, row limit %d -> %d", bs.Name, old, limit)
+			}
+			return
+		}
+	}
+}
+
+// RowLimit 当前生效的 batch 大小
+func (bs *Backends) RowLimit() int32 {
+	return atomic.LoadInt32(&bs.rowLimit)
+}
+
+// GetStats 包含当前的 batch 大小
+func (bs *Backends) GetStats() (stats BackendStatistics) {
+	stats = bs.HttpBackend.GetStats()
+	stats.RowLimit = int64(bs.RowLimit())
+	stats.WriteQueue = int64(len(bs.ch_write))
+	stats.WriteQueueCap = int64(cap(bs.ch_write))
+	spool := bs.fb.Stats()
+	stats.SpoolWrites = spool.Writes
+	stats.SpoolFrames = spool.Frames
+	stats.SpoolBytes = spool.Bytes
+	return
+}
+
+// QueueStats 写入路径上各环节的积压, 用来判断写入变慢是在管道, 缓冲还是 HTTP 请求.
+// SinceLastWrite 为距离上次成功写入的秒数, 还没有成功写入时为 -1
+type QueueStats struct {
+	WriteQueue     int64   `json:"write_queue"`
+	WriteQueueCap  int64   `json:"write_queue_cap"`
+	BufferBytes    int64   `json:"buffer_bytes"`
+	BufferRows     int64   `json:"buffer_rows"`
+	FlushInflight  int64   `json:"flush_inflight"`
+	SinceLastWrite float64 `json:"since_last_write"`
+}
+
+// QueueStats 返回写入的积压
+func (bs *Backends) QueueStats() QueueStats {
+	return newQueueStats(bs.GetStats(), time.Now())
+}
+
+func newQueueStats(stats BackendStatistics, now time.Time) (qs QueueStats) {
+	qs = QueueStats{
+		WriteQueue:     stats.WriteQueue,
+		WriteQueueCap:  stats.WriteQueueCap,
+		BufferBytes:    stats.BufferBytes,
+		BufferRows:     stats.BufferRows,
+		FlushInflight:  stats.FlushInflight,
+		SinceLastWrite: -1,
+	}
+	if stats.LastWrite > 0 {
+		qs.SinceLastWrite = now.Sub(time.Unix(0, stats.LastWrite)).Seconds()
+	}
+	return
+}
+
+// queueStats 返回各后端写入的积压
+func (ic *InfluxCluster) queueStats() (queues map[string]QueueStats) {
+	ic.lock.RLock()
+	backends := ic.backends
+	ic.lock.RUnlock()
+	queues = make(map[string]QueueStats, len(backends))
+	for name, api := range backends {
+		if bs, ok := api.(*Backends); ok {
+			queues[name] = bs.QueueStats()
+		}
+	}
+	return
+}
+
+// CountLines 统计压缩数据中的行数
+func CountLines(p []byte) (n int) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
 	if err != nil {
-		logs.Errorf("update meta error: %s\n", err)
 		return
 	}
-	return
+	defer zip.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		m, err := zip.Read(buf)
+		n += bytes.Count(buf[:m], []byte{'\n'})
+		if err != nil {
+			return
+		}
+	}
 }
@@ -5,6 +5,17 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -53,3 +64,366 @@ func TestRewrite(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+func TestFlushReason(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	cfg.Interval = 100
+	cfg.MaxRowLimit = 3
+	bs, err := NewBackends(cfg, "test", ".")
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	for i := 0; i < 3; i++ {
+		bs.Write([]byte("cpu value=3,value2=4 1434055562000010000\n"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	stats := bs.GetStats()
+	if stats.FlushByCount != 1 || stats.FlushByTimer != 0 || stats.FlushRows != 3 {
+		t.Errorf("count flush wrong: %+v", stats)
+	}
+
+	bs.Write([]byte("cpu value=3,value2=4 1434055562000010000\n"))
+	time.Sleep(300 * time.Millisecond)
+	stats = bs.GetStats()
+	if stats.FlushByCount != 1 || stats.FlushByTimer != 1 || stats.FlushRows != 4 {
+		t.Errorf("timer flush wrong: %+v", stats)
+	}
+	if stats.FlushBytes != 4*int64(len("cpu value=3,value2=4 1434055562000010000\n")) {
+		t.Errorf("flush bytes wrong: %+v", stats)
+	}
+}
+
+func TestFlushByBytes(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	cfg.Interval = 60000
+	cfg.MaxRowLimit = 1000
+	cfg.MaxBufferBytes = 64 * 1024
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// a few huge lines, far below the row limit.
+	line := fmt.Sprintf("log message=\"%s\" 1434055562000010000\n", strings.Repeat("x", 30*1024))
+	for i := 0; i < 3; i++ {
+		bs.Write([]byte(line))
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats := bs.GetStats()
+	if stats.FlushByBytes != 1 || stats.FlushByCount != 0 || stats.FlushRows != 3 || stats.FlushBytes != 3*int64(len(line)) {
+		t.Errorf("bytes flush wrong: %+v", stats)
+	}
+}
+
+func TestRewriteExpired(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	cfg.RewriteInterval = 60000
+	cfg.MaxBufferAge = 50
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=1 1434055562000010000\ncpu value=2 1434055562000020000\n"))
+	err = bs.fb.Write(buf.Bytes())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	err = bs.fb.Write(buf.Bytes())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	bs.Rewrite()
+	bs.Rewrite()
+	stats := bs.GetStats()
+	if stats.ExpiredBatches != 1 || stats.ExpiredPoints != 2 || stats.ExpiredBytes != int64(buf.Len()) {
+		t.Errorf("expired stats wrong: %+v", stats)
+	}
+	if bs.fb.IsData() {
+		t.Errorf("spool should be empty")
+	}
+}
+
+func TestFlushConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			<-release
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.MaxRowLimit = 1
+	cfg.FlushConcurrency = 2
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		bs.Write([]byte("cpu value=3,value2=4 1434055562000010000\n"))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	stats := bs.GetStats()
+	if stats.FlushInflight != 2 || stats.FlushSaturated != 48 {
+		t.Errorf("flush not bounded: %+v", stats)
+	}
+	// 2 senders, each with a few http client and server goroutines, not 50.
+	if n := runtime.NumGoroutine() - goroutines; n > 20 {
+		t.Errorf("too many goroutines: %d", n)
+	}
+	if !bs.fb.IsData() {
+		t.Errorf("saturated batches should be spooled")
+	}
+}
+
+func TestAdaptRowLimit(t *testing.T) {
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" && atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.MinRowLimit = 100
+	cfg.MaxRowLimit = 1000
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	p := []byte("cpu value=3,value2=4 1434055562000010000\n")
+	atomic.StoreInt32(&fail, 1)
+	for _, want := range []int32{500, 250, 125, 100, 100} {
+		bs.sendBatch(p, "", true)
+		if limit := bs.RowLimit(); limit != want {
+			t.Errorf("row limit should shrink to %d: %d", want, limit)
+		}
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	for i := 0; i < 10; i++ {
+		bs.sendBatch(p, "", true)
+	}
+	if limit := bs.RowLimit(); limit != 1000 {
+		t.Errorf("row limit should grow back: %d", limit)
+	}
+	if stats := bs.GetStats(); stats.RowLimit != 1000 {
+		t.Errorf("row limit stats wrong: %+v", stats)
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	var fails, status int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" && atomic.AddInt32(&fails, -1) >= 0 {
+			if atomic.LoadInt32(&status) == 0 {
+				// drop the connection.
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.WriteRetries = 2
+	cfg.RetryBackoff = 10
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer bs.Close()
+
+	p := []byte("cpu value=3,value2=4 1434055562000010000\n")
+	tests := []struct {
+		fails, status  int32
+		retries, saved int64
+		spooled        bool
+	}{
+		{1, 503, 1, 1, false},
+		{1, 0, 1, 1, false},
+		{2, 504, 2, 1, false},
+		{3, 502, 2, 0, true},
+		{1, 500, 0, 0, true},
+	}
+	for i, tt := range tests {
+		before := bs.GetStats()
+		atomic.StoreInt32(&fails, tt.fails)
+		atomic.StoreInt32(&status, tt.status)
+		bs.sendBatch(p, "", true)
+		stats := bs.GetStats()
+		if stats.WriteRetries-before.WriteRetries != tt.retries || stats.WriteRetrySuccess-before.WriteRetrySuccess != tt.saved {
+			t.Errorf("case %d: retry stats wrong: %+v", i, stats)
+		}
+		if bs.fb.IsData() != tt.spooled {
+			t.Errorf("case %d: spooled should be %v", i, tt.spooled)
+		}
+		bs.fb.CleanUp()
+		// the dropped connection marks the backend inactive until next check.
+		bs.setActive(true, nil)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var down int32 = 1
+	var lock sync.Mutex
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(503)
+			return
+		}
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		lock.Lock()
+		lines = append(lines, strings.Split(strings.TrimSpace(string(p)), "\n")...)
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 60000
+	cfg.RewriteInterval = 50
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=1 1434055562000000000\n"))
+	bs.fb.Write(buf.Bytes())
+	bs.Write([]byte("cpu value=2 1434055562000000001\n"))
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&down, 0)
+	}()
+	err = bs.Drain(5 * time.Second)
+	if err != nil {
+		t.Errorf("drain error: %s", err)
+	}
+	lock.Lock()
+	sort.Strings(lines)
+	if strings.Join(lines, "\n") != "cpu value=1 1434055562000000000\ncpu value=2 1434055562000000001" {
+		t.Errorf("spool and buffer should be drained: %v", lines)
+	}
+	lock.Unlock()
+
+	// the backend never comes back, data stays in the spool.
+	atomic.StoreInt32(&down, 1)
+	bs, err = NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Write([]byte("cpu value=3 1434055562000000002\n"))
+	err = bs.Drain(200 * time.Millisecond)
+	if err != ErrSpoolNotDrained {
+		t.Errorf("drain should time out: %v", err)
+	}
+}
+
+func TestRewriteGzipSpool(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.SpoolFormat = SPOOL_GZIP
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=1 1434055562000\ncpu value=2 1434055563000\n"))
+	err = bs.fb.WritePrecision(buf.Bytes(), "ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Rewrite()
+	if bs.fb.IsData() {
+		t.Errorf("spool should be empty")
+	}
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if len(si.lines) != 2 {
+		t.Errorf("spool should be written: %v", si.lines)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	cfg.Interval = 300
+	cfg.RewriteInterval = 20
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.backends = map[string]BackendAPI{"test": bs}
+
+	line := "cpu value=3,value2=4 1434055562000010000\n"
+	bs.Write([]byte(line))
+	bs.Write([]byte(line))
+	// sampled by Idle before the flush.
+	time.Sleep(100 * time.Millisecond)
+	qs := ic.Stats().Queues["test"]
+	if qs.BufferRows != 2 || qs.BufferBytes != 2*int64(len(line)) || qs.WriteQueueCap != 16 || qs.SinceLastWrite != -1 {
+		t.Errorf("buffered stats wrong: %+v", qs)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	qs = ic.Stats().Queues["test"]
+	if qs.BufferRows != 0 || qs.BufferBytes != 0 || qs.FlushInflight != 0 || qs.SinceLastWrite < 0 || qs.SinceLastWrite > 1 {
+		t.Errorf("flushed stats wrong: %+v", qs)
+	}
+}
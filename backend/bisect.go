@@ -0,0 +1,107 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	// bad lines logged per second of a backend.
+	BAD_LINE_LOGS = 10
+)
+
+// splitBatch 在 batch 返回 400 或 413 时二分重试, 只丢弃出错或者单独也太大的行.
+// 返回错误时部分数据可能已经写入, 由调用方整体重试, 重复写入相同的点是无害的.
+func (bs *Backends) splitBatch(p []byte, precision string, cause error) (err error) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		logs.Errorf("bad batch can't be decompressed, drop all data: %s", err)
+		return nil
+	}
+	raw, err := ioutil.ReadAll(zip)
+	if err != nil {
+		logs.Errorf("bad batch can't be decompressed, drop all data: %s", err)
+		return nil
+	}
+
+	var lines [][]byte
+	for _, line := range bytes.Split(raw, []byte{'\n'}) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return bs.bisect(lines, precision, cause)
+}
+
+// bisect 把已经返回 cause (400 或 413) 的 lines 分成两半分别写入
+func (bs *Backends) bisect(lines [][]byte, precision string, cause error) (err error) {
+	if len(lines) == 0 {
+		return
+	}
+	if len(lines) == 1 {
+		reason := DEAD_BAD_REQUEST
+		if cause == ErrTooLarge {
+			reason = DEAD_TOO_LARGE
+			atomic.AddInt64(&bs.stats.TooLargeLines, 1)
+		} else {
+			atomic.AddInt64(&bs.stats.BadLines, 1)
+		}
+		bs.logBadLine(lines[0])
+		if bs.dl != nil {
+			derr := bs.dl.Write(reason, precision, lines[0])
+			if derr != nil {
+				logs.Errorf("write dead letter of backend %s error: %s", bs.Name, derr)
+			}
+		}
+		return
+	}
+	if cause == ErrTooLarge {
+		atomic.AddInt64(&bs.stats.TooLargeSplits, 1)
+	}
+	mid := len(lines) / 2
+	err = bs.deliver(lines[:mid], precision)
+	if err != nil {
+		return
+	}
+	return bs.deliver(lines[mid:], precision)
+}
+
+func (bs *Backends) deliver(lines [][]byte, precision string) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, append(bytes.Join(lines, []byte{'\n'}), '\n'))
+	if err != nil {
+		return
+	}
+	err = bs.HttpBackend.WriteCompressedPrecision(buf.Bytes(), precision)
+	switch {
+	case err == ErrTooLarge:
+		return bs.bisect(lines, precision, err)
+	case err == ErrBadRequest && bs.DropBadBatch:
+		logs.Errorf("bad request, drop all data.")
+		bs.deadLetter(DEAD_BAD_REQUEST, precision, buf.Bytes())
+		return nil
+	case err == ErrBadRequest:
+		return bs.bisect(lines, precision, err)
+	}
+	return
+}
+
+// logBadLine 原样记录被丢弃的行, 每秒最多 BAD_LINE_LOGS 行
+func (bs *Backends) logBadLine(line []byte) {
+	now := time.Now().Unix()
+	if atomic.SwapInt64(&bs.badLogSecond, now) != now {
+		atomic.StoreInt32(&bs.badLogs, 0)
+	}
+	if atomic.AddInt32(&bs.badLogs, 1) <= BAD_LINE_LOGS {
+		logs.Errorf("backend %s drop bad line: %s", bs.Name, line)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// strictInflux rejects a batch with any bad line as influxdb does, and keeps the good batches.
+type strictInflux struct {
+	lock   sync.Mutex
+	lines  []string
+	writes int32
+	// fail the writes after limit.
+	limit int32
+	// reject bodies larger than maxBytes with 413.
+	maxBytes int
+}
+
+func (si *strictInflux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/write" {
+		w.WriteHeader(204)
+		return
+	}
+	n := atomic.AddInt32(&si.writes, 1)
+	if limit := atomic.LoadInt32(&si.limit); limit > 0 && n > limit {
+		w.WriteHeader(500)
+		return
+	}
+	zip, _ := gzip.NewReader(req.Body)
+	p, _ := ioutil.ReadAll(zip)
+	if si.maxBytes > 0 && len(p) > si.maxBytes {
+		w.WriteHeader(413)
+		return
+	}
+	_, err := models.ParsePoints(p)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	si.lock.Lock()
+	si.lines = append(si.lines, strings.Split(strings.TrimSpace(string(p)), "\n")...)
+	si.lock.Unlock()
+	w.WriteHeader(204)
+}
+
+func TestBisectBadRequest(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	good := []string{
+		"cpu value=1 1434055562000000000",
+		"cpu value=2 1434055562000000001",
+		"cpu value=3 1434055562000000002",
+		"cpu value=4 1434055562000000003",
+		"cpu value=5 1434055562000000004",
+		"cpu value=6 1434055562000000005",
+	}
+	batch := []byte(strings.Join([]string{good[0], "cpu value=", good[1], good[2], good[3], "cpu,host= value=1", good[4], good[5]}, "\n") + "\n")
+
+	// live flush path.
+	bs.sendBatch(batch, "", true)
+	if strings.Join(si.lines, "\n") != strings.Join(good, "\n") {
+		t.Errorf("good lines should be written: %v", si.lines)
+	}
+	if stats := bs.GetStats(); stats.BadLines != 2 {
+		t.Errorf("bad lines wrong: %d", stats.BadLines)
+	}
+	if bs.fb.IsData() {
+		t.Errorf("nothing should be spooled")
+	}
+
+	// replay path, the backend goes down in the middle of bisection.
+	si.lines = nil
+	var buf bytes.Buffer
+	Compress(&buf, batch)
+	bs.fb.Write(buf.Bytes())
+	atomic.StoreInt32(&si.writes, 0)
+	atomic.StoreInt32(&si.limit, 2)
+	bs.Rewrite()
+	if !bs.fb.IsData() {
+		t.Errorf("frame should be kept for retry")
+	}
+	atomic.StoreInt32(&si.limit, 0)
+	err = bs.Rewrite()
+	if err != nil || bs.fb.IsData() {
+		t.Errorf("frame should be replayed: %v", err)
+	}
+	if strings.Join(si.lines, "\n") != strings.Join(good, "\n") {
+		t.Errorf("good lines should be replayed: %v", si.lines)
+	}
+	if stats := bs.GetStats(); stats.BadLines != 4 {
+		t.Errorf("bad lines wrong: %d", stats.BadLines)
+	}
+
+	// drop all as before.
+	si.lines = nil
+	atomic.StoreInt32(&si.writes, 0)
+	bs.DropBadBatch = true
+	bs.sendBatch(batch, "", true)
+	if len(si.lines) != 0 || atomic.LoadInt32(&si.writes) != 1 || bs.fb.IsData() {
+		t.Errorf("batch should be dropped: %v", si.lines)
+	}
+}
+
+func TestSplitTooLarge(t *testing.T) {
+	si := &strictInflux{maxBytes: 200}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var good []string
+	for i := 0; i < 40; i++ {
+		good = append(good, fmt.Sprintf("cpu value=%d 14340555620000000%02d", i, i))
+	}
+	huge := "cpu value=\"" + strings.Repeat("x", 300) + "\" 1434055562000000000"
+	lines := append(append([]string{}, good[:20]...), huge)
+	batch := []byte(strings.Join(append(lines, good[20:]...), "\n") + "\n")
+	sort.Strings(good)
+
+	// live flush path.
+	bs.sendBatch(batch, "", true)
+	sort.Strings(si.lines)
+	if strings.Join(si.lines, "\n") != strings.Join(good, "\n") {
+		t.Errorf("all lines but the huge one should be written: %v", si.lines)
+	}
+	stats := bs.GetStats()
+	if stats.TooLargeLines != 1 || stats.TooLargeSplits == 0 || stats.BadLines != 0 {
+		t.Errorf("too large stats wrong: %d %d %d", stats.TooLargeLines, stats.TooLargeSplits, stats.BadLines)
+	}
+	if bs.fb.IsData() {
+		t.Errorf("nothing should be spooled")
+	}
+
+	// replay path, the backend goes down in the middle of splitting.
+	si.lines = nil
+	var buf bytes.Buffer
+	Compress(&buf, batch)
+	bs.fb.Write(buf.Bytes())
+	atomic.StoreInt32(&si.writes, 0)
+	atomic.StoreInt32(&si.limit, 3)
+	bs.Rewrite()
+	if !bs.fb.IsData() {
+		t.Errorf("frame should be kept for retry")
+	}
+	si.lines = nil
+	atomic.StoreInt32(&si.limit, 0)
+	err = bs.Rewrite()
+	if err != nil || bs.fb.IsData() {
+		t.Errorf("frame should be replayed: %v", err)
+	}
+	sort.Strings(si.lines)
+	if strings.Join(si.lines, "\n") != strings.Join(good, "\n") {
+		t.Errorf("all lines but the huge one should be replayed: %v", si.lines)
+	}
+}
@@ -6,11 +6,18 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,17 +26,50 @@ import (
 	"unsafe"
 
 	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/zxf0089216/influx-proxy/logs"
 	"github.com/zxf0089216/influx-proxy/monitor"
 )
 
+const (
+	// backends queried at the same time by a SHOW query.
+	DEFAULT_QUERY_ALL_CONCURRENCY = 8
+	// the backend to send the query to, for debugging, and the backends served the query in the response.
+	BACKEND_HEADER = "X-Influx-Proxy-Backend"
+	ZONE_HEADER    = "X-Influx-Proxy-Zone"
+	// timeout of the query on each backend, instead of timeoutquery of the backend.
+	QUERY_TIMEOUT_HEADER = "X-Query-Timeout"
+	// "true" to report failed lines of the write, same as the strict param.
+	STRICT_WRITE_HEADER = "X-Strict-Write"
+)
+
 var (
-	ErrClosed          = errors.New("write in a closed file")
-	ErrBackendNotExist = errors.New("use a backend not exists")
-	ErrQueryForbidden  = errors.New("query forbidden")
+	ErrClosed             = errors.New("write in a closed file")
+	ErrBackendNotExist    = errors.New("use a backend not exists")
+	ErrQueryForbidden     = errors.New("query forbidden")
+	ErrUnknownMeasurement = errors.New("unknown measurement")
+	ErrEmptyMeasurement   = errors.New("empty measurement")
+	ErrPartialFanout      = errors.New("failed on some backends")
+	ErrDBConflict         = errors.New("database of the query conflicts with the db parameter")
+	ErrWriteOnly          = errors.New("measurement is write-only")
+	ErrAllUnavailable     = errors.New("all backends of the measurement are unavailable")
+	ErrAllInactive        = errors.New("all backends of the db are inactive")
+	ErrKillBackend        = errors.New(`backend of the query is required, e.g. KILL QUERY 36 ON "backend"`)
+
+	seriesQuery = regexp.MustCompile(SeriesCmds)
+	selectQuery = regexp.MustCompile(SelectCmds)
+	statsQuery  = regexp.MustCompile(ProxyStatsCmds)
+	showQueries = regexp.MustCompile(ShowQueriesCmds)
+	killQuery   = regexp.MustCompile(KillQueryCmds)
 )
 
+// ScanKey 返回一行 line protocol 的 measurement, 去掉 "\,", "\ " 和 "\\" 的转义, 其他反斜杠保留.
+// 没有 tag 和 field 的行返回 io.EOF, measurement 为空时返回 ErrEmptyMeasurement.
 func ScanKey(pointbuf []byte) (key string, err error) {
 	var keybuf [100]byte
 	keyslice := keybuf[0:0]
@@ -38,9 +78,18 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 		c := pointbuf[i]
 		switch c {
 		case '\\':
-			i++
-			keyslice = append(keyslice, pointbuf[i])
+			if i+1 < buflen {
+				switch pointbuf[i+1] {
+				case ',', ' ', '\\':
+					i++
+					c = pointbuf[i]
+				}
+			}
+			keyslice = append(keyslice, c)
 		case ' ', ',':
+			if len(keyslice) == 0 {
+				return "", ErrEmptyMeasurement
+			}
 			key = string(keyslice)
 			return
 		default:
@@ -50,7 +99,7 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 	return "", io.EOF
 }
 
-// faster then bytes.TrimRight, not sure why.
+// TrimRight 去掉 p 末尾在 s 中的字节, 比 bytes.TrimRight 略快, 见 BenchmarkTrimRight.
 func TrimRight(p []byte, s []byte) (r []byte) {
 	r = p
 	if len(r) == 0 {
@@ -58,7 +107,7 @@ func TrimRight(p []byte, s []byte) (r []byte) {
 	}
 
 	i := len(r) - 1
-	for ; bytes.IndexByte(s, r[i]) != -1; i-- {
+	for ; i >= 0 && bytes.IndexByte(s, r[i]) != -1; i-- {
 	}
 	return r[0 : i+1]
 }
@@ -67,11 +116,14 @@ func TrimRight(p []byte, s []byte) (r []byte) {
 
 type InfluxCluster struct {
 	lock           sync.RWMutex
+	reload         sync.Mutex
 	Zone           string
 	nexts          string
 	query_executor Querier
 	ForbiddenQuery []*regexp.Regexp
-	ObligatedQuery []*regexp.Regexp
+	ObligatedQuery [][]*regexp.Regexp
+	GlobalQueries  []*regexp.Regexp
+	ServerQueries  []*regexp.Regexp
 	cfgsrc         *FileConfigSource
 	bas            []BackendAPI
 	backends       map[string]BackendAPI
@@ -82,6 +134,60 @@ type InfluxCluster struct {
 	defaultTags    map[string]string
 	WriteTracing   int
 	QueryTracing   int
+	KeepPrecision  int
+	ReadRepairRate float64
+	QueryDeadline  time.Duration
+	DrainTimeout   time.Duration
+	cors           *corsRules
+	auth           *authTokens
+	// X-Query-Timeout is clamped to it if > 0.
+	MaxQueryTimeout time.Duration
+	// advertised in X-Influxdb-Version, for version checks of clients.
+	InfluxdbVersion string
+	failoverWebhook string
+	nextWriteFail   bool
+	forceBackend    bool
+	hideBackend     bool
+	splitMulti      bool
+	overrides       *backendOverrides
+	drains          *drains
+	events          *stateEvents
+	sampleRates     map[string]float64
+	sharded         map[string]bool
+	hashed          map[string]bool
+	// catch-all key of KEYMAPS, DefaultMeasurementKey.
+	defaultKey   string
+	fieldMaps    map[string]map[string]string
+	stickyKeys   map[string]bool
+	stickyCache  *stickyCache
+	syncs        map[string]bool
+	transformers []WriteTransformer
+	limiter      *rateLimiter
+	quotas       *writeQuotas
+	accessLog    *AccessLog
+	concurrency  [concurrentKinds]*semaphore
+	verifies     verifyJobs
+	imports      importJobs
+	tracer       trace.Tracer
+	tp           *sdktrace.TracerProvider
+	// called by Close, e.g. to shut down the admin server.
+	closers []func()
+	// self-monitoring, statsUnroutable is 1 after the unroutable stats are logged.
+	statsEnabled     bool
+	statsDB          string
+	statsMeasurement string
+	statsBackend     string
+	statsUnroutable  int32
+	sink             MetricSink
+	stickyQuery      bool
+	replication      *replicationCap
+	queryWriteOnly   bool
+	timeBound        timeBound
+	skew             timestampSkew
+	retryAfter       int
+	keyMetrics       *keyMetrics
+	// map[string]*DBStatistics, replaced on LoadConfig.
+	dbStats atomic.Value
 
 	storedir string
 }
@@ -97,41 +203,151 @@ type Statistics struct {
 	PointsWrittenFail    int64
 	WriteRequestDuration int64
 	QueryRequestDuration int64
+	QueryVerifyDiffs     int64
+	ReadRepairs          int64
+	ReadRepairDiffs      int64
+	PointsSampled        int64
+	RateLimited          int64
+	QueriesThrottled     int64
+	WritesThrottled      int64
+	PointsDropped        int64
+	NextWriteFail        int64
+	AsyncQueries         int64
+	AsyncQueriesFail     int64
+	SyncWrites           int64
+	SyncWritesFail       int64
+	SyncWriteDuration    int64
+	QueriesWriteOnly     int64
+	AuthFailures         int64
+	PointsSkewed         int64
 }
 
 func NewInfluxCluster(cfgsrc *FileConfigSource, nodecfg *NodeConfig, storedir string) (ic *InfluxCluster) {
 	ic = &InfluxCluster{
-		Zone:           nodecfg.Zone,
-		nexts:          nodecfg.Nexts,
-		query_executor: &InfluxQLExecutor{},
-		cfgsrc:         cfgsrc,
-		bas:            make([]BackendAPI, 0),
-		stats:          &Statistics{},
-		counter:        &Statistics{},
-		ticker:         time.NewTicker(10 * time.Second),
-		defaultTags:    map[string]string{"addr": nodecfg.ListenAddr},
-		WriteTracing:   nodecfg.WriteTracing,
-		QueryTracing:   nodecfg.QueryTracing,
-		storedir:       storedir,
+		Zone:            nodecfg.Zone,
+		nexts:           nodecfg.Nexts,
+		query_executor:  &InfluxQLExecutor{},
+		cfgsrc:          cfgsrc,
+		bas:             make([]BackendAPI, 0),
+		stats:           &Statistics{},
+		counter:         &Statistics{},
+		ticker:          time.NewTicker(10 * time.Second),
+		defaultTags:     map[string]string{"addr": ListenAddrs(nodecfg.ListenAddr)[0]},
+		WriteTracing:    nodecfg.WriteTracing,
+		QueryTracing:    nodecfg.QueryTracing,
+		KeepPrecision:   nodecfg.KeepPrecision,
+		ReadRepairRate:  nodecfg.ReadRepairRate,
+		QueryDeadline:   time.Millisecond * time.Duration(nodecfg.QueryDeadline),
+		MaxQueryTimeout: time.Millisecond * time.Duration(nodecfg.MaxQueryTimeout),
+		DrainTimeout:    time.Millisecond * time.Duration(nodecfg.DrainTimeout),
+		cors:            newCorsRules(nodecfg),
+		InfluxdbVersion: nodecfg.InfluxdbVersion,
+		failoverWebhook: nodecfg.FailoverWebhook,
+		events:          newStateEvents(nodecfg),
+		nextWriteFail:   nodecfg.NextWriteFail == 1,
+		forceBackend:    nodecfg.ForceBackendHeader == 1,
+		hideBackend:     nodecfg.HideBackendHeader == 1,
+		splitMulti:      nodecfg.SplitMultiMeasurement == 1,
+		overrides:       newBackendOverrides(),
+		drains:          newDrains(),
+		storedir:        storedir,
+	}
+	if ic.InfluxdbVersion == "" {
+		ic.InfluxdbVersion = VERSION
+	}
+	ic.statsEnabled = nodecfg.StatsEnabled >= 0
+	ic.statsDB = nodecfg.StatsDatabase
+	if ic.statsDB == "" {
+		ic.statsDB = MONITOR_DB
+	}
+	ic.statsMeasurement = nodecfg.StatsMeasurement
+	if ic.statsMeasurement == "" {
+		ic.statsMeasurement = MONITOR_MEASUREMENT
+	}
+	ic.statsBackend = nodecfg.StatsBackend
+	ic.stickyQuery = nodecfg.StickyQuery == 1
+	ic.replication = newReplicationCap()
+	ic.queryWriteOnly = nodecfg.QueryWriteOnly == 1
+	ic.timeBound = newTimeBound(nodecfg)
+	ic.keyMetrics = newKeyMetrics(nodecfg)
+	ic.retryAfter = nodecfg.RetryAfter
+	if ic.retryAfter <= 0 {
+		ic.retryAfter = 1
+	}
+	if nodecfg.DrainTimeout == 0 {
+		ic.DrainTimeout = time.Millisecond * DEFAULT_DRAIN_TIMEOUT
 	}
 	host, err := os.Hostname()
 	if err != nil {
-		logs.Errorf("NewInfluxCluster Get hostname error", err)
+		logs.Errorf("NewInfluxCluster Get hostname error: %s", err)
 	}
 	ic.defaultTags["host"] = host
+	if ic.Zone != "" {
+		ic.defaultTags["zone"] = ic.Zone
+	}
 	if nodecfg.Interval > 0 {
 		ic.ticker = time.NewTicker(time.Second * time.Duration(nodecfg.Interval))
 	}
 
-	err = ic.ForbidQuery(ForbidCmds)
+	rules, err := loadQueryRules(nodecfg)
 	if err != nil {
 		panic(err)
-		return
 	}
-	err = ic.EnsureQuery(SupportCmds)
+	ic.setQueryRules(rules)
+	ic.sampleRates, err = loadSampleRates(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	ic.defaultKey = defaultMeasurementKey(nodecfg)
+	ic.sharded = loadShardedMeasurements(nodecfg)
+	ic.hashed = loadHashedMeasurements(nodecfg)
+	ic.fieldMaps = loadFieldMaps(nodecfg)
+	ic.stickyKeys = loadStickyMeasurements(nodecfg)
+	ic.stickyCache = newStickyCache(nodecfg)
+	ic.syncs = loadSyncMeasurements(nodecfg)
+	limits, err := loadRateLimits(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	ic.auth, err = newAuthTokens(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	ic.skew, err = newTimestampSkew(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	ic.limiter = newRateLimiter(limits)
+	ic.concurrency, err = loadConcurrency(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	quotas, err := loadWriteQuotas(nodecfg)
+	if err != nil {
+		panic(err)
+	}
+	ic.quotas = newWriteQuotas(quotas)
+	ic.quotas.exempt = ic.statsDB
+	ic.sink, err = newMetricSink(ic, nodecfg.StatsSink)
 	if err != nil {
 		panic(err)
-		return
+	}
+
+	if nodecfg.AccessLog != "" {
+		ic.accessLog, err = NewAccessLog(nodecfg.AccessLog, nodecfg.AccessLogBuffer)
+		if err != nil {
+			logs.Errorf("open access log error: %s", err)
+		}
+	}
+
+	ic.SetTracerProvider(nil)
+	if nodecfg.OtelTracing != 0 && nodecfg.OtlpEndpoint != "" {
+		ic.tp, err = NewOtlpTracerProvider(nodecfg.OtlpEndpoint)
+		if err != nil {
+			logs.Errorf("create otlp tracer provider error: %s", err)
+		} else {
+			ic.SetTracerProvider(ic.tp)
+		}
 	}
 
 	// feature
@@ -146,6 +362,9 @@ func (ic *InfluxCluster) statistics() {
 		ic.Flush()
 		ic.counter = (*Statistics)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&ic.stats)),
 			unsafe.Pointer(ic.counter)))
+		if !ic.statsEnabled {
+			continue
+		}
 		err := ic.WriteStatistics()
 		if err != nil {
 			logs.Errorf("WriteStatistics error.%v", err)
@@ -164,32 +383,184 @@ func (ic *InfluxCluster) Flush() {
 	ic.counter.PointsWrittenFail = 0
 	ic.counter.WriteRequestDuration = 0
 	ic.counter.QueryRequestDuration = 0
+	ic.counter.QueryVerifyDiffs = 0
+	ic.counter.ReadRepairs = 0
+	ic.counter.ReadRepairDiffs = 0
+	ic.counter.PointsSampled = 0
+	ic.counter.RateLimited = 0
+	ic.counter.QueriesThrottled = 0
+	ic.counter.WritesThrottled = 0
+	ic.counter.PointsDropped = 0
+	ic.counter.NextWriteFail = 0
+	ic.counter.AsyncQueries = 0
+	ic.counter.AsyncQueriesFail = 0
+	ic.counter.SyncWrites = 0
+	ic.counter.SyncWritesFail = 0
+	ic.counter.SyncWriteDuration = 0
+	ic.counter.QueriesWriteOnly = 0
+	ic.counter.AuthFailures = 0
+	ic.counter.PointsSkewed = 0
+}
+
+// Fields 返回写入监控库的统计字段, 计数可能正在被更新, 用原子操作读取
+func (s *Statistics) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"statQueryRequest":         atomic.LoadInt64(&s.QueryRequests),
+		"statQueryRequestFail":     atomic.LoadInt64(&s.QueryRequestsFail),
+		"statWriteRequest":         atomic.LoadInt64(&s.WriteRequests),
+		"statWriteRequestFail":     atomic.LoadInt64(&s.WriteRequestsFail),
+		"statPingRequest":          atomic.LoadInt64(&s.PingRequests),
+		"statPingRequestFail":      atomic.LoadInt64(&s.PingRequestsFail),
+		"statPointsWritten":        atomic.LoadInt64(&s.PointsWritten),
+		"statPointsWrittenFail":    atomic.LoadInt64(&s.PointsWrittenFail),
+		"statQueryRequestDuration": atomic.LoadInt64(&s.QueryRequestDuration),
+		"statWriteRequestDuration": atomic.LoadInt64(&s.WriteRequestDuration),
+		"statQueryVerifyDiff":      atomic.LoadInt64(&s.QueryVerifyDiffs),
+		"statReadRepair":           atomic.LoadInt64(&s.ReadRepairs),
+		"statReadRepairDiff":       atomic.LoadInt64(&s.ReadRepairDiffs),
+		"statPointsSampled":        atomic.LoadInt64(&s.PointsSampled),
+		"statRateLimited":          atomic.LoadInt64(&s.RateLimited),
+		"statQueriesThrottled":     atomic.LoadInt64(&s.QueriesThrottled),
+		"statWritesThrottled":      atomic.LoadInt64(&s.WritesThrottled),
+		"statPointsDropped":        atomic.LoadInt64(&s.PointsDropped),
+		"statNextWriteFail":        atomic.LoadInt64(&s.NextWriteFail),
+		"statAsyncQuery":           atomic.LoadInt64(&s.AsyncQueries),
+		"statAsyncQueryFail":       atomic.LoadInt64(&s.AsyncQueriesFail),
+		"statSyncWrite":            atomic.LoadInt64(&s.SyncWrites),
+		"statSyncWriteFail":        atomic.LoadInt64(&s.SyncWritesFail),
+		"statSyncWriteDuration":    atomic.LoadInt64(&s.SyncWriteDuration),
+		"statQueryWriteOnly":       atomic.LoadInt64(&s.QueriesWriteOnly),
+		"statAuthFail":             atomic.LoadInt64(&s.AuthFailures),
+		"statPointsSkewed":         atomic.LoadInt64(&s.PointsSkewed),
+	}
 }
 
 func (ic *InfluxCluster) WriteStatistics() (err error) {
 	metric := &monitor.Metric{
-		Name: "statistics",
-		Tags: ic.defaultTags,
-		Fields: map[string]interface{}{
-			"statQueryRequest":         ic.counter.QueryRequests,
-			"statQueryRequestFail":     ic.counter.QueryRequestsFail,
-			"statWriteRequest":         ic.counter.WriteRequests,
-			"statWriteRequestFail":     ic.counter.WriteRequestsFail,
-			"statPingRequest":          ic.counter.PingRequests,
-			"statPingRequestFail":      ic.counter.PingRequestsFail,
-			"statPointsWritten":        ic.counter.PointsWritten,
-			"statPointsWrittenFail":    ic.counter.PointsWrittenFail,
-			"statQueryRequestDuration": ic.counter.QueryRequestDuration,
-			"statWriteRequestDuration": ic.counter.WriteRequestDuration,
-		},
-		Time: time.Now(),
+		Name:   ic.statsMeasurement,
+		Tags:   ic.defaultTags,
+		Fields: ic.counter.Fields(),
+		Time:   time.Now(),
 	}
 	line, err := metric.ParseToLine()
 	if err != nil {
 		return
 	}
+	lines := line + "\n"
+
+	rs := monitor.ReadRuntimeStats()
+	metric = &monitor.Metric{
+		Name:   "runtime",
+		Tags:   ic.defaultTags,
+		Fields: rs.Fields(),
+		Time:   metric.Time,
+	}
+	line, err = metric.ParseToLine()
+	if err != nil {
+		return
+	}
+	lines += line + "\n"
+
+	ic.lock.RLock()
+	backends := ic.backends
+	ic.lock.RUnlock()
+	for name, bs := range backends {
+		stats := bs.GetStats()
+		queue := newQueueStats(stats, time.Now())
+		tags := map[string]string{"backend": name}
+		for k, v := range ic.defaultTags {
+			tags[k] = v
+		}
+		metric = &monitor.Metric{
+			Name: ic.statsMeasurement,
+			Tags: tags,
+			Fields: map[string]interface{}{
+				"statBackendQueryRequest":     stats.QueryRequests,
+				"statBackendQueryRequestFail": stats.QueryRequestsFail,
+				"statBackendWriteQueue":       stats.WriteQueue,
+				"statBackendWriteQueueCap":    stats.WriteQueueCap,
+				"statBackendBufferBytes":      stats.BufferBytes,
+				"statBackendBufferRows":       stats.BufferRows,
+				"statBackendFlushInflight":    stats.FlushInflight,
+				"statBackendSinceLastWrite":   queue.SinceLastWrite,
+			},
+			Time: metric.Time,
+		}
+		line, err = metric.ParseToLine()
+		if err != nil {
+			return
+		}
+		lines += line + "\n"
+	}
+
+	dbs, dbStats := ic.sortedDBStats()
+	for _, db := range dbs {
+		tags := map[string]string{"db": db}
+		for k, v := range ic.defaultTags {
+			tags[k] = v
+		}
+		metric = &monitor.Metric{
+			Name:   ic.statsMeasurement,
+			Tags:   tags,
+			Fields: dbStats[db].swapFields(),
+			Time:   metric.Time,
+		}
+		line, err = metric.ParseToLine()
+		if err != nil {
+			return
+		}
+		lines += line + "\n"
+	}
 
-	return ic.Write([]byte(line+"\n"), "ns", "influxproxy")
+	ic.lock.RLock()
+	sink := ic.sink
+	ic.lock.RUnlock()
+	return sink.Send([]byte(lines))
+}
+
+// sendStatistics 写入统计, 配置了 statsBackend 时直接写到这个后端, 否则按 KEYMAPS 路由.
+// 没有后端接收时只记一次日志, 不返回错误, 直到可以写入后再出错.
+func (ic *InfluxCluster) sendStatistics(p []byte) (err error) {
+	ic.lock.RLock()
+	api, ok := ic.backends[ic.statsBackend]
+	ic.lock.RUnlock()
+	_, routable := ic.GetBackends(ic.statsMeasurement, ic.statsDB)
+	_, runtimeRoutable := ic.GetBackends("runtime", ic.statsDB)
+
+	switch {
+	case ic.statsBackend != "" && ok:
+		err = api.WritePrecision(p, "ns")
+	case ic.statsBackend != "":
+		ic.statsUnroutableOnce("backend %s of stats not exists", ic.statsBackend)
+		return nil
+	case !routable || !runtimeRoutable:
+		ic.statsUnroutableOnce("stats of db %s are not routable, add %s to KEYMAPS or set statsbackend", ic.statsDB, ic.statsDB)
+		return nil
+	default:
+		err = ic.WriteContext(context.WithValue(context.Background(), internalWriteKey{}, true), p, "ns", ic.statsDB)
+	}
+	atomic.StoreInt32(&ic.statsUnroutable, 0)
+	return
+}
+
+// internalWriteKey 标记 proxy 自己的写入, 如自监控, 不计入客户端的写入统计
+type internalWriteKey struct{}
+
+// discardStats 内部写入的统计, 不输出
+var discardStats Statistics
+
+// writeStats 返回写入计数的 Statistics, 内部写入时为 discardStats
+func (ic *InfluxCluster) writeStats(ctx context.Context) *Statistics {
+	if ctx.Value(internalWriteKey{}) != nil {
+		return &discardStats
+	}
+	return ic.stats
+}
+
+func (ic *InfluxCluster) statsUnroutableOnce(format string, args ...interface{}) {
+	if atomic.CompareAndSwapInt32(&ic.statsUnroutable, 0, 1) {
+		logs.Errorf(format, args...)
+	}
 }
 
 func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
@@ -204,6 +575,7 @@ func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
 	return
 }
 
+// EnsureQuery 添加到最后一组必须匹配的规则
 func (ic *InfluxCluster) EnsureQuery(s string) (err error) {
 	r, err := regexp.Compile(s)
 	if err != nil {
@@ -212,10 +584,130 @@ func (ic *InfluxCluster) EnsureQuery(s string) (err error) {
 
 	ic.lock.Lock()
 	defer ic.lock.Unlock()
-	ic.ObligatedQuery = append(ic.ObligatedQuery, r)
+	if len(ic.ObligatedQuery) == 0 {
+		ic.ObligatedQuery = append(ic.ObligatedQuery, nil)
+	}
+	last := len(ic.ObligatedQuery) - 1
+	ic.ObligatedQuery[last] = append(ic.ObligatedQuery[last], r)
+	return
+}
+
+// EnsureQueryGroup 添加一组规则, 查询必须匹配每一组中的至少一条
+func (ic *InfluxCluster) EnsureQueryGroup(ss ...string) (err error) {
+	group, err := compileRules(ss, nil)
+	if err != nil {
+		return
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.ObligatedQuery = append(ic.ObligatedQuery, group)
+	return
+}
+
+// AddGlobalQuery 添加按db下发到所有后端的语句
+func (ic *InfluxCluster) AddGlobalQuery(s string) (err error) {
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.GlobalQueries = append(ic.GlobalQueries, r)
+	return
+}
+
+// AddServerQuery 添加下发到全部后端的语句
+func (ic *InfluxCluster) AddServerQuery(s string) (err error) {
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return
+	}
+
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.ServerQueries = append(ic.ServerQueries, r)
+	return
+}
+
+func compileRules(cmds []string, defaults []string) (rules []*regexp.Regexp, err error) {
+	if len(cmds) == 0 {
+		cmds = defaults
+	}
+	for _, cmd := range cmds {
+		r, Err := regexp.Compile(cmd)
+		if Err != nil {
+			logs.Errorf("illegal query rule %s: %s", cmd, Err)
+			return nil, Err
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+// compileGroups 编译每组规则, 没有分组时 cmds 为唯一的一组
+func compileGroups(groups [][]string, cmds []string, defaults []string) (rules [][]*regexp.Regexp, err error) {
+	if len(groups) == 0 {
+		group, err := compileRules(cmds, defaults)
+		if err != nil {
+			return nil, err
+		}
+		return [][]*regexp.Regexp{group}, nil
+	}
+	if len(cmds) != 0 {
+		logs.Warningf("supportcmds is ignored, supportcmdgroups is set")
+	}
+	for _, g := range groups {
+		group, err := compileRules(g, nil)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, group)
+	}
+	return
+}
+
+type queryRules struct {
+	forbidden []*regexp.Regexp
+	obligated [][]*regexp.Regexp
+	globals   []*regexp.Regexp
+	servers   []*regexp.Regexp
+}
+
+// loadQueryRules 编译节点配置中的查询规则, 未配置的使用默认规则
+func loadQueryRules(nodecfg *NodeConfig) (rules *queryRules, err error) {
+	rules = &queryRules{}
+	rules.forbidden, err = compileRules(nodecfg.ForbidCmds, []string{ForbidCmds})
+	if err != nil {
+		return
+	}
+	if nodecfg.ForbidContinuousQuery == 1 {
+		rules.forbidden = append(rules.forbidden, regexp.MustCompile(CreateCQCmds))
+	}
+	if len(nodecfg.AuthTokens) == 0 && nodecfg.AllowQueryAdmin != 1 {
+		rules.forbidden = append(rules.forbidden, regexp.MustCompile(QueryAdminCmds))
+	}
+	rules.obligated, err = compileGroups(nodecfg.SupportCmdGroups, nodecfg.SupportCmds, []string{SupportCmds})
+	if err != nil {
+		return
+	}
+	rules.globals, err = compileRules(nodecfg.GlobalCmds, GlobalCmds)
+	if err != nil {
+		return
+	}
+	rules.servers, err = compileRules(nodecfg.ServerCmds, ServerCmds)
 	return
 }
 
+// setQueryRules must be called with lock held.
+func (ic *InfluxCluster) setQueryRules(rules *queryRules) {
+	ic.ForbiddenQuery = rules.forbidden
+	ic.ObligatedQuery = rules.obligated
+	ic.GlobalQueries = rules.globals
+	ic.ServerQueries = rules.servers
+}
+
 func (ic *InfluxCluster) AddNext(ba BackendAPI) {
 	ic.lock.Lock()
 	defer ic.lock.Unlock()
@@ -232,11 +724,18 @@ func (ic *InfluxCluster) loadBackends() (backends map[string]BackendAPI, bas []B
 	}
 
 	for name, cfg := range bkcfgs {
-		backends[name], err = NewBackends(cfg, name, ic.storedir)
+		if cfg.FailoverWebhook == "" {
+			cfg.FailoverWebhook = ic.failoverWebhook
+		}
+		cfg.events = ic.events
+		var bs *Backends
+		bs, err = NewBackends(cfg, name, ic.storedir)
 		if err != nil {
 			logs.Errorf("create backend error: %s", err)
 			return
 		}
+		ic.overrides.apply(name, cfg, bs.HttpBackend)
+		backends[name] = bs
 	}
 
 	if ic.nexts != "" {
@@ -283,10 +782,60 @@ func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendAPI) (m2bs
 }
 
 func (ic *InfluxCluster) LoadConfig() (err error) {
+	ic.reload.Lock()
+	defer ic.reload.Unlock()
+
+	err = ic.cfgsrc.Reload()
+	if err != nil {
+		logs.Errorf("reload config file error: %s", err)
+		return
+	}
+
+	nodecfg, err := ic.cfgsrc.LoadNode()
+	if err != nil {
+		return
+	}
+	rules, err := loadQueryRules(&nodecfg)
+	if err != nil {
+		return
+	}
+	rates, err := loadSampleRates(&nodecfg)
+	if err != nil {
+		return
+	}
+	limits, err := loadRateLimits(&nodecfg)
+	if err != nil {
+		return
+	}
+	quotas, err := loadWriteQuotas(&nodecfg)
+	if err != nil {
+		return
+	}
+	skew, err := newTimestampSkew(&nodecfg)
+	if err != nil {
+		return
+	}
+	err = checkPreflight(&nodecfg)
+	if err != nil {
+		return
+	}
+
 	backends, bas, err := ic.loadBackends()
 	if err != nil {
 		return
 	}
+	if nodecfg.Preflight != "" {
+		problems := ic.preflight(backends)
+		for _, problem := range problems {
+			logs.Warningf("preflight %s", problem)
+		}
+		if len(problems) > 0 && nodecfg.Preflight == PREFLIGHT_STRICT {
+			for _, bs := range backends {
+				bs.Close()
+			}
+			return ErrPreflight
+		}
+	}
 
 	m2bs, err := ic.loadMeasurements(backends)
 	if err != nil {
@@ -298,9 +847,28 @@ func (ic *InfluxCluster) LoadConfig() (err error) {
 	ic.backends = backends
 	ic.bas = bas
 	ic.m2bs = m2bs
+	ic.setDBStats(m2bs)
+	ic.setQueryRules(rules)
+	ic.sampleRates = rates
+	ic.defaultKey = defaultMeasurementKey(&nodecfg)
+	ic.sharded = loadShardedMeasurements(&nodecfg)
+	ic.hashed = loadHashedMeasurements(&nodecfg)
+	ic.fieldMaps = loadFieldMaps(&nodecfg)
+	ic.stickyKeys = loadStickyMeasurements(&nodecfg)
+	ic.stickyQuery = nodecfg.StickyQuery == 1
+	ic.syncs = loadSyncMeasurements(&nodecfg)
+	ic.skew = skew
+	ic.limiter.setLimits(limits)
+	ic.quotas.setQuotas(quotas)
 	ic.lock.Unlock()
+	ic.stickyCache.configure(&nodecfg)
 
 	for name, bs := range orig_backends {
+		// removed backend, nobody else will replay its spool.
+		if b, ok := bs.(*Backends); ok && backends[name] == nil && ic.DrainTimeout > 0 {
+			go ic.drainBackend(name, b)
+			continue
+		}
 		err = bs.Close()
 		if err != nil {
 			logs.Errorf("fail in close backend %s", name)
@@ -309,50 +877,147 @@ func (ic *InfluxCluster) LoadConfig() (err error) {
 	return
 }
 
+// drainBackend 移除的后端在 DrainTimeout 内重放完备份文件再关闭
+func (ic *InfluxCluster) drainBackend(name string, bs *Backends) {
+	err := bs.Drain(ic.DrainTimeout)
+	if err != nil {
+		logs.Errorf("drain backend %s error: %s, data is left in %s", name, err, ic.storedir)
+		return
+	}
+	logs.Infof("backend %s drained", name)
+}
+
 func (ic *InfluxCluster) Ping() (version string, err error) {
 	atomic.AddInt64(&ic.stats.PingRequests, 1)
-	version = VERSION
+	version = ic.InfluxdbVersion
 	return
 }
 
+type PingInfo struct {
+	Version      string          `json:"version"`
+	ProxyVersion string          `json:"proxy_version"`
+	Zone         string          `json:"zone"`
+	Backends     map[string]bool `json:"backends"`
+}
+
+// WritePing 应答 /ping, 和 influxdb 一样接受 GET 和 HEAD, 返回 204, verbose=true 时返回 200 和 json
+func (ic *InfluxCluster) WritePing(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	version, _ := ic.Ping()
+	w.Header().Set("X-Influxdb-Version", version)
+	w.Header().Set("X-Influx-Proxy-Version", VERSION)
+	if req.FormValue("verbose") != "true" {
+		w.WriteHeader(204)
+		return
+	}
+
+	info := PingInfo{
+		Version:      version,
+		ProxyVersion: VERSION,
+		Zone:         ic.Zone,
+		Backends:     make(map[string]bool),
+	}
+	ic.lock.RLock()
+	for name, api := range ic.backends {
+		info.Backends[name] = api.IsActive()
+	}
+	ic.lock.RUnlock()
+	body, _ := json.Marshal(info)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
+
 func (ic *InfluxCluster) CheckQuery(q string) (err error) {
+	err = ic.CheckForbidden(q)
+	if err != nil {
+		return
+	}
+
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
-	if len(ic.ForbiddenQuery) != 0 {
-		for _, fq := range ic.ForbiddenQuery {
-			if fq.MatchString(q) {
-				return ErrQueryForbidden
-			}
+	for _, group := range ic.ObligatedQuery {
+		if !matchAny(group, q) {
+			return ErrQueryForbidden
 		}
 	}
 
-	if len(ic.ObligatedQuery) != 0 {
-		for _, pq := range ic.ObligatedQuery {
-			if pq.MatchString(q) {
-				return
-			}
+	return
+}
+
+// CheckForbidden 只检查 ForbiddenQuery, 用于不要求匹配 SupportCmds 的 db 级别的语句
+func (ic *InfluxCluster) CheckForbidden(q string) (err error) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	for _, fq := range ic.ForbiddenQuery {
+		if fq.MatchString(q) {
+			return ErrQueryForbidden
+		}
+	}
+	return
+}
+
+// matchAny 返回 q 是否匹配 rules 中的任意一条, 空的一组不限制
+func matchAny(rules []*regexp.Regexp, q string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, r := range rules {
+		if r.MatchString(q) {
+			return true
 		}
-		return ErrQueryForbidden
 	}
+	return false
+}
 
+// dbKeyMap 返回 db 的 measurement 映射, 没有配置时使用 _default_ db 的映射. 调用方需持有锁.
+func (ic *InfluxCluster) dbKeyMap(db string) (keyMap map[string][]BackendAPI, ok bool) {
+	keyMap, ok = ic.m2bs[db]
+	if !ok {
+		keyMap, ok = ic.m2bs["_default_"]
+	}
 	return
 }
 
+// defaultMeasurementKey 返回 KEYMAPS 中兜底的 key, 默认为 _default_
+func defaultMeasurementKey(nodecfg *NodeConfig) string {
+	if nodecfg.DefaultMeasurementKey == "" {
+		return "_default_"
+	}
+	return nodecfg.DefaultMeasurementKey
+}
+
+// GetBackends 返回 db 中 measurement 的后端, 依次匹配同名的 key, measurement 的前缀, 最后是兜底的 key
 func (ic *InfluxCluster) GetBackends(measurement, db string) (backends []BackendAPI, ok bool) {
+	_, backends, ok = ic.lookupBackends(measurement, db)
+	return
+}
+
+// lookupBackends 同 GetBackends, 同时返回匹配到的 KEYMAPS key
+func (ic *InfluxCluster) lookupBackends(measurement, db string) (key string, backends []BackendAPI, ok bool) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
 
-	keyMap, dbExist := ic.m2bs[db]
+	keyMap, dbExist := ic.dbKeyMap(db)
 	if !dbExist {
 		ok = false
 		return
 	}
 
+	key = measurement
 	backends, measurementExist := keyMap[measurement]
 
+	// the catch-all key is only used when nothing else matches, a measurement of the same name matches it exactly.
 	if !measurementExist {
 		for k, v := range keyMap {
-			if strings.HasPrefix(measurement, k) {
+			if k != ic.defaultKey && strings.HasPrefix(measurement, k) {
+				key = k
 				backends = v
 				measurementExist = true
 				break
@@ -362,7 +1027,8 @@ func (ic *InfluxCluster) GetBackends(measurement, db string) (backends []Backend
 	}
 
 	if !measurementExist {
-		backends, measurementExist = keyMap["_default_"]
+		key = ic.defaultKey
+		backends, measurementExist = keyMap[ic.defaultKey]
 	}
 
 	if !measurementExist {
@@ -377,6 +1043,8 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 	atomic.AddInt64(&ic.stats.QueryRequests, 1)
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.QueryRequestDuration, time.Since(start).Nanoseconds())
+		// the db may be set by the query, e.g. FROM "mydb"."autogen"."cpu".
+		atomic.AddInt64(&ic.dbStatistics(req.FormValue("db")).QueryRequests, 1)
 	}(time.Now())
 
 	switch req.Method {
@@ -384,113 +1052,512 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 	default:
 		w.WriteHeader(400)
 		w.Write([]byte("illegal method\n"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		ic.queryFailed(req)
 		return
 	}
 
+	if !ic.Acquire(w, req, CONCURRENT_QUERY) {
+		ic.queryFailed(req)
+		return
+	}
+	defer ic.Release(CONCURRENT_QUERY)
+
 	// TODO: several queries split by ';'
 	q := strings.TrimSpace(req.FormValue("q"))
 	if q == "" {
 		w.WriteHeader(400)
 		w.Write([]byte("empty query\n"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		ic.queryFailed(req)
 		return
 	}
 
-	err = ic.query_executor.Query(w, req)
-	if err == nil {
-		err = ic.ShowQuery(w, req)
+	if statsQuery.MatchString(q) {
+		return ic.showProxyStats(w)
+	}
+
+	// async only for statements without data to return, the result is never sent.
+	async := req.FormValue("async") == "true"
+	if async && !ic.ServerQuery(q) && !ic.GlobalQuery(q) && !seriesQuery.MatchString(q) {
+		w.WriteHeader(400)
+		w.Write([]byte("async is not supported for the query\n"))
+		ic.queryFailed(req)
+		return
+	}
+
+	req, span := ic.startSpan(req, "influxproxy.query")
+	defer span.End()
+	span.SetAttributes(attribute.String("db", req.FormValue("db")))
+
+	req, cancel := ic.withDeadline(req)
+	defer cancel()
+
+	req, err = ic.withQueryTimeout(req)
+	if err != nil {
+		writeError(w, 400, err)
+		ic.queryFailed(req)
+		return
+	}
+
+	if name := req.Header.Get(BACKEND_HEADER); name != "" {
+		err = ic.forcedQuery(w, req, name)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte("query error\n"))
-			atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
-			return
+			ic.queryFailed(req)
 		}
 		return
 	}
 
-	// deal with global query, e.g. create database
-	if ic.GlobalQuery(q) {
-		var db string
-		db, err = GetDBFromInfluxQL(q)
+	// running queries are per backend, only for admins.
+	if m := killQuery.FindStringSubmatch(q); m != nil || showQueries.MatchString(q) {
+		err = ic.CheckForbidden(q)
 		if err != nil {
 			w.WriteHeader(400)
-			w.Write([]byte("query error\n"))
-			atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+			w.Write([]byte("query forbidden\n"))
+			ic.queryFailed(req)
 			return
 		}
-		for _, bs := range ic.backends {
-			if bs.GetDB() == db {
-				err := bs.Query(w, req)
-				if err != nil {
-					logs.Errorf("GlobalQuery (%s) return error.%v", q, err)
-				}
-			}
-
+		if m != nil {
+			err = ic.killQuery(w, req, m)
+		} else {
+			err = ic.showQueries(w, req)
+		}
+		if err == ErrAllInactive {
+			ic.allInactive(w, req)
+			return
+		}
+		if err != nil {
+			ic.queryFailed(req)
 		}
 		return
 	}
 
-	err = ic.CheckQuery(q)
-	if err != nil {
+	err = ic.query_executor.Query(w, req)
+	if err == nil {
+		err = ic.ShowQuery(w, req)
+		if err == ErrAllInactive {
+			ic.allInactive(w, req)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("query error\n"))
+			ic.queryFailed(req)
+			return
+		}
+		return
+	}
+
+	// deal with global query, e.g. create user, create database
+	global := ic.ServerQuery(q)
+	var db string
+	if !global && ic.GlobalQuery(q) {
+		global = true
+		db, err = GetDBFromInfluxQL(q)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("query error\n"))
+			ic.queryFailed(req)
+			return
+		}
+	}
+	if global {
+		// statements of a db, e.g. retention policies and continuous queries, and of the server, e.g. users,
+		// must succeed on every backend, or the backends drift apart.
+		if db != "" {
+			err = ic.CheckForbidden(q)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("query forbidden\n"))
+				ic.queryFailed(req)
+				return
+			}
+		}
+		apis := ic.GlobalBackends(db)
+		if async {
+			ic.asyncQuery(w, req, func(w http.ResponseWriter, req *http.Request) error {
+				return ic.fanoutQuery(w, req, apis)
+			})
+			return
+		}
+		err = ic.fanoutQuery(w, req, apis)
+		if err == ErrPartialFanout {
+			ic.queryFailed(req)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("query error\n"))
+			ic.queryFailed(req)
+		}
+		return
+	}
+
+	err = ic.CheckQuery(q)
+	if err != nil {
 		w.WriteHeader(400)
 		w.Write([]byte("query forbidden\n"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		ic.queryFailed(req)
 		return
 	}
 
-	key, err := GetMeasurementFromInfluxQL(q)
+	// the query is routed as it is, the backends get the bounded one.
+	bounded, err := ic.timeBound.bound(q)
+	if err != nil {
+		writeError(w, 400, err)
+		ic.queryFailed(req)
+		return
+	}
+	if bounded != q {
+		req = req.Clone(req.Context())
+		req.Form.Set("q", bounded)
+	}
+
+	qdb, _, key, err := GetSourceFromInfluxQL(q)
 	if err != nil {
 		logs.Errorf("can't get measurement: %s\n", q)
 		w.WriteHeader(400)
 		w.Write([]byte("can't get measurement\n"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		ic.queryFailed(req)
 		return
 	}
 
-	db := req.FormValue("db")
+	db, err = queryDB(req, qdb)
+	if err != nil {
+		writeError(w, 409, err)
+		ic.queryFailed(req)
+		return
+	}
+	span.SetAttributes(attribute.String("measurement", key))
+	recordAccess(req.Context(), key)
 
-	apis, ok := ic.GetBackends(key, db)
+	mapped, apis, ok := ic.lookupBackends(key, db)
 	if !ok {
 		logs.Errorf("unknown measurement: %s,the query is %s\n", key, q)
 		w.WriteHeader(400)
 		w.Write([]byte("unknown measurement\n"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		ic.queryFailed(req)
 		return
 	}
 
-	// same zone first, other zone. pass non-active.
-	// TODO: better way?
+	// series may be on any of the backends, including write only ones.
+	if seriesQuery.MatchString(q) {
+		if async {
+			ic.asyncQuery(w, req, func(w http.ResponseWriter, req *http.Request) error {
+				return ic.fanoutQuery(w, req, apis)
+			})
+			return
+		}
+		err = ic.fanoutQuery(w, req, apis)
+		if err != nil {
+			ic.queryFailed(req)
+		}
+		return
+	}
 
-	for _, api := range apis {
-		if api.GetZone() != ic.Zone {
-			continue
+	// FROM cpu, mem of different backends.
+	if selectQuery.MatchString(q) {
+		handled, err := ic.multiQuery(w, req, db, apis)
+		if handled {
+			if err != nil {
+				ic.queryFailed(req)
+			}
+			return err
 		}
-		if !api.IsActive() || api.IsWriteOnly() {
-			continue
+	}
+
+	// each shard has part of the series, results are merged.
+	if ic.isSharded(key) && selectQuery.MatchString(q) {
+		err = ic.aggregateQuery(w, req, apis)
+		if err != nil {
+			ic.queryFailed(req)
+		}
+		return
+	}
+
+	if req.FormValue("verify") == "true" {
+		err = ic.VerifyQuery(w, req, apis)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("query error\n"))
+			ic.queryFailed(req)
+		}
+		return
+	}
+
+	ic.readRepair(req, apis)
+
+	// same zone first, other zone. pass non-active.
+	local, remote := ic.queryBackends(apis)
+	local, stickyID := ic.stickyBackends(req, mapped, db, key, local)
+	if len(local) == 0 && len(remote) == 0 && allWriteOnly(apis) {
+		if !ic.queryWriteOnly {
+			logs.Errorf("measurement %s is write-only, the query is %s", key, q)
+			writeError(w, 403, fmt.Errorf("measurement %s is write-only on this proxy", key))
+			atomic.AddInt64(&ic.stats.QueriesWriteOnly, 1)
+			ic.queryFailed(req)
+			return ErrWriteOnly
 		}
+		local = activeBackends(apis)
+	}
+	if len(local) == 0 && len(remote) == 0 {
+		logs.Errorf("all backends of %s are inactive, the query is %s", key, q)
+		ic.allInactive(w, req)
+		return ErrAllInactive
+	}
+	for _, api := range local {
+		ic.servedBy(w, req, api)
 		err = api.Query(w, req)
 		if err == nil {
+			span.SetAttributes(attribute.String("backend", api.GetName()), attribute.String("zone", api.GetZone()))
+			recordAccess(req.Context(), "", api)
+			// the next query of the client goes to the same backend, or the one failed over to.
+			if stickyID != "" {
+				ic.stickyCache.set(stickyID, api.GetName(), time.Now())
+			}
 			return
 		}
 	}
 
-	for _, api := range apis {
-		if api.GetZone() == ic.Zone {
-			continue
-		}
-		if !api.IsActive() {
-			continue
+	// remote zone may be far away, don't go beyond the deadline.
+	for _, api := range remote {
+		if req.Context().Err() != nil {
+			break
 		}
+		ic.servedBy(w, req, api)
 		err = api.Query(w, req)
 		if err == nil {
+			span.SetAttributes(attribute.String("backend", api.GetName()), attribute.String("zone", api.GetZone()))
+			recordAccess(req.Context(), "", api)
 			return
 		}
 	}
+	span.SetStatus(codes.Error, "query failed")
+	ic.servedBy(w, req)
+
+	if req.Context().Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		logs.Errorf("query timeout, the query is %s", q)
+		w.WriteHeader(504)
+		w.Write([]byte("query timeout\n"))
+		ic.queryFailed(req)
+		return context.DeadlineExceeded
+	}
 
 	w.WriteHeader(400)
 	w.Write([]byte("query error\n"))
-	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+	ic.queryFailed(req)
+	return
+}
+
+// allInactive 后端全都不可用时返回 503, 客户端 Retry-After 秒后重试, 而不是当成没有数据
+func (ic *InfluxCluster) allInactive(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(ic.retryAfter))
+	writeError(w, 503, ErrAllInactive)
+	ic.queryFailed(req)
+}
+
+// forcedQuery 不经过后端选择, 把查询原样发给后端 name, 用于排查后端之间的数据差异
+func (ic *InfluxCluster) forcedQuery(w http.ResponseWriter, req *http.Request, name string) (err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	if !ic.forceBackend {
+		w.WriteHeader(403)
+		w.Write([]byte(BACKEND_HEADER + " is not enabled\n"))
+		return ErrQueryForbidden
+	}
+	err = ic.CheckQuery(q)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("query forbidden\n"))
+		return
+	}
+	ic.lock.RLock()
+	api, ok := ic.backends[name]
+	ic.lock.RUnlock()
+	if !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("unknown backend\n"))
+		return ErrBackendNotExist
+	}
+	if !api.IsActive() {
+		w.WriteHeader(400)
+		w.Write([]byte("backend is not active\n"))
+		return ErrUnavailable
+	}
+
+	logs.Infof("query (%s) forced to backend %s", q, name)
+	recordAccess(req.Context(), "", api)
+	ic.servedBy(w, req, api)
+	err = api.Query(w, req)
+	if err != nil {
+		ic.servedBy(w, req)
+		w.WriteHeader(502)
+		w.Write([]byte("query error\n"))
+	}
+	return
+}
+
+// servedBy 在响应头中写出返回结果的后端和 zone, 多个时以逗号分隔, 没有时去掉.
+// 开启 QueryTracing 时同时记在日志中.
+func (ic *InfluxCluster) servedBy(w http.ResponseWriter, req *http.Request, apis ...BackendAPI) {
+	var names, zones []string
+	for _, api := range apis {
+		names = appendUnique(names, api.GetName())
+		zones = appendUnique(zones, api.GetZone())
+	}
+	backend, zone := strings.Join(names, ","), strings.Join(zones, ",")
+	if ic.hideBackend || len(apis) == 0 {
+		w.Header().Del(BACKEND_HEADER)
+		w.Header().Del(ZONE_HEADER)
+	} else {
+		w.Header().Set(BACKEND_HEADER, backend)
+		w.Header().Set(ZONE_HEADER, zone)
+	}
+	if ic.QueryTracing != 0 && len(apis) > 0 {
+		logs.Infof("the query is %s,served by %s in zone %s", req.FormValue("q"), backend, zone)
+	}
+}
+
+// withDeadline 设置整个查询的截止时间, X-Query-Deadline 请求头优先于配置.
+func (ic *InfluxCluster) withDeadline(req *http.Request) (*http.Request, context.CancelFunc) {
+	deadline := ic.QueryDeadline
+	if h := req.Header.Get("X-Query-Deadline"); h != "" {
+		d, err := parseDuration(h)
+		if err != nil {
+			logs.Errorf("illegal X-Query-Deadline: %s", h)
+		} else {
+			deadline = d
+		}
+	}
+	if deadline <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), deadline)
+	return req.WithContext(ctx), cancel
+}
+
+// withQueryTimeout 设置查询在每个后端上的超时, X-Query-Timeout 请求头或者 timeout 参数, 不超过 MaxQueryTimeout.
+// 都没有时用后端的 TimeoutQuery.
+func (ic *InfluxCluster) withQueryTimeout(req *http.Request) (*http.Request, error) {
+	h := req.Header.Get(QUERY_TIMEOUT_HEADER)
+	if h == "" {
+		h = req.FormValue("timeout")
+	}
+	if h == "" {
+		return req, nil
+	}
+	d, err := parseDuration(h)
+	if err != nil || d <= 0 {
+		return req, fmt.Errorf("illegal query timeout: %s", h)
+	}
+	if ic.MaxQueryTimeout > 0 && d > ic.MaxQueryTimeout {
+		d = ic.MaxQueryTimeout
+	}
+	req.Form.Del("timeout")
+	return req.WithContext(context.WithValue(req.Context(), queryTimeoutKey{}, d)), nil
+}
+
+// parseDuration accepts both duration string and milliseconds.
+func parseDuration(s string) (d time.Duration, err error) {
+	if ms, Err := strconv.ParseInt(s, 10, 64); Err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// queryBackends 返回可查询的后端, 同zone的按QueryWeight加权随机排序,
+// 权重为0的排在最后, 其它zone的按配置顺序.
+func (ic *InfluxCluster) queryBackends(apis []BackendAPI) (local []BackendAPI, remote []BackendAPI) {
+	var zero []BackendAPI
+	for _, api := range apis {
+		if !api.IsActive() {
+			continue
+		}
+		if api.GetZone() != ic.Zone {
+			remote = append(remote, api)
+			continue
+		}
+		if api.IsWriteOnly() {
+			continue
+		}
+		if api.GetQueryWeight() <= 0 {
+			zero = append(zero, api)
+			continue
+		}
+		local = append(local, api)
+	}
+	local = append(weightedShuffle(local), zero...)
+	return
+}
+
+// refuseInactive 去掉不接受写入的后端, 除了影子后端都不接受时返回 ErrAllUnavailable
+func refuseInactive(apis []BackendAPI) (writable []BackendAPI, err error) {
+	primary := 0
+	for i, api := range apis {
+		bs, ok := api.(*Backends)
+		if !ok || !bs.refuses() {
+			if writable != nil {
+				writable = append(writable, api)
+			}
+			if !api.IsShadow() {
+				primary++
+			}
+			continue
+		}
+		atomic.AddInt64(&bs.stats.RefusedPoints, 1)
+		if writable == nil {
+			writable = append(make([]BackendAPI, 0, len(apis)), apis[:i]...)
+		}
+	}
+	if writable == nil {
+		return apis, nil
+	}
+	if primary == 0 {
+		return nil, ErrAllUnavailable
+	}
+	return
+}
+
+// allWriteOnly apis 都是只写的后端
+func allWriteOnly(apis []BackendAPI) bool {
+	for _, api := range apis {
+		if !api.IsWriteOnly() {
+			return false
+		}
+	}
+	return len(apis) > 0
+}
+
+// activeBackends 返回 apis 中可用的后端, 保持原来的顺序
+func activeBackends(apis []BackendAPI) (active []BackendAPI) {
+	for _, api := range apis {
+		if api.IsActive() {
+			active = append(active, api)
+		}
+	}
+	return
+}
+
+// weightedShuffle picks apis one by one in proportion to their weights.
+func weightedShuffle(apis []BackendAPI) (sorted []BackendAPI) {
+	if len(apis) < 2 {
+		return apis
+	}
+	total := 0
+	for _, api := range apis {
+		total += api.GetQueryWeight()
+	}
+	rest := append([]BackendAPI(nil), apis...)
+	sorted = make([]BackendAPI, 0, len(apis))
+	for len(rest) > 0 {
+		n := rand.Intn(total)
+		for i, api := range rest {
+			n -= api.GetQueryWeight()
+			if n < 0 {
+				sorted = append(sorted, api)
+				total -= api.GetQueryWeight()
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+	}
 	return
 }
 
@@ -506,60 +1573,207 @@ func BytesToInt64(buf []byte) int64 {
 	return ans
 }
 
+// rewriteTimestamp 把行的时间戳换成纳秒, 没有时间戳的行使用当前时间.
+// 时间戳不变时直接返回 line, 否则只分配一次.
+// 新的行交给各个后端的写入协程异步复制, 所以不能放回 sync.Pool 复用.
+func rewriteTimestamp(line []byte, precision string) []byte {
+	d := time.Duration(models.GetPrecisionMultiplier(precision))
+	var prefix []byte
+	var nano time.Duration
+	switch bytes.Count(line, []byte{' '}) {
+	case 1:
+		nano = time.Duration(time.Now().UnixNano())
+		nano = nano / d * d
+		prefix = line
+	case 2:
+		i := bytes.LastIndexByte(line, ' ')
+		ts := line[i+1:]
+		nano = time.Duration(BytesToInt64(ts))
+		nano = nano / d * d
+		var tsbuf [20]byte
+		if bytes.Equal(strconv.AppendInt(tsbuf[:0], nano.Nanoseconds(), 10), ts) {
+			return line
+		}
+		prefix = line[:i]
+	}
+
+	out := make([]byte, 0, len(prefix)+21)
+	if prefix != nil {
+		out = append(out, prefix...)
+		out = append(out, ' ')
+	}
+	return strconv.AppendInt(out, nano.Nanoseconds(), 10)
+}
+
+// stampNow 给没有时间戳的行补上按 precision 截断的当前时间, 缓冲后重放时仍是收到的时间.
+func stampNow(line []byte, precision string) []byte {
+	if _, _, ts := splitLine(line); len(ts) != 0 {
+		return line
+	}
+	// line 指向请求的缓冲, 不能原地追加.
+	out := make([]byte, 0, len(line)+21)
+	out = append(append(out, line...), ' ')
+	return strconv.AppendInt(out, time.Now().UnixNano()/models.GetPrecisionMultiplier(precision), 10)
+}
+
 // Wrong in one row will not stop others.
 // So don't try to return error, just print it.
 func (ic *InfluxCluster) WriteRow(line []byte, precision string, db string) {
-	atomic.AddInt64(&ic.stats.PointsWritten, 1)
-	// maybe trim?
+	ic.writeRow(context.Background(), line, precision, db, nil)
+}
+
+// writeRow 返回行的 measurement, 空行返回空字符串.
+// 同步写入的 measurement 的行放到 sb 中由调用方发送, sb 为 nil 时照常异步写入.
+func (ic *InfluxCluster) writeRow(ctx context.Context, line []byte, precision string, db string, sb *syncBatch) (key string, err error) {
+	stats, dbs := ic.writeStats(ctx), ic.writeDBStats(ctx, db)
 	line = bytes.TrimRight(line, " \t\r\n")
 
-	// empty line, ignore it.
+	// blank line, not a point.
 	if len(line) == 0 {
 		return
 	}
+	atomic.AddInt64(&stats.PointsWritten, 1)
+	atomic.AddInt64(&dbs.PointsWritten, 1)
 
-	key, err := ScanKey(line)
+	key, err = ScanKey(line)
 	if err != nil {
 		logs.Errorf("scan key error: %s\n", err)
-		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		atomic.AddInt64(&stats.PointsWrittenFail, 1)
+		atomic.AddInt64(&dbs.PointsWrittenFail, 1)
 		return
 	}
 
-	bs, ok := ic.GetBackends(key, db)
+	line, key, err = ic.transform(key, line)
+	if err != nil {
+		logs.Errorf("transform %s error: %s\n", key, err)
+		atomic.AddInt64(&stats.PointsWrittenFail, 1)
+		atomic.AddInt64(&dbs.PointsWrittenFail, 1)
+		return
+	}
+	if line == nil {
+		return
+	}
+
+	ic.lock.RLock()
+	skew := ic.skew
+	ic.lock.RUnlock()
+	if out, skewed := skew.check(line, precision, time.Now()); skewed {
+		atomic.AddInt64(&stats.PointsSkewed, 1)
+		if out == nil {
+			return key, ErrTimestampSkew
+		}
+		line = out
+	}
+
+	// fields of the point split to the backends of other keys.
+	if parts := ic.splitByFields(key, db, line, precision); parts != nil {
+		for _, part := range parts {
+			err = ic.routeRow(ctx, key, part.route, part.line, precision, db, sb)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	err = ic.routeRow(ctx, key, key, line, precision, db, sb)
+	return
+}
+
+// routeRow 把 measurement 为 key 的行写到 KEYMAPS 中 route 的后端, route 通常就是 key,
+// 按 field 拆分的行为 FieldMaps 中的 key
+func (ic *InfluxCluster) routeRow(ctx context.Context, key, route string, line []byte, precision string, db string, sb *syncBatch) (err error) {
+	stats, dbs := ic.writeStats(ctx), ic.writeDBStats(ctx, db)
+	mapped, bs, ok := ic.lookupBackends(route, db)
+	if ok {
+		bs = ic.drains.exclude(bs)
+		if len(bs) == 0 {
+			logs.Errorf("all backends of %s are draining\n", key)
+			atomic.AddInt64(&stats.PointsWrittenFail, 1)
+			atomic.AddInt64(&dbs.PointsWrittenFail, 1)
+			return ErrAllDraining
+		}
+	}
+	if ok && ic.isHashed(mapped) {
+		bs = hashBackends(line, bs)
+	}
+	var spooled []BackendAPI
+	if ok {
+		bs, spooled = ic.replication.split(key, bs)
+		bs, err = refuseInactive(bs)
+		if err != nil {
+			logs.Errorf("all backends of %s are unavailable\n", key)
+			atomic.AddInt64(&stats.PointsWrittenFail, 1)
+			atomic.AddInt64(&dbs.PointsWrittenFail, 1)
+			return err
+		}
+	}
+	if ok && sb != nil && !ic.isSync(mapped) {
+		sb = nil
+	}
+	recordAccess(ctx, key, bs...)
+	traceRow(ctx, key, bs)
+
 	if !ok {
 		logs.Errorf("new measurement: %s\n", key)
-		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		atomic.AddInt64(&stats.PointsWrittenFail, 1)
+		atomic.AddInt64(&dbs.PointsWrittenFail, 1)
 		// TODO: new measurement?
+		return ErrUnknownMeasurement
+	}
+
+	ic.lock.RLock()
+	rate, ok := ic.sampleRates[key]
+	ic.lock.RUnlock()
+	if ok && !sampled(line, rate) {
+		atomic.AddInt64(&stats.PointsSampled, 1)
 		return
 	}
+	ic.keyMetrics.add(key)
 
-	lines := bytes.Split(line, []byte(" "))
-	length := len(lines)
-	buf := bytes.Buffer{}
+	// forward the line and precision untouched.
+	if ic.KeepPrecision != 0 {
+		if precision == "ns" || precision == "n" {
+			precision = ""
+		}
+		line = stampNow(line, precision)
+		spoolCapped(spooled, line, precision)
+		for _, b := range bs {
+			if sb != nil && sb.add(b, line, precision) {
+				continue
+			}
+			err = b.WritePrecision(line, precision)
+			if err != nil && b.IsShadow() {
+				err = nil
+				continue
+			}
+			if err != nil {
+				logs.Errorf("cluster write fail: %s\n", key)
+				atomic.AddInt64(&stats.PointsWrittenFail, 1)
+				atomic.AddInt64(&dbs.PointsWrittenFail, 1)
+				return
+			}
+		}
+		return
+	}
 
-	d := models.GetPrecisionMultiplier(precision)
-	var nano time.Duration
-	if len(lines) == 2 {
-		nano = time.Duration(time.Now().UnixNano())
-		nano = nano / time.Duration(d) * time.Duration(d)
-		buf.Write(line)
-		buf.Write([]byte(" "))
-	} else if len(lines) == 3 {
-		nano = time.Duration(BytesToInt64(lines[length-1]))
-		nano = nano / time.Duration(d) * time.Duration(d)
-		res := bytes.Join(lines[:length-1], []byte(" "))
-		buf.Write(res)
-		buf.Write([]byte(" "))
-	}
-	buf.Write(Int64ToBytes(nano.Nanoseconds()))
-	line = buf.Bytes()
+	line = rewriteTimestamp(line, precision)
+	spoolCapped(spooled, line, "")
 
 	// don't block here for a lont time, we just have one worker.
 	for _, b := range bs {
+		if sb != nil && sb.add(b, line, "") {
+			continue
+		}
 		err = b.Write(line)
+		// shadow failures never affect the client.
+		if err != nil && b.IsShadow() {
+			err = nil
+			continue
+		}
 		if err != nil {
 			logs.Errorf("cluster write fail: %s\n", key)
-			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+			atomic.AddInt64(&stats.PointsWrittenFail, 1)
+			atomic.AddInt64(&dbs.PointsWrittenFail, 1)
 			return
 		}
 	}
@@ -567,46 +1781,138 @@ func (ic *InfluxCluster) WriteRow(line []byte, precision string, db string) {
 }
 
 func (ic *InfluxCluster) Write(p []byte, precision string, db string) (err error) {
-	atomic.AddInt64(&ic.stats.WriteRequests, 1)
+	return ic.WriteContext(context.Background(), p, precision, db)
+}
+
+// WriteContext 同 Write, ctx 带有上游的 trace context.
+// 同步写入的 measurement 失败时返回 *SyncWriteError.
+func (ic *InfluxCluster) WriteContext(ctx context.Context, p []byte, precision string, db string) (err error) {
+	return ic.writeContext(ctx, p, precision, db, false, false)
+}
+
+// WriteSyncFallback 同 WriteContext, 同步写入失败的数据写到备份文件, 不返回错误.
+func (ic *InfluxCluster) WriteSyncFallback(ctx context.Context, p []byte, precision string, db string) (err error) {
+	return ic.writeContext(ctx, p, precision, db, true, false)
+}
+
+// WriteStrict 同 WriteContext, 所有行都尝试写入后, 有失败的行时返回 *LineErrors.
+// fallback 同 WriteSyncFallback.
+func (ic *InfluxCluster) WriteStrict(ctx context.Context, p []byte, precision string, db string, fallback bool) (err error) {
+	return ic.writeContext(ctx, p, precision, db, fallback, true)
+}
+
+func (ic *InfluxCluster) writeContext(ctx context.Context, p []byte, precision string, db string, fallback, strict bool) (err error) {
+	stats, dbs := ic.writeStats(ctx), ic.writeDBStats(ctx, db)
+	atomic.AddInt64(&stats.WriteRequests, 1)
+	atomic.AddInt64(&dbs.WriteRequests, 1)
 	defer func(start time.Time) {
-		atomic.AddInt64(&ic.stats.WriteRequestDuration, time.Since(start).Nanoseconds())
+		atomic.AddInt64(&stats.WriteRequestDuration, time.Since(start).Nanoseconds())
 	}(time.Now())
 
-	buf := bytes.NewBuffer(p)
+	ctx, span := ic.tracer.Start(ctx, "influxproxy.write", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	span.SetAttributes(attribute.String("db", db), attribute.String("precision", precision), attribute.String("zone", ic.Zone))
+	// the rows are recorded on this span, not one span each.
+	var wt *writeTrace
+	if span.IsRecording() {
+		wt = &writeTrace{}
+		ctx = context.WithValue(ctx, writeTraceKey{}, wt)
+	}
 
-	var line []byte
-	for {
-		line, err = buf.ReadBytes('\n')
-		switch err {
-		default:
-			logs.Errorf("error: %s\n", err)
-			atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
-			return
-		case io.EOF, nil:
-			err = nil
-		}
+	if !ic.quotas.take(db, CountRows(p)) {
+		span.SetStatus(codes.Error, "write quota exceeded")
+		atomic.AddInt64(&stats.WriteRequestsFail, 1)
+		atomic.AddInt64(&dbs.WriteRequestsFail, 1)
+		return ErrQuotaExceeded
+	}
 
-		if len(line) == 0 {
-			break
+	// lines are sliced from p, not copied.
+	sb := newSyncBatch()
+	// failed lines are reported if strict, the unavailable ones always.
+	// n is the line number in p, blank lines included, rows are the lines not blank.
+	// the last line may have no newline.
+	var lineErrs *LineErrors
+	rows, unavailable := 0, 0
+	for n, rest := 1, p; len(rest) > 0; n++ {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, rest = rest[:i+1], rest[i+1:]
+		} else {
+			rest = nil
 		}
-
-		ic.WriteRow(line, precision, db)
+		key, rowErr := ic.writeRow(ctx, line, precision, db, sb)
+		if key != "" || rowErr != nil {
+			rows++
+		}
+		if rowErr == ErrAllUnavailable {
+			unavailable++
+		}
+		if rowErr != nil && (strict || rowErr == ErrAllUnavailable) {
+			lineErrs = lineErrs.add(n, rowErr)
+		}
+		if rowErr != nil && wt != nil {
+			wt.failed++
+		}
+	}
+	if wt != nil {
+		wt.end(span, rows)
+	}
+	syncErr := ic.writeSync(sb, fallback)
+	if syncErr != nil {
+		span.SetStatus(codes.Error, syncErr.Error())
+		atomic.AddInt64(&stats.WriteRequestsFail, 1)
+		atomic.AddInt64(&dbs.WriteRequestsFail, 1)
 	}
 
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
 	if len(ic.bas) > 0 {
 		for _, n := range ic.bas {
+			if ic.nextWriteFail {
+				ic.writeNext(n, p)
+				continue
+			}
 			err = n.Write(p)
 			if err != nil {
 				logs.Errorf("error: %s\n", err)
-				atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+				atomic.AddInt64(&stats.WriteRequestsFail, 1)
+				atomic.AddInt64(&dbs.WriteRequestsFail, 1)
 			}
 		}
 	}
+	if syncErr != nil {
+		return syncErr
+	}
+	if unavailable > 0 {
+		span.SetStatus(codes.Error, ErrAllUnavailable.Error())
+		atomic.AddInt64(&stats.WriteRequestsFail, 1)
+		atomic.AddInt64(&dbs.WriteRequestsFail, 1)
+	}
+	// nothing is written, the client may retry the whole request.
+	if unavailable > 0 && unavailable == rows {
+		return ErrAllUnavailable
+	}
+	if lineErrs != nil {
+		lineErrs.Total = rows
+		return lineErrs
+	}
 	return
 }
 
+// writeNext 写到其他 zone 的 next, 失败或者 next 不可用只记在 NextWriteFail, 不影响请求.
+// next 是 BACKENDS 中的后端时, 不可用期间的数据由它的备份文件重放.
+func (ic *InfluxCluster) writeNext(n BackendAPI, p []byte) {
+	err := n.Write(p)
+	if err != nil {
+		logs.Errorf("write next error: %s\n", err)
+		atomic.AddInt64(&ic.stats.NextWriteFail, 1)
+		return
+	}
+	if !n.IsActive() {
+		atomic.AddInt64(&ic.stats.NextWriteFail, 1)
+	}
+}
+
 func (ic *InfluxCluster) Close() (err error) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
@@ -616,146 +1922,540 @@ func (ic *InfluxCluster) Close() (err error) {
 			logs.Errorf("fail in close backend %s", name)
 		}
 	}
+	if ic.tp != nil {
+		ic.tp.Shutdown(context.Background())
+	}
+	if ic.accessLog != nil {
+		ic.accessLog.Close()
+	}
+	ic.events.close()
+	for _, fn := range ic.closers {
+		fn()
+	}
+	return
+}
+
+// OnClose 注册 Close 时调用的函数, 和 cluster 一起关闭, e.g. admin server
+func (ic *InfluxCluster) OnClose(fn func()) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.closers = append(ic.closers, fn)
+}
+
+// QueryAllResult QueryAll 的结果, Served 为查到的 measurement 映射,
+// Missing 为本 zone 的后端都不可用或者都查询失败的映射, 它们的数据不在 Bodys 中
+type QueryAllResult struct {
+	Header  http.Header
+	Bodys   [][]byte
+	Served  []string
+	Missing []string
+}
+
+func (ic *InfluxCluster) QueryAll(req *http.Request) (result QueryAllResult, err error) {
+	result.Bodys = make([][]byte, 0)
+	qr, err := ic.queryEach(req, func(body io.Reader) (err error) {
+		p, err := ioutil.ReadAll(body)
+		if err == nil {
+			result.Bodys = append(result.Bodys, p)
+		}
+		return
+	})
+	if err != nil {
+		return QueryAllResult{}, err
+	}
+	result.Header, result.Served, result.Missing = qr.header, qr.keys, qr.missing
 	return
 }
 
-func (ic *InfluxCluster) QueryAll(req *http.Request) (sHeader http.Header, bodys [][]byte, err error) {
-	bodys = make([][]byte, 0)
-	db := req.FormValue("db")
-	m2bs := ic.m2bs[db]
+// queryEachResult queryEach 的结果, served 为返回了结果的后端, keys 和 missing 为查到和没查到的映射
+type queryEachResult struct {
+	header  http.Header
+	served  []BackendAPI
+	keys    []string
+	missing []string
+}
+
+type queryGroup struct {
+	key        string
+	candidates []BackendAPI
+}
+
+// queryDB 返回查询的 db. db 参数为空时用 FROM "db"."rp"."cpu" 中的 db, 并设置到 req 上, 两者都有但不同时返回 ErrDBConflict
+func queryDB(req *http.Request, qdb string) (db string, err error) {
+	db = req.FormValue("db")
+	switch {
+	case qdb == "" || qdb == db:
+		return
+	case db != "":
+		return db, ErrDBConflict
+	}
+	req.Form.Set("db", qdb)
+	return qdb, nil
+}
 
-	for _, v := range m2bs {
-		need := false
-		actu := false
+// queryEach 查询 db 的 measurement 映射涉及的后端, 每个后端只查一次.
+// 每个映射选本 zone 一个可用的后端, 优先选其他映射已经选中的, 失败时换映射里的其他后端.
+// 最多 DEFAULT_QUERY_ALL_CONCURRENCY 个后端同时查询, 响应边解压边交给 fn 处理, fn 不会并发调用.
+// fn 返回错误时立即结束. 部分映射没有查到时记在 missing 中, 全都没有查到时返回错误,
+// 没有一个可用的后端时返回 ErrAllInactive.
+func (ic *InfluxCluster) queryEach(req *http.Request, fn func(body io.Reader) error) (qr queryEachResult, err error) {
+	db := req.FormValue("db")
+	ic.lock.RLock()
+	m2bs, _ := ic.dbKeyMap(db)
+	ic.lock.RUnlock()
 
-		for _, api := range v {
-			if api.GetZone() != ic.Zone {
+	// in the order of keys, so the backends and the merged results are the same on every run.
+	keys := make([]string, 0, len(m2bs))
+	for key := range m2bs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var groups []queryGroup
+	for _, key := range keys {
+		var candidates []BackendAPI
+		readable := false
+		for _, api := range m2bs[key] {
+			if api.GetZone() != ic.Zone || api.IsWriteOnly() {
 				continue
 			}
-			if !api.IsActive() || api.IsWriteOnly() {
+			readable = true
+			if !api.IsActive() {
 				continue
 			}
-			need = true
+			candidates = append(candidates, api)
+		}
+		switch {
+		case len(candidates) > 0:
+			groups = append(groups, queryGroup{key: key, candidates: candidates})
+		case readable:
+			qr.missing = append(qr.missing, key)
+		}
+	}
 
-			header, _, sBody, Err := api.QueryResp(req)
-			if Err != nil {
-				err = Err
+	if len(groups) == 0 && len(qr.missing) > 0 {
+		return queryEachResult{}, ErrAllInactive
+	}
+
+	covered := func(candidates []BackendAPI, set map[BackendAPI]bool) bool {
+		for _, api := range candidates {
+			if set[api] {
+				return true
+			}
+		}
+		return false
+	}
+	tried := make(map[BackendAPI]bool)
+	done := make(map[BackendAPI]bool)
+	failed := make(map[string]bool)
+	var qerr error
+	for {
+		var round []BackendAPI
+		chosen := make(map[BackendAPI]bool)
+		for _, g := range groups {
+			if failed[g.key] || covered(g.candidates, done) || covered(g.candidates, chosen) {
 				continue
 			}
-
-			sHeader = header
-			bodys = append(bodys, sBody)
-			actu = true
+			var next BackendAPI
+			for _, api := range g.candidates {
+				if !tried[api] {
+					next = api
+					break
+				}
+			}
+			// every backend of the mapping failed.
+			if next == nil {
+				failed[g.key] = true
+				continue
+			}
+			chosen[next] = true
+			round = append(round, next)
+		}
+		if len(round) == 0 {
 			break
 		}
 
-		if need && !actu {
-			sHeader = nil
-			bodys = nil
-			return
+		// responses are handed to fn one by one in the order of round.
+		turns := make([]chan struct{}, len(round)+1)
+		for i := range turns {
+			turns[i] = make(chan struct{})
 		}
+		close(turns[0])
+		var wg sync.WaitGroup
+		var ferr error
+		sem := make(chan struct{}, DEFAULT_QUERY_ALL_CONCURRENCY)
+		for i, api := range round {
+			tried[api] = true
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, api BackendAPI) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				header, Err, fErr := queryStream(api, req, fn, turns[i])
+				<-turns[i]
+				defer close(turns[i+1])
+				switch {
+				case fErr != nil:
+					ferr = fErr
+				case Err != nil:
+					qerr = Err
+				default:
+					qr.header = header
+					qr.served = append(qr.served, api)
+					done[api] = true
+				}
+			}(i, api)
+		}
+		wg.Wait()
+		if ferr != nil {
+			return queryEachResult{}, ferr
+		}
+	}
+
+	for _, g := range groups {
+		if failed[g.key] {
+			qr.missing = append(qr.missing, g.key)
+			continue
+		}
+		qr.keys = append(qr.keys, g.key)
+	}
+	sort.Strings(qr.missing)
+	if len(qr.keys) == 0 && len(qr.missing) > 0 {
+		err = qerr
+		if err == nil {
+			err = ErrUnavailable
+		}
+		return queryEachResult{}, err
 	}
-	err = nil
 	return
 }
 
-func (ic *InfluxCluster) showMeasurements(bodys [][]byte) (fBody []byte, err error) {
-	measureMap := make(map[interface{}]seri)
-	for _, body := range bodys {
-		sSs, Err := GetSeriesArray(body)
-		if Err != nil {
-			err = Err
-			return
-		}
-		for _, s := range sSs {
-			for _, value := range s.Values {
-				valueString, ok := value[0].(string)
-				if ok {
-					if strings.Contains(valueString, "influxdb.cluster") {
-						continue
-					}
-				}
-				measureMap[value[0]] = s
-			}
+// queryStream 在 req 的副本上查询 api, 等到 turn 关闭后把响应交给 fn 处理.
+// err 为查询错误, ferr 为 fn 返回的错误.
+func queryStream(api BackendAPI, req *http.Request, fn func(body io.Reader) error, turn <-chan struct{}) (header http.Header, err, ferr error) {
+	recordAccess(req.Context(), "", api)
+	// the request is changed by the backend.
+	r := req.Clone(req.Context())
+	r.Body = nil
+	// the merged result is sent as one response.
+	r.Form.Del("chunked")
+	r.Form.Del("chunk_size")
+	resp, err := api.QueryStream(r)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zip, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			logs.Errorf("unable to decode gzip body")
+			return nil, err, nil
 		}
+		body = zip
 	}
-	var serie seri
-	var measures [][]interface{}
-	for measure, s := range measureMap {
-		measures = append(measures, []interface{}{measure})
-		serie = s
+	<-turn
+	ferr = fn(body)
+	return resp.Header, nil, ferr
+}
+
+// showMerger 合并各后端 show 语句的结果
+type showMerger interface {
+	merge(ss []seri)
+	body(messages []message) ([]byte, error)
+}
+
+// partialMessages 部分映射没有查到时返回警告, 结果不完整
+func partialMessages(req *http.Request, missing []string) []message {
+	if len(missing) == 0 {
+		return nil
 	}
-	serie.Values = measures
-	fBody, err = GetJsonBodyfromSeries([]seri{serie})
-	return
+	text := "partial results, no backend available for " + strings.Join(missing, ", ")
+	logs.Warningf("query (%s) of db %s: %s", req.FormValue("q"), req.FormValue("db"), text)
+	return []message{{Level: "warning", Text: text}}
+}
 
+// measurementsMerger 按 measurement 去重, 排序后按 WITH MEASUREMENT 过滤并分页
+type measurementsMerger struct {
+	names  map[string]bool
+	serie  seri
+	re     *regexp.Regexp
+	name   string
+	limit  int
+	offset int
+	// the stats measurement, left out in the stats db.
+	exclude string
 }
 
-func (ic *InfluxCluster) showTagFieldkey(bodys [][]byte) (fBody []byte, err error) {
-	seriesMap := make(map[string]seri)
-	for _, body := range bodys {
-		sSs, Err := GetSeriesArray(body)
-		if Err != nil {
-			err = Err
-			return
+// influxql 只接受标识符, 把 WITH MEASUREMENT = 'name' 改为 WITH MEASUREMENT = "name"
+var withMeasurementString = regexp.MustCompile(`(?i)(\bwith\s+measurement\s*=\s*)'((?:[^'\\]|\\.)*)'`)
+
+func quoteWithMeasurement(q string) string {
+	return withMeasurementString.ReplaceAllStringFunc(q, func(s string) string {
+		sub := withMeasurementString.FindStringSubmatch(s)
+		name := strings.NewReplacer(`\'`, `'`, `"`, `\"`).Replace(sub[2])
+		return sub[1] + `"` + name + `"`
+	})
+}
+
+// newMeasurementsMerger 解析 show measurements 语句, 返回下发给后端的语句, LIMIT 和 OFFSET 在合并后处理
+func newMeasurementsMerger(q string) (m *measurementsMerger, query string) {
+	m = &measurementsMerger{names: make(map[string]bool)}
+	query = quoteWithMeasurement(q)
+	stmt, err := influxql.ParseStatement(query)
+	if err != nil {
+		return
+	}
+	show, ok := stmt.(*influxql.ShowMeasurementsStatement)
+	if !ok {
+		return
+	}
+	if source, ok := show.Source.(*influxql.Measurement); ok {
+		if source.Regex != nil {
+			m.re = source.Regex.Val
+		} else {
+			m.name = source.Name
 		}
-		for _, s := range sSs {
-			if strings.Contains(s.Name, "influxdb.cluster") {
+	}
+	if show.Limit > 0 || show.Offset > 0 {
+		m.limit, m.offset = show.Limit, show.Offset
+		show.Limit, show.Offset = 0, 0
+		query = show.String()
+	}
+	return
+}
+
+func (m *measurementsMerger) merge(ss []seri) {
+	for _, s := range ss {
+		for _, value := range s.Values {
+			if len(value) == 0 {
+				continue
+			}
+			name, ok := value[0].(string)
+			if !ok || strings.Contains(name, "influxdb.cluster") || name == m.exclude {
 				continue
 			}
-			seriesMap[s.Name] = s
+			m.names[name] = true
+			m.serie = s
 		}
 	}
+}
 
-	var series []seri
-	for _, item := range seriesMap {
-		series = append(series, item)
+func (m *measurementsMerger) match(name string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(name)
+	case m.name != "":
+		return m.name == name
+	}
+	return true
+}
+
+func (m *measurementsMerger) body(messages []message) (fBody []byte, err error) {
+	names := make([]string, 0, len(m.names))
+	for name := range m.names {
+		if m.match(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if m.offset >= len(names) {
+		names = nil
+	} else {
+		names = names[m.offset:]
+	}
+	if m.limit > 0 && m.limit < len(names) {
+		names = names[:m.limit]
+	}
+	if len(names) == 0 {
+		return GetJsonBodyfromSeries(nil, messages...)
 	}
-	fBody, err = GetJsonBodyfromSeries(series)
-	return
 
+	serie := m.serie
+	serie.Values = make([][]interface{}, 0, len(names))
+	for _, name := range names {
+		serie.Values = append(serie.Values, []interface{}{name})
+	}
+	return GetJsonBodyfromSeries([]seri{serie}, messages...)
+}
+
+// tagFieldkeyMerger 按 series 名字合并各后端的结果
+type tagFieldkeyMerger map[string]seri
+
+func (m tagFieldkeyMerger) merge(ss []seri) {
+	for _, s := range ss {
+		if strings.Contains(s.Name, "influxdb.cluster") {
+			continue
+		}
+		if old, ok := m[s.Name]; ok {
+			s = mergeSeri(old, s)
+		}
+		m[s.Name] = s
+	}
+}
+
+// body 按名字排序 series, 每个 series 的行也排序, 结果和后端返回的顺序无关
+func (m tagFieldkeyMerger) body(messages []message) (fBody []byte, err error) {
+	series := make([]seri, 0, len(m))
+	for _, item := range m {
+		sortValues(item.Values)
+		series = append(series, item)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Name < series[j].Name })
+	return GetJsonBodyfromSeries(series, messages...)
 }
 
 func (ic *InfluxCluster) ShowQuery(w http.ResponseWriter, req *http.Request) (err error) {
-	fHeader, bodys, Err := ic.QueryAll(req)
-	err = Err
-	if Err != nil {
-		err = Err
-		return
+	q := strings.ToLower(strings.TrimSpace(req.FormValue("q")))
+	var merger showMerger
+	switch {
+	case strings.Contains(q, "field") || strings.Contains(q, "tag"):
+		merger = tagFieldkeyMerger{}
+	case strings.Contains(q, "retention"):
+		return ic.showRetention(w, req)
+	default:
+		q := strings.TrimSpace(req.FormValue("q"))
+		mm, query := newMeasurementsMerger(q)
+		if req.FormValue("db") == ic.statsDB {
+			mm.exclude = ic.statsMeasurement
+		}
+		merger = mm
+		if query != q {
+			req = req.Clone(req.Context())
+			req.Form.Set("q", query)
+		}
 	}
-	var fBody []byte
-	q := strings.TrimSpace(req.FormValue("q"))
-	if strings.Contains(strings.ToLower(q), "field") || strings.Contains(strings.ToLower(q), "tag") {
-		fBody, Err = ic.showTagFieldkey(bodys)
-		if Err != nil {
-			err = Err
-			return
+
+	qr, err := ic.queryEach(req, func(body io.Reader) error {
+		ss, err := DecodeSeriesArray(body)
+		if err != nil {
+			return err
 		}
-	} else if strings.Contains(strings.ToLower(q), "retention") {
-		copyHeader(w.Header(), fHeader)
-		w.WriteHeader(200)
-		// TODO 直接返回第一个数据库的保留策略, 有待改进
-		w.Write(GzipEncode(bodys[0], fHeader.Get("Content-Encoding") == "gzip"))
+		merger.merge(ss)
+		return nil
+	})
+	if err != nil {
 		return
-	} else {
-		fBody, Err = ic.showMeasurements(bodys)
-		if Err != nil {
-			err = Err
+	}
+	fBody, err := merger.body(partialMessages(req, qr.missing))
+	if err != nil {
+		return
+	}
+	ic.servedBy(w, req, qr.served...)
+	writeResp(w, qr.header, 200, fBody)
+	return
+}
+
+// TODO 直接返回第一个数据库的保留策略, 有待改进
+func (ic *InfluxCluster) showRetention(w http.ResponseWriter, req *http.Request) (err error) {
+	var first []byte
+	qr, err := ic.queryEach(req, func(body io.Reader) (err error) {
+		if first != nil {
+			_, err = io.Copy(ioutil.Discard, body)
 			return
 		}
+		first, err = ioutil.ReadAll(body)
+		return
+	})
+	if err != nil {
+		return
 	}
-	copyHeader(w.Header(), fHeader)
-	w.WriteHeader(200)
-	w.Write(GzipEncode(fBody, fHeader.Get("Content-Encoding") == "gzip"))
-	err = nil
+	ic.servedBy(w, req, qr.served...)
+	writeResp(w, qr.header, 200, first)
 	return
 }
 
+// GlobalQuery 是否为按db下发的语句, e.g. create database, create retention policy
 func (ic *InfluxCluster) GlobalQuery(q string) bool {
-	// better way??
-	matched, err := regexp.MatchString(GlobalCmds, q)
-	if err != nil {
-		return false
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	for _, r := range ic.GlobalQueries {
+		if r.MatchString(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerQuery 是否为下发到全部后端的语句, e.g. create user
+func (ic *InfluxCluster) ServerQuery(q string) bool {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	for _, r := range ic.ServerQueries {
+		if r.MatchString(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobalBackends 返回db对应的所有后端, db为空时返回全部后端
+func (ic *InfluxCluster) GlobalBackends(db string) (apis []BackendAPI) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	for _, bs := range ic.backends {
+		if db == "" || bs.GetDB() == db {
+			apis = append(apis, bs)
+		}
+	}
+	return
+}
+
+// fanoutQuery 把查询发给所有 backend, 任何一个失败都返回错误和各 backend 的结果.
+func (ic *InfluxCluster) fanoutQuery(w http.ResponseWriter, req *http.Request, apis []BackendAPI) (err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	if len(apis) == 0 {
+		logs.Errorf("query (%s) has no backend", q)
+		return ErrBackendNotExist
+	}
+
+	var header http.Header
+	var status int
+	var body []byte
+	failed := make(map[string]string)
+	recordAccess(req.Context(), "", apis...)
+	for _, api := range apis {
+		h, s, b, Err := api.QueryResp(req)
+		switch {
+		case Err != nil:
+			failed[api.GetName()] = Err.Error()
+		case s/100 != 2:
+			failed[api.GetName()] = fmt.Sprintf("status %d: %s", s, bytes.TrimSpace(b))
+		case statementError(b) != "":
+			failed[api.GetName()] = statementError(b)
+		case header == nil:
+			header, status, body = h, s, b
+		}
+	}
+
+	if len(failed) == 0 {
+		ic.servedBy(w, req, apis...)
+		writeResp(w, header, status, body)
+		return
+	}
+
+	logs.Errorf("query (%s) failed on %d of %d backends: %v", q, len(failed), len(apis), failed)
+	body, _ = json.Marshal(map[string]interface{}{
+		"error":  fmt.Sprintf("failed on %d of %d backends", len(failed), len(apis)),
+		"failed": failed,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(500)
+	w.Write(body)
+	return ErrPartialFanout
+}
+
+// writeResp writes a response got by QueryResp to client.
+// The decoded body is encoded again if the backend sent it with gzip.
+func writeResp(w http.ResponseWriter, header http.Header, status int, body []byte) {
+	copyHeader(w.Header(), header)
+	if header.Get("Content-Encoding") == "gzip" {
+		body = GzipEncode(body, true)
+		w.Header().Set("Content-Encoding", "gzip")
 	}
-	return matched
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
 }
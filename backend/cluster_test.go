@@ -6,10 +6,20 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -20,12 +30,16 @@ func TestScanKey(t *testing.T) {
 		"cpu value=3,value2=4 1434055562000010000",
 		"temper\\ ature,machine=unit42,type=assembly internal=32,external=100 1434055562000000035",
 		"temper\\,ature,machine=unit143,type=assembly internal=22,external=130 1434055562005000035",
+		"my\\\\\\ measurement value=1",
+		"c:\\temp value=1",
 	}
 	var keys []string = []string{
 		"cpu",
 		"cpu",
 		"temper ature",
 		"temper,ature",
+		"my\\ measurement",
+		"c:\\temp",
 	}
 
 	var key string
@@ -42,9 +56,71 @@ func TestScanKey(t *testing.T) {
 		}
 	}
 
+	for _, s := range []string{"cpu\\", "cpu", ""} {
+		if _, err = ScanKey([]byte(s)); err != io.EOF {
+			t.Errorf("line without fields %q should fail: %v", s, err)
+		}
+	}
+	for _, s := range []string{" value=1", ",host=a value=1"} {
+		if _, err = ScanKey([]byte(s)); err != ErrEmptyMeasurement {
+			t.Errorf("empty measurement %q should fail: %v", s, err)
+		}
+	}
+
 	return
 }
 
+func FuzzScanKey(f *testing.F) {
+	for _, s := range []string{
+		"cpu,host=server01 value=1 1434055562000000000",
+		"temper\\ ature value=1",
+		"cpu\\",
+		"\\\\\\",
+		",",
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		key, err := ScanKey(line)
+		if err == nil && key == "" {
+			t.Errorf("empty key without error: %q", line)
+		}
+	})
+}
+
+func TestTrimRight(t *testing.T) {
+	tests := []struct {
+		p    string
+		want string
+	}{
+		{"", ""},
+		{" \t\r\n", ""},
+		{"cpu value=1", "cpu value=1"},
+		{"cpu value=1 \r\n", "cpu value=1"},
+		{" cpu", " cpu"},
+	}
+	for _, tt := range tests {
+		if got := string(TrimRight([]byte(tt.p), []byte(" \t\r\n"))); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkTrimRight(b *testing.B) {
+	line := []byte("cpu,host=server01,region=uswest value=1 1434055562000000000 \r\n")
+	cutset := []byte(" \t\r\n")
+	b.Run("custom", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			TrimRight(line, cutset)
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bytes.TrimRight(line, " \t\r\n")
+		}
+	})
+}
+
 func BenchmarkScanKey(b *testing.B) {
 	buf := &bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
@@ -101,7 +177,7 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	m2bs := make(map[string][]BackendAPI)
 	m2bs["cpu"] = append(m2bs["cpu"], backends["write_only"], backends["test1"])
 	m2bs["write_only"] = append(m2bs["write_only"], backends["write_only"])
-	ic.m2bs = m2bs
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": m2bs}
 
 	return
 }
@@ -138,7 +214,7 @@ func TestInfluxdbClusterWrite(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		err := ic.Write(tt.args, "ns")
+		err := ic.Write(tt.args, "ns", "test")
 		if err != nil {
 			t.Error(tt.name, err)
 			continue
@@ -164,6 +240,59 @@ func TestInfluxdbClusterPing(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+func TestInfluxdbClusterWritePing(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ic.InfluxdbVersion = "1.8.10"
+	ts := httptest.NewServer(http.HandlerFunc(ic.WritePing))
+	defer ts.Close()
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, _ := http.NewRequest(method, ts.URL+"/ping", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 204 || resp.Header.Get("X-Influxdb-Version") != "1.8.10" ||
+			resp.Header.Get("X-Influx-Proxy-Version") != VERSION {
+			t.Errorf("%s ping wrong: %d %v", method, resp.StatusCode, resp.Header)
+		}
+	}
+	resp, err := http.Post(ts.URL+"/ping", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 405 {
+		t.Errorf("post ping should not be allowed: %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:8086/ping?verbose=true", nil)
+	w := httptest.NewRecorder()
+	ic.WritePing(w, req)
+	var info PingInfo
+	err = json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" || w.Header().Get("X-Influxdb-Version") != "1.8.10" {
+		t.Errorf("verbose ping wrong: %d %v", w.Code, w.Header())
+	}
+	if info.Version != "1.8.10" || info.ProxyVersion != VERSION || len(info.Backends) != 3 || !info.Backends["test1"] {
+		t.Errorf("verbose ping body wrong: %s", w.Body.Bytes())
+	}
+
+	// influxdb version defaults to the proxy version.
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	if version, _ := ic.Ping(); version != VERSION {
+		t.Errorf("default version wrong: %s", version)
+	}
+}
+
 func TestInfluxdbClusterQuery(t *testing.T) {
 	ic, err := CreateTestInfluxCluster()
 	if err != nil {
@@ -183,7 +312,7 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		{
 			name:  "cpu",
 			query: "SELECT * from cpu where time > now() - 1m",
-			want:  400,
+			want:  204,
 		},
 		{
 			name:  "test",
@@ -208,12 +337,12 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		{
 			name:  "show_cpu",
 			query: "SHOW tag keys from \"cpu\" ",
-			want:  204,
+			want:  200,
 		},
 		{
 			name:  "delete_cpu",
 			query: " DELETE FROM \"cpu\" WHERE time < '2000-01-01T00:00:00Z'",
-			want:  400,
+			want:  204,
 		},
 		{
 			name:  "show_measurements",
@@ -233,7 +362,7 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		{
 			name:  "write.only",
 			query: " select cpu_load from write_only WHERE time > now() - 1m",
-			want:  400,
+			want:  403,
 		},
 	}
 
@@ -247,3 +376,2710 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		}
 	}
 }
+
+// CreateRecordInfluxCluster 的备份文件放在 dir 下
+func CreateRecordInfluxCluster(dbs map[string]string, dir string) (ic *InfluxCluster, queried map[string]int, lock *sync.Mutex, err error) {
+	lock = &sync.Mutex{}
+	queried = make(map[string]int)
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.backends = make(map[string]BackendAPI)
+	for name, db := range dbs {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				lock.Lock()
+				queried[name]++
+				lock.Unlock()
+			}
+			w.WriteHeader(204)
+		}))
+		cfg, _ := CreateTestBackendConfig(db)
+		cfg.URL = ts.URL
+		ic.backends[name], err = NewBackends(cfg, name, dir)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func TestInfluxdbClusterGlobalQuery(t *testing.T) {
+	ic, queried, lock, err := CreateRecordInfluxCluster(map[string]string{
+		"test1": "db1",
+		"test2": "db1",
+		"test3": "db2",
+	}, t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]int
+	}{
+		{
+			name:  "create_retention_policy",
+			query: "CREATE RETENTION POLICY \"10m.events\" ON \"db1\" DURATION 60m REPLICATION 2",
+			want:  map[string]int{"test1": 1, "test2": 1},
+		},
+		{
+			name:  "create_database",
+			query: "CREATE DATABASE db2",
+			want:  map[string]int{"test3": 1},
+		},
+		{
+			name:  "create_user",
+			query: "CREATE USER \"jdoe\" WITH PASSWORD '1337password'",
+			want:  map[string]int{"test1": 1, "test2": 1, "test3": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		lock.Lock()
+		for k := range queried {
+			delete(queried, k)
+		}
+		lock.Unlock()
+
+		q := url.Values{}
+		q.Set("q", tt.query)
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		if w.status != 204 {
+			t.Error(tt.name, w.status)
+		}
+
+		lock.Lock()
+		if len(queried) != len(tt.want) {
+			t.Error(tt.name, queried)
+		}
+		for k, v := range tt.want {
+			if queried[k] != v {
+				t.Error(tt.name, k, queried[k])
+			}
+		}
+		lock.Unlock()
+	}
+
+	// the backends applied the statement are told apart from the failed one.
+	down := httptest.NewServer(http.HandlerFunc(HandlerAny))
+	down.Close()
+	cfg, _ := CreateTestBackendConfig("db1")
+	cfg.URL = down.URL
+	bs, err := NewBackends(cfg, "down", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closed with the cluster.
+	ic.backends["down"] = bs
+	lock.Lock()
+	for k := range queried {
+		delete(queried, k)
+	}
+	lock.Unlock()
+	q := url.Values{}
+	q.Set("q", "SET PASSWORD FOR \"jdoe\" = 'secret'")
+	req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := NewDummyResponseWriter()
+	if err = ic.Query(w, req); err != ErrPartialFanout || w.status != 500 ||
+		!bytes.Contains(w.buffer.Bytes(), []byte(`failed on 1 of 4 backends`)) || !bytes.Contains(w.buffer.Bytes(), []byte(`"down":`)) {
+		t.Errorf("failed backend should be listed: %v %d %s", err, w.status, w.buffer.String())
+	}
+	lock.Lock()
+	if len(queried) != 3 {
+		t.Errorf("the other backends should be queried: %v", queried)
+	}
+	lock.Unlock()
+}
+
+func TestInfluxdbClusterDDLFanout(t *testing.T) {
+	ic, queried, lock, err := CreateRecordInfluxCluster(map[string]string{
+		"test1": "db1",
+		"test2": "db1",
+		"test3": "db2",
+	}, t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+
+	query := func(q string) (w *DummyResponseWriter, queries map[string]int, err error) {
+		lock.Lock()
+		for k := range queried {
+			delete(queried, k)
+		}
+		lock.Unlock()
+		v := url.Values{}
+		v.Set("q", q)
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+v.Encode(), nil)
+		w = NewDummyResponseWriter()
+		err = ic.Query(w, req)
+		lock.Lock()
+		defer lock.Unlock()
+		queries = make(map[string]int)
+		for k, v := range queried {
+			queries[k] = v
+		}
+		return
+	}
+
+	cq := "CREATE CONTINUOUS QUERY cq_1h ON db2 BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END"
+	w, queries, _ := query(cq)
+	if w.status != 204 || len(queries) != 1 || queries["test3"] != 1 {
+		t.Errorf("cq should be sent to the backends of db2: %d %v", w.status, queries)
+	}
+	w, queries, _ = query("ALTER RETENTION POLICY \"autogen\" ON \"db1\" DURATION 30d")
+	if w.status != 204 || len(queries) != 2 {
+		t.Errorf("rp should be sent to the backends of db1: %d %v", w.status, queries)
+	}
+
+	// a statement error in 200 fails the statement too.
+	errored := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0,"error":"retention policy conflicts with an existing policy"}]}`))
+	}))
+	defer errored.Close()
+	cfg, _ := CreateTestBackendConfig("db1")
+	cfg.URL = errored.URL
+	bs, err := NewBackends(cfg, "errored", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closed with the cluster.
+	ic.backends["errored"] = bs
+
+	w, queries, err = query("CREATE RETENTION POLICY \"month\" ON \"db1\" DURATION 30d REPLICATION 1")
+	if err != ErrPartialFanout || w.status != 500 || len(queries) != 2 {
+		t.Errorf("rp should fail if any backend fails: %v %d %v", err, w.status, queries)
+	}
+	if !bytes.Contains(w.buffer.Bytes(), []byte(`"errored":"retention policy conflicts with an existing policy"`)) ||
+		!bytes.Contains(w.buffer.Bytes(), []byte(`failed on 1 of 3 backends`)) {
+		t.Errorf("failed backends should be listed: %s", w.buffer.String())
+	}
+
+	// the forbidden rules apply, CQs can be forbidden altogether.
+	rules, err := loadQueryRules(&NodeConfig{ForbidContinuousQuery: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.setQueryRules(rules)
+	w, queries, _ = query(cq)
+	if w.status != 400 || len(queries) != 0 {
+		t.Errorf("cq should be forbidden: %d %v", w.status, queries)
+	}
+	w, queries, _ = query("DROP CONTINUOUS QUERY cq_1h ON db2")
+	if w.status != 204 || len(queries) != 1 {
+		t.Errorf("cq should be dropped: %d %v", w.status, queries)
+	}
+}
+
+func TestInfluxdbClusterDropSeries(t *testing.T) {
+	ic, queried, lock, err := CreateRecordInfluxCluster(map[string]string{
+		"test1": "db1",
+		"test2": "db1",
+		"test3": "db1",
+	}, t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+	ic.backends["test2"].(*Backends).HttpBackend.WriteOnly = 1
+	ic.m2bs = map[string]map[string][]BackendAPI{"db1": {
+		"cpu": {ic.backends["test1"], ic.backends["test2"]},
+		"mem": {ic.backends["test3"]},
+	}}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte("shard unavailable"))
+	}))
+	defer broken.Close()
+	cfg, _ := CreateTestBackendConfig("db1")
+	cfg.URL = broken.URL
+	bs, err := NewBackends(cfg, "broken", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   map[string]int
+	}{
+		{
+			name:   "drop_series",
+			query:  "DROP SERIES FROM cpu WHERE host = 'x'",
+			status: 204,
+			want:   map[string]int{"test1": 1, "test2": 1},
+		},
+		{
+			name:   "delete",
+			query:  "DELETE FROM \"cpu\" WHERE time < '2000-01-01T00:00:00Z'",
+			status: 204,
+			want:   map[string]int{"test1": 1, "test2": 1},
+		},
+		{
+			name:   "select",
+			query:  "SELECT * FROM cpu",
+			status: 204,
+			want:   map[string]int{"test1": 1},
+		},
+		{
+			name:   "partial_failure",
+			query:  "DROP SERIES FROM mem WHERE host = 'x'",
+			status: 500,
+			want:   map[string]int{"test3": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		lock.Lock()
+		for k := range queried {
+			delete(queried, k)
+		}
+		lock.Unlock()
+		if tt.name == "partial_failure" {
+			ic.m2bs["db1"]["mem"] = append(ic.m2bs["db1"]["mem"], bs)
+		}
+
+		q := url.Values{}
+		q.Set("db", "db1")
+		q.Set("q", tt.query)
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		err = ic.Query(w, req)
+		if w.status != tt.status {
+			t.Error(tt.name, w.status)
+		}
+
+		lock.Lock()
+		if len(queried) != len(tt.want) {
+			t.Error(tt.name, queried)
+		}
+		for k, v := range tt.want {
+			if queried[k] != v {
+				t.Error(tt.name, k, queried[k])
+			}
+		}
+		lock.Unlock()
+
+		if tt.status == 500 {
+			if err != ErrPartialFanout {
+				t.Error(tt.name, err)
+			}
+			if !bytes.Contains(w.buffer.Bytes(), []byte(`"broken":"status 500: shard unavailable"`)) {
+				t.Error(tt.name, w.buffer.String())
+			}
+		}
+	}
+}
+
+func TestGlobalQueryConfig(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{
+		GlobalCmds: []string{"(?i:^\\s*create\\s+database\\s)"},
+	}, ".")
+	if ic.GlobalQuery("CREATE RETENTION POLICY \"rp\" ON \"db\" DURATION 1h REPLICATION 1") {
+		t.Error("retention policy should not be global")
+	}
+	if !ic.GlobalQuery("create database db") {
+		t.Error("create database should be global")
+	}
+	if !ic.ServerQuery("DROP USER \"jdoe\"") {
+		t.Error("drop user should be server wide")
+	}
+}
+
+func TestObligatedQueryGroups(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	if ic.CheckQuery("select value from cpu") != nil || ic.CheckQuery("show databases") != ErrQueryForbidden {
+		t.Error("default support cmds wrong")
+	}
+
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{
+		SupportCmdGroups: [][]string{
+			{"(?i:^\\s*select\\s)", "(?i:^\\s*show\\s+measurements)"},
+			{"(?i:\\swhere\\s.*time\\s*[<>])", "(?i:^\\s*show\\s)"},
+		},
+	}, ".")
+	tests := []struct {
+		q  string
+		ok bool
+	}{
+		{"select value from cpu where time > now() - 1h", true},
+		{"show measurements", true},
+		// matches the first group only.
+		{"select value from cpu", false},
+		// matches the second group only.
+		{"show databases", false},
+		{"drop measurement cpu", false},
+	}
+	for _, tt := range tests {
+		if err := ic.CheckQuery(tt.q); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.q, err)
+		}
+	}
+
+	// EnsureQuery adds to the last group.
+	ic.EnsureQuery("(?i:^\\s*select\\s.*\\slimit\\s)")
+	if ic.CheckQuery("select value from cpu limit 10") != nil || ic.CheckQuery("show databases") != ErrQueryForbidden {
+		t.Error("ensured query should be in the last group")
+	}
+	ic.EnsureQueryGroup("(?i:\\scpu\\b)")
+	if ic.CheckQuery("select value from mem where time > now() - 1h") != ErrQueryForbidden || ic.CheckQuery("select value from cpu where time > now() - 1h") != nil {
+		t.Error("new group should be required")
+	}
+}
+
+func TestInfluxdbClusterQueryWeight(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	weights := map[string]int{"heavy": 3, "light": 1, "last": 0}
+	bss := make(map[string]*Backends)
+	for name, weight := range weights {
+		weight := weight
+		cfg, ts := CreateTestBackendConfig("test")
+		defer ts.Close()
+		cfg.QueryWeight = &weight
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer bs.Close()
+		bss[name] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{
+		"test": {"cpu": {bss["last"], bss["light"], bss["heavy"]}},
+	}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "select value from cpu")
+	for i := 0; i < 2000; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		ic.Query(NewDummyResponseWriter(), req)
+	}
+
+	heavy := bss["heavy"].GetStats().QueryRequests
+	light := bss["light"].GetStats().QueryRequests
+	if heavy+light != 2000 || bss["last"].GetStats().QueryRequests != 0 {
+		t.Errorf("query count wrong: %d %d %d", heavy, light, bss["last"].GetStats().QueryRequests)
+	}
+	if ratio := float64(heavy) / float64(light); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("weight ratio wrong: %d %d", heavy, light)
+	}
+
+	atomic.StoreInt32(&bss["heavy"].disabled, 1)
+	atomic.StoreInt32(&bss["light"].disabled, 1)
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	ic.Query(NewDummyResponseWriter(), req)
+	if bss["last"].GetStats().QueryRequests != 1 {
+		t.Errorf("zero weight backend should be queried when others are down")
+	}
+
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+	if hb.GetQueryWeight() != 1 {
+		t.Errorf("unset weight should be 1: %d", hb.GetQueryWeight())
+	}
+}
+
+func TestInfluxdbClusterQueryDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{Zone: "local", QueryDeadline: 200}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Zone = "remote"
+	bs, err := NewBackends(cfg, "remote", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs.Close()
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "select value from cpu")
+
+	for _, header := range []string{"", "100ms", "100"} {
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		if header != "" {
+			ic.QueryDeadline = 0
+			req.Header.Set("X-Query-Deadline", header)
+		}
+		w := NewDummyResponseWriter()
+		start := time.Now()
+		ic.Query(w, req)
+		if time.Since(start) > time.Second {
+			t.Errorf("deadline exceeded: %s", time.Since(start))
+		}
+		if w.status != 504 {
+			t.Errorf("status wrong: %d", w.status)
+		}
+		if !bs.IsActive() {
+			t.Errorf("backend should not be inactive after deadline")
+		}
+	}
+}
+
+func TestInfluxdbClusterReloadRules(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(HandlerAny))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(forbid string) {
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {"test": {"url": %q, "db": "test", "zone": "local"}},
+	"KEYMAPS": {"test": {"cpu": ["test"]}},
+	"NODES": {"l1": {"zone": "local", "forbidcmds": [%q]}}
+}`, ts.URL, forbid)
+		err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ic *InfluxCluster
+	query := func() int {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "select * from cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w.status
+	}
+
+	writeConfig(`(?i:^\s*grant\b)`)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic = NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := query(); status != 204 {
+		t.Errorf("status wrong before reload: %d", status)
+	}
+
+	writeConfig(`(?i:select\s+\*)`)
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := query(); status != 400 {
+		t.Errorf("query should be forbidden after reload: %d", status)
+	}
+
+	writeConfig(`(`)
+	err = ic.LoadConfig()
+	if err == nil {
+		t.Errorf("invalid regexp should fail reload")
+	}
+	if status := query(); status != 400 {
+		t.Errorf("previous rules should be kept: %d", status)
+	}
+}
+
+func TestInfluxdbClusterKeepPrecision(t *testing.T) {
+	var lock sync.Mutex
+	written := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			zip, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			body, _ := io.ReadAll(zip)
+			lock.Lock()
+			written[req.URL.Query().Get("precision")] += string(body)
+			lock.Unlock()
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{KeepPrecision: 1}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 50
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs.Close()
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	ic.Write([]byte("cpu,host=server01 value=1 1434055562\n"), "s", "test")
+	ic.Write([]byte("cpu,host=server01 value=2 1434055562000000000\n"), "ns", "test")
+	time.Sleep(300 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if written["s"] != "cpu,host=server01 value=1 1434055562\n" {
+		t.Errorf("second precision not forwarded verbatim: %q", written["s"])
+	}
+	if written[""] != "cpu,host=server01 value=2 1434055562000000000\n" {
+		t.Errorf("nanosecond line wrong: %q", written[""])
+	}
+	if bs.GetStats().FlushByPrecision != 1 {
+		t.Errorf("precision flush wrong: %+v", bs.GetStats())
+	}
+}
+
+func TestInfluxdbClusterKeepPrecisionSpool(t *testing.T) {
+	var down int32 = 1
+	var lock sync.Mutex
+	var written []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(503)
+			return
+		}
+		zip, _ := gzip.NewReader(req.Body)
+		body, _ := io.ReadAll(zip)
+		lock.Lock()
+		written = append(written, req.URL.Query().Get("precision")+":"+string(body))
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{KeepPrecision: 1}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 50
+	cfg.RewriteInterval = 50
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	received := time.Now().Unix()
+	ic.Write([]byte("cpu,host=server01 value=1\n"), "s", "test")
+	// replayed well after the second it was received.
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&down, 0)
+	for i := 0; i < 50 && bs.fb.IsData(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(written) != 1 {
+		t.Fatalf("spooled line should be replayed once: %q", written)
+	}
+	var stamp int64
+	_, err = fmt.Sscanf(written[0], "s:cpu,host=server01 value=1 %d\n", &stamp)
+	if err != nil || stamp < received || stamp > received+1 {
+		t.Errorf("replayed line should carry the time it was received: %q", written[0])
+	}
+}
+
+func TestInfluxdbClusterDefaultDB(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test1 := ic.backends["test1"]
+	test2 := ic.backends["test2"]
+	ic.m2bs["_default_"] = map[string][]BackendAPI{
+		"cpu":       {test2},
+		"_default_": {test1},
+	}
+
+	tests := []struct {
+		db, measurement string
+		want            BackendAPI
+	}{
+		// explicit db first, even when the measurement is not found.
+		{"test", "cpu", test1},
+		{"other", "cpu", test2},
+		{"other", "mem", test1},
+	}
+	for _, tt := range tests {
+		apis, ok := ic.GetBackends(tt.measurement, tt.db)
+		if !ok || apis[len(apis)-1] != tt.want {
+			t.Errorf("%s.%s routed wrong: %v %v", tt.db, tt.measurement, apis, ok)
+		}
+	}
+	_, ok := ic.GetBackends("mem", "test")
+	if ok {
+		t.Errorf("explicit db should not fall back to the wildcard db")
+	}
+
+	err = ic.Write([]byte("mem value=1 1434055562000000000\n"), "", "other")
+	if err != nil {
+		t.Errorf("write to db not listed should succeed: %s", err)
+	}
+}
+
+func TestInfluxdbClusterDefaultMeasurementKey(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test1 := ic.backends["test1"]
+	test2 := ic.backends["test2"]
+	ic.defaultKey = defaultMeasurementKey(&NodeConfig{DefaultMeasurementKey: "*"})
+	ic.m2bs["test"] = map[string][]BackendAPI{
+		"_default_": {test2},
+		"cpu":       {test2, test1},
+		"*":         {test1},
+	}
+
+	tests := []struct {
+		measurement string
+		key         string
+	}{
+		// a real measurement named _default_.
+		{"_default_", "_default_"},
+		{"_default_x", "_default_"},
+		{"cpu1", "cpu"},
+		{"mem", "*"},
+		{"*", "*"},
+	}
+	for _, tt := range tests {
+		key, apis, ok := ic.lookupBackends(tt.measurement, "test")
+		if !ok || key != tt.key || len(apis) != len(ic.m2bs["test"][tt.key]) {
+			t.Errorf("%s routed by %s, want %s", tt.measurement, key, tt.key)
+		}
+	}
+	routes := ic.Routes()
+	if routes["test"]["*"].Match != ROUTE_DEFAULT || routes["test"]["_default_"].Match != ROUTE_MEASUREMENT {
+		t.Errorf("only the catch-all key should match by default: %+v", routes["test"])
+	}
+
+	// the catch-all is not matched as a prefix.
+	ic.defaultKey = defaultMeasurementKey(&NodeConfig{})
+	ic.m2bs["test"] = map[string][]BackendAPI{
+		"cpu":       {test2},
+		"_default_": {test1},
+	}
+	if key, _, _ := ic.lookupBackends("_default_foo", "test"); ic.defaultKey != "_default_" || key != "_default_" {
+		t.Errorf("_default_foo routed by %s", key)
+	}
+	if key, _, _ := ic.lookupBackends("cpu2", "test"); key != "cpu" {
+		t.Errorf("cpu2 routed by %s", key)
+	}
+}
+
+func TestInfluxdbClusterRemoveBackend(t *testing.T) {
+	var written int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			atomic.AddInt32(&written, 1)
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(backends string) {
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {%s},
+	"KEYMAPS": {"test": {"cpu": ["keep"]}},
+	"NODES": {"l1": {"zone": "local"}}
+}`, backends)
+		err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := fmt.Sprintf(`"keep": {"url": %q, "db": "test", "rewriteinterval": 60000}`, ts.URL)
+	old := fmt.Sprintf(`"old": {"url": %q, "db": "test", "rewriteinterval": 60000}`, ts.URL)
+	writeConfig(keep + "," + old)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pending spool of the backend to be removed, the rewrite loop is not up yet.
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=1 1434055562000000000\n"))
+	ic.backends["old"].(*Backends).fb.Write(buf.Bytes())
+
+	writeConfig(keep)
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&written) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&written) != 1 {
+		t.Errorf("spool of removed backend should be drained: %d", written)
+	}
+}
+
+func TestInfluxdbClusterShowQuery(t *testing.T) {
+	a := []byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["influxdb.cluster.shard"]]}]}]}`)
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["mem"],["cpu"]]}]}]}`)
+	ts1 := CreateReplicaServer(a, true)
+	defer ts1.Close()
+	ts2 := CreateReplicaServer(b, false)
+	defer ts2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	var apis []BackendAPI
+	for i, u := range []string{ts1.URL, ts2.URL} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = u
+		bs, err := NewBackends(cfg, fmt.Sprintf("show%d", i), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {apis[0]}, "mem": {apis[1]}}}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "SHOW measurements")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	err := ic.ShowQuery(w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := DecodeSeriesArray(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[interface{}]bool)
+	for _, s := range ss {
+		for _, v := range s.Values {
+			names[v[0]] = true
+		}
+	}
+	if w.Code != 200 || len(names) != 2 || !names["cpu"] || !names["mem"] {
+		t.Errorf("merged measurements wrong: %d %v", w.Code, names)
+	}
+}
+
+// BenchmarkShowQuery 合并大的 show measurements 响应, 用 -benchmem 或 -memprofile 查看内存
+func BenchmarkShowQuery(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[`)
+	for i := 0; i < 200000; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `["measurement_%08d"]`, i)
+	}
+	buf.WriteString(`]}]}]}`)
+	ts := CreateReplicaServer(buf.Bytes(), false)
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	m2bs := make(map[string][]BackendAPI)
+	for i := 0; i < 4; i++ {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, fmt.Sprintf("show%d", i), b.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer bs.Close()
+		m2bs[fmt.Sprintf("m%d", i)] = []BackendAPI{bs}
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": m2bs}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "SHOW measurements")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		err := ic.ShowQuery(httptest.NewRecorder(), req)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInfluxdbClusterShadowWrite(t *testing.T) {
+	var lock sync.Mutex
+	written := make(map[string]string)
+	server := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/write" {
+				body := req.Body
+				if req.Header.Get("Content-Encoding") == "gzip" {
+					body, _ = gzip.NewReader(req.Body)
+				}
+				p, _ := io.ReadAll(body)
+				lock.Lock()
+				written[name] += string(p)
+				lock.Unlock()
+			}
+			w.WriteHeader(status)
+		}))
+	}
+	primary := server("primary", 204)
+	defer primary.Close()
+	shadow := server("shadow", 204)
+	defer shadow.Close()
+	broken := server("broken", 500)
+	defer broken.Close()
+
+	newBackends := func(url, name string, shadow int) *Backends {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = url
+		cfg.Shadow = shadow
+		cfg.WriteOnly = shadow
+		cfg.WriteRetries = -1
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	bs1 := newBackends(primary.URL, "primary", 0)
+	defer bs1.Close()
+	bs2 := newBackends(broken.URL, "broken", 1)
+	defer bs2.Close()
+	// closed in the test.
+	bs3 := newBackends(shadow.URL, "shadow", 1)
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs2, bs1, bs3}}}
+
+	err := ic.Write([]byte("cpu value=1 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Errorf("shadow failure should not fail the write: %s", err)
+	}
+	wait := func(cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wait(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return written["primary"] != "" && written["shadow"] != "" && bs2.GetStats().ShadowWriteFail > 0
+	})
+	lock.Lock()
+	if written["primary"] != "cpu value=1 1434055562000000000\n" || written["shadow"] != written["primary"] {
+		t.Errorf("shadow should receive mirrored writes: %q", written)
+	}
+	lock.Unlock()
+	if bs2.GetStats().ShadowWriteFail != 1 || bs2.fb.IsData() {
+		t.Errorf("failed shadow batch should be counted and dropped: %+v", bs2.GetStats())
+	}
+
+	// a closed shadow never fails the primary.
+	bs3.Close()
+	err = ic.Write([]byte("cpu value=2 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Errorf("closed shadow should not fail the write: %s", err)
+	}
+	wait(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return strings.Contains(written["primary"], "value=2")
+	})
+	lock.Lock()
+	if !strings.Contains(written["primary"], "value=2") {
+		t.Errorf("primary should be written: %q", written)
+	}
+	lock.Unlock()
+}
+
+func TestInfluxdbClusterQueryAllDedup(t *testing.T) {
+	ic, queried, lock, err := CreateRecordInfluxCluster(map[string]string{
+		"b1": "test",
+		"b2": "test",
+		"b3": "test",
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, b2, b3 := ic.backends["b1"], ic.backends["b2"], ic.backends["b3"]
+	m2bs := map[string][]BackendAPI{"disk": {b3}}
+	for i := 0; i < 200; i++ {
+		m2bs[fmt.Sprintf("m%d", i)] = []BackendAPI{b1, b2}
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": m2bs}
+
+	queryAll := func() [][]byte {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SHOW measurements")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		result, err := ic.QueryAll(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Bodys
+	}
+
+	// one of b1 and b2, and b3.
+	bodys := queryAll()
+	lock.Lock()
+	if len(bodys) != 2 || queried["b1"]+queried["b2"] != 1 || queried["b3"] != 1 {
+		t.Errorf("each backend should be queried once: %d %v", len(bodys), queried)
+	}
+	for name := range queried {
+		delete(queried, name)
+	}
+	lock.Unlock()
+
+	// b1 is down, its mappings fail over to b2.
+	b1.(*Backends).HttpBackend.URL = "http://127.0.0.1:1"
+	bodys = queryAll()
+	lock.Lock()
+	if len(bodys) != 2 || queried["b2"] != 1 || queried["b3"] != 1 {
+		t.Errorf("failed backend should be replaced once: %d %v", len(bodys), queried)
+	}
+	lock.Unlock()
+}
+
+func TestInfluxdbClusterQueryAllOrder(t *testing.T) {
+	var apis []BackendAPI
+	for i := 0; i < 4; i++ {
+		// the later backends answer first.
+		delay := time.Duration(4-i) * 5 * time.Millisecond
+		name := fmt.Sprintf("b%d", i)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(delay)
+			w.Header().Set("X-Backend", name)
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"series":[{"name":"measurements","columns":["name"],"values":[["%s"]]}]}]}`, name)
+		}))
+		defer ts.Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {
+		"disk": {apis[3]}, "cpu": {apis[0]}, "mem": {apis[2]}, "net": {apis[1]},
+	}}
+
+	queryAll := func() (string, string) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SHOW measurements")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		result, err := ic.QueryAll(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Header.Get("X-Backend"), string(bytes.Join(result.Bodys, []byte("\n")))
+	}
+
+	header, first := queryAll()
+	// cpu, disk, mem, net.
+	for i, name := range []string{"b0", "b3", "b2", "b1"} {
+		if !strings.Contains(strings.Split(first, "\n")[i], name) {
+			t.Fatalf("bodies should be in the order of the keys: %s", first)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		h, got := queryAll()
+		if h != header || got != first {
+			t.Fatalf("QueryAll should be deterministic: %s %s\n%s\n%s", header, h, first, got)
+		}
+	}
+}
+
+func TestInfluxdbClusterShowMeasurementsPage(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	newServer := func(names ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			received = append(received, req.FormValue("q"))
+			lock.Unlock()
+			var values []string
+			for _, name := range names {
+				values = append(values, fmt.Sprintf(`[%q]`, name))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[%s]}]}]}`, strings.Join(values, ","))
+		}))
+	}
+	ts1 := newServer("cpu", "disk", "mem", "net")
+	defer ts1.Close()
+	ts2 := newServer("cpu1", "disk", "mem", "swap")
+	defer ts2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	var apis []BackendAPI
+	for i, u := range []string{ts1.URL, ts2.URL} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = u
+		bs, err := NewBackends(cfg, fmt.Sprintf("page%d", i), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {apis[0]}, "swap": {apis[1]}}}
+
+	show := func(query string) (names []string) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", query)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		err := ic.ShowQuery(w, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := DecodeSeriesArray(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range ss {
+			for _, v := range s.Values {
+				names = append(names, v[0].(string))
+			}
+		}
+		return
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SHOW MEASUREMENTS", "cpu,cpu1,disk,mem,net,swap"},
+		{"SHOW MEASUREMENTS LIMIT 2", "cpu,cpu1"},
+		{"SHOW MEASUREMENTS LIMIT 2 OFFSET 2", "disk,mem"},
+		{"SHOW MEASUREMENTS LIMIT 2 OFFSET 4", "net,swap"},
+		{"SHOW MEASUREMENTS OFFSET 6", ""},
+		{"SHOW MEASUREMENTS WITH MEASUREMENT =~ /^cpu/", "cpu,cpu1"},
+		{"SHOW MEASUREMENTS WITH MEASUREMENT =~ /s/ LIMIT 1 OFFSET 1", "swap"},
+		{"SHOW MEASUREMENTS WITH MEASUREMENT = 'mem'", "mem"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(show(tt.query), ","); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, q := range received {
+		if strings.Contains(q, "LIMIT") || strings.Contains(q, "OFFSET") {
+			t.Errorf("limit and offset should be applied after merged: %s", q)
+		}
+		if strings.Contains(q, "'mem'") {
+			t.Errorf("string measurement should be quoted as identifier: %s", q)
+		}
+	}
+}
+
+func TestInfluxdbClusterMergedHeader(t *testing.T) {
+	newServer := func(name string, gzipped bool) *httptest.Server {
+		body := []byte(fmt.Sprintf(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[[%q]]}]}]}`, name))
+		if gzipped {
+			var buf bytes.Buffer
+			Compress(&buf, body)
+			body = buf.Bytes()
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if gzipped {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Influxdb-Version", "1.8.10")
+			w.Header().Set("Request-Id", name)
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(200)
+			w.Write(body)
+		}))
+	}
+
+	for _, gzipped := range []bool{false, true} {
+		ts1 := newServer("cpu", gzipped)
+		defer ts1.Close()
+		ts2 := newServer("mem", gzipped)
+		defer ts2.Close()
+
+		ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+		var apis []BackendAPI
+		for i, u := range []string{ts1.URL, ts2.URL} {
+			cfg, _ := CreateTestBackendConfig("test")
+			cfg.URL = u
+			bs, err := NewBackends(cfg, fmt.Sprintf("header%d", i), t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bs.Close()
+			apis = append(apis, bs)
+		}
+		ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {apis[0]}, "mem": {apis[1]}}}
+
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SHOW measurements")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		err := ic.ShowQuery(w, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := w.Header()
+		if h.Get("Content-Length") != strconv.Itoa(w.Body.Len()) || len(h["Content-Length"]) != 1 {
+			t.Errorf("gzip %v: content length %v of body %d", gzipped, h["Content-Length"], w.Body.Len())
+		}
+		if h.Get("Connection") != "" || h.Get("Content-Type") != "application/json" || h.Get("X-Influxdb-Version") != "1.8.10" || h.Get("Request-Id") == "" {
+			t.Errorf("gzip %v: headers wrong: %v", gzipped, h)
+		}
+		var body io.Reader = w.Body
+		if gzipped {
+			if h.Get("Content-Encoding") != "gzip" {
+				t.Fatalf("content encoding should be kept: %v", h)
+			}
+			body, err = gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		p, err := io.ReadAll(body)
+		if err != nil || !bytes.Contains(p, []byte(`"cpu"`)) || !bytes.Contains(p, []byte(`"mem"`)) {
+			t.Errorf("gzip %v: merged body wrong: %s %v", gzipped, p, err)
+		}
+	}
+}
+
+func TestInfluxdbClusterChunkedQuery(t *testing.T) {
+	var lock sync.Mutex
+	var forms []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		req.ParseForm()
+		lock.Lock()
+		forms = append(forms, req.Form)
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		if req.Form.Get("chunked") == "true" {
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]]}],"partial":true}]}`)
+			w.(http.Flusher).Flush()
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[2,2]]}]}]}`)
+			return
+		}
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "chunked", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	query := func(q string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Set("db", "test")
+		form.Set("q", q)
+		form.Set("chunked", "true")
+		form.Set("chunk_size", "1")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+form.Encode(), nil)
+		w := httptest.NewRecorder()
+		ic.Query(w, req)
+		return w
+	}
+
+	w := query("select value from cpu")
+	lock.Lock()
+	if len(forms) != 1 || forms[0].Get("chunked") != "true" || forms[0].Get("chunk_size") != "1" {
+		t.Errorf("chunk_size should be forwarded: %v", forms)
+	}
+	forms = nil
+	lock.Unlock()
+	if w.Code != 200 || strings.Count(w.Body.String(), "\n") != 2 || w.Header().Get("Content-Length") != "" {
+		t.Errorf("chunks should be streamed: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	// merged queries are sent without chunking and answered in one chunk.
+	w = query("SHOW measurements")
+	lock.Lock()
+	if len(forms) != 1 || forms[0].Get("chunked") != "" || forms[0].Get("chunk_size") != "" {
+		t.Errorf("chunking should be removed from merged queries: %v", forms)
+	}
+	lock.Unlock()
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"cpu"`) {
+		t.Errorf("merged query wrong: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestInfluxdbClusterWriteBlankLines(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"   ", " \t\r\n\n  \n", "\\", "\n\\\n"} {
+		err = ic.Write([]byte(p), "ns", "test")
+		if err != nil {
+			t.Errorf("write %q: %s", p, err)
+		}
+	}
+}
+
+func TestInfluxdbClusterWriteLines(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	tests := []struct {
+		p     string
+		lines int
+	}{
+		{"cpu value=1 1\ncpu value=2 2\n", 2},
+		// no trailing newline, the last line is still written.
+		{"cpu value=1 1\ncpu value=2 2", 2},
+		{"cpu value=1 1\r\ncpu value=2 2\r\n", 2},
+		// blank lines in the middle don't end the batch.
+		{"cpu value=1 1\n\n  \t\ncpu value=2 2\n\ncpu value=3 3", 3},
+		{"\n\ncpu value=1 1\n\n", 1},
+	}
+	for _, tt := range tests {
+		written := atomic.LoadInt64(&ic.stats.PointsWritten)
+		if err = ic.Write([]byte(tt.p), "", "test"); err != nil {
+			t.Errorf("write %q: %s", tt.p, err)
+		}
+		bs.FlushBuffer()
+		bs.wg.Wait()
+		si.lock.Lock()
+		lines := si.lines
+		si.lines = nil
+		si.lock.Unlock()
+		if len(lines) != tt.lines || atomic.LoadInt64(&ic.stats.PointsWritten)-written != int64(tt.lines) || CountRows([]byte(tt.p)) != tt.lines {
+			t.Errorf("write %q: %d points expected, got %v, counted %d", tt.p, tt.lines, lines, ic.stats.PointsWritten-written)
+		}
+	}
+
+	// the line numbers count blank lines, the total doesn't.
+	err = ic.WriteStrict(context.Background(), []byte("cpu value=1 1\n\nmem value=2 2"), "", "test", false)
+	e, ok := err.(*LineErrors)
+	if !ok || e.Total != 2 || len(e.Lines) != 1 || e.Lines[0].Line != 3 {
+		t.Errorf("line errors wrong: %+v", err)
+	}
+}
+
+func TestRewriteTimestamp(t *testing.T) {
+	tests := []struct {
+		line      string
+		precision string
+		want      string
+	}{
+		{"cpu value=1 1434055562000000123", "ns", "cpu value=1 1434055562000000123"},
+		{"cpu value=1 01434055562000000123", "ns", "cpu value=1 1434055562000000123"},
+		{"cpu value=1 1434055562000000123", "s", "cpu value=1 1434055562000000000"},
+		{"cpu value=1 1434055562123", "ms", "cpu value=1 1434055000000"},
+	}
+	for _, tt := range tests {
+		line := []byte(tt.line)
+		got := rewriteTimestamp(line, tt.precision)
+		if string(got) != tt.want {
+			t.Errorf("%q %s: got %q, want %q", tt.line, tt.precision, got, tt.want)
+		}
+		if string(line) != tt.line {
+			t.Errorf("%q should not be modified: %q", tt.line, line)
+		}
+	}
+
+	before := time.Now().UnixNano()
+	got := rewriteTimestamp([]byte("cpu value=1"), "s")
+	series, fields, ts := splitLine(got)
+	n, _ := strconv.ParseInt(string(ts), 10, 64)
+	if string(series) != "cpu" || string(fields) != "value=1" || n%int64(time.Second) != 0 || n < before-int64(time.Second) {
+		t.Errorf("line without timestamp should get the current time: %q", got)
+	}
+}
+
+func benchmarkCluster(b *testing.B) *InfluxCluster {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		b.Fatal(err)
+	}
+	cb := &countBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{cb, cb}
+	return ic
+}
+
+// BenchmarkWriteRow 用 -benchmem 查看每个点的分配
+func BenchmarkWriteRow(b *testing.B) {
+	ic := benchmarkCluster(b)
+	for _, tt := range []struct {
+		name      string
+		line      string
+		precision string
+	}{
+		{"ns", "cpu,host=server01,region=uswest value=1 1434055562000000000", "ns"},
+		{"s", "cpu,host=server01,region=uswest value=1 1434055562", "s"},
+		{"now", "cpu,host=server01,region=uswest value=1", "ns"},
+	} {
+		line := []byte(tt.line)
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ic.WriteRow(line, tt.precision, "test")
+			}
+		})
+	}
+}
+
+// BenchmarkWrite 写入 1000 行的请求
+func BenchmarkWrite(b *testing.B) {
+	ic := benchmarkCluster(b)
+	buf := bytes.Buffer{}
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "cpu,host=server%d,region=uswest value=%d 1434055562%09d\n", i, i, i)
+	}
+	p := buf.Bytes()
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ic.Write(p, "ns", "test")
+	}
+}
+
+func TestInfluxdbClusterNextWriteFail(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(HandlerAny))
+	ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 10
+	cfg.WriteRetries = -1
+	next, err := NewBackends(cfg, "next", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200 && next.IsActive(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{NextWriteFail: 1}, ".")
+	ic.AddNext(next)
+	err = ic.Write([]byte("cpu value=1 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Errorf("next failures should not fail the request: %s", err)
+	}
+	if ic.stats.NextWriteFail != 1 || ic.stats.WriteRequestsFail != 0 {
+		t.Errorf("down next should count in NextWriteFail: %d %d", ic.stats.NextWriteFail, ic.stats.WriteRequestsFail)
+	}
+	for i := 0; i < 200 && !next.fb.IsData(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !next.fb.IsData() {
+		t.Errorf("write to the down next should be spooled")
+	}
+
+	// closed next fails the write, counted in WriteRequestsFail by default.
+	next.Close()
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.AddNext(next)
+	ic.Write([]byte("cpu value=1 1434055562000000000\n"), "ns", "test")
+	if ic.stats.NextWriteFail != 0 || ic.stats.WriteRequestsFail != 1 {
+		t.Errorf("next failures should count in WriteRequestsFail by default: %d %d", ic.stats.NextWriteFail, ic.stats.WriteRequestsFail)
+	}
+}
+
+func TestInfluxdbClusterShowColumnsMerge(t *testing.T) {
+	newServer := func(series string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[%s]}]}`, series)
+		}))
+	}
+	// an older backend without fieldType, in a different order.
+	ts1 := newServer(`{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["idle","float"],["user","float"]]}`)
+	defer ts1.Close()
+	ts2 := newServer(`{"name":"cpu","columns":["fieldKey"],"values":[["idle"],["system"]]}`)
+	defer ts2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	var apis []BackendAPI
+	for i, u := range []string{ts1.URL, ts2.URL} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = u
+		bs, err := NewBackends(cfg, fmt.Sprintf("columns%d", i), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {apis[0]}, "mem": {apis[1]}}}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "SHOW FIELD KEYS")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	err := ic.ShowQuery(w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := DecodeSeriesArray(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || fmt.Sprint(ss[0].Columns) != "[fieldKey fieldType]" {
+		t.Fatalf("merged series wrong: %+v", ss)
+	}
+	rows := make(map[string]interface{})
+	for _, v := range ss[0].Values {
+		if len(v) != 2 {
+			t.Fatalf("row should have all columns: %v", v)
+		}
+		rows[v[0].(string)] = v[1]
+	}
+	// idle from both, the typed one and the one filled with null.
+	if len(ss[0].Values) != 4 || rows["user"] != "float" || rows["system"] != nil {
+		t.Errorf("merged values wrong: %v", ss[0].Values)
+	}
+}
+
+func TestInfluxdbClusterAsyncQuery(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	queried := make(map[string]string)
+	var apis []BackendAPI
+	for _, name := range []string{"shard1", "shard2"} {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				w.WriteHeader(204)
+				return
+			}
+			<-release
+			lock.Lock()
+			queried[name] = req.FormValue("q")
+			lock.Unlock()
+			w.WriteHeader(204)
+		}))
+		defer ts.Close()
+		cfg, _ := CreateTestBackendConfig("db1")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"db1": {"cpu": apis}}
+
+	query := func(s string) *DummyResponseWriter {
+		q := url.Values{}
+		q.Set("db", "db1")
+		q.Set("q", s)
+		q.Set("async", "true")
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	if w := query("SELECT * FROM cpu"); w.status != 400 {
+		t.Errorf("async select should be rejected: %d", w.status)
+	}
+
+	// the shards block until released, the response doesn't wait for them.
+	drop := "DROP SERIES FROM cpu WHERE host = 'x'"
+	if w := query(drop); w.status != 204 {
+		t.Errorf("async drop should return 204 at once: %d", w.status)
+	}
+	close(release)
+	for i := 0; i < 300; i++ {
+		lock.Lock()
+		n := len(queried)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if queried["shard1"] != drop || queried["shard2"] != drop {
+		t.Errorf("async drop should be executed on all shards: %v", queried)
+	}
+	if ic.stats.AsyncQueries != 1 || atomic.LoadInt64(&ic.stats.AsyncQueriesFail) != 0 {
+		t.Errorf("async query stats wrong: %d %d", ic.stats.AsyncQueries, ic.stats.AsyncQueriesFail)
+	}
+}
+
+func TestInfluxdbClusterForceBackend(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ForceBackendHeader: 1}, ".")
+	ic.backends = make(map[string]BackendAPI)
+	for _, name := range []string{"b1", "b2"} {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","backend"],"values":[[0,"%s"]]}]}]}`, name)
+		}))
+		defer ts.Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		ic.backends[name] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {ic.backends["b1"]}}}
+
+	query := func(backend string) *DummyResponseWriter {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SELECT * FROM cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		req.Header.Set(BACKEND_HEADER, backend)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	// b2 is not mapped, but answers when forced.
+	w := query("b2")
+	if w.status != 200 || w.Header().Get(BACKEND_HEADER) != "b2" || !strings.Contains(w.buffer.String(), `"b2"`) {
+		t.Errorf("query should be sent to the forced backend: %d %v %s", w.status, w.Header(), w.buffer.String())
+	}
+	if w = query("b3"); w.status != 400 {
+		t.Errorf("unknown backend should be rejected: %d", w.status)
+	}
+	atomic.StoreInt32(&ic.backends["b2"].(*Backends).disabled, 1)
+	if w = query("b2"); w.status != 400 {
+		t.Errorf("inactive backend should be rejected: %d", w.status)
+	}
+
+	ic.forceBackend = false
+	if w = query("b1"); w.status != 403 {
+		t.Errorf("forced backend should be rejected when not enabled: %d", w.status)
+	}
+}
+
+func TestInfluxdbClusterServedBy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`))
+	}))
+	defer ts.Close()
+	// local 先断开连接, 之后恢复成 ts 的应答
+	var broken int32 = 1
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&broken) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer down.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{Zone: "z1"}, ".")
+	var apis []BackendAPI
+	for _, b := range []struct{ name, url, zone string }{
+		{"local", down.URL, "z1"},
+		{"remote", ts.URL, "z2"},
+		{"local2", ts.URL, "z1"},
+	} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = b.url
+		cfg.Zone = b.zone
+		cfg.CheckInterval = 60000
+		bs, err := NewBackends(cfg, b.name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		bs.setActive(true, nil)
+		apis = append(apis, bs)
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis[:2], "mem": apis[2:]}}
+
+	query := func(s string) *DummyResponseWriter {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", s)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	// the local backend fails, the remote one answers.
+	w := query("SELECT * FROM cpu")
+	if w.status != 200 || w.Header().Get(BACKEND_HEADER) != "remote" || w.Header().Get(ZONE_HEADER) != "z2" {
+		t.Errorf("failed over query should name the remote backend: %d %v", w.status, w.Header())
+	}
+	// merged from the local backends of cpu and mem, the local one of cpu is down now.
+	w = query("SHOW MEASUREMENTS")
+	if w.status != 200 || w.Header().Get(BACKEND_HEADER) != "local2" || w.Header().Get(ZONE_HEADER) != "z1" {
+		t.Errorf("merged query should name the backends: %d %v", w.status, w.Header())
+	}
+	atomic.StoreInt32(&broken, 0)
+	apis[0].(*Backends).setActive(true, nil)
+	w = query("SHOW MEASUREMENTS")
+	if w.Header().Get(BACKEND_HEADER) != "local,local2" {
+		t.Errorf("merged query should name all the backends: %v", w.Header())
+	}
+
+	ic.hideBackend = true
+	w = query("SELECT * FROM cpu")
+	if w.status != 200 || w.Header().Get(BACKEND_HEADER) != "" || w.Header().Get(ZONE_HEADER) != "" {
+		t.Errorf("backend headers should be hidden: %v", w.Header())
+	}
+}
+
+func TestInfluxdbClusterQueryAllPartial(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}]}]}`))
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.HandlerFunc(HandlerAny))
+	down.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	apis := make(map[string]*Backends)
+	for _, b := range []struct{ name, url string }{{"ok", ts.URL}, {"fail", down.URL}, {"inactive", ts.URL}} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = b.url
+		cfg.CheckInterval = 60000
+		bs, err := NewBackends(cfg, b.name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis[b.name] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {
+		"cpu":  {apis["ok"]},
+		"mem":  {apis["fail"]},
+		"disk": {apis["inactive"]},
+	}}
+	apis["inactive"].HttpBackend.disabled = 1
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "SHOW MEASUREMENTS")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	result, err := ic.QueryAll(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Bodys) != 1 || strings.Join(result.Served, ",") != "cpu" || strings.Join(result.Missing, ",") != "disk,mem" {
+		t.Errorf("served and missing mappings wrong: %d %v %v", len(result.Bodys), result.Served, result.Missing)
+	}
+
+	// the merged result is returned with a warning.
+	w := NewDummyResponseWriter()
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	ic.Query(w, req)
+	body := w.buffer.String()
+	if w.status != 200 || !strings.Contains(body, `"values":[["cpu"]]`) ||
+		!strings.Contains(body, `"messages":[{"level":"warning","text":"partial results, no backend available for disk, mem"}]`) {
+		t.Errorf("partial result should have a warning: %d %s", w.status, body)
+	}
+
+	// nothing served is an error.
+	delete(ic.m2bs["test"], "cpu")
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	if _, err = ic.QueryAll(req); err == nil {
+		t.Errorf("no mapping served should be an error")
+	}
+}
+
+func TestInfluxdbClusterMultiMeasurement(t *testing.T) {
+	var lock sync.Mutex
+	queried := make(map[string][]string)
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	apis := make(map[string]BackendAPI)
+	for _, name := range []string{"b1", "b2"} {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				w.WriteHeader(204)
+				return
+			}
+			q := req.FormValue("q")
+			lock.Lock()
+			queried[name] = append(queried[name], q)
+			lock.Unlock()
+			m, _ := GetMeasurementFromInfluxQL(q)
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%s","columns":["time","value"],"values":[[1434055562000000000,1]]}]}]}`, m)
+		}))
+		defer ts.Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis[name] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {
+		"cpu":  {apis["b1"]},
+		"mem":  {apis["b1"]},
+		"disk": {apis["b2"]},
+	}}
+
+	query := func(s string) *DummyResponseWriter {
+		lock.Lock()
+		queried = make(map[string][]string)
+		lock.Unlock()
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", s)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	// on the same backends, forwarded as it is.
+	w := query("SELECT * FROM cpu, \"mem\" WHERE time > now() - 1h")
+	lock.Lock()
+	if w.status != 200 || len(queried["b1"]) != 1 || queried["b1"][0] != "SELECT * FROM cpu, \"mem\" WHERE time > now() - 1h" {
+		t.Errorf("measurements of the same backends should be forwarded: %d %v", w.status, queried)
+	}
+	lock.Unlock()
+
+	w = query("SELECT * FROM cpu, disk WHERE time > now() - 1h")
+	if w.status != 400 || !strings.Contains(w.buffer.String(), ErrSpanBackends.Error()) {
+		t.Errorf("measurements of different backends should be rejected: %d %s", w.status, w.buffer.String())
+	}
+
+	// split and merged in the order of FROM.
+	ic.splitMulti = true
+	w = query("SELECT * FROM disk, cpu WHERE time > now() - 1h")
+	lock.Lock()
+	if len(queried["b1"]) != 1 || queried["b1"][0] != "SELECT * FROM cpu WHERE time > now() - 1h" ||
+		len(queried["b2"]) != 1 || queried["b2"][0] != "SELECT * FROM disk WHERE time > now() - 1h" {
+		t.Errorf("each measurement should be queried on its backends: %v", queried)
+	}
+	lock.Unlock()
+	if w.Header().Get(BACKEND_HEADER) != "b2,b1" || !strings.Contains(w.buffer.String(), "[[1434055562000000000,1]]") {
+		t.Errorf("both backends should be named, timestamps kept: %v %s", w.Header(), w.buffer.String())
+	}
+	series, err := DecodeSeriesArray(&w.buffer)
+	if w.status != 200 || err != nil || len(series) != 2 || series[0].Name != "disk" || series[1].Name != "cpu" {
+		t.Errorf("results should be merged: %d %+v %v", w.status, series, err)
+	}
+}
+
+func TestInfluxdbClusterQualifiedFrom(t *testing.T) {
+	var lock sync.Mutex
+	var got url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			lock.Lock()
+			got = req.URL.Query()
+			lock.Unlock()
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	cfg, _ := CreateTestBackendConfig("mydb")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic.backends = map[string]BackendAPI{"b1": bs}
+	ic.m2bs = map[string]map[string][]BackendAPI{"mydb": {"cpu": {bs}}}
+
+	query := func(db, q string) *DummyResponseWriter {
+		form := url.Values{}
+		if db != "" {
+			form.Set("db", db)
+		}
+		form.Set("q", q)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+form.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	// routed by the db of the query, the rp is kept.
+	q := `SELECT * FROM "mydb"."autogen"."cpu"`
+	w := query("", q)
+	lock.Lock()
+	sent := got.Get("q")
+	lock.Unlock()
+	if w.status != 200 || sent != q {
+		t.Errorf("qualified query should be routed by its db: %d %s %s", w.status, sent, w.buffer.String())
+	}
+	if w = query("mydb", q); w.status != 200 {
+		t.Errorf("same db should be allowed: %d", w.status)
+	}
+	if w = query("other", q); w.status != 409 || !strings.Contains(w.buffer.String(), ErrDBConflict.Error()) {
+		t.Errorf("conflicting db should be rejected: %d %s", w.status, w.buffer.String())
+	}
+	if w = query("", "SELECT * FROM cpu"); w.status != 400 {
+		t.Errorf("query without any db should be unknown: %d", w.status)
+	}
+}
+
+func TestTagFieldkeyMerger(t *testing.T) {
+	bodies := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["tagKey"],"values":[["host"]]},{"name":"cpu","columns":["tagKey"],"values":[["region"],["host"]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["tagKey"],"values":[["zone"],["host"]]},{"name":"disk","columns":["tagKey"],"values":[["path"]]}]}]}`,
+	}
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"],["zone"]]},` +
+		`{"name":"disk","columns":["tagKey"],"values":[["path"]]},` +
+		`{"name":"mem","columns":["tagKey"],"values":[["host"]]}]}]}`
+
+	// the same output whichever backend answers first.
+	for _, order := range [][]int{{0, 1}, {1, 0}} {
+		m := tagFieldkeyMerger{}
+		for _, i := range order {
+			var resp statementArray
+			err := json.Unmarshal([]byte(bodies[i]), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.merge(resp.Results[0].Series)
+		}
+		body, err := m.body(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(body)) != want {
+			t.Errorf("tag keys should be merged and sorted: %s", body)
+		}
+	}
+}
+
+func TestInfluxdbClusterQueryTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			return
+		}
+		select {
+		case <-req.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{MaxQueryTimeout: 100}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.TimeoutQuery = 60000
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic.backends = map[string]BackendAPI{"b1": bs}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	query := func(timeout string) (*DummyResponseWriter, time.Duration) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SELECT * FROM cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		req.Header.Set(QUERY_TIMEOUT_HEADER, timeout)
+		w := NewDummyResponseWriter()
+		start := time.Now()
+		ic.Query(w, req)
+		return w, time.Since(start)
+	}
+
+	// a short timeout aborts the slow backend.
+	w, elapsed := query("50ms")
+	if w.status != 504 || elapsed > time.Second {
+		t.Errorf("query should time out: %d %s", w.status, elapsed)
+	}
+	// clamped to maxquerytimeout.
+	w, elapsed = query("10s")
+	if w.status != 504 || elapsed > time.Second {
+		t.Errorf("timeout should be clamped: %d %s", w.status, elapsed)
+	}
+	if w, _ = query("soon"); w.status != 400 {
+		t.Errorf("illegal timeout should be rejected: %d", w.status)
+	}
+	if !bs.IsActive() {
+		t.Errorf("timed out backend should stay active")
+	}
+}
+
+func TestInfluxdbClusterHealth(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.backends = make(map[string]BackendAPI)
+	for _, name := range []string{"b1", "b2"} {
+		cfg, ts := CreateTestBackendConfig("test")
+		defer ts.Close()
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// closed by ic.Close.
+		ic.backends[name] = bs
+	}
+	if h := ic.Health(); h.Status != HEALTH_OK || h.Backends != 2 || h.Active != 2 {
+		t.Errorf("all backends should be healthy: %+v", h)
+	}
+	atomic.StoreInt32(&ic.backends["b2"].(*Backends).disabled, 1)
+	if h := ic.Health(); h.Status != HEALTH_DEGRADED || h.Active != 1 {
+		t.Errorf("inactive backend should degrade the health: %+v", h)
+	}
+
+	closed := false
+	ic.OnClose(func() { closed = true })
+	ic.Close()
+	if !closed {
+		t.Errorf("closers should be called by Close")
+	}
+}
+
+func TestInfluxdbClusterStatsConfig(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("mon")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{StatsDatabase: "mon", StatsMeasurement: "proxy"}, ".")
+	ic.backends = map[string]BackendAPI{"b1": bs}
+
+	// not routable, logged once and skipped.
+	ic.m2bs = map[string]map[string][]BackendAPI{}
+	if err = ic.WriteStatistics(); err != nil || atomic.LoadInt32(&ic.statsUnroutable) != 1 {
+		t.Errorf("unroutable stats should be skipped: %v", err)
+	}
+	if ic.stats.PointsWrittenFail != 0 {
+		t.Errorf("unroutable stats should not be written: %d", ic.stats.PointsWrittenFail)
+	}
+
+	written := func() []string {
+		bs.FlushBuffer()
+		bs.wg.Wait()
+		si.lock.Lock()
+		defer si.lock.Unlock()
+		lines := si.lines
+		si.lines = nil
+		return lines
+	}
+
+	// routed by KEYMAPS of the stats db.
+	ic.m2bs = map[string]map[string][]BackendAPI{"mon": {"_default_": {bs}}}
+	if err = ic.WriteStatistics(); err != nil || atomic.LoadInt32(&ic.statsUnroutable) != 0 {
+		t.Errorf("stats should be written: %v", err)
+	}
+	lines := written()
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "proxy,") || !strings.HasPrefix(lines[1], "runtime,") {
+		t.Errorf("stats should be written to the measurement: %v", lines)
+	}
+
+	// sent to the backend directly.
+	ic.m2bs = map[string]map[string][]BackendAPI{}
+	ic.statsBackend = "b1"
+	if err = ic.WriteStatistics(); err != nil {
+		t.Error(err)
+	}
+	if lines = written(); len(lines) < 3 {
+		t.Errorf("stats should be sent to the backend: %v", lines)
+	}
+}
+
+func TestInfluxdbClusterWriteStrict(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	ic.backends = map[string]BackendAPI{"b1": bs}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("cpu value=%d %d", i, 1434055562000000000+i))
+	}
+	lines[6] = "mem value=6 1434055562000000006"
+	p := []byte(strings.Join(lines, "\n"))
+
+	if err = ic.Write(p, "ns", "test"); err != nil {
+		t.Errorf("failed lines should be ignored: %v", err)
+	}
+	err = ic.WriteStrict(context.Background(), p, "ns", "test", false)
+	e, ok := err.(*LineErrors)
+	if !ok || e.Total != 10 || len(e.Lines) != 1 || e.Lines[0].Line != 7 || e.Lines[0].Error != ErrUnknownMeasurement.Error() {
+		t.Fatalf("line 7 should be reported: %v", err)
+	}
+
+	// the other lines are written all the same.
+	bs.FlushBuffer()
+	bs.wg.Wait()
+	if len(si.lines) != 18 {
+		t.Errorf("other lines should be written: %d", len(si.lines))
+	}
+
+	if err = ic.WriteStrict(context.Background(), []byte("cpu value=1\n\ncpu value=2\n"), "ns", "test", false); err != nil {
+		t.Errorf("strict write should succeed: %v", err)
+	}
+}
+
+func TestInfluxdbClusterStickyQuery(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{StickyQuery: 1}, ".")
+	hits := make([]int64, 3)
+	servers := make([]*httptest.Server, 3)
+	apis := make([]BackendAPI, 3)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				atomic.AddInt64(&hits[i], 1)
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		}))
+		defer servers[i].Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = servers[i].URL
+		bs, err := NewBackends(cfg, fmt.Sprintf("b%d", i), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis[i] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis}}
+
+	query := func(id string) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SELECT * FROM cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		req.AddCookie(&http.Cookie{Name: STICKY_COOKIE, Value: id})
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		if w.status != 200 {
+			t.Fatalf("query failed: %d", w.status)
+		}
+	}
+	// the only backend hit by the client, and resets the counters.
+	served := func() int {
+		n := -1
+		for i := range hits {
+			if atomic.SwapInt64(&hits[i], 0) == 0 {
+				continue
+			}
+			if n >= 0 {
+				t.Fatalf("queries of a client should hit one backend: %v", hits)
+			}
+			n = i
+		}
+		return n
+	}
+
+	for i := 0; i < 10; i++ {
+		query("dashboard")
+	}
+	first := served()
+	if first < 0 {
+		t.Fatal("no backend was hit")
+	}
+
+	// the backend fails, the client sticks to another one.
+	servers[first].Close()
+	for i := 0; i < 10; i++ {
+		query("dashboard")
+	}
+	if second := served(); second < 0 || second == first {
+		t.Errorf("queries should fail over: %d %d", first, second)
+	}
+
+	// clients are spread over the backends.
+	used := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		query(fmt.Sprintf("client%d", i))
+		used[served()] = true
+	}
+	if len(used) != 2 {
+		t.Errorf("clients should use both backends: %v", used)
+	}
+}
+
+func TestInfluxdbClusterStickyMeasurements(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{StickyMeasurements: []string{"cpu"}}, ".")
+	hits := make([]int64, 3)
+	servers := make([]*httptest.Server, 3)
+	apis := make([]BackendAPI, 3)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				atomic.AddInt64(&hits[i], 1)
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		}))
+		defer servers[i].Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = servers[i].URL
+		bs, err := NewBackends(cfg, fmt.Sprintf("b%d", i), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis[i] = bs
+	}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis, "mem": apis}}
+
+	query := func(addr, measurement string) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SELECT * FROM "+measurement)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		req.RemoteAddr = addr
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		if w.status != 200 {
+			t.Fatalf("query failed: %d", w.status)
+		}
+	}
+	// backends hit since the last call.
+	served := func() (used []int) {
+		for i := range hits {
+			if atomic.SwapInt64(&hits[i], 0) > 0 {
+				used = append(used, i)
+			}
+		}
+		return
+	}
+
+	for i := 0; i < 20; i++ {
+		query("10.0.0.1:1234", "cpu")
+	}
+	first := served()
+	if len(first) != 1 {
+		t.Fatalf("queries of a client should hit one backend: %v", first)
+	}
+	// other ports of the same address are the same client, other measurements are not sticky.
+	for i := 0; i < 20; i++ {
+		query("10.0.0.1:5678", "cpu")
+	}
+	if used := served(); len(used) != 1 || used[0] != first[0] {
+		t.Errorf("the client should stay on backend %d: %v", first[0], used)
+	}
+	for i := 0; i < 30; i++ {
+		query("10.0.0.1:1234", "mem")
+	}
+	if used := served(); len(used) < 2 {
+		t.Errorf("measurements not sticky should be spread: %v", used)
+	}
+
+	// fails over and sticks to the new backend.
+	servers[first[0]].Close()
+	for i := 0; i < 20; i++ {
+		query("10.0.0.1:1234", "cpu")
+	}
+	second := served()
+	if len(second) != 1 || second[0] == first[0] {
+		t.Errorf("queries should fail over to one backend: %d %v", first[0], second)
+	}
+	key := stickyKey("10.0.0.1", "test", "cpu")
+	if name := ic.stickyCache.get(key, time.Now()); len(second) == 1 && name != fmt.Sprintf("b%d", second[0]) {
+		t.Errorf("sticky entry should be updated: %s", name)
+	}
+	if name := ic.stickyCache.get(key, time.Now().Add(time.Millisecond*DEFAULT_STICKY_TTL+time.Second)); name != "" {
+		t.Errorf("sticky entry should expire: %s", name)
+	}
+}
+
+func TestStickyCacheEvict(t *testing.T) {
+	sc := newStickyCache(&NodeConfig{StickyEntries: 2})
+	now := time.Now()
+	sc.set("a", "b1", now)
+	sc.set("b", "b2", now)
+	// a is used, b is the oldest.
+	sc.get("a", now)
+	sc.set("c", "b3", now)
+	if sc.lru.Len() != 2 || sc.get("a", now) != "b1" || sc.get("b", now) != "" || sc.get("c", now) != "b3" {
+		t.Errorf("least recently used entry should be evicted: %d", sc.lru.Len())
+	}
+}
+
+func TestInfluxdbClusterStickyPrecedence(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(node string) {
+		backend := fmt.Sprintf(`{"url": %q, "db": "test", "rewriteinterval": 60000}`, ts.URL)
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {"b0": %s, "b1": %s, "b2": %s},
+	"KEYMAPS": {"test": {"cpu": ["b0", "b1", "b2"]}},
+	"NODES": {"l1": {%s}}
+}`, backend, backend, backend, node)
+		if err := os.WriteFile(cfgfile, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`"stickyquery": 1, "stickymeasurements": ["cpu"], "stickyentries": 2`)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	if err := ic.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	apis := ic.m2bs["test"]["cpu"]
+	last := apis[len(apis)-1].GetName()
+
+	newReq := func(id string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?db=test&q=select+*+from+cpu", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if id != "" {
+			req.Header.Set(STICKY_HEADER, id)
+		}
+		return req
+	}
+	ic.stickyCache.set(stickyKey("10.0.0.1", "test", "cpu"), last, time.Now())
+
+	// the client id wins over the address.
+	req := newReq("dashboard")
+	sorted, key := ic.stickyBackends(req, "cpu", "test", "cpu", apis)
+	if want := ic.sticky(req, apis); key != "" || sorted[0] != want[0] {
+		t.Errorf("client id should pick the backend: %s %s %s", key, sorted[0].GetName(), want[0].GetName())
+	}
+	sorted, key = ic.stickyBackends(newReq(""), "cpu", "test", "cpu", apis)
+	if key == "" || sorted[0].GetName() != last {
+		t.Errorf("client address should pick the backend: %s %s", key, sorted[0].GetName())
+	}
+	if routes := ic.Routes(); !routes["test"]["cpu"].Sticky {
+		t.Errorf("sticky should be in the routes: %+v", routes["test"]["cpu"])
+	}
+
+	// the settings are reloaded, entries are kept up to the new size.
+	ic.stickyCache.set("a", "b0", time.Now())
+	ic.stickyCache.set("b", "b0", time.Now())
+	writeConfig(`"stickymeasurements": ["cpu"], "stickyttl": 1000, "stickyentries": 1`)
+	if err := ic.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ic.stickyCache.ttl != time.Second || ic.stickyCache.lru.Len() != 1 || ic.stickyCache.get("b", time.Now()) != "b0" {
+		t.Errorf("sticky cache should be reloaded: %s %d", ic.stickyCache.ttl, ic.stickyCache.lru.Len())
+	}
+	if _, key = ic.stickyBackends(newReq("dashboard"), "cpu", "test", "cpu", apis); key == "" {
+		t.Errorf("client id should be ignored without stickyquery")
+	}
+}
+
+func TestInfluxdbClusterStatsNotCounted(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig(MONITOR_DB)
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	ic.backends = map[string]BackendAPI{"b1": bs}
+	ic.m2bs = map[string]map[string][]BackendAPI{MONITOR_DB: {"_default_": {bs}}}
+
+	before := *ic.stats
+	if err = ic.WriteStatistics(); err != nil {
+		t.Fatal(err)
+	}
+	bs.FlushBuffer()
+	bs.wg.Wait()
+	if len(si.lines) == 0 {
+		t.Fatal("stats should be written")
+	}
+	if *ic.stats != before {
+		t.Errorf("stats writes should not be counted: %+v", *ic.stats)
+	}
+
+	// the stats measurement is left out of the stats db.
+	m, _ := newMeasurementsMerger("SHOW MEASUREMENTS")
+	m.exclude = MONITOR_MEASUREMENT
+	m.merge([]seri{{Name: "measurements", Columns: []string{"name"}, Values: [][]interface{}{{"cpu"}, {MONITOR_MEASUREMENT}}}})
+	if len(m.names) != 1 || !m.names["cpu"] {
+		t.Errorf("stats measurement should be excluded: %v", m.names)
+	}
+}
+
+func TestInfluxdbClusterQueryWriteOnly(t *testing.T) {
+	var hits int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			atomic.AddInt64(&hits, 1)
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.WriteOnly = 1
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	query := func(ic *InfluxCluster) *DummyResponseWriter {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "SELECT * FROM cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+	w := query(ic)
+	if w.status != 403 || !strings.Contains(w.buffer.String(), "measurement cpu is write-only on this proxy") || hits != 0 {
+		t.Errorf("write only measurement should be rejected: %d %s", w.status, w.buffer.String())
+	}
+	if ic.stats.QueriesWriteOnly != 1 {
+		t.Errorf("rejection should be counted: %d", ic.stats.QueriesWriteOnly)
+	}
+	if h := ic.Health(); len(h.WriteOnly["test"]) != 1 || h.WriteOnly["test"][0] != "cpu" {
+		t.Errorf("write only key should be flagged: %+v", h)
+	}
+
+	// falls back to the write only backend.
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{QueryWriteOnly: 1}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+	if w = query(ic); w.status != 200 || atomic.LoadInt64(&hits) != 1 {
+		t.Errorf("write only backend should be queried: %d %d", w.status, hits)
+	}
+}
+
+func TestInfluxdbClusterSpoolOnFailure(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	ic.backends = make(map[string]BackendAPI)
+	for _, name := range []string{"refusing", "spooling", "active"} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		if name == "refusing" {
+			cfg.SpoolOnFailure = -1
+		}
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "active" {
+			atomic.StoreInt32(&bs.disabled, 1)
+		}
+		ic.backends[name] = bs
+	}
+	refusing, spooling := ic.backends["refusing"].(*Backends), ic.backends["spooling"].(*Backends)
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {
+		"cpu":  {refusing},
+		"mem":  {ic.backends["active"]},
+		"disk": {spooling},
+		"net":  {refusing, ic.backends["active"]},
+	}}
+
+	if err := ic.Write([]byte("cpu value=1 1434055562000000000\n"), "ns", "test"); err != ErrAllUnavailable {
+		t.Errorf("write should fail fast: %v", err)
+	}
+	refusing.FlushBuffer()
+	if refusing.fb.IsData() || refusing.GetStats().RefusedPoints != 1 {
+		t.Errorf("refused line should not be spooled: %d", refusing.GetStats().RefusedPoints)
+	}
+
+	// only the line of cpu is reported.
+	err := ic.Write([]byte("mem value=1 1434055562000000000\ncpu value=1 1434055562000000000\nnet value=1 1434055562000000000\n"), "ns", "test")
+	e, ok := err.(*LineErrors)
+	if !ok || len(e.Lines) != 1 || e.Lines[0].Line != 2 || e.Lines[0].Error != ErrAllUnavailable.Error() {
+		t.Fatalf("partial write should be reported: %v", err)
+	}
+	active := ic.backends["active"].(*Backends)
+	active.FlushBuffer()
+	active.wg.Wait()
+	if len(si.lines) != 2 {
+		t.Errorf("mem and net should be written: %v", si.lines)
+	}
+
+	// spooled as usual by default.
+	if err = ic.Write([]byte("disk value=1 1434055562000000000\n"), "ns", "test"); err != nil {
+		t.Errorf("write should be spooled: %v", err)
+	}
+	spooling.FlushBuffer()
+	spooling.wg.Wait()
+	if !spooling.fb.IsData() {
+		t.Errorf("line should be spooled")
+	}
+}
+
+func TestInfluxdbClusterTimeBound(t *testing.T) {
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			received = req.FormValue("q")
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{UnboundedQueryRange: "1h"}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	query := func(q string) int {
+		v := url.Values{}
+		v.Set("db", "test")
+		v.Set("q", q)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+v.Encode(), nil)
+		w := NewDummyResponseWriter()
+		received = ""
+		ic.Query(w, req)
+		return w.status
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"select value from cpu where time > now() - 5m", "select value from cpu where time > now() - 5m"},
+		{"select value from cpu where time >= '2015-06-11T20:46:02Z' and host = 'a'", "select value from cpu where time >= '2015-06-11T20:46:02Z' and host = 'a'"},
+		{"select value from cpu", "SELECT value FROM cpu WHERE time > now() - 1h"},
+		{"select value from cpu where host = 'a' or host = 'b'", "SELECT value FROM cpu WHERE (host = 'a' OR host = 'b') AND time > now() - 1h"},
+		{"select value from cpu where time < now()", "SELECT value FROM cpu WHERE (time < now()) AND time > now() - 1h"},
+	}
+	for _, tt := range tests {
+		if status := query(tt.q); status != 204 {
+			t.Errorf("%s: status wrong: %d", tt.q, status)
+		}
+		if received != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.q, received, tt.want)
+		}
+	}
+
+	ic.timeBound = timeBound{reject: true}
+	if status := query("select value from cpu"); status != 400 || received != "" {
+		t.Errorf("unbounded query should be rejected: %d", status)
+	}
+	if status := query("select value from cpu where time > now() - 5m"); status != 204 {
+		t.Errorf("bounded query should pass: %d", status)
+	}
+}
+
+func TestInfluxdbClusterAllInactive(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	var apis []BackendAPI
+	for _, name := range []string{"b1", "b2"} {
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		atomic.StoreInt32(&bs.disabled, 1)
+		apis = append(apis, bs)
+	}
+
+	for _, retryAfter := range []int{0, 30} {
+		ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{RetryAfter: retryAfter}, ".")
+		ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis[:1], "mem": apis[1:]}}
+		expected := "1"
+		if retryAfter > 0 {
+			expected = "30"
+		}
+		for _, q := range []string{"SELECT value FROM cpu", "SHOW MEASUREMENTS", "SHOW FIELD KEYS", "SHOW RETENTION POLICIES"} {
+			params := url.Values{}
+			params.Set("db", "test")
+			params.Set("q", q)
+			req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+params.Encode(), nil)
+			w := NewDummyResponseWriter()
+			ic.Query(w, req)
+			if w.status != 503 || w.Header().Get("Retry-After") != expected || !strings.Contains(w.buffer.String(), ErrAllInactive.Error()) {
+				t.Errorf("%s: should be unavailable: %d %q %s", q, w.status, w.Header().Get("Retry-After"), w.buffer.String())
+			}
+		}
+		if ic.stats.QueryRequestsFail != 4 {
+			t.Errorf("failures should be counted: %d", ic.stats.QueryRequestsFail)
+		}
+	}
+}
+
+func TestInfluxdbClusterDBStats(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{Zone: "sh", StatsBackend: "b1"}, ".")
+	ic.backends = map[string]BackendAPI{"b1": bs}
+	ic.m2bs = map[string]map[string][]BackendAPI{
+		"a":         {"cpu": {bs}},
+		"b":         {"cpu": {bs}},
+		"_default_": {"cpu": {bs}},
+	}
+	ic.setDBStats(ic.m2bs)
+
+	ic.Write([]byte("cpu value=1\ncpu value=2\nmem value=3\n"), "", "a")
+	ic.Write([]byte("cpu value=1\n"), "", "b")
+	ic.Write([]byte("cpu value=1\n"), "", "other")
+	q := url.Values{}
+	q.Set("db", "b")
+	q.Set("q", "SELECT value FROM mem")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	ic.Query(NewDummyResponseWriter(), req)
+
+	if err = ic.WriteStatistics(); err != nil {
+		t.Fatal(err)
+	}
+	bs.FlushBuffer()
+	bs.wg.Wait()
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	points := make(map[string]string)
+	for _, line := range si.lines {
+		if strings.HasPrefix(line, "cpu ") {
+			continue
+		}
+		if !strings.Contains(line, ",zone=sh") {
+			t.Errorf("zone should be tagged: %s", line)
+		}
+		for _, db := range []string{"a", "b", "other", "_default_"} {
+			if strings.Contains(line, ",db="+db+",") {
+				points[db] = line
+			}
+		}
+	}
+	if len(points) != 2 {
+		t.Fatalf("a point of each configured db expected: %v", si.lines)
+	}
+	for db, fields := range map[string][]string{
+		"a": {"statWriteRequest=1i", "statPointsWritten=3i", "statPointsWrittenFail=1i", "statQueryRequest=0i"},
+		"b": {"statWriteRequest=1i", "statPointsWritten=1i", "statQueryRequest=1i", "statQueryRequestFail=1i"},
+	} {
+		for _, field := range fields {
+			if !strings.Contains(points[db], field) {
+				t.Errorf("%s of db %s wrong: %s", field, db, points[db])
+			}
+		}
+	}
+
+	// reset after written, kept on reload.
+	stats := ic.dbStatistics("a")
+	ic.setDBStats(map[string]map[string][]BackendAPI{"a": {"cpu": {bs}}})
+	if ic.dbStatistics("a") != stats || stats.PointsWritten != 0 || ic.dbStatistics("b") != &discardDBStats {
+		t.Errorf("db stats wrong after reload: %+v", stats)
+	}
+}
@@ -8,5 +8,28 @@ var (
 	ForbidCmds   = "(?i:^\\s*grant|^\\s*revoke|\\(\\)\\$)"
 	SupportCmds  = "(?i:from|drop\\s*measurement)"
 	ExecutorCmds = "(?i:show\\s*measurements|show\\s*tag\\s*keys|show\\s*series|show\\s*field\\s*keys|show\\s*retention\\s*policies)"
-	GlobalCmds   = "(?i:create database\\s)"
+	// statements deleting series, sent to every backend of the measurement.
+	SeriesCmds = "(?i:^\\s*(drop\\s+series|delete)\\s+from\\s)"
+	// statements merged across shards of a sharded measurement.
+	SelectCmds = "(?i:^\\s*select\\s)"
+	// counters of the proxy itself, answered without any backend.
+	ProxyStatsCmds = "(?i:^\\s*show\\s+proxy\\s+stats\\s*;?\\s*$)"
+	// running queries of every backend, and the kill of one, e.g. KILL QUERY 36 ON "backend".
+	ShowQueriesCmds = "(?i:^\\s*show\\s+queries\\s*;?\\s*$)"
+	KillQueryCmds   = "(?i:^\\s*kill\\s+query\\s+(\\d+)(?:\\s+on\\s+(\"[^\"]*\"|[^\\s;\"]+))?\\s*;?\\s*$)"
+	// forbidden without AuthTokens unless AllowQueryAdmin, any client could see and kill the queries of the others.
+	QueryAdminCmds = "(?i:^\\s*(show\\s+queries|kill\\s+query)\\b)"
+	// statements scoped to a database, sent to every backend of that db.
+	GlobalCmds = []string{
+		"(?i:^\\s*create\\s+database\\s)",
+		"(?i:^\\s*(create|alter|drop)\\s+retention\\s+policy\\s)",
+		"(?i:^\\s*(create|drop)\\s+continuous\\s+query\\s)",
+	}
+	// forbidden if ForbidContinuousQuery, CQs on the backends don't follow the routing of the proxy.
+	CreateCQCmds = "(?i:^\\s*create\\s+continuous\\s+query\\s)"
+	// statements for the whole server, sent to every backend.
+	ServerCmds = []string{
+		"(?i:^\\s*(create|drop)\\s+user\\s)",
+		"(?i:^\\s*set\\s+password\\s)",
+	}
 )
@@ -0,0 +1,115 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_CONCURRENCY_WAIT   = 100
+	DEFAULT_CONCURRENCY_STATUS = 429
+)
+
+// kinds of concurrency limits
+const (
+	CONCURRENT_QUERY = iota
+	CONCURRENT_WRITE
+	concurrentKinds
+)
+
+// semaphore 限制同时处理的请求数, nil 表示不限制
+type semaphore struct {
+	slots chan struct{}
+	// how long to wait for a slot before rejected.
+	wait time.Duration
+	// answered when rejected, 429 or 503.
+	status int
+}
+
+func newSemaphore(n int, wait time.Duration, status int) *semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &semaphore{
+		slots:  make(chan struct{}, n),
+		wait:   wait,
+		status: status,
+	}
+}
+
+func (s *semaphore) acquire(req *http.Request) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	return false
+}
+
+func (s *semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+func loadConcurrency(nodecfg *NodeConfig) (sems [concurrentKinds]*semaphore, err error) {
+	if nodecfg.MaxConcurrentQueries < 0 || nodecfg.MaxConcurrentWrites < 0 || nodecfg.ConcurrencyWait < 0 {
+		return sems, ErrIllegalConfig
+	}
+	status := nodecfg.ConcurrencyStatus
+	switch status {
+	case 0:
+		status = DEFAULT_CONCURRENCY_STATUS
+	case 429, 503:
+	default:
+		return sems, ErrIllegalConfig
+	}
+	wait := time.Millisecond * time.Duration(nodecfg.ConcurrencyWait)
+	if nodecfg.ConcurrencyWait == 0 {
+		wait = time.Millisecond * DEFAULT_CONCURRENCY_WAIT
+	}
+	sems[CONCURRENT_QUERY] = newSemaphore(nodecfg.MaxConcurrentQueries, wait, status)
+	sems[CONCURRENT_WRITE] = newSemaphore(nodecfg.MaxConcurrentWrites, wait, status)
+	return
+}
+
+// Acquire 占用一个 kind 的并发名额, 等待超时后应答 429 或 503 并返回 false.
+// 成功时必须调用 Release.
+func (ic *InfluxCluster) Acquire(w http.ResponseWriter, req *http.Request, kind int) bool {
+	sem := ic.concurrency[kind]
+	if sem.acquire(req) {
+		return true
+	}
+	if kind == CONCURRENT_QUERY {
+		atomic.AddInt64(&ic.stats.QueriesThrottled, 1)
+	} else {
+		atomic.AddInt64(&ic.stats.WritesThrottled, 1)
+	}
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(sem.status)
+	w.Write([]byte("{\"error\":\"too many concurrent requests\"}\n"))
+	return false
+}
+
+func (ic *InfluxCluster) Release(kind int) {
+	ic.concurrency[kind].release()
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	var arrived int64
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		atomic.AddInt64(&arrived, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{MaxConcurrentQueries: 2, ConcurrencyWait: 50, ConcurrencyStatus: 503}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}}}
+
+	query := func() *DummyResponseWriter {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "select value from cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = query().status
+		}(i)
+	}
+	for i := 0; i < 100 && atomic.LoadInt64(&arrived) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the third waits ConcurrencyWait and is throttled.
+	start := time.Now()
+	w := query()
+	if w.status != 503 || w.Header().Get("Retry-After") == "" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("query over the limit should be throttled: %d %v", w.status, time.Since(start))
+	}
+	if atomic.LoadInt64(&ic.stats.QueriesThrottled) != 1 {
+		t.Errorf("throttled counter wrong: %d", ic.stats.QueriesThrottled)
+	}
+
+	close(release)
+	wg.Wait()
+	for i, status := range statuses {
+		if status != 200 {
+			t.Errorf("query %d in the limit should proceed: %d", i, status)
+		}
+	}
+	if w = query(); w.status != 200 {
+		t.Errorf("query should proceed after released: %d", w.status)
+	}
+}
+
+func TestLoadConcurrency(t *testing.T) {
+	sems, err := loadConcurrency(&NodeConfig{MaxConcurrentWrites: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sems[CONCURRENT_QUERY] != nil || sems[CONCURRENT_WRITE].status != DEFAULT_CONCURRENCY_STATUS {
+		t.Errorf("concurrency wrong: %+v", sems)
+	}
+	_, err = loadConcurrency(&NodeConfig{MaxConcurrentQueries: 1, ConcurrencyStatus: 500})
+	if err != ErrIllegalConfig {
+		t.Errorf("status should be 429 or 503: %v", err)
+	}
+}
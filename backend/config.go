@@ -20,13 +20,120 @@ var (
 )
 
 type NodeConfig struct {
-	ListenAddr   string
-	Zone         string
-	Nexts        string
-	Interval     int
-	IdleTimeout  int
-	WriteTracing int
-	QueryTracing int
+	ListenAddr      string
+	Zone            string
+	Nexts           string
+	Interval        int
+	IdleTimeout     int
+	WriteTracing    int
+	QueryTracing    int
+	ForbidCmds      []string
+	SupportCmds     []string
+	GlobalCmds      []string
+	ServerCmds      []string
+	QueryDeadline   int
+	MaxQueryTimeout int
+	OtelTracing     int
+	OtlpEndpoint    string
+	KeepPrecision   int
+	ReadRepairRate  float64
+	DrainTimeout    int
+	CorsOrigins     []string
+	CorsMethods     []string
+	CorsHeaders     []string
+	InfluxdbVersion string
+	// measurement to the fraction of points kept.
+	SampleRates map[string]float64
+	// per client and per second, 0 means no limit.
+	WriteRateLimit   float64
+	WritePointsLimit float64
+	QueryRateLimit   float64
+	TrustForwarded   int
+	RateLimitClients int
+	// at most in process at the same time, 0 means no limit.
+	MaxConcurrentQueries int
+	MaxConcurrentWrites  int
+	ConcurrencyWait      int
+	ConcurrencyStatus    int
+	// db to points written per second, 0 means no limit.
+	WriteQuotas map[string]float64
+	// file of the access log, "-" for stdout, empty to disable.
+	AccessLog       string
+	AccessLogBuffer int
+	// measurements whose backends each keep part of the series, e.g. split by tag.
+	ShardedMeasurements []string
+	// default failover webhook of the backends.
+	FailoverWebhook string
+	// keys of KEYMAPS whose series are each written to one of the backends, picked by hash.
+	HashedMeasurements []string
+	// POSTed when a backend becomes active or inactive, at most StateWebhookRate per second of a backend.
+	StateWebhook        string
+	StateWebhookRetries int
+	StateWebhookRate    float64
+	// 1 to count failed writes of nexts in NextWriteFail instead of WriteRequestsFail.
+	NextWriteFail int
+	// keys of KEYMAPS written to the backends before the write request is answered.
+	SyncMeasurements []string
+	// 1 to accept X-Influx-Proxy-Backend of queries, sent to the named backend as they are.
+	ForceBackendHeader int
+	// 1 to leave out X-Influx-Proxy-Backend and X-Influx-Proxy-Zone of responses, if backend names are sensitive.
+	HideBackendHeader int
+	// 1 to split a select FROM measurements of different backends into one query for each and merge the results,
+	// or it is rejected.
+	SplitMultiMeasurement int
+	// self-monitoring, -1 to disable. written to StatsBackend directly if set, or routed by KEYMAPS.
+	StatsEnabled     int
+	StatsDatabase    string
+	StatsMeasurement string
+	StatsBackend     string
+	// address of the admin server with /admin/*, /metrics, /health and /debug/pprof, disabled if empty.
+	AdminListenAddr string
+	// 1 to query a client, by X-Influx-Proxy-Client or the influxproxy_client cookie, from the same backend while it is healthy.
+	StickyQuery int
+	// 1 to query the write only backends of a measurement if it has no other, or it gets 403.
+	QueryWriteOnly int
+	// window added to selects without a lower time bound, e.g. "1h" or milliseconds,
+	// or 1 in RejectUnboundedQuery to reject them.
+	UnboundedQueryRange  string
+	RejectUnboundedQuery int
+	// a query must match a rule of every group, instead of SupportCmds.
+	SupportCmdGroups [][]string
+	// "lenient" or "strict" to check new backends are reachable and have their db when the config is loaded.
+	Preflight string
+	// permissions of the socket file when ListenAddr or AdminListenAddr is unix:/path/to/socket, e.g. "0660".
+	SocketMode string
+	// paths served on each address of ListenAddr, e.g. {":8087": ["/write", "/ping"]}, all of them if not listed.
+	ListenEndpoints map[string][]string
+	// seconds in Retry-After of the 503 when every backend of the db is inactive, 1 by default.
+	RetryAfter int
+	// top N measurements of points written in /metrics, 0 to disable, and 1 in N points counted, 1 by default.
+	MeasurementMetrics       int
+	MeasurementMetricsSample int
+	// where the self-monitoring points go, "influxdb" (default), "stdout" or "none".
+	StatsSink string
+	// keys of KEYMAPS queried from the backend last answered the same client address, db and measurement,
+	// for StickyTTL milliseconds since, at most StickyEntries remembered. A client id of StickyQuery goes first.
+	StickyMeasurements []string
+	StickyTTL          int
+	StickyEntries      int
+	// tokens accepted from clients, each "read", "write" or "admin", or a list like "read,write",
+	// e.g. {"$WRITE_TOKEN": "write"}. Requests aren't checked if empty.
+	AuthTokens map[string]string
+	// 1 to forbid CREATE CONTINUOUS QUERY, the CQs would run on each backend regardless of KEYMAPS.
+	ForbidContinuousQuery int
+	// 1 to allow SHOW QUERIES and KILL QUERY without AuthTokens, otherwise they need an admin token.
+	AllowQueryAdmin int
+	// fields of a key of KEYMAPS written to the backends of another key, e.g. {"cpu": {"guest": "cpu_guest"}},
+	// a point is split into one line for each key, the fields not listed stay with the key.
+	FieldMaps map[string]map[string]string
+	// points more than MaxFutureSkew ahead of now or MaxPastSkew behind, e.g. "1h" or milliseconds, are dropped,
+	// or moved to the bound if SkewPolicy is "clamp". Empty means no bound.
+	MaxFutureSkew string
+	MaxPastSkew   string
+	SkewPolicy    string
+	// catch-all key of KEYMAPS, "_default_" by default. A measurement is routed by the key equal to it,
+	// else by a key it starts with, else by the catch-all; a measurement named as the catch-all matches it exactly.
+	DefaultMeasurementKey string
 }
 
 type BackendConfig struct {
@@ -41,6 +148,50 @@ type BackendConfig struct {
 	CheckInterval   int
 	RewriteInterval int
 	WriteOnly       int
+	// weight of the backend among the queried ones of its zone, 1 if unset.
+	// 0 only queries it when the others of the zone are inactive or fail.
+	QueryWeight      *int
+	SyncPolicy       string
+	SyncInterval     int
+	MaxBufferAge     int
+	MaxBufferBytes   int
+	FlushConcurrency int
+	MinRowLimit      int
+	SlowWrite        int
+	WriteRetries     int
+	RetryBackoff     int
+	DropBadBatch     int
+	DedupPoints      int
+	DedupWarn        int
+	DeadLetter       int
+	DeadLetterSize   int
+	// receives a copy of writes, never queried, failures don't affect clients.
+	Shadow      int
+	ShadowSpool int
+	// precision of all writes forwarded to the backend, e.g. ms.
+	ForcePrecision string
+	// POSTed when writes start or stop being spooled, defaults to the one in node config.
+	FailoverWebhook string
+	// group commit of the spool, frames are written together after the delay in ms or the bytes.
+	SpoolCommitDelay int
+	SpoolCommitBytes int
+	// -1 to refuse writes while the backend is inactive, instead of spooling them.
+	SpoolOnFailure int
+	// "gzip" to store the spool as gzip members readable by zcat, "frame" by default.
+	SpoolFormat string
+	// headers of all requests to the backend, $VAR and ${VAR} are expanded from the environment.
+	Headers   map[string]string
+	UserAgent string
+	// -1 to only use HTTP/1.1, h2 is negotiated with TLS backends by default.
+	HTTP2 int
+	// 1 to create the db on the backend when it becomes active, with the clause after WITH if set,
+	// e.g. `DURATION 30d REPLICATION 1 NAME "month"`.
+	CreateDatabase     int
+	CreateDatabaseWith string
+	// frames of the spool replayed at the same time, frames sharing a series stay in order.
+	RewriteConcurrency int
+
+	events *stateEvents
 }
 
 type BasicAuth struct {
@@ -49,6 +200,7 @@ type BasicAuth struct {
 }
 type FileConfigSource struct {
 	node         string
+	cfgfiles     []string
 	BACKENDS     map[string]BackendConfig
 	KEYMAPS      map[string]map[string][]string
 	NODES        map[string]NodeConfig
@@ -56,18 +208,112 @@ type FileConfigSource struct {
 }
 
 func NewFileConfigSource(cfgfile string, node string) (fcs *FileConfigSource) {
+	return NewMultiFileConfigSource([]string{cfgfile}, node)
+}
+
+// NewMultiFileConfigSource 从多个配置文件合并配置, 后面的文件优先, 见 Reload
+func NewMultiFileConfigSource(cfgfiles []string, node string) (fcs *FileConfigSource) {
 	fcs = &FileConfigSource{
-		node: node,
+		node:     node,
+		cfgfiles: cfgfiles,
 	}
-	file, err := os.Open(cfgfile)
+	err := fcs.Reload()
 	if err != nil {
 		logs.Errorf("file load error: %s", fcs.node)
+	}
+	return
+}
+
+// configFile 一个配置文件的内容, 没有 DEFAULT_NODE 时为 nil
+type configFile struct {
+	BACKENDS     map[string]BackendConfig
+	KEYMAPS      map[string]map[string][]string
+	NODES        map[string]NodeConfig
+	DEFAULT_NODE *NodeConfig
+}
+
+// Reload 重新读取配置文件, 失败时保留原有配置.
+// 多个文件按顺序合并: 同名的 backend, node, 和同一个 db 下同名的 key, 以后面的文件为准, DEFAULT_NODE 取最后一个有的.
+// 多个文件合并后 KEYMAPS 引用了不存在的 backend 时返回 ErrIllegalConfig.
+func (fcs *FileConfigSource) Reload() (err error) {
+	if len(fcs.cfgfiles) == 0 || fcs.cfgfiles[0] == "" {
+		return
+	}
+	var tmp FileConfigSource
+	for _, cfgfile := range fcs.cfgfiles {
+		var cf configFile
+		cf, err = readConfigFile(cfgfile)
+		if err != nil {
+			logs.Errorf("read config file %s error: %s", cfgfile, err)
+			return
+		}
+		tmp.merge(&cf)
+	}
+	if len(fcs.cfgfiles) > 1 {
+		err = tmp.validate()
+		if err != nil {
+			return
+		}
+	}
+	fcs.BACKENDS = tmp.BACKENDS
+	fcs.KEYMAPS = tmp.KEYMAPS
+	fcs.NODES = tmp.NODES
+	fcs.DEFAULT_NODE = tmp.DEFAULT_NODE
+	return
+}
+
+func readConfigFile(cfgfile string) (cf configFile, err error) {
+	file, err := os.Open(cfgfile)
+	if err != nil {
 		return
 	}
 	defer file.Close()
-	dec := json.NewDecoder(file)
-	err = dec.Decode(fcs)
+	err = json.NewDecoder(file).Decode(&cf)
+	return
+}
 
+// merge 把 cf 合并进来, cf 优先
+func (fcs *FileConfigSource) merge(cf *configFile) {
+	if cf.BACKENDS != nil && fcs.BACKENDS == nil {
+		fcs.BACKENDS = make(map[string]BackendConfig, len(cf.BACKENDS))
+	}
+	for name, cfg := range cf.BACKENDS {
+		fcs.BACKENDS[name] = cfg
+	}
+	if cf.KEYMAPS != nil && fcs.KEYMAPS == nil {
+		fcs.KEYMAPS = make(map[string]map[string][]string, len(cf.KEYMAPS))
+	}
+	for db, keys := range cf.KEYMAPS {
+		if fcs.KEYMAPS[db] == nil {
+			fcs.KEYMAPS[db] = make(map[string][]string, len(keys))
+		}
+		for key, names := range keys {
+			fcs.KEYMAPS[db][key] = names
+		}
+	}
+	if cf.NODES != nil && fcs.NODES == nil {
+		fcs.NODES = make(map[string]NodeConfig, len(cf.NODES))
+	}
+	for name, nodecfg := range cf.NODES {
+		fcs.NODES[name] = nodecfg
+	}
+	if cf.DEFAULT_NODE != nil {
+		fcs.DEFAULT_NODE = *cf.DEFAULT_NODE
+	}
+}
+
+// validate 检查 KEYMAPS 引用的 backend 都存在
+func (fcs *FileConfigSource) validate() (err error) {
+	for db, keys := range fcs.KEYMAPS {
+		for key, names := range keys {
+			for _, name := range names {
+				if _, ok := fcs.BACKENDS[name]; !ok {
+					logs.Errorf("backend %s of key %s in db %s not exists", name, key, db)
+					err = ErrIllegalConfig
+				}
+			}
+		}
+	}
 	return
 }
 
@@ -84,17 +330,47 @@ func (fcs *FileConfigSource) LoadBackends() (backends map[string]*BackendConfig,
 	backends = make(map[string]*BackendConfig)
 	for name, val := range fcs.BACKENDS {
 		cfg := &BackendConfig{
-			URL:             val.URL,
-			DB:              val.DB,
-			Zone:            val.Zone,
-			Interval:        val.Interval,
-			Timeout:         val.Timeout,
-			TimeoutQuery:    val.TimeoutQuery,
-			MaxRowLimit:     val.MaxRowLimit,
-			CheckInterval:   val.CheckInterval,
-			RewriteInterval: val.RewriteInterval,
-			WriteOnly:       val.WriteOnly,
-			BasicAuth:       val.BasicAuth,
+			URL:              val.URL,
+			DB:               val.DB,
+			Zone:             val.Zone,
+			Interval:         val.Interval,
+			Timeout:          val.Timeout,
+			TimeoutQuery:     val.TimeoutQuery,
+			MaxRowLimit:      val.MaxRowLimit,
+			CheckInterval:    val.CheckInterval,
+			RewriteInterval:  val.RewriteInterval,
+			WriteOnly:        val.WriteOnly,
+			QueryWeight:      val.QueryWeight,
+			SyncPolicy:       val.SyncPolicy,
+			SyncInterval:     val.SyncInterval,
+			MaxBufferAge:     val.MaxBufferAge,
+			MaxBufferBytes:   val.MaxBufferBytes,
+			FlushConcurrency: val.FlushConcurrency,
+			MinRowLimit:      val.MinRowLimit,
+			SlowWrite:        val.SlowWrite,
+			WriteRetries:     val.WriteRetries,
+			RetryBackoff:     val.RetryBackoff,
+			DropBadBatch:     val.DropBadBatch,
+			DedupPoints:      val.DedupPoints,
+			DedupWarn:        val.DedupWarn,
+			DeadLetter:       val.DeadLetter,
+			DeadLetterSize:   val.DeadLetterSize,
+			Shadow:           val.Shadow,
+			ShadowSpool:      val.ShadowSpool,
+			ForcePrecision:   val.ForcePrecision,
+			FailoverWebhook:  val.FailoverWebhook,
+			SpoolCommitDelay: val.SpoolCommitDelay,
+			SpoolCommitBytes: val.SpoolCommitBytes,
+			SpoolOnFailure:   val.SpoolOnFailure,
+			SpoolFormat:      val.SpoolFormat,
+			Headers:          val.Headers,
+			UserAgent:        val.UserAgent,
+			HTTP2:            val.HTTP2,
+			BasicAuth:        val.BasicAuth,
+
+			CreateDatabase:     val.CreateDatabase,
+			CreateDatabaseWith: val.CreateDatabaseWith,
+			RewriteConcurrency: val.RewriteConcurrency,
 		}
 		if cfg.Interval == 0 {
 			cfg.Interval = 1000
@@ -114,6 +390,61 @@ func (fcs *FileConfigSource) LoadBackends() (backends map[string]*BackendConfig,
 		if cfg.RewriteInterval == 0 {
 			cfg.RewriteInterval = 10000
 		}
+		switch cfg.SyncPolicy {
+		case "":
+			cfg.SyncPolicy = SYNC_ALWAYS
+		case SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER:
+		default:
+			logs.Errorf("unknown sync policy %s of backend %s", cfg.SyncPolicy, name)
+			err = ErrIllegalConfig
+			return
+		}
+		switch cfg.SpoolFormat {
+		case "":
+			cfg.SpoolFormat = SPOOL_FRAME
+		case SPOOL_FRAME, SPOOL_GZIP:
+		default:
+			logs.Errorf("unknown spool format %s of backend %s", cfg.SpoolFormat, name)
+			err = ErrIllegalConfig
+			return
+		}
+		if cfg.SyncInterval == 0 {
+			cfg.SyncInterval = 1000
+		}
+		if cfg.SpoolCommitDelay < 0 || cfg.SpoolCommitBytes < 0 {
+			logs.Errorf("spool commit delay and bytes of backend %s should not be negative", name)
+			err = ErrIllegalConfig
+			return
+		}
+		if cfg.MaxBufferBytes < 0 {
+			logs.Errorf("maxbufferbytes %d of backend %s is negative", cfg.MaxBufferBytes, name)
+			err = ErrIllegalConfig
+			return
+		}
+		if cfg.MinRowLimit > cfg.MaxRowLimit {
+			logs.Errorf("minrowlimit %d of backend %s is larger than maxrowlimit %d", cfg.MinRowLimit, name, cfg.MaxRowLimit)
+			err = ErrIllegalConfig
+			return
+		}
+		// negative to disable the in-line retry.
+		if cfg.WriteRetries == 0 {
+			cfg.WriteRetries = DEFAULT_WRITE_RETRIES
+		}
+		if cfg.RetryBackoff == 0 {
+			cfg.RetryBackoff = DEFAULT_RETRY_BACKOFF
+		}
+		if cfg.FlushConcurrency == 0 {
+			cfg.FlushConcurrency = DEFAULT_FLUSH_CONCURRENCY
+		}
+		if _, ok := normalPrecision(cfg.ForcePrecision); !ok {
+			logs.Errorf("unknown precision %s of backend %s", cfg.ForcePrecision, name)
+			err = ErrIllegalConfig
+			return
+		}
+		// shadow backends are never queried.
+		if cfg.Shadow != 0 {
+			cfg.WriteOnly = 1
+		}
 		backends[name] = cfg
 	}
 	logs.Debugf("%d backends loaded from file.", len(backends))
@@ -0,0 +1,69 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultiFileConfigSource(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	backends := write("backends.json", `{
+	"BACKENDS": {
+		"b1": {"url": "http://127.0.0.1:8086", "db": "test"},
+		"b2": {"url": "http://127.0.0.1:8087", "db": "test"}
+	},
+	"NODES": {"l1": {"listenaddr": ":6666"}},
+	"DEFAULT_NODE": {"listenaddr": ":7076"}
+}`)
+	keymaps := write("keymaps.json", `{
+	"KEYMAPS": {"test": {"cpu": ["b1"], "_default_": ["b2"]}},
+	"NODES": {"l1": {"listenaddr": ":6667"}}
+}`)
+
+	fcs := NewMultiFileConfigSource([]string{backends, keymaps}, "l1")
+	cfgs, err := fcs.LoadBackends()
+	if err != nil || len(cfgs) != 2 || cfgs["b2"].URL != "http://127.0.0.1:8087" {
+		t.Fatalf("backends should be loaded: %v %v", cfgs, err)
+	}
+	m, _ := fcs.LoadMeasurements()
+	if len(m["test"]["cpu"]) != 1 || m["test"]["cpu"][0] != "b1" || m["test"]["_default_"][0] != "b2" {
+		t.Errorf("keymaps should be loaded: %v", m)
+	}
+	// the later file wins.
+	nodecfg, _ := fcs.LoadNode()
+	if nodecfg.ListenAddr != ":6667" || fcs.DEFAULT_NODE.ListenAddr != ":7076" {
+		t.Errorf("node of the later file should be used: %s %s", nodecfg.ListenAddr, fcs.DEFAULT_NODE.ListenAddr)
+	}
+
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apis, ok := ic.GetBackends("cpu", "test"); !ok || len(apis) != 1 || apis[0].GetName() != "b1" {
+		t.Errorf("cpu should be routed to b1: %v", apis)
+	}
+
+	// a dangling backend fails the reload, the config is kept.
+	write("keymaps.json", `{"KEYMAPS": {"test": {"cpu": ["b3"]}}}`)
+	if err = fcs.Reload(); err != ErrIllegalConfig {
+		t.Errorf("dangling backend should be rejected: %v", err)
+	}
+	if m, _ = fcs.LoadMeasurements(); m["test"]["cpu"][0] != "b1" {
+		t.Errorf("config should be kept: %v", m)
+	}
+}
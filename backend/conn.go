@@ -0,0 +1,159 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const CONN_WINDOW = time.Minute
+
+// ConnStats 到后端的连接统计, NewPerMinute 为最近一分钟新建的连接数,
+// Proto 为最近一次连接协商的协议, h2 或 http/1.1
+type ConnStats struct {
+	HTTP2        bool    `json:"http2"`
+	Proto        string  `json:"proto,omitempty"`
+	NewConns     int64   `json:"new_conns"`
+	ReusedConns  int64   `json:"reused_conns"`
+	NewPerMinute float64 `json:"new_conns_per_minute"`
+}
+
+// connTrace 用 httptrace 统计连接, 新建的连接按 quotaWindow 的方式估计每分钟的数量
+type connTrace struct {
+	lock  sync.Mutex
+	start time.Time
+	prev  float64
+	cur   float64
+	proto atomic.Value
+	trace *httptrace.ClientTrace
+}
+
+func newConnTrace(stats *BackendStatistics) (ct *connTrace) {
+	ct = &connTrace{start: time.Now().Truncate(CONN_WINDOW)}
+	ct.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&stats.ReusedConns, 1)
+				return
+			}
+			atomic.AddInt64(&stats.NewConns, 1)
+			ct.add(time.Now())
+			proto := "http/1.1"
+			if conn, ok := info.Conn.(*tls.Conn); ok && conn.ConnectionState().NegotiatedProtocol == "h2" {
+				proto = "h2"
+			}
+			ct.proto.Store(proto)
+		},
+	}
+	return
+}
+
+func (ct *connTrace) slide(now time.Time) {
+	elapsed := now.Sub(ct.start)
+	switch {
+	case elapsed < CONN_WINDOW:
+		return
+	case elapsed < 2*CONN_WINDOW:
+		ct.prev = ct.cur
+	default:
+		ct.prev = 0
+	}
+	ct.cur = 0
+	ct.start = now.Truncate(CONN_WINDOW)
+}
+
+func (ct *connTrace) add(now time.Time) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.slide(now)
+	ct.cur++
+}
+
+// perMinute 最近一分钟新建的连接数
+func (ct *connTrace) perMinute(now time.Time) float64 {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.slide(now)
+	weight := 1 - float64(now.Sub(ct.start))/float64(CONN_WINDOW)
+	return ct.prev*weight + ct.cur
+}
+
+// traced 返回带连接统计的 req
+func (hb *HttpBackend) traced(req *http.Request) *http.Request {
+	if hb.conns == nil {
+		return req
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), hb.conns.trace))
+}
+
+// newTransport 后端的 transport, http2 为 false 时只用 HTTP/1.1.
+// 开启时通过 TLS ALPN 协商, 后端不支持 h2 时自动回到 HTTP/1.1, 明文连接总是 HTTP/1.1.
+// socket 不为空时连接这个 unix socket
+func newTransport(http2 bool, socket string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = http2
+	if !http2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return transport
+}
+
+// base 请求 URL 的前缀, unix socket 的 host 没有意义
+func (hb *HttpBackend) base() string {
+	if hb.socket != "" {
+		return "http://unix"
+	}
+	return hb.URL
+}
+
+// unixSocket 返回 unix:///path/to/socket 形式的 URL 中 socket 的路径, 其他 URL 返回空
+func unixSocket(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "unix" {
+		return ""
+	}
+	return u.Path
+}
+
+// ConnStats 返回连接统计
+func (hb *HttpBackend) ConnStats() (stats ConnStats) {
+	stats.HTTP2 = hb.http2
+	stats.NewConns = atomic.LoadInt64(&hb.stats.NewConns)
+	stats.ReusedConns = atomic.LoadInt64(&hb.stats.ReusedConns)
+	if hb.conns != nil {
+		stats.NewPerMinute = hb.conns.perMinute(time.Now())
+		stats.Proto, _ = hb.conns.proto.Load().(string)
+	}
+	return
+}
+
+// connStats 返回各后端的连接统计
+func (ic *InfluxCluster) connStats() (conns map[string]ConnStats) {
+	ic.lock.RLock()
+	backends := ic.backends
+	ic.lock.RUnlock()
+	conns = make(map[string]ConnStats, len(backends))
+	for name, api := range backends {
+		if bs, ok := api.(*Backends); ok {
+			conns[name] = bs.ConnStats()
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHttpBackendHTTP2(t *testing.T) {
+	newServer := func(h2 bool) *httptest.Server {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(204)
+		}))
+		ts.EnableHTTP2 = h2
+		ts.StartTLS()
+		return ts
+	}
+
+	tests := []struct {
+		server bool
+		client bool
+		proto  string
+	}{
+		{true, true, "h2"},
+		// falls back to HTTP/1.1.
+		{false, true, "http/1.1"},
+		{true, false, "http/1.1"},
+	}
+	for _, tt := range tests {
+		ts := newServer(tt.server)
+		hb := &HttpBackend{http2: tt.client}
+		hb.conns = newConnTrace(&hb.stats)
+		transport := newTransport(tt.client, "")
+		transport.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		client := &http.Client{Transport: transport}
+
+		for i := 0; i < 3; i++ {
+			req, _ := http.NewRequest("GET", ts.URL+"/ping", nil)
+			resp, err := client.Do(hb.traced(req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if (resp.ProtoMajor == 2) != (tt.proto == "h2") {
+				t.Errorf("%v: proto wrong: %s", tt, resp.Proto)
+			}
+		}
+		stats := hb.ConnStats()
+		if stats.HTTP2 != tt.client || stats.Proto != tt.proto || stats.NewConns != 1 || stats.ReusedConns != 2 || stats.NewPerMinute != 1 {
+			t.Errorf("%v: conn stats wrong: %+v", tt, stats)
+		}
+		transport.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestConnTraceWindow(t *testing.T) {
+	ct := newConnTrace(&BackendStatistics{})
+	start := time.Now().Truncate(CONN_WINDOW)
+	ct.start = start
+	for i := 0; i < 6; i++ {
+		ct.add(start.Add(time.Second))
+	}
+	if n := ct.perMinute(start.Add(2 * time.Second)); n != 6 {
+		t.Errorf("per minute wrong: %v", n)
+	}
+	// half of the last minute is still in the window.
+	if n := ct.perMinute(start.Add(CONN_WINDOW + CONN_WINDOW/2)); n != 3 {
+		t.Errorf("per minute wrong: %v", n)
+	}
+	if n := ct.perMinute(start.Add(3 * CONN_WINDOW)); n != 0 {
+		t.Errorf("per minute wrong: %v", n)
+	}
+}
+
+func TestInfluxdbClusterConnStats(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.backends = map[string]BackendAPI{"test": bs}
+
+	bs.Ping()
+	bs.Ping()
+	stats := ic.Stats().Connections["test"]
+	if !stats.HTTP2 || stats.NewConns < 1 || stats.ReusedConns < 1 || stats.Proto != "http/1.1" {
+		t.Errorf("conn stats wrong: %+v", stats)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	DEFAULT_CORS_METHODS = "GET, POST, OPTIONS"
+	DEFAULT_CORS_HEADERS = "Accept, Authorization, Content-Type, Content-Encoding"
+)
+
+type corsRules struct {
+	origins []string
+	methods string
+	headers string
+}
+
+func newCorsRules(nodecfg *NodeConfig) (cors *corsRules) {
+	if len(nodecfg.CorsOrigins) == 0 {
+		return nil
+	}
+	cors = &corsRules{
+		origins: nodecfg.CorsOrigins,
+		methods: strings.Join(nodecfg.CorsMethods, ", "),
+		headers: strings.Join(nodecfg.CorsHeaders, ", "),
+	}
+	if cors.methods == "" {
+		cors.methods = DEFAULT_CORS_METHODS
+	}
+	if cors.headers == "" {
+		cors.headers = DEFAULT_CORS_HEADERS
+	}
+	return
+}
+
+// matchOrigin 判断 origin 是否匹配 pattern, pattern 中可以有一个 * 匹配任意字符串,
+// 例如 * 或者 https://*.example.com
+func matchOrigin(pattern, origin string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == origin
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+func (cors *corsRules) allowed(origin string) bool {
+	for _, pattern := range cors.origins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS 给匹配 CorsOrigins 的请求加上 CORS 头, 不匹配的请求照常处理, 只是没有 CORS 头.
+// 返回 true 表示是已经应答的预检请求.
+func (ic *InfluxCluster) CORS(w http.ResponseWriter, req *http.Request) (preflight bool) {
+	if ic.cors == nil {
+		return false
+	}
+	preflight = req.Method == "OPTIONS"
+	origin := req.Header.Get("Origin")
+	if origin != "" {
+		// the response differs by origin.
+		w.Header().Add("Vary", "Origin")
+	}
+	if origin != "" && ic.cors.allowed(origin) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", ic.cors.methods)
+			h.Set("Access-Control-Allow-Headers", ic.cors.headers)
+		}
+	}
+	if preflight {
+		w.WriteHeader(204)
+	}
+	return
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		pattern, origin string
+		match           bool
+	}{
+		{"*", "http://localhost:3000", true},
+		{"https://grafana.example.com", "https://grafana.example.com", true},
+		{"https://grafana.example.com", "https://grafana.example.com.evil.io", false},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "http://a.example.com", false},
+	}
+	for _, tt := range tests {
+		if matchOrigin(tt.pattern, tt.origin) != tt.match {
+			t.Errorf("%s match %s should be %v", tt.pattern, tt.origin, tt.match)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{CorsOrigins: []string{"https://*.example.com"}}, ".")
+
+	req, _ := http.NewRequest("OPTIONS", "http://localhost:8086/query", nil)
+	req.Header.Set("Origin", "https://grafana.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	if !ic.CORS(w, req) || w.Code != 204 {
+		t.Errorf("preflight should be answered: %d", w.Code)
+	}
+	h := w.Header()
+	if h.Get("Access-Control-Allow-Origin") != "https://grafana.example.com" ||
+		h.Get("Access-Control-Allow-Methods") != DEFAULT_CORS_METHODS || h.Get("Access-Control-Allow-Headers") != DEFAULT_CORS_HEADERS {
+		t.Errorf("preflight headers wrong: %v", h)
+	}
+
+	// normal request, handled by the caller.
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query", nil)
+	req.Header.Set("Origin", "https://grafana.example.com")
+	w = httptest.NewRecorder()
+	if ic.CORS(w, req) || w.Header().Get("Access-Control-Allow-Origin") != "https://grafana.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("allow origin should be attached: %v", w.Header())
+	}
+
+	// disallowed origin, answered without cors headers.
+	req.Header.Set("Origin", "https://evil.io")
+	w = httptest.NewRecorder()
+	if ic.CORS(w, req) || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("disallowed origin should get no cors headers: %v", w.Header())
+	}
+
+	// disabled.
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	req, _ = http.NewRequest("OPTIONS", "http://localhost:8086/query", nil)
+	req.Header.Set("Origin", "https://grafana.example.com")
+	w = httptest.NewRecorder()
+	if ic.CORS(w, req) || len(w.Header()) != 0 {
+		t.Errorf("cors should be disabled: %v", w.Header())
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// createDatabaseQuery 返回创建 db 的语句, with 为 WITH 之后的保留策略
+func createDatabaseQuery(db, with string) string {
+	q := fmt.Sprintf(`CREATE DATABASE "%s"`, strings.ReplaceAll(db, `"`, `\"`))
+	if with = strings.TrimSpace(with); with != "" {
+		q += " WITH " + with
+	}
+	return q
+}
+
+// createDatabase 在后端执行 createDB, db 已经存在时也会成功. 失败时只记日志, 不改变后端的状态,
+// 下次健康检查时重试
+func (hb *HttpBackend) createDatabase() (err error) {
+	q := url.Values{}
+	q.Set("q", hb.createDB)
+	req, err := http.NewRequest("POST", hb.base()+"/query", strings.NewReader(q.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hb.basicAuth(req)
+	hb.setHeaders(req)
+
+	resp, err := hb.client.Do(hb.traced(req))
+	if err != nil {
+		logs.Errorf("create database %s on %s error: %s", hb.DB, hb.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logs.Errorf("create database %s on %s error: %s", hb.DB, hb.URL, err)
+		return
+	}
+
+	msg := statementError(body)
+	if resp.StatusCode/100 != 2 || msg != "" {
+		err = errors.New(strings.TrimSpace(fmt.Sprintf("status %d %s", resp.StatusCode, msg)))
+		logs.Errorf("create database %s on %s error: %s", hb.DB, hb.URL, err)
+		return
+	}
+	logs.Infof("%s on %s", hb.createDB, hb.URL)
+	return
+}
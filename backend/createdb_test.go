@@ -0,0 +1,82 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpBackendCreateDatabase(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	// 1 to fail the creation, 2 to fail the pings too.
+	var failing int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case atomic.LoadInt32(&failing) == 2:
+			// a dead backend, the connection is closed.
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+		case req.URL.Path == "/ping":
+			w.WriteHeader(204)
+		case atomic.LoadInt32(&failing) == 1:
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0,"error":"database is read only"}]}`))
+		default:
+			lock.Lock()
+			queries = append(queries, req.FormValue("q"))
+			lock.Unlock()
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		}
+	}))
+	defer ts.Close()
+	created := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), queries...)
+	}
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.CheckInterval = 20
+	cfg.CreateDatabase = 1
+	cfg.CreateDatabaseWith = `DURATION 30d NAME "month"`
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+
+	// failures are retried, the backend stays active.
+	time.Sleep(100 * time.Millisecond)
+	if !hb.IsActive() || len(created()) != 0 {
+		t.Errorf("failed creation should not make the backend inactive: %v %v", hb.IsActive(), created())
+	}
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(100 * time.Millisecond)
+	if q := created(); len(q) != 1 || q[0] != `CREATE DATABASE "test" WITH DURATION 30d NAME "month"` {
+		t.Errorf("db should be created once: %v", q)
+	}
+
+	// created again when the backend comes back.
+	atomic.StoreInt32(&failing, 2)
+	time.Sleep(100 * time.Millisecond)
+	if hb.IsActive() {
+		t.Errorf("backend should be inactive")
+	}
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(100 * time.Millisecond)
+	if q := created(); len(q) != 2 || !hb.IsActive() {
+		t.Errorf("db should be created again: %v", q)
+	}
+
+	if q := createDatabaseQuery(`my"db`, ""); q != `CREATE DATABASE "my\"db"` {
+		t.Errorf("query wrong: %s", q)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// DBStatistics 单个 db 的计数, 写入监控库时读取并清零
+type DBStatistics struct {
+	QueryRequests     int64
+	QueryRequestsFail int64
+	WriteRequests     int64
+	WriteRequestsFail int64
+	PointsWritten     int64
+	PointsWrittenFail int64
+}
+
+// discardDBStats 没有配置的 db 和内部写入的统计, 不输出
+var discardDBStats DBStatistics
+
+// swapFields 返回写入监控库的统计字段, 字段名同总的统计, 读取后清零
+func (s *DBStatistics) swapFields() map[string]interface{} {
+	return map[string]interface{}{
+		"statQueryRequest":      atomic.SwapInt64(&s.QueryRequests, 0),
+		"statQueryRequestFail":  atomic.SwapInt64(&s.QueryRequestsFail, 0),
+		"statWriteRequest":      atomic.SwapInt64(&s.WriteRequests, 0),
+		"statWriteRequestFail":  atomic.SwapInt64(&s.WriteRequestsFail, 0),
+		"statPointsWritten":     atomic.SwapInt64(&s.PointsWritten, 0),
+		"statPointsWrittenFail": atomic.SwapInt64(&s.PointsWrittenFail, 0),
+	}
+}
+
+// setDBStats 按 KEYMAPS 的 db 建立计数, 在 LoadConfig 时调用. 保留的 db 沿用原来的计数,
+// 之后只读, 写入和查询时不用加锁. _default_ 匹配的 db 不单独计数
+func (ic *InfluxCluster) setDBStats(m2bs map[string]map[string][]BackendAPI) {
+	orig, _ := ic.dbStats.Load().(map[string]*DBStatistics)
+	stats := make(map[string]*DBStatistics, len(m2bs))
+	for db := range m2bs {
+		if db == "_default_" {
+			continue
+		}
+		if s, ok := orig[db]; ok {
+			stats[db] = s
+			continue
+		}
+		stats[db] = &DBStatistics{}
+	}
+	ic.dbStats.Store(stats)
+}
+
+// dbStatistics 返回 db 的计数, 没有配置的 db 返回 discardDBStats
+func (ic *InfluxCluster) dbStatistics(db string) *DBStatistics {
+	stats, _ := ic.dbStats.Load().(map[string]*DBStatistics)
+	if s, ok := stats[db]; ok {
+		return s
+	}
+	return &discardDBStats
+}
+
+// writeDBStats 同 writeStats, 返回 db 的计数
+func (ic *InfluxCluster) writeDBStats(ctx context.Context, db string) *DBStatistics {
+	if ctx.Value(internalWriteKey{}) != nil {
+		return &discardDBStats
+	}
+	return ic.dbStatistics(db)
+}
+
+// queryFailed 计入失败的查询, 同时计入 req 的 db
+func (ic *InfluxCluster) queryFailed(req *http.Request) {
+	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+	atomic.AddInt64(&ic.dbStatistics(req.FormValue("db")).QueryRequestsFail, 1)
+}
+
+// sortedDBStats 按 db 名排序返回各 db 的计数
+func (ic *InfluxCluster) sortedDBStats() (dbs []string, stats map[string]*DBStatistics) {
+	stats, _ = ic.dbStats.Load().(map[string]*DBStatistics)
+	for db := range stats {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return
+}
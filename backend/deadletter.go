@@ -0,0 +1,203 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	DEFAULT_DEAD_LETTER_SIZE = 64 * 1024 * 1024
+)
+
+// reasons of dead letters
+const (
+	DEAD_BAD_REQUEST = "bad_request"
+	DEAD_NOT_FOUND   = "not_found"
+	DEAD_TOO_LARGE   = "too_large"
+	DEAD_EXPIRED     = "expired"
+)
+
+var (
+	ErrDeadLetterDisabled = errors.New("dead letter disabled")
+)
+
+// DeadLetter 保存被丢弃的数据, 以 line protocol 追加到 <name>.dead,
+// 超过 maxSize 时轮转到 <name>.dead.1, 只保留一个旧文件.
+type DeadLetter struct {
+	lock     sync.Mutex
+	filename string
+	maxSize  int64
+	file     *os.File
+	size     int64
+}
+
+type DeadLetterInfo struct {
+	Size    int64 `json:"size"`
+	Rotated int64 `json:"rotated"`
+}
+
+func NewDeadLetter(filename string, maxSize int64) (dl *DeadLetter, err error) {
+	dl = &DeadLetter{
+		filename: filename,
+		maxSize:  maxSize,
+	}
+	err = dl.open()
+	return
+}
+
+func (dl *DeadLetter) open() (err error) {
+	dl.file, err = os.OpenFile(dl.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		logs.Errorf("open dead letter error: %s", err)
+		return
+	}
+	stat, err := dl.file.Stat()
+	if err != nil {
+		return
+	}
+	dl.size = stat.Size()
+	return
+}
+
+// Write 追加 line protocol 数据 p, 前面加上记录原因, 时间和精度的注释
+func (dl *DeadLetter) Write(reason, precision string, p []byte) (err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# reason=%s time=%s", reason, time.Now().UTC().Format(time.RFC3339))
+	if precision != "" {
+		fmt.Fprintf(&buf, " precision=%s", precision)
+	}
+	buf.WriteByte('\n')
+	buf.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if dl.size > 0 && dl.size+int64(buf.Len()) > dl.maxSize {
+		err = dl.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err := dl.file.Write(buf.Bytes())
+	dl.size += int64(n)
+	return
+}
+
+// WriteCompressed 同 Write, p 为 gzip 压缩的数据
+func (dl *DeadLetter) WriteCompressed(reason, precision string, p []byte) (err error) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return
+	}
+	defer zip.Close()
+	raw, err := ioutil.ReadAll(zip)
+	if err != nil {
+		return
+	}
+	return dl.Write(reason, precision, raw)
+}
+
+func (dl *DeadLetter) rotate() (err error) {
+	dl.file.Close()
+	err = os.Rename(dl.filename, dl.filename+".1")
+	if err != nil {
+		logs.Errorf("rotate dead letter error: %s", err)
+	}
+	return dl.open()
+}
+
+// Info 当前文件和轮转文件的大小
+func (dl *DeadLetter) Info() (info DeadLetterInfo) {
+	dl.lock.Lock()
+	info.Size = dl.size
+	dl.lock.Unlock()
+	stat, err := os.Stat(dl.filename + ".1")
+	if err == nil {
+		info.Rotated = stat.Size()
+	}
+	return
+}
+
+// Reader 读取当前文件已经写入的内容, 之后追加的数据不包括在内
+func (dl *DeadLetter) Reader() (r io.ReadCloser, size int64, err error) {
+	dl.lock.Lock()
+	size = dl.size
+	dl.lock.Unlock()
+
+	file, err := os.Open(dl.filename)
+	if err != nil {
+		return
+	}
+	r = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, size), file}
+	return
+}
+
+// Truncate 清空当前文件, 删除轮转文件
+func (dl *DeadLetter) Truncate() (err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	err = dl.file.Truncate(0)
+	if err != nil {
+		return
+	}
+	dl.size = 0
+	err = os.Remove(dl.filename + ".1")
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+func (dl *DeadLetter) Close() {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	dl.file.Close()
+}
+
+// DeadLetters 各后端 dead letter 文件的大小, 不包括没有开启的后端
+func (ic *InfluxCluster) DeadLetters() (infos map[string]DeadLetterInfo) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	infos = make(map[string]DeadLetterInfo)
+	for name, api := range ic.backends {
+		bs, ok := api.(*Backends)
+		if !ok || bs.DeadLetter() == nil {
+			continue
+		}
+		infos[name] = bs.DeadLetter().Info()
+	}
+	return
+}
+
+// DeadLetter 返回后端 name 的 dead letter 文件
+func (ic *InfluxCluster) DeadLetter(name string) (dl *DeadLetter, err error) {
+	ic.lock.RLock()
+	api, ok := ic.backends[name]
+	ic.lock.RUnlock()
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	bs, ok := api.(*Backends)
+	if !ok || bs.DeadLetter() == nil {
+		return nil, ErrDeadLetterDisabled
+	}
+	return bs.DeadLetter(), nil
+}
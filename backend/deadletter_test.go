@@ -0,0 +1,144 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.dead")
+	dl, err := NewDeadLetter(filename, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+
+	line := []byte("cpu value=1 1434055562000000000")
+	err = dl.Write(DEAD_BAD_REQUEST, "s", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, size, err := dl.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ioutil.ReadAll(r)
+	r.Close()
+	lines := strings.Split(string(p), "\n")
+	if int64(len(p)) != size || len(lines) != 3 || lines[1] != string(line) ||
+		!strings.HasPrefix(lines[0], "# reason=bad_request time=") || !strings.HasSuffix(lines[0], " precision=s") {
+		t.Errorf("dead letter wrong: %d %q", size, p)
+	}
+
+	// over the cap, rotated.
+	err = dl.Write(DEAD_NOT_FOUND, "", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := dl.Info()
+	if info.Rotated != size || info.Size == 0 || info.Size >= 100 {
+		t.Errorf("dead letter should be rotated: %+v", info)
+	}
+
+	err = dl.Truncate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := dl.Info(); info.Size != 0 || info.Rotated != 0 {
+		t.Errorf("dead letter should be truncated: %+v", info)
+	}
+	dl.Write(DEAD_EXPIRED, "", line)
+	reopen, err := NewDeadLetter(filename, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopen.Close()
+	if reopen.Info().Size != dl.Info().Size {
+		t.Errorf("size should be kept after reopen: %+v %+v", reopen.Info(), dl.Info())
+	}
+}
+
+func TestDeadLetterBackends(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer notFound.Close()
+
+	read := func(bs *Backends) string {
+		r, _, err := bs.DeadLetter().Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		p, _ := ioutil.ReadAll(r)
+		return string(p)
+	}
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.MaxBufferAge = 1
+	cfg.DeadLetter = 1
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// bad lines found by bisection.
+	bs.sendBatch([]byte("cpu value=1 1434055562000000000\ncpu value=\n"), "", true)
+	if p := read(bs); !strings.Contains(p, "# reason=bad_request") || !strings.HasSuffix(p, "\ncpu value=\n") {
+		t.Errorf("bad line should be kept: %q", p)
+	}
+	bs.DeadLetter().Truncate()
+
+	// expired in the spool.
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=2 1434055562000000000\n"))
+	bs.fb.Write(buf.Bytes())
+	time.Sleep(10 * time.Millisecond)
+	bs.Rewrite()
+	if p := read(bs); !strings.Contains(p, "# reason=expired") || !strings.HasSuffix(p, "\ncpu value=2 1434055562000000000\n") {
+		t.Errorf("expired batch should be kept: %q", p)
+	}
+
+	// db not found.
+	cfg.URL = notFound.URL
+	nf, err := NewBackends(cfg, "notfound", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nf.Close()
+	nf.sendBatch([]byte("cpu value=3 1434055562000000000\n"), "", true)
+	if p := read(nf); !strings.Contains(p, "# reason=not_found") || !strings.HasSuffix(p, "\ncpu value=3 1434055562000000000\n") {
+		t.Errorf("batch of not found should be kept: %q", p)
+	}
+
+	// disabled by default.
+	cfg.DeadLetter = 0
+	off, err := NewBackends(cfg, "off", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer off.Close()
+	if off.DeadLetter() != nil {
+		t.Errorf("dead letter should be disabled")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// dedupBatch 合并 batch 中 series 和时间戳相同的点, 同 InfluxDB, 同名的 field 后写的覆盖先写的.
+// 合并后的点在第一次出现的位置, 返回合并后的 batch 和被合并掉的行数. 没有重复时原样返回 p.
+func dedupBatch(p []byte) (out []byte, collisions int) {
+	lines := bytes.Split(p, []byte{'\n'})
+	seen := make(map[string]int, len(lines))
+	merged := make(map[int][][]byte)
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		_, fields, ts := splitLine(line)
+		if len(ts) == 0 {
+			keep[i] = true
+			continue
+		}
+		key := string(canonicalSeries(line)) + " " + string(ts)
+		first, ok := seen[key]
+		if !ok {
+			seen[key] = i
+			keep[i] = true
+			continue
+		}
+		collisions++
+		if merged[first] == nil {
+			_, ffields, _ := splitLine(lines[first])
+			merged[first] = splitFields(ffields)
+		}
+		merged[first] = mergeFields(merged[first], splitFields(fields))
+	}
+	if collisions == 0 {
+		return p, 0
+	}
+
+	out = make([]byte, 0, len(p))
+	for i, line := range lines {
+		if !keep[i] {
+			continue
+		}
+		fields, ok := merged[i]
+		if !ok {
+			out = append(out, line...)
+			out = append(out, '\n')
+			continue
+		}
+		series, _, ts := splitLine(line)
+		out = append(out, series...)
+		out = append(out, ' ')
+		out = append(out, bytes.Join(fields, []byte{','})...)
+		out = append(out, ' ')
+		out = append(out, ts...)
+		out = append(out, '\n')
+	}
+	return
+}
+
+// splitFields 按逗号分开 field, 处理转义和带引号的字符串字段
+func splitFields(fields []byte) (kvs [][]byte) {
+	start := 0
+	quoted := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				kvs = append(kvs, fields[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(kvs, fields[start:])
+}
+
+// fieldKey 返回 key=value 中的 key
+func fieldKey(kv []byte) []byte {
+	for i := 0; i < len(kv); i++ {
+		switch kv[i] {
+		case '\\':
+			i++
+		case '=':
+			return kv[:i]
+		}
+	}
+	return kv
+}
+
+// mergeFields 把 later 合并到 kvs, 同名的 field 用 later 的值
+func mergeFields(kvs, later [][]byte) [][]byte {
+	for _, kv := range later {
+		replaced := false
+		for i := range kvs {
+			if bytes.Equal(fieldKey(kvs[i]), fieldKey(kv)) {
+				kvs[i] = kv
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			kvs = append(kvs, kv)
+		}
+	}
+	return kvs
+}
+
+// dedup 开启 DedupPoints 时合并 batch 中重复的点, 计入 DuplicatePoints
+func (bs *Backends) dedup(p []byte) []byte {
+	if !bs.DedupPoints {
+		return p
+	}
+	out, collisions := dedupBatch(p)
+	if collisions == 0 {
+		return p
+	}
+	atomic.AddInt64(&bs.stats.DuplicatePoints, int64(collisions))
+	if bs.DedupWarn {
+		logs.Warningf("backend %s merged %d points of the same series and timestamp", bs.Name, collisions)
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDedupBatch(t *testing.T) {
+	batch := strings.Join([]string{
+		"cpu,host=a,region=x value=1,idle=5 1434055562000000000",
+		"mem,host=a used=1 1434055562000000000",
+		"cpu,region=x,host=a value=2 1434055562000000000",
+		"cpu,host=a,region=x value=3 1434055562000000001",
+		`cpu,host=a,region=x msg="a,b=c",value=4 1434055562000000000`,
+		"mem,host=a used=2 1434055562000000000",
+	}, "\n") + "\n"
+	out, collisions := dedupBatch([]byte(batch))
+	want := strings.Join([]string{
+		`cpu,host=a,region=x value=4,idle=5,msg="a,b=c" 1434055562000000000`,
+		"mem,host=a used=2 1434055562000000000",
+		"cpu,host=a,region=x value=3 1434055562000000001",
+	}, "\n") + "\n"
+	if collisions != 3 || string(out) != want {
+		t.Errorf("points should be merged: %d\n%s", collisions, out)
+	}
+
+	batch = "cpu value=1 1434055562000000000\ncpu value=1 1434055562000000001\n"
+	if out, collisions = dedupBatch([]byte(batch)); collisions != 0 || string(out) != batch {
+		t.Errorf("batch without duplicates should be kept: %d %s", collisions, out)
+	}
+}
+
+func TestBackendsDedupPoints(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.DedupPoints = 1
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	bs.Write([]byte("cpu value=1 1434055562000000000\n"))
+	bs.Write([]byte("cpu value=2 1434055562000000000\n"))
+	bs.Write([]byte("cpu value=3 1434055562000000001\n"))
+	bs.FlushBuffer()
+	bs.wg.Wait()
+
+	if strings.Join(si.lines, "\n") != "cpu value=2 1434055562000000000\ncpu value=3 1434055562000000001" {
+		t.Errorf("duplicate points should be merged: %v", si.lines)
+	}
+	if stats := bs.GetStats(); stats.DuplicatePoints != 1 {
+		t.Errorf("duplicate points wrong: %d", stats.DuplicatePoints)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	DRAIN_DRAINING = "draining"
+	DRAIN_DRAINED  = "drained"
+)
+
+var (
+	ErrNotDraining  = errors.New("backend is not draining")
+	ErrAllDraining  = errors.New("all backends of the measurement are draining")
+	ErrNotSpoolable = errors.New("backend has no spool")
+)
+
+// DrainStatus 下线中的后端状态, 管道, 缓冲和备份文件都空了以后为 drained
+type DrainStatus struct {
+	Backend string    `json:"backend"`
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+	// rows waiting in the channel and batches being sent.
+	Queued  int   `json:"queued"`
+	Backlog int64 `json:"backlog_bytes"`
+	// spooled bytes abandoned by force.
+	Dropped int64 `json:"dropped_bytes"`
+}
+
+type drainJob struct {
+	started time.Time
+	dropped int64
+}
+
+// drains 下线中的后端, 不再写入, 重新加载配置后仍然生效
+type drains struct {
+	lock sync.Mutex
+	jobs map[string]*drainJob
+	// copy of the names in jobs, read by every written point.
+	names atomic.Value
+}
+
+func newDrains() *drains {
+	d := &drains{jobs: make(map[string]*drainJob)}
+	d.names.Store(map[string]bool{})
+	return d
+}
+
+func (d *drains) update() {
+	names := make(map[string]bool, len(d.jobs))
+	for name := range d.jobs {
+		names[name] = true
+	}
+	d.names.Store(names)
+}
+
+// exclude 去掉下线中的后端, 没有下线中的后端时直接返回 bs
+func (d *drains) exclude(bs []BackendAPI) []BackendAPI {
+	names := d.names.Load().(map[string]bool)
+	if len(names) == 0 {
+		return bs
+	}
+	writable := make([]BackendAPI, 0, len(bs))
+	for _, b := range bs {
+		if !names[b.GetName()] {
+			writable = append(writable, b)
+		}
+	}
+	return writable
+}
+
+func (ic *InfluxCluster) spoolBackend(name string) (bs *Backends, err error) {
+	ic.lock.RLock()
+	api, ok := ic.backends[name]
+	ic.lock.RUnlock()
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	bs, ok = api.(*Backends)
+	if !ok {
+		return nil, ErrNotSpoolable
+	}
+	return
+}
+
+// StartDrain 停止写入后端 name, 清空缓冲, 由重放协程发完备份文件.
+// force 时丢弃备份文件中剩下的数据. addr 为请求方地址, 记在日志中
+func (ic *InfluxCluster) StartDrain(name string, force bool, addr string) (status DrainStatus, err error) {
+	bs, err := ic.spoolBackend(name)
+	if err != nil {
+		return
+	}
+	ic.drains.lock.Lock()
+	job, ok := ic.drains.jobs[name]
+	if !ok {
+		job = &drainJob{started: time.Now()}
+		ic.drains.jobs[name] = job
+		ic.drains.update()
+		logs.Warningf("drain of backend %s started by %s", name, addr)
+	}
+	ic.drains.lock.Unlock()
+
+	// rows routed before excluded are in the channel, flushed after them.
+	bs.FlushBuffer()
+	if force {
+		bs.wg.Wait()
+		var dropped int64
+		dropped, err = bs.fb.Discard()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&job.dropped, dropped)
+		logs.Warningf("backlog of backend %s dropped by %s, %d bytes", name, addr, dropped)
+	}
+	return ic.DrainStatus(name)
+}
+
+// DrainStatus 返回后端 name 的下线状态
+func (ic *InfluxCluster) DrainStatus(name string) (status DrainStatus, err error) {
+	ic.drains.lock.Lock()
+	job, ok := ic.drains.jobs[name]
+	ic.drains.lock.Unlock()
+	if !ok {
+		return status, ErrNotDraining
+	}
+	bs, err := ic.spoolBackend(name)
+	if err != nil {
+		return
+	}
+	status = DrainStatus{
+		Backend: name,
+		State:   DRAIN_DRAINING,
+		Started: job.started,
+		Queued:  bs.Pending(),
+		Backlog: bs.fb.Backlog(),
+		Dropped: atomic.LoadInt64(&job.dropped),
+	}
+	if status.Queued == 0 && status.Backlog == 0 {
+		status.State = DRAIN_DRAINED
+	}
+	return
+}
+
+// StopDrain 重新开始写入后端 name
+func (ic *InfluxCluster) StopDrain(name string, addr string) (err error) {
+	ic.drains.lock.Lock()
+	defer ic.drains.lock.Unlock()
+	if _, ok := ic.drains.jobs[name]; !ok {
+		return ErrNotDraining
+	}
+	delete(ic.drains.jobs, name)
+	ic.drains.update()
+	logs.Warningf("drain of backend %s stopped by %s", name, addr)
+	return
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInfluxdbClusterDrain(t *testing.T) {
+	var status int32 = 503
+	var lock sync.Mutex
+	var written []string
+	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		code := int(atomic.LoadInt32(&status))
+		if code == 204 {
+			var body io.Reader = req.Body
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				body, _ = gzip.NewReader(req.Body)
+			}
+			p, _ := ioutil.ReadAll(body)
+			lock.Lock()
+			written = append(written, string(p))
+			lock.Unlock()
+		}
+		w.WriteHeader(code)
+	}))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts2.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	cfg := fmt.Sprintf(`{
+	"BACKENDS": {
+		"b1": {"url": %q, "db": "test", "interval": 10, "rewriteinterval": 50, "writeretries": -1},
+		"b2": {"url": %q, "db": "test", "interval": 10}
+	},
+	"KEYMAPS": {"test": {"cpu": ["b1", "b2"], "mem": ["b1"]}},
+	"NODES": {"l1": {}}
+}`, ts1.URL, ts2.URL)
+	err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := ic.backends["b1"].(*Backends)
+
+	wait := func(cond func() bool) {
+		for i := 0; i < 300 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err = ic.DrainStatus("b1"); err != ErrNotDraining {
+		t.Errorf("backend should not be draining: %v", err)
+	}
+	ic.Write([]byte("cpu value=1 1434055562000000000\n"), "ns", "test")
+	wait(func() bool { return b1.fb.Backlog() > 0 })
+
+	st, err := ic.StartDrain("b1", false, "127.0.0.1:1234")
+	if err != nil || st.State != DRAIN_DRAINING || st.Backlog == 0 {
+		t.Errorf("spooled data should be drained: %+v %v", st, err)
+	}
+	ic.Write([]byte("cpu value=2 1434055562000000000\n"), "ns", "test")
+	if err = ic.Write([]byte("mem value=2 1434055562000000000\n"), "ns", "test"); err != nil {
+		t.Errorf("write error: %v", err)
+	}
+	if ic.stats.PointsWrittenFail != 1 {
+		t.Errorf("measurement only on the draining backend should fail: %d", ic.stats.PointsWrittenFail)
+	}
+
+	atomic.StoreInt32(&status, 204)
+	wait(func() bool {
+		st, _ = ic.DrainStatus("b1")
+		return st.State == DRAIN_DRAINED
+	})
+	lock.Lock()
+	got := strings.Join(written, "")
+	lock.Unlock()
+	if st.State != DRAIN_DRAINED || st.Dropped != 0 || got != "cpu value=1 1434055562000000000\n" {
+		t.Errorf("backlog should be replayed, new writes not routed: %+v %q", st, got)
+	}
+
+	// force abandons the backlog.
+	atomic.StoreInt32(&status, 503)
+	err = ic.StopDrain("b1", "127.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.Write([]byte("cpu value=3 1434055562000000000\n"), "ns", "test")
+	wait(func() bool { return b1.fb.Backlog() > 0 })
+	st, err = ic.StartDrain("b1", true, "127.0.0.1:1234")
+	if err != nil || st.State != DRAIN_DRAINED || st.Dropped == 0 {
+		t.Errorf("force should drop the backlog: %+v %v", st, err)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	STATE_ACTIVE   = "active"
+	STATE_INACTIVE = "inactive"
+
+	DEFAULT_STATE_EVENTS          = 256
+	DEFAULT_STATE_WEBHOOK_RETRIES = 3
+	// per backend and per second.
+	DEFAULT_STATE_WEBHOOK_RATE = 0.1
+	STATE_WEBHOOK_QUEUE        = 64
+	STATE_WEBHOOK_TIMEOUT      = 5 * time.Second
+	STATE_WEBHOOK_BACKOFF      = time.Second
+)
+
+// StateEvent 后端在 active 和 inactive 之间切换的事件
+type StateEvent struct {
+	Backend string    `json:"backend"`
+	URL     string    `json:"url"`
+	Old     string    `json:"old"`
+	New     string    `json:"new"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+	// events of the backend suppressed by the rate limit before this one.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+func stateName(active bool) string {
+	if active {
+		return STATE_ACTIVE
+	}
+	return STATE_INACTIVE
+}
+
+// stateEvents 保存最近的状态事件, 配置了 webhook 时依次 POST 出去.
+// 每个后端按 rate 限速, 被限速的事件合并成最后一个, 之后补发, 所以接收方总能拿到最终状态.
+type stateEvents struct {
+	lock   sync.Mutex
+	ring   []StateEvent
+	next   int
+	full   bool
+	closed bool
+
+	url        string
+	retries    int
+	rate       float64
+	backoff    time.Duration
+	client     *http.Client
+	ch         chan StateEvent
+	done       chan struct{}
+	buckets    map[string]*tokenBucket
+	suppressed map[string]*StateEvent
+	dropped    int64
+}
+
+func newStateEvents(nodecfg *NodeConfig) (se *stateEvents) {
+	se = &stateEvents{
+		ring:       make([]StateEvent, DEFAULT_STATE_EVENTS),
+		url:        nodecfg.StateWebhook,
+		retries:    nodecfg.StateWebhookRetries,
+		rate:       nodecfg.StateWebhookRate,
+		backoff:    STATE_WEBHOOK_BACKOFF,
+		buckets:    make(map[string]*tokenBucket),
+		suppressed: make(map[string]*StateEvent),
+	}
+	if se.retries == 0 {
+		se.retries = DEFAULT_STATE_WEBHOOK_RETRIES
+	}
+	if se.rate <= 0 {
+		se.rate = DEFAULT_STATE_WEBHOOK_RATE
+	}
+	if se.url != "" {
+		se.client = &http.Client{Timeout: STATE_WEBHOOK_TIMEOUT}
+		se.ch = make(chan StateEvent, STATE_WEBHOOK_QUEUE)
+		se.done = make(chan struct{})
+		go se.run()
+	}
+	return
+}
+
+// add 记录一个事件, 不会阻塞
+func (se *stateEvents) add(event StateEvent) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.closed {
+		return
+	}
+	se.ring[se.next] = event
+	se.next = (se.next + 1) % len(se.ring)
+	if se.next == 0 {
+		se.full = true
+	}
+	if se.ch == nil {
+		return
+	}
+
+	if s, ok := se.suppressed[event.Backend]; ok {
+		// a delayed one is waiting, send the latest state with it.
+		event.Suppressed = s.Suppressed + 1
+		event.Old = s.Old
+		*s = event
+		return
+	}
+	tb, ok := se.buckets[event.Backend]
+	if !ok {
+		tb = &tokenBucket{}
+		se.buckets[event.Backend] = tb
+	}
+	wait, ok := tb.take(1, se.rate, time.Now())
+	if ok {
+		se.send(event)
+		return
+	}
+	backend := event.Backend
+	se.suppressed[backend] = &event
+	time.AfterFunc(wait, func() { se.release(backend) })
+}
+
+// release 补发被限速的最后一个事件
+func (se *stateEvents) release(backend string) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	s, ok := se.suppressed[backend]
+	if !ok || se.closed {
+		return
+	}
+	delete(se.suppressed, backend)
+	se.buckets[backend].take(1, se.rate, time.Now())
+	if s.Old == s.New {
+		// flapped back, nothing changed for the receiver.
+		return
+	}
+	se.send(*s)
+}
+
+func (se *stateEvents) send(event StateEvent) {
+	select {
+	case se.ch <- event:
+	default:
+		atomic.AddInt64(&se.dropped, 1)
+		logs.Errorf("state webhook queue is full, drop event of backend %s", event.Backend)
+	}
+}
+
+func (se *stateEvents) run() {
+	defer close(se.done)
+	for event := range se.ch {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		backoff := se.backoff
+		for i := 0; ; i++ {
+			err = se.post(body)
+			if err == nil || i >= se.retries {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			atomic.AddInt64(&se.dropped, 1)
+			logs.Errorf("state webhook of backend %s error: %s", event.Backend, err)
+		}
+	}
+}
+
+func (se *stateEvents) post(body []byte) (err error) {
+	resp, err := se.client.Post(se.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status: %d", resp.StatusCode)
+	}
+	return
+}
+
+// events 返回最近的事件, 旧的在前
+func (se *stateEvents) events() (events []StateEvent) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	events = make([]StateEvent, 0, len(se.ring))
+	if se.full {
+		events = append(events, se.ring[se.next:]...)
+	}
+	return append(events, se.ring[:se.next]...)
+}
+
+// Dropped 没有送达 webhook 的事件数
+func (se *stateEvents) Dropped() int64 {
+	return atomic.LoadInt64(&se.dropped)
+}
+
+// close 发完队列中的事件后退出, 被限速的事件不再补发
+func (se *stateEvents) close() {
+	se.lock.Lock()
+	if se.closed {
+		se.lock.Unlock()
+		return
+	}
+	se.closed = true
+	se.lock.Unlock()
+	if se.ch != nil {
+		close(se.ch)
+		<-se.done
+	}
+}
+
+// Events 返回最近的后端状态事件
+func (ic *InfluxCluster) Events() []StateEvent {
+	return ic.events.events()
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStateEvents(t *testing.T) {
+	var posts int32
+	var lock sync.Mutex
+	var events []StateEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the first post fails and is retried.
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		var event StateEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer hook.Close()
+
+	se := newStateEvents(&NodeConfig{StateWebhook: hook.URL, StateWebhookRate: 1})
+	se.backoff = 10 * time.Millisecond
+	flap := func(active bool) {
+		se.add(StateEvent{Backend: "b1", Old: stateName(!active), New: stateName(active), Time: time.Now()})
+	}
+	// the first is sent, the others are merged into the last one.
+	flap(false)
+	flap(true)
+	flap(false)
+	flap(true)
+	se.add(StateEvent{Backend: "b2", Old: STATE_ACTIVE, New: STATE_INACTIVE, Error: "refused"})
+
+	for i := 0; i < 300; i++ {
+		lock.Lock()
+		n := len(events)
+		lock.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	se.close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 3 || events[0].Backend != "b1" || events[0].New != STATE_INACTIVE || events[1].Error != "refused" {
+		t.Fatalf("webhook events wrong: %+v", events)
+	}
+	if last := events[2]; last.Old != STATE_INACTIVE || last.New != STATE_ACTIVE || last.Suppressed != 2 {
+		t.Errorf("suppressed events should be merged: %+v", last)
+	}
+	if ring := se.events(); len(ring) != 5 || ring[4].Backend != "b2" {
+		t.Errorf("all events should be kept in the ring: %+v", ring)
+	}
+	if se.Dropped() != 0 {
+		t.Errorf("retried event should not be dropped: %d", se.Dropped())
+	}
+}
+
+func TestStateEventsRing(t *testing.T) {
+	se := newStateEvents(&NodeConfig{})
+	defer se.close()
+	for i := 0; i < DEFAULT_STATE_EVENTS+10; i++ {
+		se.add(StateEvent{Backend: "b1", Suppressed: i})
+	}
+	events := se.events()
+	if len(events) != DEFAULT_STATE_EVENTS || events[0].Suppressed != 10 || events[len(events)-1].Suppressed != DEFAULT_STATE_EVENTS+9 {
+		t.Errorf("ring should keep the latest events in order: %d %+v", len(events), events[0])
+	}
+}
+
+func TestInfluxdbClusterStateEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	ts.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.events = ic.events
+	bs, err := NewBackends(cfg, "down", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// down at startup, found by the initial check.
+	for i := 0; i < 200 && len(ic.Events()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := ic.Events()
+	if len(events) != 1 || events[0].Backend != "down" || events[0].URL != ts.URL ||
+		events[0].Old != STATE_ACTIVE || events[0].New != STATE_INACTIVE || events[0].Error == "" {
+		t.Errorf("initial check should record the event: %+v", events)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	EXPORT_CHUNK_SIZE = 10000
+)
+
+var (
+	ErrExportBackend = errors.New("backend not found for the measurement")
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+	tagEscaper         = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+	stringEscaper      = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+)
+
+func quoteIdent(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// ExportBackend 选择导出数据的副本, name 为空时选择第一个可查询的副本
+func (ic *InfluxCluster) ExportBackend(db, measurement, name string) (api BackendAPI, err error) {
+	apis, ok := ic.GetBackends(measurement, db)
+	if !ok {
+		return nil, ErrUnknownMeasurement
+	}
+	if name != "" {
+		for _, api = range apis {
+			if api.GetName() == name {
+				return
+			}
+		}
+		return nil, ErrExportBackend
+	}
+	local, remote := ic.queryBackends(apis)
+	apis = append(local, remote...)
+	if len(apis) == 0 {
+		return nil, ErrExportBackend
+	}
+	return apis[0], nil
+}
+
+func exportRequest(db, q string, chunked bool) (req *http.Request, err error) {
+	form := url.Values{}
+	form.Set("q", q)
+	form.Set("db", db)
+	form.Set("epoch", "ns")
+	if chunked {
+		form.Set("chunked", "true")
+		form.Set("chunk_size", fmt.Sprint(EXPORT_CHUNK_SIZE))
+	}
+	req, err = http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	if err != nil {
+		return
+	}
+	req.Form = form
+	return
+}
+
+// fieldTypes 查询 measurement 的字段类型, 用于区分整数和浮点数
+func fieldTypes(api BackendAPI, db, measurement string) (types map[string]string, err error) {
+	req, err := exportRequest(db, "SHOW FIELD KEYS FROM "+quoteIdent(measurement), false)
+	if err != nil {
+		return
+	}
+	_, status, body, err := api.QueryResp(req)
+	if err != nil {
+		return
+	}
+	if status/100 != 2 {
+		return nil, fmt.Errorf("show field keys status %d: %s", status, body)
+	}
+
+	types = make(map[string]string)
+	series, err := GetSeriesArray(body)
+	if err != nil {
+		return
+	}
+	for _, s := range series {
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				continue
+			}
+			key, _ := v[0].(string)
+			typ, _ := v[1].(string)
+			if _, ok := types[key]; !ok {
+				types[key] = typ
+			}
+		}
+	}
+	return
+}
+
+// Export 把 measurement 在 [start, end) 之间的数据转成 line protocol 写到 w,
+// 按 chunk 读取后端的结果, 不缓存全部数据. start 和 end 为空表示不限制.
+func (ic *InfluxCluster) Export(w io.Writer, api BackendAPI, db, measurement, start, end string) (lines int64, err error) {
+	types, err := fieldTypes(api, db, measurement)
+	if err != nil {
+		return
+	}
+
+	var conds []string
+	if start != "" {
+		conds = append(conds, "time >= "+timeCond(start))
+	}
+	if end != "" {
+		conds = append(conds, "time < "+timeCond(end))
+	}
+	q := "SELECT * FROM " + quoteIdent(measurement)
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += " GROUP BY *"
+
+	req, err := exportRequest(db, q, true)
+	if err != nil {
+		return
+	}
+	resp, err := api.QueryStream(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("export status %d: %s", resp.StatusCode, body)
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	for {
+		var chunk statementArray
+		err = dec.Decode(&chunk)
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return
+		}
+		if chunk.Error != "" {
+			return lines, errors.New(chunk.Error)
+		}
+		for _, r := range chunk.Results {
+			if r.Error != "" {
+				return lines, errors.New(r.Error)
+			}
+			for _, s := range r.Series {
+				var n int64
+				n, err = writeSeriesLines(bw, s, types)
+				lines += n
+				if err != nil {
+					return
+				}
+			}
+		}
+		err = bw.Flush()
+		if err != nil {
+			return
+		}
+		logs.Debugf("export %s.%s from %s: %d lines", db, measurement, api.GetName(), lines)
+	}
+}
+
+// writeSeriesLines 把一个 series 转成 line protocol, 跳过为 null 的字段
+func writeSeriesLines(w *bufio.Writer, s seri, types map[string]string) (lines int64, err error) {
+	var prefix strings.Builder
+	prefix.WriteString(measurementEscaper.Replace(s.Name))
+	keys := make([]string, 0, len(s.Tags))
+	for k, v := range s.Tags {
+		// tags of GROUP BY * missing in this series.
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prefix.WriteString(",")
+		prefix.WriteString(tagEscaper.Replace(k))
+		prefix.WriteString("=")
+		prefix.WriteString(tagEscaper.Replace(s.Tags[k]))
+	}
+
+	timeIdx := -1
+	for i, c := range s.Columns {
+		if c == "time" {
+			timeIdx = i
+		}
+	}
+
+	for _, row := range s.Values {
+		fields := 0
+		for i, v := range row {
+			if i == timeIdx || i >= len(s.Columns) || v == nil {
+				continue
+			}
+			if fields == 0 {
+				w.WriteString(prefix.String())
+				w.WriteString(" ")
+			} else {
+				w.WriteString(",")
+			}
+			fields++
+			w.WriteString(tagEscaper.Replace(s.Columns[i]))
+			w.WriteString("=")
+			w.WriteString(formatField(v, types[s.Columns[i]]))
+		}
+		if fields == 0 {
+			continue
+		}
+		if timeIdx >= 0 && timeIdx < len(row) {
+			w.WriteString(" ")
+			w.WriteString(fmt.Sprint(row[timeIdx]))
+		}
+		_, err = w.WriteString("\n")
+		if err != nil {
+			return
+		}
+		lines++
+	}
+	return
+}
+
+func formatField(v interface{}, typ string) string {
+	switch v := v.(type) {
+	case json.Number:
+		switch typ {
+		case "integer":
+			return v.String() + "i"
+		case "unsigned":
+			return v.String() + "u"
+		}
+		return v.String()
+	case string:
+		return "\"" + stringEscaper.Replace(v) + "\""
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// fakeInflux keeps written points in memory, and answers SHOW FIELD KEYS and
+// SELECT * GROUP BY * in chunks of two rows.
+type fakeInflux struct {
+	lock   sync.Mutex
+	points []models.Point
+}
+
+func (fi *fakeInflux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/write":
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, _ = gzip.NewReader(req.Body)
+		}
+		p, _ := io.ReadAll(body)
+		points, err := models.ParsePoints(p)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		fi.lock.Lock()
+		fi.points = append(fi.points, points...)
+		fi.lock.Unlock()
+		w.WriteHeader(204)
+	case "/query":
+		fi.lock.Lock()
+		defer fi.lock.Unlock()
+		enc := json.NewEncoder(w)
+		if strings.HasPrefix(req.FormValue("q"), "SHOW FIELD KEYS") {
+			types := map[string]string{}
+			for _, pt := range fi.points {
+				fields, _ := pt.Fields()
+				for k, v := range fields {
+					switch v.(type) {
+					case float64:
+						types[k] = "float"
+					case int64:
+						types[k] = "integer"
+					case string:
+						types[k] = "string"
+					case bool:
+						types[k] = "boolean"
+					}
+				}
+			}
+			s := seri{Name: "cpu", Columns: []string{"fieldKey", "fieldType"}}
+			for k, v := range types {
+				s.Values = append(s.Values, []interface{}{k, v})
+			}
+			enc.Encode(statementArray{Results: []statement{{Series: []seri{s}}}})
+			return
+		}
+
+		fieldSet, tagSet := map[string]bool{}, map[string]bool{}
+		series := map[string][]models.Point{}
+		for _, pt := range fi.points {
+			fields, _ := pt.Fields()
+			for k := range fields {
+				fieldSet[k] = true
+			}
+			for _, tag := range pt.Tags() {
+				tagSet[string(tag.Key)] = true
+			}
+			key := string(pt.Tags().HashKey())
+			series[key] = append(series[key], pt)
+		}
+		columns := []string{"time"}
+		for k := range fieldSet {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns[1:])
+		for _, points := range series {
+			tags := map[string]string{}
+			for k := range tagSet {
+				tags[k] = points[0].Tags().GetString(k)
+			}
+			for i := 0; i < len(points); i += 2 {
+				end := i + 2
+				if end > len(points) {
+					end = len(points)
+				}
+				s := seri{Name: "cpu", Tags: tags, Columns: columns}
+				for _, pt := range points[i:end] {
+					fields, _ := pt.Fields()
+					row := []interface{}{pt.UnixNano()}
+					for _, c := range columns[1:] {
+						row = append(row, fields[c])
+					}
+					s.Values = append(s.Values, row)
+				}
+				enc.Encode(statementArray{Results: []statement{{Series: []seri{s}}}})
+			}
+		}
+	default:
+		w.WriteHeader(204)
+	}
+}
+
+func sortedLines(s string) []string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	fi := &fakeInflux{}
+	ts := httptest.NewServer(fi)
+	defer ts.Close()
+	fi2 := &fakeInflux{}
+	ts2 := httptest.NewServer(fi2)
+	defer ts2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{KeepPrecision: 1}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.Interval = 50
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	cfg.URL = ts2.URL
+	// exported from test unless it is down.
+	zero := 0
+	cfg.QueryWeight = &zero
+	replica, err := NewBackends(cfg, "replica", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs, replica}}}
+
+	data := strings.Join([]string{
+		"cpu,host=server01,region=us\\ west load=0.5,procs=12i,running=true 1434055562000000000",
+		"cpu,host=server01,region=us\\ west load=1,procs=13i,running=false 1434055563000000000",
+		"cpu,host=server01,region=us\\ west load=1.25 1434055564000000000",
+		"cpu,host=server\\,02\\=a load=2,state=\"idle \\\"now\\\" c:\\\\tmp\" 1434055562000000000",
+		"cpu procs=1i 1434055565000000000",
+	}, "\n") + "\n"
+	job, err := ic.Import(strings.NewReader(data), "test", "ns", false)
+	if err != nil || job.Routed != 5 {
+		t.Fatalf("import wrong: %+v %v", job, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	api, err := ic.ExportBackend("test", "cpu", "")
+	if err != nil || api.GetName() != "test" {
+		t.Fatalf("export backend wrong: %v %v", api, err)
+	}
+	var buf bytes.Buffer
+	lines, err := ic.Export(&buf, api, "test", "cpu", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines != 5 || strings.Join(sortedLines(buf.String()), "\n") != strings.Join(sortedLines(data), "\n") {
+		t.Errorf("round trip wrong: %d\n%s", lines, buf.String())
+	}
+
+	// the replica lost its data, export from it gets nothing.
+	fi2.lock.Lock()
+	fi2.points = nil
+	fi2.lock.Unlock()
+	api, err = ic.ExportBackend("test", "cpu", "replica")
+	if err != nil || api.GetName() != "replica" {
+		t.Fatalf("export backend wrong: %v %v", api, err)
+	}
+	buf.Reset()
+	lines, err = ic.Export(&buf, api, "test", "cpu", "", "")
+	if err != nil || lines != 0 || buf.Len() != 0 {
+		t.Errorf("replica export wrong: %d %v %s", lines, err, buf.String())
+	}
+
+	_, err = ic.ExportBackend("test", "cpu", "unknown")
+	if err != ErrExportBackend {
+		t.Errorf("unknown backend should fail: %v", err)
+	}
+}
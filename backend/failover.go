@@ -0,0 +1,85 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	FAILOVER_WEBHOOK_TIMEOUT = 5 * time.Second
+)
+
+// FailoverEvent 后端进入或退出 failover 时 POST 给 webhook 的内容
+type FailoverEvent struct {
+	Backend  string    `json:"backend"`
+	URL      string    `json:"url"`
+	Failover bool      `json:"failover"`
+	Time     time.Time `json:"time"`
+}
+
+// failoverHook 依次发送 failover 事件, 失败只记录日志
+type failoverHook struct {
+	url    string
+	client *http.Client
+	lock   sync.Mutex
+}
+
+func newFailoverHook(url string) *failoverHook {
+	return &failoverHook{
+		url:    url,
+		client: &http.Client{Timeout: FAILOVER_WEBHOOK_TIMEOUT},
+	}
+}
+
+func (fh *failoverHook) post(event FailoverEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	resp, err := fh.client.Post(fh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logs.Errorf("failover webhook of backend %s error: %s", event.Backend, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logs.Errorf("failover webhook of backend %s status: %d", event.Backend, resp.StatusCode)
+	}
+}
+
+// setFailover 记录数据是否因为后端不可用而落盘, 进入或退出 failover 时通知 webhook
+func (bs *Backends) setFailover(on bool) {
+	var state int64
+	if on {
+		atomic.AddInt64(&bs.stats.Failovers, 1)
+		state = 1
+	}
+	if atomic.SwapInt64(&bs.stats.Failover, state) == state {
+		return
+	}
+	if on {
+		logs.Warningf("backend %s failover, writes are spooled", bs.Name)
+	} else {
+		logs.Infof("backend %s recovered from failover", bs.Name)
+	}
+	if bs.hook != nil {
+		go bs.hook.post(FailoverEvent{
+			Backend:  bs.Name,
+			URL:      bs.URL,
+			Failover: on,
+			Time:     time.Now(),
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendsFailover(t *testing.T) {
+	var status int32 = 503
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	var lock sync.Mutex
+	var events []FailoverEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event FailoverEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		lock.Lock()
+		events = append(events, event)
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer hook.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.WriteRetries = -1
+	cfg.RewriteInterval = 50
+	cfg.FailoverWebhook = hook.URL
+	bs, err := NewBackends(cfg, "failover", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	wait := func(cond func() bool) {
+		for i := 0; i < 200 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	eventsLen := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(events)
+	}
+
+	bs.Write([]byte("cpu value=1 1434055562000000000\n"))
+	wait(func() bool { return eventsLen() == 1 })
+	stats := bs.GetStats()
+	if stats.Failovers == 0 || stats.Failover != 1 || !bs.fb.IsData() {
+		t.Errorf("failed write should fail over to the spool: %+v", stats)
+	}
+
+	atomic.StoreInt32(&status, 204)
+	wait(func() bool { return eventsLen() == 2 })
+	if stats = bs.GetStats(); stats.Failover != 0 || bs.fb.IsData() {
+		t.Errorf("recovery should clear the failover state: %+v", stats)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 2 || !events[0].Failover || events[1].Failover || events[0].Backend != "failover" || events[0].URL != ts.URL {
+		t.Errorf("failover events wrong: %+v", events)
+	}
+}
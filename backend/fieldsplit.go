@@ -0,0 +1,102 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// fieldPart 按 field 拆分出的一行, 写到 KEYMAPS 中 route 的后端
+type fieldPart struct {
+	route string
+	line  []byte
+}
+
+// loadFieldMaps KEYMAPS 中按 field key 拆分的 key, key -> field key -> 写入的 KEYMAPS key
+func loadFieldMaps(nodecfg *NodeConfig) (fieldMaps map[string]map[string]string) {
+	fieldMaps = make(map[string]map[string]string, len(nodecfg.FieldMaps))
+	for key, fields := range nodecfg.FieldMaps {
+		if len(fields) != 0 {
+			fieldMaps[key] = fields
+		}
+	}
+	return
+}
+
+// unescapeFieldKey 去掉 field key 中 "\,", "\=" 和 "\ " 的转义
+func unescapeFieldKey(k []byte) string {
+	if bytes.IndexByte(k, '\\') < 0 {
+		return string(k)
+	}
+	out := make([]byte, 0, len(k))
+	for i := 0; i < len(k); i++ {
+		if k[i] == '\\' && i+1 < len(k) && (k[i+1] == ',' || k[i+1] == '=' || k[i+1] == ' ') {
+			i++
+		}
+		out = append(out, k[i])
+	}
+	return string(out)
+}
+
+// splitByFields 按 FieldMaps 把 measurement 为 key 的行拆成多行, 同一个 route 的 field 在一行中,
+// 按 field 第一次出现的顺序. 没有映射的 field 留在 key 自己的后端.
+// 不需要拆分时返回 nil. 没有时间戳的行拆分前加上当前时间, 各行的时间戳相同.
+func (ic *InfluxCluster) splitByFields(key, db string, line []byte, precision string) (parts []fieldPart) {
+	ic.lock.RLock()
+	n := len(ic.fieldMaps)
+	ic.lock.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	mapped, _, ok := ic.lookupBackends(key, db)
+	if !ok {
+		return nil
+	}
+	ic.lock.RLock()
+	fields := ic.fieldMaps[mapped]
+	ic.lock.RUnlock()
+	if fields == nil {
+		return nil
+	}
+
+	series, fieldSet, ts := splitLine(line)
+	var routes []string
+	groups := make(map[string][][]byte)
+	for _, kv := range splitFields(fieldSet) {
+		route, ok := fields[unescapeFieldKey(fieldKey(kv))]
+		if !ok {
+			route = key
+		}
+		if _, ok := groups[route]; !ok {
+			routes = append(routes, route)
+		}
+		groups[route] = append(groups[route], kv)
+	}
+	if len(routes) == 1 {
+		return []fieldPart{{route: routes[0], line: line}}
+	}
+
+	if len(ts) == 0 {
+		if ic.KeepPrecision != 0 {
+			ts = strconv.AppendInt(nil, time.Now().UnixNano()/models.GetPrecisionMultiplier(precision), 10)
+		} else {
+			_, _, ts = splitLine(rewriteTimestamp(line, precision))
+		}
+	}
+	for _, route := range routes {
+		part := make([]byte, 0, len(series)+len(fieldSet)+len(ts)+2)
+		part = append(part, series...)
+		part = append(part, ' ')
+		part = append(part, bytes.Join(groups[route], []byte{','})...)
+		part = append(part, ' ')
+		part = append(part, ts...)
+		parts = append(parts, fieldPart{route: route, line: part})
+	}
+	return
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInfluxdbClusterFieldMaps(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &lineBackend{BackendAPI: ic.backends["test1"]}
+	b := &lineBackend{BackendAPI: ic.backends["test1"]}
+	d := &lineBackend{BackendAPI: ic.backends["test1"]}
+	written := func(lb *lineBackend) (lines []string) {
+		lb.lock.Lock()
+		defer lb.lock.Unlock()
+		for _, line := range lb.lines {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		lb.lines = nil
+		return
+	}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{d}
+	ic.m2bs["test"]["cpu_ab"] = []BackendAPI{a}
+	ic.m2bs["test"]["cpu_c"] = []BackendAPI{b}
+	ic.fieldMaps = loadFieldMaps(&NodeConfig{FieldMaps: map[string]map[string]string{
+		"cpu": {"a": "cpu_ab", "b": "cpu_ab", "c": "cpu_c", "x,y": "cpu_c"},
+	}})
+
+	tests := []struct {
+		line    string
+		a, b, d string
+	}{
+		{
+			line: `cpu,host=s1 a=1,c="x,y",b=2i 1434055562000000000`,
+			a:    `cpu,host=s1 a=1,b=2i 1434055562000000000`,
+			b:    `cpu,host=s1 c="x,y" 1434055562000000000`,
+		},
+		{
+			line: `cpu,host=s1 d=4,a=1 1434055562000000000`,
+			a:    `cpu,host=s1 a=1 1434055562000000000`,
+			d:    `cpu,host=s1 d=4 1434055562000000000`,
+		},
+		{
+			// all fields of one key, written as it is.
+			line: `cpu,host=s1 c=3 1434055562000000000`,
+			b:    `cpu,host=s1 c=3 1434055562000000000`,
+		},
+		{
+			line: `cpu,host=s1 x\,y=3,d=4 1434055562000000000`,
+			b:    `cpu,host=s1 x\,y=3 1434055562000000000`,
+			d:    `cpu,host=s1 d=4 1434055562000000000`,
+		},
+		{
+			// matched by prefix.
+			line: `cpu2,host=s1 c=3,d=4 1434055562000000000`,
+			b:    `cpu2,host=s1 c=3 1434055562000000000`,
+			d:    `cpu2,host=s1 d=4 1434055562000000000`,
+		},
+	}
+	for _, tt := range tests {
+		if err = ic.Write([]byte(tt.line+"\n"), "ns", "test"); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			name string
+			lb   *lineBackend
+			want string
+		}{{"A", a, tt.a}, {"B", b, tt.b}, {"D", d, tt.d}} {
+			got := strings.Join(written(c.lb), "\n")
+			if got != c.want {
+				t.Errorf("%s: %s got %q, want %q", tt.line, c.name, got, c.want)
+			}
+		}
+	}
+
+	// the parts of a point without timestamp have the same one.
+	if err = ic.Write([]byte("cpu,host=s1 a=1,c=2\n"), "ns", "test"); err != nil {
+		t.Fatal(err)
+	}
+	pa, pb := written(a), written(b)
+	if len(pa) != 1 || len(pb) != 1 {
+		t.Fatalf("point should be split: %v %v", pa, pb)
+	}
+	_, _, tsa := splitLine([]byte(pa[0]))
+	_, _, tsb := splitLine([]byte(pb[0]))
+	if len(tsa) == 0 || string(tsa) != string(tsb) {
+		t.Errorf("timestamps differ: %s %s", pa[0], pb[0])
+	}
+	if routes := ic.Routes(); routes["test"]["cpu"].Fields["c"] != "cpu_c" {
+		t.Errorf("field maps should be in the routes: %+v", routes["test"]["cpu"])
+	}
+}
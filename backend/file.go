@@ -5,98 +5,625 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"github.com/zxf0089216/influx-proxy/logs"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBrokenMeta = errors.New("broken meta")
+	ErrNotGzip    = errors.New("gzip spool only takes gzip data")
+)
+
+const (
+	SYNC_ALWAYS   = "always"
+	SYNC_INTERVAL = "interval"
+	SYNC_NEVER    = "never"
+
+	DEFAULT_SPOOL_COMMIT_BYTES = 1024 * 1024
+
+	// SPOOL_FRAME 帧头和数据都在 .dat 中, SPOOL_GZIP 数据是 .gz 中首尾相接的 gzip member,
+	// 可以直接 zcat, 帧头在 .idx 中
+	SPOOL_FRAME = "frame"
+	SPOOL_GZIP  = "gzip"
 )
 
 type FileBackend struct {
-	lock     sync.Mutex
-	filename string
-	dataflag bool
-	producer *os.File
-	consumer *os.File
-	meta     *os.File
+	lock         sync.Mutex
+	filename     string
+	dataflag     bool
+	size         int64 // size of complete frames in data file
+	producer     *os.File
+	consumer     *os.File
+	syncPolicy   string
+	syncInterval time.Duration
+	closed       chan struct{}
+	// frames waiting for group commit, written by one syscall.
+	pending     []byte
+	commitDelay time.Duration
+	commitBytes int
+	timer       *time.Timer
+	stats       SpoolStatistics
+	// SPOOL_GZIP: producer and consumer are the index, the data are in gz.
+	gz        *os.File
+	gzSize    int64 // size of complete members in gz file
+	gzRead    int64 // offset of the member to read next
+	gzMeta    int64 // offset of the member at meta
+	pendingGz []byte
+}
+
+// SpoolStatistics 备份文件的写入统计, Writes 为写文件的次数
+type SpoolStatistics struct {
+	Writes int64
+	Frames int64
+	Bytes  int64
 }
 
-func NewFileBackend(filename string, storedir string) (fb *FileBackend, err error) {
+func NewFileBackend(cfg *BackendConfig, filename string, storedir string) (fb *FileBackend, err error) {
 	fb = &FileBackend{
-		filename: filepath.Join(storedir, filename),
-		dataflag: false,
+		filename:     filepath.Join(storedir, filename),
+		dataflag:     false,
+		syncPolicy:   cfg.SyncPolicy,
+		syncInterval: time.Millisecond * time.Duration(cfg.SyncInterval),
+		closed:       make(chan struct{}),
+		commitDelay:  time.Millisecond * time.Duration(cfg.SpoolCommitDelay),
+		commitBytes:  cfg.SpoolCommitBytes,
+	}
+	if fb.syncPolicy == "" {
+		fb.syncPolicy = SYNC_ALWAYS
+	}
+	if fb.commitBytes <= 0 {
+		fb.commitBytes = DEFAULT_SPOOL_COMMIT_BYTES
 	}
 
-	fb.producer, err = os.OpenFile(fb.filename+".dat", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	other := fb.filename + ".idx"
+	if cfg.SpoolFormat == SPOOL_GZIP {
+		other = fb.filename + ".dat"
+		fb.gz, err = os.OpenFile(fb.filename+".gz", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logs.Error("open gzip spool error: ", err)
+			return
+		}
+	}
+	if fi, err := os.Stat(other); err == nil && fi.Size() > 0 {
+		logs.Warningf("%s of another spool format is left, not replayed", other)
+	}
+
+	fb.producer, err = os.OpenFile(fb.framesName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		logs.Error("open producer error: ", err)
 		return
 	}
 
-	fb.consumer, err = os.OpenFile(fb.filename+".dat", os.O_RDONLY, 0644)
+	fb.consumer, err = os.OpenFile(fb.framesName(), os.O_RDONLY, 0644)
 	if err != nil {
 		logs.Error("open consumer error: ", err)
 		return
 	}
 
-	fb.meta, err = os.OpenFile(fb.filename+".rec", os.O_RDWR|os.O_CREATE, 0644)
+	err = fb.recover()
+	if err != nil {
+		logs.Error("recover error: ", err)
+		return
+	}
+
+	if fb.syncPolicy == SYNC_INTERVAL && fb.syncInterval > 0 {
+		go fb.syncLoop()
+	}
+	return
+}
+
+// framesName 帧头所在的文件
+func (fb *FileBackend) framesName() string {
+	if fb.gz != nil {
+		return fb.filename + ".idx"
+	}
+	return fb.filename + ".dat"
+}
+
+// syncLoop fsync data and meta every syncInterval, for SYNC_INTERVAL.
+func (fb *FileBackend) syncLoop() {
+	ticker := time.NewTicker(fb.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fb.closed:
+			return
+		case <-ticker.C:
+			fb.lock.Lock()
+			err := fb.sync()
+			if err != nil {
+				logs.Error("sync producer error: ", err)
+			}
+			err = syncFile(fb.filename + ".rec")
+			if err != nil && !os.IsNotExist(err) {
+				logs.Error("sync meta error: ", err)
+			}
+			fb.lock.Unlock()
+		}
+	}
+}
+
+// sync fsync 数据文件, gzip 格式时先 fsync 数据再 fsync 索引
+func (fb *FileBackend) sync() (err error) {
+	if fb.gz != nil {
+		err = fb.gz.Sync()
+		if err != nil {
+			return
+		}
+	}
+	return fb.producer.Sync()
+}
+
+func syncFile(name string) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// recover 启动时校验数据文件和 meta: 截掉崩溃时写了一半的帧,
+// meta 损坏, 不在帧边界上或者超出数据文件时从头重放.
+func (fb *FileBackend) recover() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	os.Remove(fb.filename + ".rec.tmp")
+
+	fi, err := fb.producer.Stat()
 	if err != nil {
-		logs.Error("open meta error: ", err)
 		return
 	}
 
-	err = fb.RollbackMeta()
+	off, err := fb.readMeta()
 	if err != nil {
-		err = nil
+		logs.Warningf("meta of %s is broken, replay from the beginning: %s", fb.filename, err)
+		off = 0
+	}
+
+	var gzSize int64
+	if fb.gz != nil {
+		gfi, err := fb.gz.Stat()
+		if err != nil {
+			return err
+		}
+		gzSize = gfi.Size()
+	}
+
+	end, gzEnd, gzOff, aligned, err := fb.scan(off, fi.Size(), gzSize)
+	if err != nil {
+		return
+	}
+	if end < fi.Size() {
+		logs.Warningf("drop partial frame at %d of %s, %d bytes", end, fb.filename, fi.Size()-end)
+		err = fb.producer.Truncate(end)
+		if err != nil {
+			return
+		}
+	}
+	fb.size = end
+	// members written before a crash without their frames in the index.
+	if gzEnd < gzSize {
+		logs.Warningf("drop partial gzip member at %d of %s, %d bytes", gzEnd, fb.filename, gzSize-gzEnd)
+		err = fb.gz.Truncate(gzEnd)
+		if err != nil {
+			return
+		}
+	}
+	fb.gzSize = gzEnd
+
+	if off > end || !aligned {
+		logs.Warningf("meta of %s points to %d, out of data file %d, replay from the beginning", fb.filename, off, end)
+		off, gzOff = 0, 0
+		err = fb.writeMeta(off)
+		if err != nil {
+			return
+		}
+	}
+	fb.gzRead, fb.gzMeta = gzOff, gzOff
+
+	_, err = fb.consumer.Seek(off, io.SeekStart)
+	if err != nil {
+		return
+	}
+	fb.dataflag = off < fb.size
+	return
+}
+
+// readMeta 读取已经消费的偏移, 没有 meta 文件表示还没有消费过.
+func (fb *FileBackend) readMeta() (off int64, err error) {
+	buf, err := ioutil.ReadFile(fb.filename + ".rec")
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return
+	case len(buf) != 8:
+		return 0, ErrBrokenMeta
+	}
+	off = int64(binary.BigEndian.Uint64(buf))
+	if off < 0 {
+		return 0, ErrBrokenMeta
 	}
 	return
 }
 
+// scan 从头遍历帧头, 返回最后一个完整帧的结尾, 以及 off 是否在帧边界上.
+// gzip 格式时还返回最后一个完整帧在 gz 文件中的结尾和 off 对应的位置, gzSize 为 gz 文件大小.
+func (fb *FileBackend) scan(off int64, size int64, gzSize int64) (end, gzEnd, gzOff int64, aligned bool, err error) {
+	var header [4]byte
+	aligned = off == 0
+	for end < size {
+		_, err = fb.consumer.ReadAt(header[:], end)
+		if err == io.EOF {
+			return end, gzEnd, gzOff, aligned, nil
+		}
+		if err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		next := end + 4
+		if length&FRAME_TIMESTAMP != 0 {
+			next += 8
+		}
+		if length&FRAME_PRECISION != 0 {
+			var plen [1]byte
+			_, err = fb.consumer.ReadAt(plen[:], next)
+			if err == io.EOF {
+				return end, gzEnd, gzOff, aligned, nil
+			}
+			if err != nil {
+				return
+			}
+			next += 1 + int64(plen[0])
+		}
+		gzNext := gzEnd
+		if fb.gz != nil {
+			gzNext += int64(length &^ FRAME_FLAGS)
+		} else {
+			next += int64(length &^ FRAME_FLAGS)
+		}
+		if next > size || gzNext > gzSize {
+			return
+		}
+		end, gzEnd = next, gzNext
+		if end == off {
+			aligned = true
+			gzOff = gzEnd
+		}
+	}
+	return
+}
+
+// frame: uint32 length, int64 enqueue time in unix nano if FRAME_TIMESTAMP
+// is set in length, uint8 length and precision if FRAME_PRECISION is set,
+// then the data. Frames without timestamp are written by older versions.
+const (
+	FRAME_TIMESTAMP = 1 << 31
+	FRAME_PRECISION = 1 << 30
+	FRAME_FLAGS     = FRAME_TIMESTAMP | FRAME_PRECISION
+)
+
 // Write 写到文件中
 func (fb *FileBackend) Write(p []byte) (err error) {
+	return fb.WritePrecision(p, "")
+}
+
+// WritePrecision 写到文件中, 并记录数据的时间精度, 空表示纳秒.
+// 开启 group commit 时帧先放在内存中, 等待 commitDelay 或者攒够 commitBytes 后一起写入.
+// gzip 格式时 p 必须是 gzip 数据.
+func (fb *FileBackend) WritePrecision(p []byte, precision string) (err error) {
+	if fb.gz != nil && (len(p) < 2 || p[0] != 0x1f || p[1] != 0x8b) {
+		return ErrNotGzip
+	}
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	var length uint32 = uint32(len(p))
-	err = binary.Write(fb.producer, binary.BigEndian, length)
+	var header [13]byte
+	hlen := 12
+	length := uint32(len(p)) | FRAME_TIMESTAMP
+	if precision != "" {
+		length |= FRAME_PRECISION
+		header[12] = byte(len(precision))
+		hlen = 13
+	}
+	binary.BigEndian.PutUint32(header[:4], length)
+	binary.BigEndian.PutUint64(header[4:12], uint64(time.Now().UnixNano()))
+	fb.pending = append(fb.pending, header[:hlen]...)
+	fb.pending = append(fb.pending, precision...)
+	if fb.gz != nil {
+		fb.pendingGz = append(fb.pendingGz, p...)
+	} else {
+		fb.pending = append(fb.pending, p...)
+	}
+	atomic.AddInt64(&fb.stats.Frames, 1)
+
+	if fb.commitDelay <= 0 || len(fb.pending)+len(fb.pendingGz) >= fb.commitBytes {
+		return fb.commit()
+	}
+	if fb.timer == nil {
+		fb.timer = time.AfterFunc(fb.commitDelay, fb.commitTimer)
+	}
+	return
+}
+
+func (fb *FileBackend) commitTimer() {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.timer = nil
+	select {
+	case <-fb.closed:
+		// committed by Close.
+		return
+	default:
+	}
+	err := fb.commit()
 	if err != nil {
-		logs.Error("write length error: ", err)
+		logs.Errorf("commit spool of %s error: %s", fb.filename, err)
+	}
+}
+
+// commit 把等待中的帧一次写入文件, SYNC_ALWAYS 时只 fsync 一次.
+// 写入失败时截掉写了一半的数据, 这些帧被丢弃. gzip 格式时先写数据再写索引.
+func (fb *FileBackend) commit() (err error) {
+	if fb.timer != nil {
+		fb.timer.Stop()
+		fb.timer = nil
+	}
+	if len(fb.pending) == 0 {
 		return
 	}
+	p, gz := fb.pending, fb.pendingGz
+	fb.pending, fb.pendingGz = fb.pending[:0], fb.pendingGz[:0]
+	if cap(fb.pending) > 2*fb.commitBytes {
+		fb.pending = nil
+	}
+	if cap(fb.pendingGz) > 2*fb.commitBytes {
+		fb.pendingGz = nil
+	}
 
-	n, err := fb.producer.Write(p)
+	if len(gz) > 0 {
+		err = writeAll(fb.gz, gz)
+	}
+	if err == nil {
+		err = writeAll(fb.producer, p)
+	}
 	if err != nil {
 		logs.Error("write error: ", err)
+		// don't leave a partial frame for reader.
+		fb.producer.Truncate(fb.size)
+		if fb.gz != nil {
+			fb.gz.Truncate(fb.gzSize)
+		}
 		return
 	}
-	if n != len(p) {
-		return io.ErrShortWrite
+	fb.size += int64(len(p))
+	fb.gzSize += int64(len(gz))
+	atomic.AddInt64(&fb.stats.Writes, 1)
+	atomic.AddInt64(&fb.stats.Bytes, int64(len(p)+len(gz)))
+
+	if fb.syncPolicy == SYNC_ALWAYS {
+		err = fb.sync()
+		if err != nil {
+			logs.Error("sync producer error: ", err)
+			return
+		}
+	}
+
+	fb.dataflag = true
+	return
+}
+
+func writeAll(f *os.File, p []byte) (err error) {
+	n, err := f.Write(p)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
 	}
+	return
+}
+
+// Stats 返回备份文件的写入统计
+func (fb *FileBackend) Stats() (stats SpoolStatistics) {
+	stats.Writes = atomic.LoadInt64(&fb.stats.Writes)
+	stats.Frames = atomic.LoadInt64(&fb.stats.Frames)
+	stats.Bytes = atomic.LoadInt64(&fb.stats.Bytes)
+	return
+}
+
+// Backlog 还没有确认重放的字节数, 包括等待 group commit 的帧
+func (fb *FileBackend) Backlog() (n int64) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.backlog()
+}
 
-	err = fb.producer.Sync()
+func (fb *FileBackend) backlog() (n int64) {
+	if fb.gz != nil {
+		return fb.gzSize - fb.gzMeta + int64(len(fb.pendingGz))
+	}
+	off, err := fb.readMeta()
+	if err != nil || off > fb.size {
+		off = 0
+	}
+	return fb.size - off + int64(len(fb.pending))
+}
+
+// Discard 丢弃还没有重放的数据, 返回丢弃的字节数
+func (fb *FileBackend) Discard() (dropped int64, err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	dropped = fb.backlog()
+	err = fb.discard()
+	return
+}
+
+// Purge 同 Discard, 返回丢弃的帧数, 字节数和行数
+func (fb *FileBackend) Purge() (frames, size, lines int64, err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	frames, size, lines, err = fb.contents(true)
 	if err != nil {
-		logs.Error("sync meta error: ", err)
 		return
 	}
+	err = fb.discard()
+	return
+}
 
-	fb.dataflag = true
+// Contents 返回还没有重放的帧数和字节数, 包括等待 group commit 的帧.
+// lines 为 true 时读出数据计算行数, 否则只读帧头
+func (fb *FileBackend) Contents(lines bool) (frames, size, n int64, err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.contents(lines)
+}
+
+func (fb *FileBackend) contents(lines bool) (frames, size, n int64, err error) {
+	off, err := fb.readMeta()
+	gzOff := fb.gzMeta
+	if err != nil || off > fb.size {
+		off, gzOff = 0, 0
+	}
+	var gz, pendingGz io.ReaderAt
+	if fb.gz != nil {
+		gz, pendingGz = fb.gz, bytes.NewReader(fb.pendingGz)
+	}
+	frames, n, err = countFrames(fb.consumer, off, fb.size, gz, gzOff, lines)
+	if err != nil {
+		return
+	}
+	pframes, pn, err := countFrames(bytes.NewReader(fb.pending), 0, int64(len(fb.pending)), pendingGz, 0, lines)
+	if err != nil {
+		return
+	}
+	return frames + pframes, fb.backlog(), n + pn, nil
+}
+
+// countFrames 同 scan, 数 off 到 end 之间的帧, lines 为 true 时读出数据计算行数.
+// gz 不为 nil 时数据从 gz 的 gzOff 开始读
+func countFrames(r io.ReaderAt, off, end int64, gz io.ReaderAt, gzOff int64, lines bool) (frames, n int64, err error) {
+	var header [4]byte
+	for off < end {
+		_, err = r.ReadAt(header[:], off)
+		if err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		next := off + 4
+		if length&FRAME_TIMESTAMP != 0 {
+			next += 8
+		}
+		if length&FRAME_PRECISION != 0 {
+			var plen [1]byte
+			_, err = r.ReadAt(plen[:], next)
+			if err != nil {
+				return
+			}
+			next += 1 + int64(plen[0])
+		}
+		size := int64(length &^ FRAME_FLAGS)
+		if lines {
+			p := make([]byte, size)
+			if gz != nil {
+				_, err = gz.ReadAt(p, gzOff)
+			} else {
+				_, err = r.ReadAt(p, next)
+			}
+			if err != nil {
+				return
+			}
+			n += int64(CountLines(p))
+		}
+		if gz != nil {
+			off = next
+			gzOff += size
+		} else {
+			off = next + size
+		}
+		frames++
+	}
+	return
+}
+
+func (fb *FileBackend) discard() (err error) {
+	if fb.timer != nil {
+		fb.timer.Stop()
+		fb.timer = nil
+	}
+	fb.pending, fb.pendingGz = fb.pending[:0], fb.pendingGz[:0]
+	err = fb.CleanUp()
+	if err != nil {
+		return
+	}
+	err = fb.writeMeta(0)
+	fb.gzMeta = 0
 	return
 }
 
-// IsData 查看数据标识位dataflag
+// IsData 查看数据标识位dataflag, 先提交等待中的帧
 func (fb *FileBackend) IsData() (dataflag bool) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
+	err := fb.commit()
+	if err != nil {
+		logs.Errorf("commit spool of %s error: %s", fb.filename, err)
+	}
 	return fb.dataflag
 }
 
 // FIXME: signal here
 func (fb *FileBackend) Read() (p []byte, err error) {
-	if !fb.IsData() {
-		return nil, nil
+	p, _, _, err = fb.ReadFrame()
+	return
+}
+
+// ReadFrame 读取一批数据及其写入时间和精度, 旧格式的数据写入时间为零值
+func (fb *FileBackend) ReadFrame() (p []byte, enqueued time.Time, precision string, err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	if !fb.dataflag {
+		return
 	}
 
+	start, err := fb.consumer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		logs.Error("seek consumer error: ", err)
+		return
+	}
+	if start >= fb.size {
+		// all read, wait for UpdateMeta or RollbackMeta.
+		fb.dataflag = false
+		return
+	}
+
+	gzStart := fb.gzRead
+	p, enqueued, precision, err = fb.readFrame()
+	if err != nil {
+		fb.gzRead = gzStart
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		logs.Errorf("drop broken frame at %d of %s", start, fb.filename)
+		err = fb.truncate(start)
+		return nil, time.Time{}, "", err
+	}
+	if err != nil {
+		fb.consumer.Seek(start, io.SeekStart)
+		return nil, time.Time{}, "", err
+	}
+	return
+}
+
+func (fb *FileBackend) readFrame() (p []byte, enqueued time.Time, precision string, err error) {
 	var length uint32
 
 	err = binary.Read(fb.consumer, binary.BigEndian, &length)
@@ -105,9 +632,51 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 		return
 	}
 
+	flags := length & FRAME_FLAGS
+	length &^= FRAME_FLAGS
+	if flags&FRAME_TIMESTAMP != 0 {
+		var ts int64
+		err = binary.Read(fb.consumer, binary.BigEndian, &ts)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			logs.Error("read timestamp error: ", err)
+			return
+		}
+		enqueued = time.Unix(0, ts)
+	}
+
+	if flags&FRAME_PRECISION != 0 {
+		var plen [1]byte
+		_, err = io.ReadFull(fb.consumer, plen[:])
+		if err == nil {
+			buf := make([]byte, plen[0])
+			_, err = io.ReadFull(fb.consumer, buf)
+			precision = string(buf)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			logs.Error("read precision error: ", err)
+			return
+		}
+	}
+
 	p = make([]byte, length)
 
-	_, err = io.ReadFull(fb.consumer, p)
+	if fb.gz != nil {
+		_, err = fb.gz.ReadAt(p, fb.gzRead)
+		if err == nil {
+			fb.gzRead += int64(length)
+		}
+	} else {
+		_, err = io.ReadFull(fb.consumer, p)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		logs.Error("read error: ", err)
 		return
@@ -115,6 +684,31 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 	return
 }
 
+// truncate 丢弃 off 之后的数据, gzip 格式时同时丢弃 gzRead 之后的数据.
+func (fb *FileBackend) truncate(off int64) (err error) {
+	err = fb.producer.Truncate(off)
+	if err != nil {
+		logs.Error("truncate error: ", err)
+		return
+	}
+	fb.size = off
+	if fb.gz != nil {
+		err = fb.gz.Truncate(fb.gzRead)
+		if err != nil {
+			logs.Error("truncate error: ", err)
+			return
+		}
+		fb.gzSize = fb.gzRead
+	}
+	_, err = fb.consumer.Seek(off, io.SeekStart)
+	if err != nil {
+		logs.Error("seek consumer error: ", err)
+		return
+	}
+	fb.dataflag = false
+	return
+}
+
 // CleanUp
 func (fb *FileBackend) CleanUp() (err error) {
 	_, err = fb.consumer.Seek(0, io.SeekStart)
@@ -135,13 +729,23 @@ func (fb *FileBackend) CleanUp() (err error) {
 		return
 	}
 
-	fb.producer, err = os.OpenFile(fb.filename+".dat",
+	fb.producer, err = os.OpenFile(fb.framesName(),
 		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		logs.Error("open producer error: ", err)
 		return
 	}
 
+	// the index is truncated first, the members left are dropped by recover.
+	if fb.gz != nil {
+		err = fb.gz.Truncate(0)
+		if err != nil {
+			logs.Error("truncate error: ", err)
+			return
+		}
+	}
+
+	fb.size, fb.gzSize, fb.gzRead = 0, 0, 0
 	fb.dataflag = false
 	return
 }
@@ -150,19 +754,15 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	off_producer, err := fb.producer.Seek(0, io.SeekCurrent)
-	if err != nil {
-		logs.Error("seek producer error: ", err)
-		return
-	}
-
 	off, err := fb.consumer.Seek(0, io.SeekCurrent)
 	if err != nil {
 		logs.Error("seek consumer error: ", err)
 		return
 	}
 
-	if off_producer == off {
+	// truncate data before meta, a crash between leaves meta past the end,
+	// recover resets it and replays from the beginning.
+	if off >= fb.size {
 		err = fb.CleanUp()
 		if err != nil {
 			return
@@ -170,43 +770,68 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 		off = 0
 	}
 
-	_, err = fb.meta.Seek(0, io.SeekStart)
+	logs.Debugf("write meta: %d", off)
+	err = fb.writeMeta(off)
 	if err != nil {
-		logs.Error("seek meta error: ", err)
+		logs.Error("write meta error: ", err)
 		return
 	}
+	fb.gzMeta = fb.gzRead
 
-	logs.Debugf("write meta: %d", off)
-	err = binary.Write(fb.meta, binary.BigEndian, &off)
+	return
+}
+
+// writeMeta replaces the meta file atomically, write a temp file then rename,
+// so a crash never leaves a partial offset.
+func (fb *FileBackend) writeMeta(off int64) (err error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(off))
+
+	tmpname := fb.filename + ".rec.tmp"
+	tmp, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		logs.Error("write meta error: ", err)
 		return
 	}
-
-	err = fb.meta.Sync()
+	_, err = tmp.Write(buf[:])
+	if err == nil && fb.syncPolicy == SYNC_ALWAYS {
+		err = tmp.Sync()
+	}
+	if Err := tmp.Close(); err == nil {
+		err = Err
+	}
 	if err != nil {
-		logs.Error("sync meta error: ", err)
+		os.Remove(tmpname)
 		return
 	}
 
+	err = os.Rename(tmpname, fb.filename+".rec")
+	if err != nil {
+		return
+	}
+	if fb.syncPolicy == SYNC_ALWAYS {
+		err = syncFile(filepath.Dir(fb.filename))
+	}
 	return
 }
 
+// RollbackMeta 回到 meta 记录的位置重新读取, 可以重复调用.
+// meta 损坏或者超出数据文件时从头重放.
 func (fb *FileBackend) RollbackMeta() (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	_, err = fb.meta.Seek(0, io.SeekStart)
+	off, err := fb.readMeta()
 	if err != nil {
-		logs.Error("RollbackMeta seek meta error: ", err)
-		return
+		logs.Warningf("RollbackMeta meta of %s is broken, replay from the beginning: %s", fb.filename, err)
+		off = 0
 	}
-
-	var off int64
-	err = binary.Read(fb.meta, binary.BigEndian, &off)
-	if err != nil {
-		logs.Error("RollbackMeta read meta error: ", err)
-		return
+	if off > fb.size {
+		logs.Warningf("RollbackMeta meta of %s points to %d, out of data file %d", fb.filename, off, fb.size)
+		off = 0
+	}
+	fb.gzRead = fb.gzMeta
+	if off == 0 {
+		fb.gzRead = 0
 	}
 
 	_, err = fb.consumer.Seek(off, io.SeekStart)
@@ -214,11 +839,24 @@ func (fb *FileBackend) RollbackMeta() (err error) {
 		logs.Error("RollbackMeta seek consumer error: ", err)
 		return
 	}
+	fb.dataflag = off < fb.size
 	return
 }
 
 func (fb *FileBackend) Close() {
+	close(fb.closed)
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	err := fb.commit()
+	if err != nil {
+		logs.Errorf("commit spool of %s error: %s", fb.filename, err)
+	}
+	if fb.syncPolicy != SYNC_NEVER {
+		fb.sync()
+	}
 	fb.producer.Close()
 	fb.consumer.Close()
-	fb.meta.Close()
+	if fb.gz != nil {
+		fb.gz.Close()
+	}
 }
@@ -6,8 +6,14 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
@@ -43,7 +49,7 @@ func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
 }
 
 func TestFileBackend(t *testing.T) {
-	fb, err := NewFileBackend("../testbk", ".")
+	fb, err := NewFileBackend(&BackendConfig{}, "../testbk", ".")
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -61,6 +67,521 @@ func TestFileBackend(t *testing.T) {
 		return
 	}
 
-	readAndProcess(t, fb, "data", 16)
+	readAndProcess(t, fb, "data", 32)
 	readAndProcess(t, fb, "full", 0)
 }
+
+func TestFileBackendSyncPolicy(t *testing.T) {
+	for _, policy := range []string{SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER} {
+		dir := t.TempDir()
+		fb, err := NewFileBackend(&BackendConfig{SyncPolicy: policy, SyncInterval: 10}, "test", dir)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+
+		err = fb.Write([]byte("data"))
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+		err = fb.Write([]byte("full"))
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+		_, err = fb.Read()
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+		err = fb.UpdateMeta()
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		fb.Close()
+
+		meta, err := ioutil.ReadFile(filepath.Join(dir, "test.rec"))
+		if err != nil || len(meta) != 8 || binary.BigEndian.Uint64(meta) != 16 {
+			t.Errorf("%s: meta wrong: %v %v", policy, meta, err)
+		}
+		if _, err = os.Stat(filepath.Join(dir, "test.rec.tmp")); !os.IsNotExist(err) {
+			t.Errorf("%s: temp meta left", policy)
+		}
+
+		fb, err = NewFileBackend(&BackendConfig{SyncPolicy: policy}, "test", dir)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			return
+		}
+		err = fb.Write([]byte("more"))
+		if err != nil {
+			t.Errorf("error: %s", err)
+		}
+		p, err := fb.Read()
+		if err != nil || string(p) != "full" {
+			t.Errorf("%s: reopen read wrong: %s %v", policy, p, err)
+		}
+		fb.Close()
+	}
+}
+
+// go test -bench=FileBackendWrite shows the cost of fsync for each policy.
+func BenchmarkFileBackendWrite(b *testing.B) {
+	p := bytes.Repeat([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\n"), 64)
+	for _, policy := range []string{SYNC_ALWAYS, SYNC_INTERVAL, SYNC_NEVER} {
+		b.Run(policy, func(b *testing.B) {
+			fb, err := NewFileBackend(&BackendConfig{SyncPolicy: policy, SyncInterval: 1000}, "bench", b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fb.Close()
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = fb.Write(p)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileBackendGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	fb, err := NewFileBackend(&BackendConfig{SpoolCommitDelay: 50, SpoolCommitBytes: 64}, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFrames(t, fb, "a", "b")
+	err = fb.WritePrecision([]byte("c"), "ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := fb.Stats(); stats.Writes != 0 || stats.Frames != 3 {
+		t.Errorf("frames should wait for the commit: %+v", stats)
+	}
+	// committed by the timer.
+	for i := 0; i < 100 && fb.Stats().Writes == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := fb.Stats(); stats.Writes != 1 {
+		t.Errorf("frames should be written at once: %+v", stats)
+	}
+	if got := drain(t, fb); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("frame boundaries should be kept: %v", got)
+	}
+
+	// committed when the bytes are reached.
+	writeFrames(t, fb, string(bytes.Repeat([]byte("d"), 64)))
+	if stats := fb.Stats(); stats.Writes != 2 || stats.Frames != 4 {
+		t.Errorf("frames over the bytes should be written: %+v", stats)
+	}
+
+	// committed by Close.
+	writeFrames(t, fb, "e")
+	fb.Close()
+	fb = reopen(t, dir)
+	defer fb.Close()
+	if got := drain(t, fb); len(got) != 2 || got[1] != "e" {
+		t.Errorf("pending frames should be written by close: %v", got)
+	}
+}
+
+// BenchmarkFileBackendGroupCommit spools batches of a down backend under high ingest.
+func BenchmarkFileBackendGroupCommit(b *testing.B) {
+	p := bytes.Repeat([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\n"), 64)
+	for _, delay := range []int{0, 50} {
+		b.Run(fmt.Sprintf("delay=%d", delay), func(b *testing.B) {
+			fb, err := NewFileBackend(&BackendConfig{SyncPolicy: SYNC_ALWAYS, SpoolCommitDelay: delay}, "bench", b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer fb.Close()
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := fb.Write(p)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			fb.IsData()
+			b.ReportMetric(float64(fb.Stats().Writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestFileBackendOldFrame(t *testing.T) {
+	dir := t.TempDir()
+	// frame written by older versions, without timestamp.
+	err := ioutil.WriteFile(filepath.Join(dir, "test.dat"), []byte("\x00\x00\x00\x03old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := NewFileBackend(&BackendConfig{}, "test", dir)
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	defer fb.Close()
+
+	err = fb.Write([]byte("new"))
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+
+	p, enqueued, _, err := fb.ReadFrame()
+	if err != nil || string(p) != "old" || !enqueued.IsZero() {
+		t.Errorf("old frame wrong: %s %s %v", p, enqueued, err)
+	}
+	p, enqueued, _, err = fb.ReadFrame()
+	if err != nil || string(p) != "new" || time.Since(enqueued) > time.Minute {
+		t.Errorf("new frame wrong: %s %s %v", p, enqueued, err)
+	}
+}
+
+func TestFileBackendPrecision(t *testing.T) {
+	dir := t.TempDir()
+	fb := reopen(t, dir)
+	writeFrames(t, fb, "ns")
+	err := fb.WritePrecision([]byte("s"), "s")
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	fb.Close()
+
+	// precision frames are kept over restart.
+	fb = reopen(t, dir)
+	defer fb.Close()
+	for _, want := range []string{"", "s"} {
+		p, _, precision, err := fb.ReadFrame()
+		if err != nil || precision != want {
+			t.Errorf("precision wrong: %s %q %v", p, precision, err)
+		}
+	}
+}
+
+// reopen simulates a restart after crash, the old FileBackend is dropped without Close.
+func reopen(t *testing.T, dir string) *FileBackend {
+	fb, err := NewFileBackend(&BackendConfig{}, "test", dir)
+	if err != nil {
+		t.Fatalf("reopen error: %s", err)
+	}
+	return fb
+}
+
+// drain reads and commits all frames, bounded to catch infinite loops.
+func drain(t *testing.T, fb *FileBackend) (got []string) {
+	for i := 0; fb.IsData(); i++ {
+		if i > 100 {
+			t.Fatalf("drain never ends: %v", got)
+		}
+		p, err := fb.Read()
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if p != nil {
+			got = append(got, string(p))
+		}
+		err = fb.UpdateMeta()
+		if err != nil {
+			t.Fatalf("update meta error: %s", err)
+		}
+	}
+	return
+}
+
+func writeFrames(t *testing.T, fb *FileBackend, frames ...string) {
+	for _, f := range frames {
+		err := fb.Write([]byte(f))
+		if err != nil {
+			t.Fatalf("write error: %s", err)
+		}
+	}
+}
+
+func TestFileBackendCrash(t *testing.T) {
+	tests := []struct {
+		name  string
+		crash func(t *testing.T, dir string, fb *FileBackend)
+		want  []string
+	}{
+		{
+			name: "after write",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "after read before update meta",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				fb.Read()
+			},
+			// a is delivered again, at least once.
+			want: []string{"a", "b"},
+		},
+		{
+			name: "after update meta",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				fb.Read()
+				fb.UpdateMeta()
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "in the middle of write",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a")
+				f, _ := os.OpenFile(filepath.Join(dir, "test.dat"), os.O_WRONLY|os.O_APPEND, 0644)
+				f.Write([]byte{0x80, 0, 0, 5, 0, 0})
+				f.Close()
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "in the middle of clean up",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				fb.Read()
+				fb.UpdateMeta()
+				fb.Read()
+				// data truncated, but meta not updated yet.
+				os.Truncate(filepath.Join(dir, "test.dat"), 0)
+			},
+			want: nil,
+		},
+		{
+			name: "in the middle of update meta",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				fb.Read()
+				fb.UpdateMeta()
+				fb.Read()
+				ioutil.WriteFile(filepath.Join(dir, "test.rec.tmp"), []byte{0, 0}, 0644)
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "broken meta",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				fb.Read()
+				fb.UpdateMeta()
+				ioutil.WriteFile(filepath.Join(dir, "test.rec"), []byte("xyz"), 0644)
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "meta not at frame boundary",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a", "b")
+				var buf [8]byte
+				binary.BigEndian.PutUint64(buf[:], 5)
+				ioutil.WriteFile(filepath.Join(dir, "test.rec"), buf[:], 0644)
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "meta past end of data",
+			crash: func(t *testing.T, dir string, fb *FileBackend) {
+				writeFrames(t, fb, "a")
+				var buf [8]byte
+				binary.BigEndian.PutUint64(buf[:], 1000)
+				ioutil.WriteFile(filepath.Join(dir, "test.rec"), buf[:], 0644)
+			},
+			want: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		fb := reopen(t, dir)
+		tt.crash(t, dir, fb)
+
+		fb = reopen(t, dir)
+		got := drain(t, fb)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		// still works after recovery.
+		writeFrames(t, fb, "c")
+		got = drain(t, fb)
+		if fmt.Sprint(got) != "[c]" {
+			t.Errorf("%s: got %v after recovery", tt.name, got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "test.rec.tmp")); !os.IsNotExist(err) {
+			t.Errorf("%s: temp meta left", tt.name)
+		}
+		fb.Close()
+	}
+}
+
+func TestFileBackendRollbackMeta(t *testing.T) {
+	fb := reopen(t, t.TempDir())
+	defer fb.Close()
+	writeFrames(t, fb, "a", "b")
+
+	for i := 0; i < 3; i++ {
+		p, err := fb.Read()
+		if err != nil || string(p) != "a" {
+			t.Errorf("read after rollback wrong: %s %v", p, err)
+		}
+		err = fb.RollbackMeta()
+		if err != nil {
+			t.Errorf("rollback error: %s", err)
+		}
+		err = fb.RollbackMeta()
+		if err != nil {
+			t.Errorf("rollback error: %s", err)
+		}
+	}
+
+	// rollback after everything read still replays.
+	fb.Read()
+	fb.Read()
+	if p, _ := fb.Read(); p != nil || fb.IsData() {
+		t.Errorf("read past end: %s", p)
+	}
+	fb.RollbackMeta()
+	if got := drain(t, fb); fmt.Sprint(got) != "[a b]" {
+		t.Errorf("drain after rollback wrong: %v", got)
+	}
+}
+
+func TestFileBackendGzip(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &BackendConfig{SpoolFormat: SPOOL_GZIP}
+	fb, err := NewFileBackend(cfg, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.Write([]byte("cpu value=1\n")); err != ErrNotGzip {
+		t.Errorf("plain data should be refused: %v", err)
+	}
+
+	var a, b bytes.Buffer
+	Compress(&a, []byte("cpu value=1\n"))
+	Compress(&b, []byte("mem value=2\nmem value=3\n"))
+	if err = fb.WritePrecision(a.Bytes(), "ms"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	frames, size, lines, err := fb.Contents(true)
+	if err != nil || frames != 2 || size != int64(a.Len()+b.Len()) || lines != 3 {
+		t.Errorf("contents wrong: %d %d %d %v", frames, size, lines, err)
+	}
+
+	// the spool is what zcat reads, each chunk a gzip member by itself.
+	gz, _ := ioutil.ReadFile(filepath.Join(dir, "test.gz"))
+	zip, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ioutil.ReadAll(zip)
+	if string(p) != "cpu value=1\nmem value=2\nmem value=3\n" {
+		t.Errorf("concatenated members wrong: %q", p)
+	}
+	zip, err = gzip.NewReader(bytes.NewReader(gz[a.Len():]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zip.Multistream(false)
+	p, _ = ioutil.ReadAll(zip)
+	if string(p) != "mem value=2\nmem value=3\n" {
+		t.Errorf("standalone member wrong: %q", p)
+	}
+
+	p, _, precision, err := fb.ReadFrame()
+	if err != nil || !bytes.Equal(p, a.Bytes()) || precision != "ms" {
+		t.Errorf("read wrong: %v %s", err, precision)
+	}
+	fb.UpdateMeta()
+	p, _ = fb.Read()
+	if !bytes.Equal(p, b.Bytes()) {
+		t.Errorf("read wrong")
+	}
+	// b is read again after a failure and a restart.
+	fb.RollbackMeta()
+	fb.Close()
+
+	fb, err = NewFileBackend(cfg, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	if size = fb.Backlog(); size != int64(b.Len()) {
+		t.Errorf("backlog wrong: %d", size)
+	}
+	got := drain(t, fb)
+	if len(got) != 1 || got[0] != b.String() {
+		t.Errorf("replay wrong: %d", len(got))
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, "test.gz")); fi.Size() != 0 {
+		t.Errorf("spool should be cleaned up: %d", fi.Size())
+	}
+}
+
+func TestFileBackendGzipCrash(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &BackendConfig{SpoolFormat: SPOOL_GZIP}
+	fb, err := NewFileBackend(cfg, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b bytes.Buffer
+	Compress(&a, []byte("cpu value=1\n"))
+	Compress(&b, []byte("cpu value=2\n"))
+	fb.Write(a.Bytes())
+	fb.Write(b.Bytes())
+	fb.Close()
+
+	// the member of b is written, its frame is not.
+	idx := filepath.Join(dir, "test.idx")
+	fi, _ := os.Stat(idx)
+	os.Truncate(idx, fi.Size()-3)
+
+	fb, err = NewFileBackend(cfg, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := drain(t, fb)
+	if len(got) != 1 || got[0] != a.String() {
+		t.Errorf("recovery wrong: %d", len(got))
+	}
+	fb.Write(b.Bytes())
+	fb.Close()
+
+	// the member of b is partially written.
+	gz := filepath.Join(dir, "test.gz")
+	fi, _ = os.Stat(gz)
+	os.Truncate(gz, fi.Size()-3)
+
+	fb, err = NewFileBackend(cfg, "test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	if got = drain(t, fb); len(got) != 0 {
+		t.Errorf("partial member should be dropped: %d", len(got))
+	}
+	if fi, _ = os.Stat(gz); fi.Size() != 0 {
+		t.Errorf("partial member left: %d", fi.Size())
+	}
+	fb.Write(a.Bytes())
+	if got = drain(t, fb); len(got) != 1 || got[0] != a.String() {
+		t.Errorf("write after recovery wrong: %d", len(got))
+	}
+}
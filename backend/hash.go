@@ -0,0 +1,68 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+)
+
+// loadHashedMeasurements KEYMAPS 中按 series 哈希只写一个后端的 key, e.g. _default_
+func loadHashedMeasurements(nodecfg *NodeConfig) (hashed map[string]bool) {
+	hashed = make(map[string]bool, len(nodecfg.HashedMeasurements))
+	for _, key := range nodecfg.HashedMeasurements {
+		hashed[key] = true
+	}
+	return
+}
+
+func (ic *InfluxCluster) isHashed(key string) bool {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.hashed[key]
+}
+
+// canonicalSeries 返回 line 的 series key, tag 按字典序排列, tag 顺序不同的同一个 series 结果相同
+func canonicalSeries(line []byte) []byte {
+	series, _, _ := splitLine(line)
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(series); i++ {
+		switch series[i] {
+		case '\\':
+			i++
+		case ',':
+			parts = append(parts, series[start:i])
+			start = i + 1
+		}
+	}
+	if len(parts) < 2 {
+		return series
+	}
+	parts = append(parts, series[start:])
+	tags := parts[1:]
+	sort.Slice(tags, func(i, j int) bool { return bytes.Compare(tags[i], tags[j]) < 0 })
+	return bytes.Join(parts, []byte{','})
+}
+
+// hashBackends 按 series 哈希从 bs 中选一个后端, 同一个 series 总是写到同一个后端. 影子后端照常接收副本.
+func hashBackends(line []byte, bs []BackendAPI) (picked []BackendAPI) {
+	var candidates []BackendAPI
+	for _, b := range bs {
+		if b.IsShadow() {
+			picked = append(picked, b)
+			continue
+		}
+		candidates = append(candidates, b)
+	}
+	if len(candidates) == 0 {
+		return bs
+	}
+	h := fnv.New64a()
+	h.Write(canonicalSeries(line))
+	b := candidates[mix64(h.Sum64())%uint64(len(candidates))]
+	return append([]BackendAPI{b}, picked...)
+}
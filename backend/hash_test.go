@@ -0,0 +1,101 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCanonicalSeries(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"cpu value=1 1434055562000000000", "cpu"},
+		{"cpu,host=a,region=b value=1", "cpu,host=a,region=b"},
+		{"cpu,region=b,host=a value=1", "cpu,host=a,region=b"},
+		{"c\\,pu,z=1\\,2,a=x\\ y value=1", "c\\,pu,a=x\\ y,z=1\\,2"},
+	}
+	for _, tt := range tests {
+		if got := string(canonicalSeries([]byte(tt.line))); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+// seriesBackend 记录写入的 series
+type seriesBackend struct {
+	BackendAPI
+	lock   sync.Mutex
+	series map[string]int
+}
+
+func (sb *seriesBackend) Write(p []byte) (err error) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	series, _, _ := splitLine(p)
+	sb.series[string(series)]++
+	return
+}
+
+func TestInfluxdbClusterHashedWrite(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool []*seriesBackend
+	var apis []BackendAPI
+	for i := 0; i < 4; i++ {
+		sb := &seriesBackend{BackendAPI: ic.backends["test1"], series: make(map[string]int)}
+		pool = append(pool, sb)
+		apis = append(apis, sb)
+	}
+	ic.m2bs["test"]["_default_"] = apis
+	ic.hashed = map[string]bool{"_default_": true}
+
+	buf := bytes.Buffer{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 4000; i++ {
+			fmt.Fprintf(&buf, "disk,host=server%d,path=/data value=%d 1434055562%09d\n", i, round, round)
+		}
+	}
+	// same series with the tags in another order.
+	buf.WriteString("disk,path=/data,host=server0 value=9 1434055563000000000\n")
+	err = ic.Write(buf.Bytes(), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := make(map[string]int)
+	for i, sb := range pool {
+		n := 0
+		for series, count := range sb.series {
+			key := string(canonicalSeries([]byte(series)))
+			if j, ok := owner[key]; ok && j != i {
+				t.Errorf("series %s written to backend %d and %d", key, j, i)
+			}
+			owner[key] = i
+			n += count
+		}
+		// each series is written 3 times, 1000 series on average.
+		if n < 3*800 || n > 3*1200 {
+			t.Errorf("backend %d got %d points, not balanced", i, n)
+		}
+	}
+	if len(owner) != 4000 {
+		t.Errorf("series lost: %d", len(owner))
+	}
+
+	// other keys are still written to all their backends.
+	cb := &countBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{cb, cb}
+	ic.WriteRow([]byte("cpu value=1"), "ns", "test")
+	if cb.writes != 2 {
+		t.Errorf("unhashed key should be replicated: %d", cb.writes)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "sort"
+
+const (
+	HEALTH_OK       = "ok"
+	HEALTH_DEGRADED = "degraded"
+)
+
+// Health /health 的结果
+type Health struct {
+	Status   string `json:"status"`
+	Backends int    `json:"backends"`
+	Active   int    `json:"active"`
+	// KEYMAPS keys of each db whose backends are all write only, not queryable.
+	WriteOnly map[string][]string `json:"write_only,omitempty"`
+}
+
+// Health 返回后端的可用情况, 有不可用的后端时为 HEALTH_DEGRADED
+func (ic *InfluxCluster) Health() (h Health) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	h.Status = HEALTH_OK
+	for _, api := range ic.backends {
+		h.Backends++
+		if api.IsActive() {
+			h.Active++
+		}
+	}
+	for db, keys := range ic.m2bs {
+		for key, apis := range keys {
+			if !allWriteOnly(apis) {
+				continue
+			}
+			if h.WriteOnly == nil {
+				h.WriteOnly = make(map[string][]string)
+			}
+			h.WriteOnly[db] = append(h.WriteOnly[db], key)
+		}
+	}
+	for _, keys := range h.WriteOnly {
+		sort.Strings(keys)
+	}
+	if h.Active < h.Backends {
+		h.Status = HEALTH_DEGRADED
+	}
+	return
+}
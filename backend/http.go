@@ -7,6 +7,7 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -15,19 +16,35 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrBadRequest = errors.New("Bad Request\n")
 	ErrNotFound   = errors.New("Not Found\n")
+	ErrTooLarge   = errors.New("Request Entity Too Large\n")
 	ErrInternal   = errors.New("Internal Error")
 	ErrUnknown    = errors.New("Unknown Error\n")
+	// 502, 503 and 504, the backend may be back soon.
+	ErrUnavailable = errors.New("Service Unavailable\n")
+	// closed with data left in the spool file.
+	ErrSpoolNotDrained = errors.New("spool not drained")
 )
 
+// gzipPool 复用 Compress 的 gzip.Writer, 每个都带有几百 KB 的压缩状态
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
 func Compress(buf *bytes.Buffer, p []byte) (err error) {
-	zip := gzip.NewWriter(buf)
+	zip := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(zip)
+	zip.Reset(buf)
 	n, err := zip.Write(p)
 	if err != nil {
 		return
@@ -41,64 +58,269 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 }
 
 type HttpBackend struct {
-	BasicAuth *BasicAuth
-	client    *http.Client
-	transport http.Transport
-	Interval  int
-	URL       string
-	DB        string
-	Zone      string
-	Active    bool
-	running   bool
-	WriteOnly int
+	BasicAuth   *BasicAuth
+	client      *http.Client
+	transport   *http.Transport
+	Interval    int
+	URL         string
+	DB          string
+	Zone        string
+	Active      bool
+	running     bool
+	WriteOnly   int
+	Shadow      int
+	QueryWeight int
+	stats       BackendStatistics
+	name        string
+	events      *stateEvents
+	stateLock   sync.Mutex
+	// set by the admin api, 1 write only, -1 not, 0 as in the config.
+	writeOnlyOverride int32
+	disabled          int32
+	// timeout of each query, unless set by the request.
+	TimeoutQuery time.Duration
+	// set on every request to the backend, with User-Agent.
+	headers http.Header
+	http2   bool
+	conns   *connTrace
+	// path of the unix socket if URL is unix:///path/to/socket.
+	socket string
+	// CREATE DATABASE sent when the backend becomes active, empty if disabled.
+	createDB string
+}
+
+// BackendStatistics 单个后端的累计计数
+type BackendStatistics struct {
+	QueryRequests     int64
+	QueryRequestsFail int64
+	FlushByCount      int64
+	FlushByTimer      int64
+	FlushByClose      int64
+	FlushByPrecision  int64
+	FlushByBytes      int64
+	FlushInflight     int64
+	FlushSaturated    int64
+	RowLimit          int64
+	FlushRows         int64
+	FlushBytes        int64
+	ExpiredBatches    int64
+	ExpiredPoints     int64
+	ExpiredBytes      int64
+	WriteRetries      int64
+	WriteRetrySuccess int64
+	BadLines          int64
+	TooLargeSplits    int64
+	TooLargeLines     int64
+	DuplicatePoints   int64
+	CappedPoints      int64
+	RefusedPoints     int64
+	ShadowDropped     int64
+	ShadowWriteFail   int64
+	Failovers         int64
+	// 1 when writes are spooled because the backend is unavailable.
+	Failover int64
+	// writes waiting in the channel of the backend.
+	WriteQueue int64
+	// writes of the spool file, less than frames with group commit.
+	SpoolWrites int64
+	SpoolFrames int64
+	SpoolBytes  int64
+	// connections to the backend, traced by httptrace.
+	NewConns    int64
+	ReusedConns int64
+	// capacity of the channel, bytes and rows of the buffer, the buffer sampled by Idle.
+	WriteQueueCap int64
+	BufferBytes   int64
+	BufferRows    int64
+	// unix nano of the last successful write, 0 if none yet.
+	LastWrite int64
+}
+
+// Flushes 返回flush总次数
+func (stats *BackendStatistics) Flushes() int64 {
+	return stats.FlushByCount + stats.FlushByTimer + stats.FlushByClose + stats.FlushByPrecision + stats.FlushByBytes
 }
 
 func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
+	return newHttpBackend(cfg, "")
+}
+
+// newHttpBackend 带上后端名字, 状态事件在第一次检查前就能记录
+func newHttpBackend(cfg *BackendConfig, name string) (hb *HttpBackend) {
 	hb = &HttpBackend{
 		client: &http.Client{
 			Timeout: time.Millisecond * time.Duration(cfg.Timeout),
 		},
-		// TODO: query timeout? use req.Cancel
-		// client_query: &http.Client{
-		//     Timeout: time.Millisecond * time.Duration(cfg.TimeoutQuery),
-		// },
-		BasicAuth: cfg.BasicAuth,
-		Interval:  cfg.CheckInterval,
-		URL:       cfg.URL,
-		DB:        cfg.DB,
-		Zone:      cfg.Zone,
-		Active:    true,
-		running:   true,
-		WriteOnly: cfg.WriteOnly,
+		TimeoutQuery: time.Millisecond * time.Duration(cfg.TimeoutQuery),
+		BasicAuth:    cfg.BasicAuth,
+		Interval:     cfg.CheckInterval,
+		URL:          cfg.URL,
+		DB:           cfg.DB,
+		Zone:         cfg.Zone,
+		Active:       true,
+		running:      true,
+		WriteOnly:    cfg.WriteOnly,
+		Shadow:       cfg.Shadow,
+		QueryWeight:  1,
+		name:         name,
+		events:       cfg.events,
+	}
+	if cfg.QueryWeight != nil {
+		hb.QueryWeight = *cfg.QueryWeight
+	}
+	hb.headers = backendHeaders(cfg)
+	hb.http2 = cfg.HTTP2 >= 0
+	hb.conns = newConnTrace(&hb.stats)
+	hb.socket = unixSocket(hb.URL)
+	hb.client.Transport = newTransport(hb.http2, hb.socket)
+	// queries are not sent through the proxy of the environment.
+	hb.transport = newTransport(hb.http2, hb.socket)
+	hb.transport.Proxy = nil
+	if cfg.CreateDatabase == 1 {
+		hb.createDB = createDatabaseQuery(cfg.DB, cfg.CreateDatabaseWith)
 	}
 	go hb.CheckActive()
 	return
 }
 
+// backendHeaders 返回后端请求的头, 值中的环境变量被展开, User-Agent 默认为 influx-proxy/VERSION
+func backendHeaders(cfg *BackendConfig) http.Header {
+	header := make(http.Header, len(cfg.Headers)+1)
+	for k, v := range cfg.Headers {
+		header.Set(k, os.ExpandEnv(v))
+	}
+	ua := "influx-proxy/" + VERSION
+	if cfg.UserAgent != "" {
+		ua = os.ExpandEnv(cfg.UserAgent)
+	}
+	header.Set("User-Agent", ua)
+	return header
+}
+
 // TODO: update active when calling successed or failed.
 
 func (hb *HttpBackend) CheckActive() {
 	var err error
-	for hb.running {
+	// created since the backend became active.
+	created := false
+	for hb.isRunning() {
 		_, err = hb.Ping()
-		hb.Active = (err == nil)
+		hb.setActive(err == nil, err)
+		switch {
+		case err != nil:
+			created = false
+		case hb.createDB != "" && !created:
+			created = hb.createDatabase() == nil
+		}
 		time.Sleep(time.Millisecond * time.Duration(hb.Interval))
 	}
 }
 
+// isRunning 是否未关闭
+func (hb *HttpBackend) isRunning() bool {
+	hb.stateLock.Lock()
+	defer hb.stateLock.Unlock()
+	return hb.running
+}
+
+// setActive 更新后端状态, 在 active 和 inactive 之间切换时记录事件
+func (hb *HttpBackend) setActive(active bool, err error) {
+	hb.stateLock.Lock()
+	defer hb.stateLock.Unlock()
+	old := hb.Active
+	hb.Active = active
+	if old == active || hb.events == nil {
+		return
+	}
+	event := StateEvent{
+		Backend: hb.name,
+		URL:     hb.URL,
+		Old:     stateName(old),
+		New:     stateName(active),
+		Time:    time.Now(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	hb.events.add(event)
+}
+
 func (hb *HttpBackend) IsWriteOnly() bool {
+	switch atomic.LoadInt32(&hb.writeOnlyOverride) {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
 	if hb.WriteOnly == 0 {
 		return false
 	}
 	return true
 }
 
-func (hb *HttpBackend) IsActive() bool {
+// IsShadow 是否为影子后端, 只接收写入的副本
+func (hb *HttpBackend) IsShadow() bool {
+	return hb.Shadow != 0
+}
+
+// isHealthy 健康检查是否通过
+func (hb *HttpBackend) isHealthy() bool {
+	hb.stateLock.Lock()
+	defer hb.stateLock.Unlock()
 	return hb.Active
 }
 
+// IsActive 健康检查通过, 并且没有被 admin 接口停用
+func (hb *HttpBackend) IsActive() bool {
+	return hb.isHealthy() && atomic.LoadInt32(&hb.disabled) == 0
+}
+
+func (hb *HttpBackend) GetQueryWeight() int {
+	return hb.QueryWeight
+}
+
+func (hb *HttpBackend) GetStats() (stats BackendStatistics) {
+	stats.QueryRequests = atomic.LoadInt64(&hb.stats.QueryRequests)
+	stats.QueryRequestsFail = atomic.LoadInt64(&hb.stats.QueryRequestsFail)
+	stats.FlushByCount = atomic.LoadInt64(&hb.stats.FlushByCount)
+	stats.FlushByTimer = atomic.LoadInt64(&hb.stats.FlushByTimer)
+	stats.FlushByClose = atomic.LoadInt64(&hb.stats.FlushByClose)
+	stats.FlushByPrecision = atomic.LoadInt64(&hb.stats.FlushByPrecision)
+	stats.FlushByBytes = atomic.LoadInt64(&hb.stats.FlushByBytes)
+	stats.FlushInflight = atomic.LoadInt64(&hb.stats.FlushInflight)
+	stats.FlushSaturated = atomic.LoadInt64(&hb.stats.FlushSaturated)
+	stats.FlushRows = atomic.LoadInt64(&hb.stats.FlushRows)
+	stats.FlushBytes = atomic.LoadInt64(&hb.stats.FlushBytes)
+	stats.ExpiredBatches = atomic.LoadInt64(&hb.stats.ExpiredBatches)
+	stats.ExpiredPoints = atomic.LoadInt64(&hb.stats.ExpiredPoints)
+	stats.ExpiredBytes = atomic.LoadInt64(&hb.stats.ExpiredBytes)
+	stats.WriteRetries = atomic.LoadInt64(&hb.stats.WriteRetries)
+	stats.WriteRetrySuccess = atomic.LoadInt64(&hb.stats.WriteRetrySuccess)
+	stats.BadLines = atomic.LoadInt64(&hb.stats.BadLines)
+	stats.TooLargeSplits = atomic.LoadInt64(&hb.stats.TooLargeSplits)
+	stats.TooLargeLines = atomic.LoadInt64(&hb.stats.TooLargeLines)
+	stats.DuplicatePoints = atomic.LoadInt64(&hb.stats.DuplicatePoints)
+	stats.CappedPoints = atomic.LoadInt64(&hb.stats.CappedPoints)
+	stats.RefusedPoints = atomic.LoadInt64(&hb.stats.RefusedPoints)
+	stats.ShadowDropped = atomic.LoadInt64(&hb.stats.ShadowDropped)
+	stats.ShadowWriteFail = atomic.LoadInt64(&hb.stats.ShadowWriteFail)
+	stats.Failovers = atomic.LoadInt64(&hb.stats.Failovers)
+	stats.Failover = atomic.LoadInt64(&hb.stats.Failover)
+	stats.NewConns = atomic.LoadInt64(&hb.stats.NewConns)
+	stats.ReusedConns = atomic.LoadInt64(&hb.stats.ReusedConns)
+	stats.BufferBytes = atomic.LoadInt64(&hb.stats.BufferBytes)
+	stats.BufferRows = atomic.LoadInt64(&hb.stats.BufferRows)
+	stats.LastWrite = atomic.LoadInt64(&hb.stats.LastWrite)
+	return
+}
+
 func (hb *HttpBackend) Ping() (version string, err error) {
-	resp, err := hb.client.Get(hb.URL + "/ping")
+	req, err := http.NewRequest("GET", hb.base()+"/ping", nil)
+	if err != nil {
+		return
+	}
+	hb.setHeaders(req)
+	resp, err := hb.client.Do(hb.traced(req))
 	if err != nil {
 		logs.Error("http error: ", err)
 		return
@@ -121,8 +343,28 @@ func (hb *HttpBackend) Ping() (version string, err error) {
 	return
 }
 
+// skipHeaders 不复制的响应头: hop-by-hop 头, Date, 以及写完 body 后再设置的 Content-Length 和 Content-Encoding
+var skipHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Date":                true,
+	"Content-Length":      true,
+	"Content-Encoding":    true,
+}
+
+// copyHeader 复制后端的响应头, e.g. Content-Type, X-Influxdb-Version, Request-Id
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
+		if skipHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
 		for _, v := range vv {
 			dst.Add(k, v)
 		}
@@ -133,14 +375,49 @@ func (hb *HttpBackend) GetZone() (zone string) {
 	return hb.Zone
 }
 
+// queryTimeoutKey 请求上设置的后端查询超时
+type queryTimeoutKey struct{}
+
+// queryContext 返回带查询超时的 req 的副本, 请求上设置的超时优先于 TimeoutQuery.
+// 后端在副本上设置 db, 认证和 Headers, 同一个 req 发给下一个后端时不带上这个后端的.
+func (hb *HttpBackend) queryContext(req *http.Request) (*http.Request, context.CancelFunc) {
+	timeout := hb.TimeoutQuery
+	if d, ok := req.Context().Value(queryTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return req.Clone(ctx), cancel
+}
+
+// cancelBody 关闭时取消查询的 context
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 func (hb *HttpBackend) QueryResp(req *http.Request) (header http.Header, status int, body []byte, err error) {
+	req, cancel := hb.queryContext(req)
+	defer cancel()
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
 	req.Form.Set("db", hb.DB)
 	req.ContentLength = 0
 
-	req.URL, err = url.Parse(hb.URL + "/query?" + req.Form.Encode())
+	// Add basic auth
+	hb.basicAuth(req)
+	hb.setHeaders(req)
+
+	req.URL, err = url.Parse(hb.base() + "/query?" + req.Form.Encode())
 	if err != nil {
 		logs.Error("internal url parse error: ", err)
 		return
@@ -148,22 +425,27 @@ func (hb *HttpBackend) QueryResp(req *http.Request) (header http.Header, status
 
 	q := strings.TrimSpace(req.FormValue("q"))
 
-	resp, err := hb.transport.RoundTrip(req)
-	defer resp.Body.Close()
+	atomic.AddInt64(&hb.stats.QueryRequests, 1)
+	resp, err := hb.transport.RoundTrip(hb.traced(req))
 	if err != nil {
 		logs.Errorf("query error: %s,the query is %s\n", err, q)
-		hb.Active = false
+		atomic.AddInt64(&hb.stats.QueryRequestsFail, 1)
+		// canceled by client or deadline, not the backend's fault.
+		if req.Context().Err() == nil {
+			hb.setActive(false, err)
+		}
 		return
 	}
+	defer resp.Body.Close()
 
 	respDody := resp.Body
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		respDody, err = gzip.NewReader(resp.Body)
-		defer respDody.Close()
 		if err != nil {
 			logs.Errorf("unable to decode gzip body")
 			return
 		}
+		defer respDody.Close()
 	}
 
 	body, err = ioutil.ReadAll(respDody)
@@ -177,9 +459,49 @@ func (hb *HttpBackend) QueryResp(req *http.Request) (header http.Header, status
 	return
 }
 
+// QueryStream 返回未读取的响应, 用于 chunked 查询, 调用者负责关闭 Body.
+func (hb *HttpBackend) QueryStream(req *http.Request) (resp *http.Response, err error) {
+	req, cancel := hb.queryContext(req)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	if len(req.Form) == 0 {
+		req.Form = url.Values{}
+	}
+	req.Form.Set("db", hb.DB)
+	req.ContentLength = 0
+
+	// Add basic auth
+	hb.basicAuth(req)
+	hb.setHeaders(req)
+
+	req.URL, err = url.Parse(hb.base() + "/query?" + req.Form.Encode())
+	if err != nil {
+		logs.Error("internal url parse error: ", err)
+		return
+	}
+
+	atomic.AddInt64(&hb.stats.QueryRequests, 1)
+	resp, err = hb.transport.RoundTrip(hb.traced(req))
+	if err != nil {
+		logs.Errorf("query error: %s,the query is %s\n", err, req.Form.Get("q"))
+		atomic.AddInt64(&hb.stats.QueryRequestsFail, 1)
+		if req.Context().Err() == nil {
+			hb.setActive(false, err)
+		}
+		return
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return
+}
+
 // Don't setup Accept-Encoding: gzip. Let real client do so.
 // If real client don't support gzip and we setted, it will be a mistake.
 func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err error) {
+	req, cancel := hb.queryContext(req)
+	defer cancel()
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
@@ -188,43 +510,95 @@ func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err erro
 
 	// Add basic auth
 	hb.basicAuth(req)
+	hb.setHeaders(req)
 
-	req.URL, err = url.Parse(hb.URL + "/query?" + req.Form.Encode())
+	req.URL, err = url.Parse(hb.base() + "/query?" + req.Form.Encode())
 	if err != nil {
 		logs.Error("internal url parse error: ", err)
 		return
 	}
 
 	q := strings.TrimSpace(req.FormValue("q"))
-	resp, err := hb.transport.RoundTrip(req)
+	atomic.AddInt64(&hb.stats.QueryRequests, 1)
+	resp, err := hb.transport.RoundTrip(hb.traced(req))
 	if err != nil {
 		logs.Errorf("query error: %s,the query is %s\n", err, q)
-		hb.Active = false
+		atomic.AddInt64(&hb.stats.QueryRequestsFail, 1)
+		// canceled by client or deadline, not the backend's fault.
+		if req.Context().Err() == nil {
+			hb.setActive(false, err)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
 	copyHeader(w.Header(), resp.Header)
 
+	if req.Form.Get("chunked") == "true" && resp.StatusCode == 200 {
+		hb.streamQuery(w, resp, q)
+		return
+	}
+
 	p, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logs.Errorf("read body error: %s,the query is %s\n", err, q)
 		return
 	}
 
+	// the body is forwarded as it is, still encoded.
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(p)))
 	w.WriteHeader(resp.StatusCode)
 	w.Write(p)
 	return
 }
 
+// streamQuery 把 chunked 查询的结果边读边转发给客户端.
+// 响应头已经写出, 中途出错不能再换后端, 只记录日志.
+func (hb *HttpBackend) streamQuery(w http.ResponseWriter, resp *http.Response, q string) {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logs.Errorf("read chunked body error: %s,the query is %s\n", err, q)
+			return
+		}
+	}
+}
+
 func (hb *HttpBackend) basicAuth(req *http.Request) {
 	// Add basic auth
 	if hb.BasicAuth != nil {
-		req.Header.Add("Authorization", fmt.Sprintf("Basic %s",
+		req.Header.Set("Authorization", fmt.Sprintf("Basic %s",
 			base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", hb.BasicAuth.Username, hb.BasicAuth.Password)))))
 	}
 }
 
+// setHeaders 设置 Headers 和 User-Agent, 覆盖客户端的同名请求头
+func (hb *HttpBackend) setHeaders(req *http.Request) {
+	for k := range hb.headers {
+		req.Header.Set(k, hb.headers.Get(k))
+	}
+}
+
 func (hb *HttpBackend) Write(p []byte) (err error) {
 	var buf bytes.Buffer
 	err = Compress(&buf, p)
@@ -239,59 +613,92 @@ func (hb *HttpBackend) Write(p []byte) (err error) {
 }
 
 func (hb *HttpBackend) WriteCompressed(p []byte) (err error) {
+	return hb.WriteCompressedPrecision(p, "")
+}
+
+// WriteCompressedPrecision 带 precision 参数写入, 空表示纳秒
+func (hb *HttpBackend) WriteCompressedPrecision(p []byte, precision string) (err error) {
 	buf := bytes.NewBuffer(p)
-	err = hb.WriteStream(buf, true)
+	err = hb.writeStream(buf, true, precision)
 	return
 }
 
 func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error) {
+	return hb.writeStream(stream, compressed, "")
+}
+
+func (hb *HttpBackend) writeStream(stream io.Reader, compressed bool, precision string) (err error) {
+	status, respbuf, err := hb.post(stream, compressed, precision)
+	if err != nil || status == 204 {
+		return
+	}
+	logs.Error("write status code: ", status)
+	logs.Errorf("error response: %s\n", respbuf)
+
+	// translate code to error
+	// https://docs.influxdata.com/influxdb/v1.1/tools/api/#write
+	switch status {
+	case 400:
+		err = ErrBadRequest
+	case 404:
+		err = ErrNotFound
+	case 413:
+		err = ErrTooLarge
+	case 502, 503, 504:
+		err = ErrUnavailable
+	default: // mostly tcp connection timeout
+		logs.Errorf("status: %d", status)
+		err = ErrUnknown
+	}
+	return
+}
+
+// post 发送一次写入, 返回状态码, 不是 204 时返回响应内容
+func (hb *HttpBackend) post(stream io.Reader, compressed bool, precision string) (status int, respbuf []byte, err error) {
 	q := url.Values{}
 	q.Set("db", hb.DB)
+	if precision != "" {
+		q.Set("precision", precision)
+	}
 
-	req, err := http.NewRequest("POST", hb.URL+"/write?"+q.Encode(), stream)
+	req, err := http.NewRequest("POST", hb.base()+"/write?"+q.Encode(), stream)
 	if compressed {
 		req.Header.Add("Content-Encoding", "gzip")
 	}
 
 	// Add basic auth
 	hb.basicAuth(req)
+	hb.setHeaders(req)
 
-	resp, err := hb.client.Do(req)
+	resp, err := hb.client.Do(hb.traced(req))
 	if err != nil {
 		logs.Error("http error: ", err)
-		hb.Active = false
+		hb.setActive(false, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 204 {
+	status = resp.StatusCode
+	if status == 204 {
+		atomic.StoreInt64(&hb.stats.LastWrite, time.Now().UnixNano())
 		return
 	}
-	logs.Error("write status code: ", resp.StatusCode)
-
-	respbuf, err := ioutil.ReadAll(resp.Body)
+	respbuf, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logs.Error("readall error: ", err)
-		return
-	}
-	logs.Errorf("error response: %s\n", respbuf)
-
-	// translate code to error
-	// https://docs.influxdata.com/influxdb/v1.1/tools/api/#write
-	switch resp.StatusCode {
-	case 400:
-		err = ErrBadRequest
-	case 404:
-		err = ErrNotFound
-	default: // mostly tcp connection timeout
-		logs.Errorf("status: %d", resp.StatusCode)
-		err = ErrUnknown
 	}
 	return
 }
 
 func (hb *HttpBackend) Close() (err error) {
+	hb.stateLock.Lock()
 	hb.running = false
-	hb.transport.CloseIdleConnections()
+	hb.stateLock.Unlock()
+	if hb.transport != nil {
+		hb.transport.CloseIdleConnections()
+	}
+	if transport, ok := hb.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
 	return
 }
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -17,6 +19,11 @@ func HandlerAny(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	logs.Errorf("handler any get url: %s", req.URL)
 	w.Header().Add("X-Influxdb-Version", VERSION)
+	if req.URL.Path == "/query" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(req.FormValue("q"))), "show") {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key"],"values":[["host"]]}]}]}`))
+		return
+	}
 	w.WriteHeader(204)
 	return
 }
@@ -142,3 +149,126 @@ func TestHttpBackendQuery(t *testing.T) {
 		return
 	}
 }
+
+func TestHttpBackendHeaders(t *testing.T) {
+	t.Setenv("TEST_API_KEY", "secret")
+	var lock sync.Mutex
+	seen := map[string]http.Header{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		seen[req.URL.Path] = req.Header.Clone()
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	header := func(path, key string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		return seen[path].Get(key)
+	}
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.Headers = map[string]string{"X-Api-Key": "${TEST_API_KEY}", "x-static": "v"}
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if _, err = bs.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=select+*+from+cpu", nil)
+	req.Header.Set("User-Agent", "client")
+	if err = bs.Query(NewDummyResponseWriter(), req); err != nil {
+		t.Fatal(err)
+	}
+	// the replay of the spool.
+	var buf bytes.Buffer
+	Compress(&buf, []byte("cpu value=1\n"))
+	bs.fb.Write(buf.Bytes())
+	bs.Rewrite()
+	if bs.fb.IsData() {
+		t.Fatalf("spool should be written")
+	}
+
+	for _, path := range []string{"/ping", "/query", "/write"} {
+		if header(path, "X-Api-Key") != "secret" || header(path, "X-Static") != "v" || header(path, "User-Agent") != "influx-proxy/"+VERSION {
+			t.Errorf("headers of %s wrong: %v", path, seen[path])
+		}
+	}
+
+	cfg.UserAgent = "proxy-$TEST_API_KEY"
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+	hb.Ping()
+	if ua := header("/ping", "User-Agent"); ua != "proxy-secret" {
+		t.Errorf("user agent wrong: %s", ua)
+	}
+}
+
+func TestHttpBackendHeadersNotShared(t *testing.T) {
+	var lock sync.Mutex
+	seen := map[string]http.Header{}
+	newBackend := func(name string, headers map[string]string, auth *BasicAuth) *Backends {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/ping" {
+				lock.Lock()
+				seen[name] = req.Header.Clone()
+				lock.Unlock()
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		}))
+		t.Cleanup(ts.Close)
+		cfg, _ := CreateTestBackendConfig(name)
+		cfg.URL = ts.URL
+		cfg.Headers = headers
+		cfg.BasicAuth = auth
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bs.Close() })
+		return bs
+	}
+	a := newBackend("a", map[string]string{"X-Api-Key": "a-secret"}, &BasicAuth{Username: "a", Password: "a-password"})
+	b := newBackend("b", map[string]string{"X-Tenant": "b"}, nil)
+
+	// the same request goes to one backend after another, e.g. failover and fan-out.
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=select+*+from+cpu", nil)
+	req.ParseForm()
+	for _, query := range []func(api BackendAPI) error{
+		func(api BackendAPI) error { return api.Query(NewDummyResponseWriter(), req) },
+		func(api BackendAPI) (err error) { _, _, _, err = api.QueryResp(req); return },
+		func(api BackendAPI) error {
+			resp, err := api.QueryStream(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		},
+	} {
+		lock.Lock()
+		seen = map[string]http.Header{}
+		lock.Unlock()
+		for _, api := range []BackendAPI{a, b} {
+			if err := query(api); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lock.Lock()
+		if seen["a"].Get("X-Api-Key") != "a-secret" || seen["a"].Get("Authorization") == "" {
+			t.Errorf("headers of a wrong: %v", seen["a"])
+		}
+		if seen["b"].Get("X-Api-Key") != "" || seen["b"].Get("Authorization") != "" || seen["b"].Get("X-Tenant") != "b" {
+			t.Errorf("headers of a should not be sent to b: %v", seen["b"])
+		}
+		lock.Unlock()
+	}
+	if len(req.Header) != 0 || req.Form.Has("db") {
+		t.Errorf("request of the caller should not be changed: %v %v", req.Header, req.Form)
+	}
+}
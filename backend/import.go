@@ -0,0 +1,154 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	IMPORT_JOBS     = 100
+	IMPORT_MAX_LINE = 16 * 1024 * 1024
+	IMPORT_PROGRESS = 100000
+)
+
+// ImportJob 批量导入任务, 运行中也可以查看进度
+type ImportJob struct {
+	Id           int64               `json:"id"`
+	DB           string              `json:"db"`
+	Precision    string              `json:"precision"`
+	DryRun       bool                `json:"dry_run"`
+	Status       string              `json:"status"`
+	Error        string              `json:"error,omitempty"`
+	Routed       int64               `json:"routed"`
+	Dropped      int64               `json:"dropped"`
+	Measurements map[string]int64    `json:"measurements"`
+	Backends     map[string][]string `json:"backends"`
+	StartAt      time.Time           `json:"start_at"`
+	FinishAt     *time.Time          `json:"finish_at,omitempty"` // nil while the job is running
+}
+
+type importJobs struct {
+	lock   sync.Mutex
+	lastId int64
+	jobs   []*ImportJob
+}
+
+// Import 逐行读取 line protocol 并按正常写入的路由分发, 不把整个 body 读到内存.
+// dryRun 只统计路由结果, 不写入后端.
+func (ic *InfluxCluster) Import(r io.Reader, db, precision string, dryRun bool) (job ImportJob, err error) {
+	j := &ImportJob{
+		Id:           atomic.AddInt64(&ic.imports.lastId, 1),
+		DB:           db,
+		Precision:    precision,
+		DryRun:       dryRun,
+		Status:       "running",
+		Measurements: make(map[string]int64),
+		Backends:     make(map[string][]string),
+		StartAt:      time.Now(),
+	}
+	ic.imports.lock.Lock()
+	ic.imports.jobs = append(ic.imports.jobs, j)
+	if len(ic.imports.jobs) > IMPORT_JOBS {
+		ic.imports.jobs = ic.imports.jobs[len(ic.imports.jobs)-IMPORT_JOBS:]
+	}
+	ic.imports.lock.Unlock()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), IMPORT_MAX_LINE)
+	var lines int64
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		// comments and context lines of influx_inspect export.
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var key string
+		var ok bool
+		if dryRun {
+			var bs []BackendAPI
+			key, err = ScanKey(line)
+			if err == nil {
+				bs, ok = ic.GetBackends(key, db)
+				if !ok {
+					err = ErrUnknownMeasurement
+				}
+			}
+			ic.imports.lock.Lock()
+			if err == nil && j.Backends[key] == nil {
+				j.Backends[key] = backendNames(bs)
+			}
+			ic.imports.lock.Unlock()
+		} else {
+			key, err = ic.writeRow(context.Background(), line, precision, db, nil)
+		}
+
+		ic.imports.lock.Lock()
+		if err != nil {
+			j.Dropped++
+		} else {
+			j.Routed++
+			j.Measurements[key]++
+		}
+		ic.imports.lock.Unlock()
+
+		lines++
+		if lines%IMPORT_PROGRESS == 0 {
+			logs.Infof("import job %d: %d lines processed", j.Id, lines)
+		}
+	}
+	err = scanner.Err()
+
+	ic.imports.lock.Lock()
+	defer ic.imports.lock.Unlock()
+	if !dryRun {
+		for key := range j.Measurements {
+			bs, _ := ic.GetBackends(key, db)
+			j.Backends[key] = backendNames(bs)
+		}
+	}
+	finish := time.Now()
+	j.FinishAt = &finish
+	j.Status = "done"
+	if err != nil {
+		j.Status = "failed"
+		j.Error = err.Error()
+	}
+	logs.Infof("import job %d %s, db: %s, routed: %d, dropped: %d", j.Id, j.Status, db, j.Routed, j.Dropped)
+	job = j.copy()
+	return
+}
+
+func (j *ImportJob) copy() (job ImportJob) {
+	job = *j
+	job.Measurements = make(map[string]int64, len(j.Measurements))
+	for k, v := range j.Measurements {
+		job.Measurements[k] = v
+	}
+	job.Backends = make(map[string][]string, len(j.Backends))
+	for k, v := range j.Backends {
+		job.Backends[k] = v
+	}
+	return
+}
+
+// ImportJobs 返回运行中和最近的导入任务
+func (ic *InfluxCluster) ImportJobs() (jobs []ImportJob) {
+	ic.imports.lock.Lock()
+	defer ic.imports.lock.Unlock()
+	for _, job := range ic.imports.jobs {
+		jobs = append(jobs, job.copy())
+	}
+	return
+}
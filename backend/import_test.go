@@ -0,0 +1,84 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type countBackend struct {
+	BackendAPI
+	writes int64
+}
+
+func (cb *countBackend) Write(p []byte) (err error) {
+	atomic.AddInt64(&cb.writes, 1)
+	return
+}
+
+func TestImport(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cb := &countBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{cb}
+
+	data := strings.Join([]string{
+		"# DML",
+		"# CONTEXT-DATABASE: test",
+		"cpu,host=server01 value=1 1434055562000000000",
+		"",
+		"cpu,host=server02 value=2 1434055562000000000",
+		"mem,host=server01 value=3 1434055562000000000",
+		"cpu value=4 1434055562000000000",
+	}, "\n")
+
+	for _, dryRun := range []bool{true, false} {
+		job, err := ic.Import(strings.NewReader(data), "test", "ns", dryRun)
+		if err != nil {
+			t.Errorf("import error: %s", err)
+			return
+		}
+		if job.Status != "done" || job.Routed != 3 || job.Dropped != 1 || job.Measurements["cpu"] != 3 {
+			t.Errorf("dry run %t, summary wrong: %+v", dryRun, job)
+		}
+		if job.FinishAt == nil || job.FinishAt.Before(job.StartAt) {
+			t.Errorf("dry run %t, finish time wrong: %v", dryRun, job.FinishAt)
+		}
+		if len(job.Backends["cpu"]) != 1 {
+			t.Errorf("dry run %t, backends wrong: %v", dryRun, job.Backends)
+		}
+
+		writes := atomic.LoadInt64(&cb.writes)
+		if dryRun && writes != 0 {
+			t.Errorf("dry run should not write: %d", writes)
+		}
+		if !dryRun && writes != 3 {
+			t.Errorf("writes wrong: %d", writes)
+		}
+	}
+
+	jobs := ic.ImportJobs()
+	if len(jobs) != 2 || !jobs[0].DryRun || jobs[1].DryRun {
+		t.Errorf("jobs wrong: %+v", jobs)
+	}
+}
+
+func TestImportLongLine(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data := "cpu value=1 1434055562000000000\ncpu,host=" + strings.Repeat("x", IMPORT_MAX_LINE) + " value=1\n"
+	job, err := ic.Import(strings.NewReader(data), "test", "ns", true)
+	if err == nil || job.Status != "failed" || job.Routed != 1 {
+		t.Errorf("long line should fail the job: %+v %v", job, err)
+	}
+}
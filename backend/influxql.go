@@ -116,6 +116,12 @@ func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
 }
 
 func GetMeasurementFromInfluxQL(q string) (m string, err error) {
+	_, _, m, err = GetSourceFromInfluxQL(q)
+	return
+}
+
+// GetSourceFromInfluxQL 同 GetMeasurementFromInfluxQL, 另外返回 FROM "db"."rp"."cpu" 中的 db 和 rp, 没有时为空
+func GetSourceFromInfluxQL(q string) (db, rp, m string, err error) {
 	buf := bytes.NewBuffer([]byte(q))
 	scanner := bufio.NewScanner(buf)
 	scanner.Buffer([]byte(q), len(q))
@@ -128,13 +134,161 @@ func GetMeasurementFromInfluxQL(q string) (m string, err error) {
 	for i := 0; i < len(tokens); i++ {
 		if strings.ToLower(tokens[i]) == "from" || strings.ToLower(tokens[i]) == "measurement" {
 			if i+1 < len(tokens) {
-				m = getMeasurement(tokens[i+1:])
+				db, rp, m = getSource(tokens[i+1:])
 				return
 			}
 		}
 	}
 
-	return "", ErrIllegalQL
+	return "", "", "", ErrIllegalQL
+}
+
+// GetMeasurementsFromInfluxQL 返回 FROM 后以逗号分隔的所有 measurement, 正则原样返回
+func GetMeasurementsFromInfluxQL(q string) (ms []string, err error) {
+	members, _, _, err := scanFromList(q)
+	if err != nil {
+		return
+	}
+	for _, member := range members {
+		ms = append(ms, memberMeasurement(member))
+	}
+	return
+}
+
+// memberMeasurement 返回 FROM 列表中一项的 measurement, 同 GetMeasurementFromInfluxQL
+func memberMeasurement(member string) string {
+	_, _, m := memberSource(member)
+	return m
+}
+
+// memberSource 返回 FROM 列表中一项的 db, rp 和 measurement
+func memberSource(member string) (db, rp, m string) {
+	buf := bytes.NewBuffer([]byte(member))
+	scanner := bufio.NewScanner(buf)
+	scanner.Buffer([]byte(member), len(member))
+	scanner.Split(ScanToken)
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	if len(tokens) == 0 {
+		return "", "", member
+	}
+	return getSource(tokens)
+}
+
+// scanFromList 找到第一个 FROM, 返回后面以逗号分隔的各项原文, 和整个列表在 q 中的位置.
+// 引号和正则中的逗号不分隔, FROM 后是子查询时返回 ErrIllegalQL.
+func scanFromList(q string) (members []string, start, end int, err error) {
+	depth := 0
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case c == '"' || c == '\'':
+			i, err = skipQuoted(q, i)
+			if err != nil {
+				return
+			}
+			i--
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && isKeywordAt(q, i, "from"):
+			return scanMembers(q, i+len("from"))
+		}
+	}
+	err = ErrIllegalQL
+	return
+}
+
+func scanMembers(q string, p int) (members []string, start, end int, err error) {
+	p = skipSpaces(q, p)
+	start = p
+	for {
+		mstart := p
+		p, err = scanMember(q, p)
+		if err != nil {
+			return
+		}
+		if p == mstart {
+			err = ErrIllegalQL
+			return
+		}
+		members = append(members, q[mstart:p])
+		end = p
+		p = skipSpaces(q, p)
+		if p >= len(q) || q[p] != ',' {
+			return
+		}
+		p = skipSpaces(q, p+1)
+	}
+}
+
+// scanMember 返回 FROM 列表中从 p 开始的一项的结束位置, e.g. "db"."rp"."cpu", /cpu.*/
+func scanMember(q string, p int) (end int, err error) {
+	if p < len(q) && q[p] == '/' {
+		for end = p + 1; end < len(q); end++ {
+			switch q[end] {
+			case '\\':
+				end++
+			case '/':
+				return end + 1, nil
+			}
+		}
+		return end, ErrUnclosed
+	}
+	for end = p; end < len(q); {
+		switch q[end] {
+		case '"', '\'':
+			end, err = skipQuoted(q, end)
+			if err != nil {
+				return
+			}
+		case '(':
+			return end, ErrIllegalQL
+		case ' ', '\t', '\r', '\n', ',', ';', ')':
+			return
+		default:
+			end++
+		}
+	}
+	return
+}
+
+// skipQuoted 返回从 i 开始的引号内容之后的位置
+func skipQuoted(q string, i int) (end int, err error) {
+	quote := q[i]
+	for end = i + 1; end < len(q); end++ {
+		switch q[end] {
+		case '\\':
+			end++
+		case quote:
+			return end + 1, nil
+		}
+	}
+	return end, ErrUnmatchedQuote
+}
+
+func skipSpaces(q string, p int) int {
+	for p < len(q) && (q[p] == ' ' || q[p] == '\t' || q[p] == '\r' || q[p] == '\n') {
+		p++
+	}
+	return p
+}
+
+// isKeywordAt q 的 i 处是否是单独的关键字 kw, 不区分大小写
+func isKeywordAt(q string, i int, kw string) bool {
+	if i+len(kw) >= len(q) || !strings.EqualFold(q[i:i+len(kw)], kw) {
+		return false
+	}
+	if i > 0 && !isSpaceOrParen(q[i-1]) {
+		return false
+	}
+	return isSpaceOrParen(q[i+len(kw)])
+}
+
+func isSpaceOrParen(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(' || c == ')'
 }
 
 func GetDBFromInfluxQL(q string) (m string, err error) {
@@ -147,10 +301,12 @@ func GetDBFromInfluxQL(q string) (m string, err error) {
 		tokens = append(tokens, scanner.Text())
 	}
 
+	// CREATE DATABASE "db", CREATE RETENTION POLICY "rp" ON "db" ...
 	for i := 0; i < len(tokens); i++ {
-		if strings.ToLower(tokens[i]) == "database" {
+		switch strings.ToLower(tokens[i]) {
+		case "database", "on":
 			if i+1 < len(tokens) {
-				m = getMeasurement(tokens[i+1:])
+				m = unquoteIdent(tokens[i+1])
 				return
 			}
 		}
@@ -159,34 +315,80 @@ func GetDBFromInfluxQL(q string) (m string, err error) {
 	return "", ErrIllegalQL
 }
 
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
 func getMeasurement(tokens []string) (m string) {
-	if len(tokens) >= 2 && strings.HasPrefix(tokens[1], ".") {
-		m = tokens[1]
-		m = m[1:]
-		if m[0] == '"' || m[0] == '\'' {
-			m = m[1 : len(m)-1]
+	_, _, m = getSource(tokens)
+	return
+}
+
+// getSource 返回 FROM 之后的 tokens 中的 db, rp 和 measurement, e.g. "db"."rp"."cpu", db..cpu, rp.cpu
+func getSource(tokens []string) (db, rp, m string) {
+	var parts []string
+	rest := tokens[0]
+	// a quoted token is unquoted by the scanner, the rest is glued to it by dots.
+	if first := tokens[0]; len(first) >= 2 && (first[0] == '"' || first[0] == '\'') {
+		parts = append(parts, first[1:len(first)-1])
+		rest = ""
+	}
+	for _, token := range tokens[1:] {
+		if !strings.HasPrefix(token, ".") {
+			break
 		}
-		return
+		rest += token
 	}
-
-	m = tokens[0]
-	if m[0] == '/' {
-		return m
+	if len(parts) > 0 {
+		rest = strings.TrimPrefix(rest, ".")
+		if rest == "" {
+			return "", "", parts[0]
+		}
 	}
+	parts = append(parts, splitIdent(rest)...)
 
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
-		return
+	n := len(parts)
+	m = parts[n-1]
+	if n >= 2 {
+		rp = parts[n-2]
 	}
-
-	index := strings.IndexByte(m, '.')
-	if index == -1 {
-		return
+	if n >= 3 {
+		db = parts[n-3]
 	}
+	return
+}
 
-	m = m[index+1:]
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
+// splitIdent 按点分开 db.rp.measurement, 去掉引号, 正则原样返回
+func splitIdent(s string) (parts []string) {
+	if s == "" || strings.IndexByte("([{", s[0]) != -1 {
+		return []string{s}
 	}
-	return
+	var part []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '.':
+			parts = append(parts, string(part))
+			part = nil
+		case c == '/' && len(part) == 0:
+			end, err := scanMember(s, i)
+			if err != nil {
+				end = len(s)
+			}
+			part = append(part, s[i:end]...)
+			i = end - 1
+		case c == '"' || c == '\'':
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				part = append(part, s[i])
+			}
+		default:
+			part = append(part, c)
+		}
+	}
+	return append(parts, string(part))
 }
@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 // SHOW USERS
 // SHOW SUBSCRIPTIONS
@@ -85,6 +88,72 @@ func TestInfluxQL(t *testing.T) {
 	checkPoint(t, "SHOW FIELD KEYS FROM \"1h\".\"cpu.load\"", "cpu.load")
 }
 
+func TestGetDBFromInfluxQL(t *testing.T) {
+	tests := map[string]string{
+		"CREATE DATABASE \"foo\"":                     "foo",
+		"CREATE DATABASE \"mydb\" WITH NAME \"myrp\"": "mydb",
+		"CREATE RETENTION POLICY \"10m.events\" ON \"somedb\" DURATION 60m REPLICATION 2": "somedb",
+		"ALTER RETENTION POLICY \"1h.cpu\" ON mydb DEFAULT":                               "mydb",
+		"DROP CONTINUOUS QUERY \"myquery\" ON \"mydb\"":                                   "mydb",
+	}
+	for q, want := range tests {
+		db, err := GetDBFromInfluxQL(q)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if db != want {
+			t.Errorf("db wrong: %s != %s", db, want)
+		}
+	}
+}
+
+func TestGetMeasurementsFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"select * from cpu", []string{"cpu"}},
+		{"SELECT * FROM cpu, mem WHERE time > now() - 1h", []string{"cpu", "mem"}},
+		{"SELECT * FROM cpu,mem", []string{"cpu", "mem"}},
+		{"SELECT mean(\"value\") FROM \"cpu,1\" , 'mem' GROUP BY time(1m)", []string{"cpu,1", "mem"}},
+		{"SELECT * FROM \"c\\\"pu\",/disk,.*/", []string{"c\"pu", "/disk,.*/"}},
+		{"(select *) from cpu, mem;", []string{"cpu", "mem"}},
+	}
+	for _, tt := range tests {
+		ms, err := GetMeasurementsFromInfluxQL(tt.q)
+		if err != nil || strings.Join(ms, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: %q %v", tt.q, ms, err)
+		}
+	}
+	if _, err := GetMeasurementsFromInfluxQL("SELECT * FROM (SELECT * FROM cpu, mem)"); err == nil {
+		t.Errorf("subquery should not be a list of measurements")
+	}
+}
+
+func TestGetSourceFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		q            string
+		db, rp, want string
+	}{
+		{"SELECT * FROM cpu", "", "", "cpu"},
+		{"SELECT * FROM autogen.cpu", "", "autogen", "cpu"},
+		{"SELECT * FROM \"mydb\".\"autogen\".\"cpu\" WHERE time > now() - 1h", "mydb", "autogen", "cpu"},
+		{"SELECT * FROM mydb.autogen.cpu", "mydb", "autogen", "cpu"},
+		{"SELECT * FROM mydb..cpu", "mydb", "", "cpu"},
+		{"SELECT * FROM \"my db\"..\"c.pu\"", "my db", "", "c.pu"},
+		{"SELECT * FROM mydb.\"auto\\\"gen\".cpu", "mydb", "auto\"gen", "cpu"},
+		{"SELECT * FROM mydb.autogen./cpu.*/", "mydb", "autogen", "/cpu.*/"},
+		{"SHOW SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'", "telegraf", "autogen", "cpu"},
+	}
+	for _, tt := range tests {
+		db, rp, m, err := GetSourceFromInfluxQL(tt.q)
+		if err != nil || db != tt.db || rp != tt.rp || m != tt.want {
+			t.Errorf("%s: %q %q %q %v", tt.q, db, rp, m, err)
+		}
+	}
+}
+
 func checkPoint(t *testing.T, q string, m string) {
 	qm, err := GetMeasurementFromInfluxQL(q)
 	if err != nil {
@@ -14,10 +14,16 @@ type BackendAPI interface {
 	Querier
 	IsActive() (b bool)
 	IsWriteOnly() (b bool)
+	IsShadow() (b bool)
 	Ping() (version string, err error)
 	GetZone() (zone string)
 	GetDB() (db string)
+	GetName() (name string)
+	GetQueryWeight() (weight int)
+	GetStats() (stats BackendStatistics)
 	Write(p []byte) (err error)
+	WritePrecision(p []byte, precision string) (err error)
 	Close() (err error)
 	QueryResp(req *http.Request) (header http.Header, status int, body []byte, err error)
+	QueryStream(req *http.Request) (resp *http.Response, err error)
 }
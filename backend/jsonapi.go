@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
 )
 
 /*
@@ -12,18 +15,41 @@ import (
 */
 
 type seri struct {
-	Name    string          `json:"name,omitempty"`
-	Columns []string        `json:"columns"`
-	Values  [][]interface{} `json:"values"`
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+type message struct {
+	Level string `json:"level"`
+	Text  string `json:"text"`
 }
 
 type statement struct {
-	StatementId int    `json:"statement_id"`
-	Series      []seri `json:"series,omitempty"`
+	StatementId int       `json:"statement_id"`
+	Series      []seri    `json:"series,omitempty"`
+	Messages    []message `json:"messages,omitempty"`
+	Error       string    `json:"error,omitempty"`
 }
 
 type statementArray struct {
 	Results []statement `json:"results"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// statementError 返回响应中的错误, 包括各条语句的错误, 没有错误或者不是 json 时返回空
+func statementError(body []byte) string {
+	var result statementArray
+	if json.Unmarshal(body, &result) != nil {
+		return ""
+	}
+	for _, r := range result.Results {
+		if r.Error != "" {
+			return r.Error
+		}
+	}
+	return result.Error
 }
 
 // GetSerisArray byte转化为seri
@@ -38,6 +64,18 @@ func GetSeriesArray(sBody []byte) (ss []seri, err error) {
 	return
 }
 
+// DecodeSeriesArray 从响应流中解码第一个 statement 的 seri
+func DecodeSeriesArray(r io.Reader) (ss []seri, err error) {
+	var tmp statementArray
+	err = json.NewDecoder(r).Decode(&tmp)
+	if err == nil {
+		if len(tmp.Results) > 0 && len(tmp.Results[0].Series) > 0 {
+			ss = tmp.Results[0].Series
+		}
+	}
+	return
+}
+
 // GetValuesArray byte转化为[][]string
 //func GetValuesArray(sBody []byte) (ms [][]string, err error) {
 //	var tmp statementArray
@@ -51,10 +89,11 @@ func GetSeriesArray(sBody []byte) (ss []seri, err error) {
 //}
 
 // GetJsonBodyfromSeries seri转化为byte
-func GetJsonBodyfromSeries(series []seri) (body []byte, err error) {
+func GetJsonBodyfromSeries(series []seri, messages ...message) (body []byte, err error) {
 	tmpstatement := statement{
 		StatementId: 0,
 		Series:      series,
+		Messages:    messages,
 	}
 	body, err = json.Marshal(statementArray{
 		Results: []statement{tmpstatement},
@@ -65,6 +104,94 @@ func GetJsonBodyfromSeries(series []seri) (body []byte, err error) {
 	return
 }
 
+// mergeSeri 合并两个后端返回的同名 seri, 去掉重复的行.
+// 列不同时按 canonicalColumns 排列, 缺少的列填 null.
+func mergeSeri(a, b seri) seri {
+	if !sameColumns(a.Columns, b.Columns) {
+		columns := canonicalColumns(a.Columns, b.Columns)
+		a.Values = remapValues(a.Columns, columns, a.Values)
+		b.Values = remapValues(b.Columns, columns, b.Values)
+		a.Columns = columns
+	}
+	seen := make(map[string]bool, len(a.Values)+len(b.Values))
+	values := make([][]interface{}, 0, len(a.Values)+len(b.Values))
+	for _, vs := range [][][]interface{}{a.Values, b.Values} {
+		for _, row := range vs {
+			key, err := json.Marshal(row)
+			if err == nil && seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			values = append(values, row)
+		}
+	}
+	a.Values = values
+	return a
+}
+
+// sortValues 按列依次比较排序行, 值按字符串比较
+func sortValues(values [][]interface{}) {
+	sort.SliceStable(values, func(i, j int) bool {
+		a, b := values[i], values[j]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			x, y := fmt.Sprint(a[k]), fmt.Sprint(b[k])
+			if x != y {
+				return x < y
+			}
+		}
+		return len(a) < len(b)
+	})
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalColumns 两组列的并集, time 在最前, 其余按名字排序, 和后端返回的顺序无关
+func canonicalColumns(a, b []string) (columns []string) {
+	set := make(map[string]bool, len(a)+len(b))
+	for _, c := range append(append([]string{}, a...), b...) {
+		if !set[c] {
+			set[c] = true
+			columns = append(columns, c)
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		if columns[i] == "time" || columns[j] == "time" {
+			return columns[i] == "time"
+		}
+		return columns[i] < columns[j]
+	})
+	return
+}
+
+// remapValues 把按 from 排列的行改成按 to 排列, 缺少的列为 nil
+func remapValues(from, to []string, values [][]interface{}) (remapped [][]interface{}) {
+	index := make(map[string]int, len(from))
+	for i, c := range from {
+		index[c] = i
+	}
+	remapped = make([][]interface{}, len(values))
+	for i, row := range values {
+		r := make([]interface{}, len(to))
+		for j, c := range to {
+			if k, ok := index[c]; ok && k < len(row) {
+				r[j] = row[k]
+			}
+		}
+		remapped[i] = r
+	}
+	return
+}
+
 // GzipEncode 把byte类型压缩
 func GzipEncode(body []byte, need bool) (b []byte) {
 	if !need {
@@ -72,9 +199,9 @@ func GzipEncode(body []byte, need bool) (b []byte) {
 	} else {
 		var buf bytes.Buffer
 		w := gzip.NewWriter(&buf)
-		defer w.Close()
 		w.Write(body)
-		w.Flush()
+		// the footer is written by Close.
+		w.Close()
 		b = buf.Bytes()
 	}
 	return
@@ -0,0 +1,56 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMergeSeri(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{
+			name: "same columns",
+			a:    `{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"]]}`,
+			b:    `{"name":"cpu","columns":["tagKey"],"values":[["host"],["zone"]]}`,
+			want: `{"name":"cpu","columns":["tagKey"],"values":[["host"],["region"],["zone"]]}`,
+		},
+		{
+			name: "different order",
+			a:    `{"name":"cpu","columns":["value","time"],"values":[[1,0]]}`,
+			b:    `{"name":"cpu","columns":["time","value"],"values":[[0,1],[10,2]]}`,
+			want: `{"name":"cpu","columns":["time","value"],"values":[[0,1],[10,2]]}`,
+		},
+		{
+			name: "missing columns",
+			a:    `{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["idle","float"]]}`,
+			b:    `{"name":"cpu","columns":["fieldKey","unit"],"values":[["idle","%"]]}`,
+			want: `{"name":"cpu","columns":["fieldKey","fieldType","unit"],"values":[["idle","float",null],["idle",null,"%"]]}`,
+		},
+	}
+	for _, tt := range tests {
+		var a, b seri
+		json.Unmarshal([]byte(tt.a), &a)
+		json.Unmarshal([]byte(tt.b), &b)
+		got, _ := json.Marshal(mergeSeri(a, b))
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		// the schema doesn't depend on which backend answers first.
+		reversed := mergeSeri(b, a)
+		if len(reversed.Values) != len(mergeSeri(a, b).Values) {
+			t.Errorf("%s: reversed values wrong: %v", tt.name, reversed.Values)
+		}
+		if tt.name != "same columns" && fmt.Sprint(reversed.Columns) != fmt.Sprint(mergeSeri(a, b).Columns) {
+			t.Errorf("%s: columns should be canonical: %v", tt.name, reversed.Columns)
+		}
+	}
+}
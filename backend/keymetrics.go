@@ -0,0 +1,128 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// measurements beyond the top N are summed up in this key, written as a gauge of its own.
+	OTHER_MEASUREMENT = "_other"
+	// measurements counted at most, KEY_METRICS_TRACKED times the top N.
+	KEY_METRICS_TRACKED = 10
+)
+
+// keyMetrics 每个 measurement 写入的点数. 最多记 KEY_METRICS_TRACKED*top 个 measurement,
+// 更多的计入 other, 输出时只有最多的 top 个有自己的 label.
+// sample 大于 1 时每 sample 个点只数一次, 每次加 sample
+type keyMetrics struct {
+	top    int
+	sample int64
+	seq    int64
+	other  int64
+	lock   sync.RWMutex
+	counts map[string]*int64
+}
+
+// newKeyMetrics top 为 0 时不统计, 返回 nil
+func newKeyMetrics(nodecfg *NodeConfig) *keyMetrics {
+	if nodecfg.MeasurementMetrics <= 0 {
+		return nil
+	}
+	km := &keyMetrics{
+		top:    nodecfg.MeasurementMetrics,
+		sample: int64(nodecfg.MeasurementMetricsSample),
+		counts: make(map[string]*int64),
+	}
+	if km.sample < 1 {
+		km.sample = 1
+	}
+	return km
+}
+
+// add 记一个写入 key 的点
+func (km *keyMetrics) add(key string) {
+	if km == nil {
+		return
+	}
+	if km.sample > 1 && atomic.AddInt64(&km.seq, 1)%km.sample != 0 {
+		return
+	}
+	km.lock.RLock()
+	counter, ok := km.counts[key]
+	km.lock.RUnlock()
+	if !ok {
+		km.lock.Lock()
+		counter, ok = km.counts[key]
+		if !ok && len(km.counts) < km.top*KEY_METRICS_TRACKED {
+			counter = new(int64)
+			km.counts[key] = counter
+			ok = true
+		}
+		km.lock.Unlock()
+	}
+	if !ok {
+		counter = &km.other
+	}
+	atomic.AddInt64(counter, km.sample)
+}
+
+type keyCount struct {
+	key   string
+	count int64
+}
+
+// topN 返回点数最多的 top 个 measurement, 按点数从多到少, 其余的合计在 OTHER_MEASUREMENT
+func (km *keyMetrics) topN() (counts []keyCount) {
+	km.lock.RLock()
+	for key, counter := range km.counts {
+		counts = append(counts, keyCount{key, atomic.LoadInt64(counter)})
+	}
+	km.lock.RUnlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].key < counts[j].key
+	})
+
+	other := atomic.LoadInt64(&km.other)
+	if len(counts) > km.top {
+		for _, kc := range counts[km.top:] {
+			other += kc.count
+		}
+		counts = counts[:km.top]
+	}
+	if other > 0 {
+		counts = append(counts, keyCount{OTHER_MEASUREMENT, other})
+	}
+	return
+}
+
+// writeMetrics 以prometheus文本格式输出每个 measurement 写入的点数.
+// measurement 进出 top N 时 _other 会变小, 所以 _other 是单独的 gauge, 每个 measurement 的 counter 只增不减
+func (km *keyMetrics) writeMetrics(w io.Writer) {
+	if km == nil {
+		return
+	}
+	name := "influxproxy_measurement_points_written_total"
+	writeMetricHeader(w, name, "counter", "Number of points written by measurement, for the top N measurements.")
+	var other int64
+	for _, kc := range km.topN() {
+		if kc.key == OTHER_MEASUREMENT {
+			other = kc.count
+			continue
+		}
+		fmt.Fprintf(w, "%s{measurement=%s} %d\n", name, quoteLabel(kc.key), kc.count)
+	}
+	name = "influxproxy_measurement_points_written_other"
+	writeMetricHeader(w, name, "gauge", "Number of points written by the measurements beyond the top N, changes as they enter and leave the top N.")
+	fmt.Fprintf(w, "%s %d\n", name, other)
+}
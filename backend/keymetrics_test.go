@@ -0,0 +1,96 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInfluxdbClusterKeyMetrics(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{MeasurementMetrics: 5}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs}, "mem": {bs}}}
+	for i := 0; i < 3; i++ {
+		ic.WriteRow([]byte("cpu value=1"), "", "test")
+	}
+	ic.WriteRow([]byte("mem value=1"), "", "test")
+	// not written, not counted.
+	ic.WriteRow([]byte("disk value=1"), "", "test")
+
+	var buf bytes.Buffer
+	ic.WriteMetrics(&buf)
+	for _, line := range []string{
+		`influxproxy_measurement_points_written_total{measurement="cpu"} 3`,
+		`influxproxy_measurement_points_written_total{measurement="mem"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metric not found: %s", line)
+		}
+	}
+	if strings.Contains(buf.String(), `measurement="disk"`) || !strings.Contains(buf.String(), "influxproxy_measurement_points_written_other 0\n") {
+		t.Errorf("unknown measurement should not be counted:\n%s", buf.String())
+	}
+
+	// label values escaped for prometheus, not as go strings.
+	ic.m2bs["test"]["_default_"] = []BackendAPI{bs}
+	ic.WriteRow([]byte(`温度,host=a value=1`), "", "test")
+	ic.WriteRow([]byte(`a\"b value=1`), "", "test")
+	buf.Reset()
+	ic.WriteMetrics(&buf)
+	for _, line := range []string{
+		`influxproxy_measurement_points_written_total{measurement="温度"} 1`,
+		`influxproxy_measurement_points_written_total{measurement="a\\\"b"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metric not found: %s\n%s", line, buf.String())
+		}
+	}
+
+	if v := quoteLabel("a\nb"); v != `"a\nb"` {
+		t.Errorf("newline should be escaped: %s", v)
+	}
+
+	// disabled by default.
+	buf.Reset()
+	NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".").WriteMetrics(&buf)
+	if strings.Contains(buf.String(), "influxproxy_measurement_points_written_total") {
+		t.Errorf("measurement metrics should be disabled")
+	}
+}
+
+func TestKeyMetricsCapped(t *testing.T) {
+	km := newKeyMetrics(&NodeConfig{MeasurementMetrics: 2})
+	for i := 0; i < 30; i++ {
+		for j := 0; j <= i%5; j++ {
+			km.add(fmt.Sprintf("m%d", i))
+		}
+	}
+	// only the first 20 measurements are tracked, the others are in _other.
+	if len(km.counts) != 2*KEY_METRICS_TRACKED {
+		t.Errorf("tracked measurements not capped: %d", len(km.counts))
+	}
+	counts := km.topN()
+	if fmt.Sprint(counts) != "[{m14 5} {m19 5} {_other 80}]" {
+		t.Errorf("top measurements wrong: %v", counts)
+	}
+
+	km = newKeyMetrics(&NodeConfig{MeasurementMetrics: 2, MeasurementMetricsSample: 10})
+	for i := 0; i < 105; i++ {
+		km.add("cpu")
+	}
+	if counts = km.topN(); fmt.Sprint(counts) != "[{cpu 100}]" {
+		t.Errorf("sampled count wrong: %v", counts)
+	}
+}
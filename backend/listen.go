@@ -0,0 +1,95 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const UNIX_PREFIX = "unix:"
+
+var ErrSocketInUse = errors.New("socket is in use by another process")
+
+// ListenAddrs 返回逗号分隔的监听地址, 第一个为主地址, 统计数据的 addr tag 使用主地址
+func ListenAddrs(listenAddr string) (addrs []string) {
+	for _, addr := range strings.Split(listenAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+	return
+}
+
+// Listen 监听 addr, unix:/path/to/socket 为 unix socket, 其他为 tcp 地址.
+// mode 为 socket 文件的权限, 如 0660, 空表示默认. 上次没有清理的 socket 文件会被删除,
+// 还有进程在监听时返回 ErrSocketInUse
+func Listen(addr string, mode string) (ln net.Listener, err error) {
+	if !strings.HasPrefix(addr, UNIX_PREFIX) {
+		if addr == "" {
+			addr = ":http"
+		}
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(addr, UNIX_PREFIX), "//")
+
+	var perm uint64
+	if mode != "" {
+		perm, err = strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			logs.Errorf("illegal socket mode %s", mode)
+			return nil, ErrIllegalConfig
+		}
+	}
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		return
+	}
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+	if mode != "" {
+		err = os.Chmod(path, os.FileMode(perm))
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// removeStaleSocket 删除没有进程监听的 socket 文件
+func removeStaleSocket(path string) (err error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		logs.Errorf("%s exists and is not a socket", path)
+		return ErrIllegalConfig
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+	logs.Warningf("remove stale socket %s", path)
+	return os.Remove(path)
+}
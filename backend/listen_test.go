@@ -0,0 +1,127 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := Listen(UNIX_PREFIX+path, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode wrong: %v %v", fi.Mode(), err)
+	}
+	if _, err = Listen(UNIX_PREFIX+path, ""); err != ErrSocketInUse {
+		t.Errorf("socket in use should not be removed: %v", err)
+	}
+	ln.Close()
+
+	// left by a crash.
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = Listen(UNIX_PREFIX+"//"+path, "")
+	if err != nil {
+		t.Fatalf("stale socket should be removed: %s", err)
+	}
+	ln.Close()
+
+	if _, err = Listen(UNIX_PREFIX+path, "999"); err != ErrIllegalConfig {
+		t.Errorf("illegal mode should be rejected: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err = Listen(UNIX_PREFIX+file, ""); err != ErrIllegalConfig {
+		t.Errorf("regular file should not be removed: %v", err)
+	}
+}
+
+func TestBackendsUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "influxdb.sock")
+	ln, err := Listen(UNIX_PREFIX+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := &strictInflux{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			w.WriteHeader(200)
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			return
+		}
+		si.ServeHTTP(w, req)
+	}))
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = "unix://" + path
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if _, err = bs.Ping(); err != nil {
+		t.Errorf("ping error: %s", err)
+	}
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "select value from cpu")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := NewDummyResponseWriter()
+	if err = bs.Query(w, req); err != nil || w.status != 200 || !bytes.Contains(w.buffer.Bytes(), []byte("statement_id")) {
+		t.Errorf("query error: %v %d", err, w.status)
+	}
+	bs.Write([]byte("cpu value=1 1434055562000000000\n"))
+	bs.FlushBuffer()
+	bs.wg.Wait()
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if len(si.lines) != 1 || !bs.IsActive() {
+		t.Errorf("write error: %v", si.lines)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	tests := []struct {
+		addr  string
+		addrs []string
+	}{
+		{"", []string{""}},
+		{":7076", []string{":7076"}},
+		{"10.0.0.1:7076, 10.8.0.1:7076,", []string{"10.0.0.1:7076", "10.8.0.1:7076"}},
+		{"unix:/tmp/proxy.sock,:7076", []string{"unix:/tmp/proxy.sock", ":7076"}},
+	}
+	for _, tt := range tests {
+		if addrs := ListenAddrs(tt.addr); fmt.Sprint(addrs) != fmt.Sprint(tt.addrs) {
+			t.Errorf("%q: got %q", tt.addr, addrs)
+		}
+	}
+
+	// the primary address in statistics.
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ListenAddr: "10.0.0.1:7076,10.8.0.1:7076"}, ".")
+	if ic.defaultTags["addr"] != "10.0.0.1:7076" {
+		t.Errorf("addr tag wrong: %s", ic.defaultTags["addr"])
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zxf0089216/influx-proxy/monitor"
+)
+
+type backendMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(stats *BackendStatistics) float64
+}
+
+var backendMetrics = []backendMetric{
+	{"influxproxy_backend_query_requests_total", "counter", "Number of queries sent to the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.QueryRequests) }},
+	{"influxproxy_backend_query_requests_fail_total", "counter", "Number of queries failed on the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.QueryRequestsFail) }},
+	{"influxproxy_backend_flush_rows_total", "counter", "Number of rows flushed from the buffer.",
+		func(stats *BackendStatistics) float64 { return float64(stats.FlushRows) }},
+	{"influxproxy_backend_flush_bytes_total", "counter", "Number of bytes flushed from the buffer.",
+		func(stats *BackendStatistics) float64 { return float64(stats.FlushBytes) }},
+	{"influxproxy_backend_flush_rows_avg", "gauge", "Average rows of a flushed batch.",
+		func(stats *BackendStatistics) float64 { return average(stats.FlushRows, stats.Flushes()) }},
+	{"influxproxy_backend_flush_bytes_avg", "gauge", "Average bytes of a flushed batch.",
+		func(stats *BackendStatistics) float64 { return average(stats.FlushBytes, stats.Flushes()) }},
+	{"influxproxy_backend_flush_inflight", "gauge", "Number of flushed batches being sent to the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.FlushInflight) }},
+	{"influxproxy_backend_flush_saturated_total", "counter", "Number of batches spooled because too many flushes were in flight.",
+		func(stats *BackendStatistics) float64 { return float64(stats.FlushSaturated) }},
+	{"influxproxy_backend_write_queue", "gauge", "Number of writes waiting in the channel of the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.WriteQueue) }},
+	{"influxproxy_backend_write_queue_capacity", "gauge", "Capacity of the channel of the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.WriteQueueCap) }},
+	{"influxproxy_backend_buffer_bytes", "gauge", "Bytes in the buffer of the backend, sampled every rewriteinterval.",
+		func(stats *BackendStatistics) float64 { return float64(stats.BufferBytes) }},
+	{"influxproxy_backend_buffer_rows", "gauge", "Rows in the buffer of the backend, sampled every rewriteinterval.",
+		func(stats *BackendStatistics) float64 { return float64(stats.BufferRows) }},
+	{"influxproxy_backend_last_write_timestamp_seconds", "gauge", "Unix time of the last successful write to the backend, 0 if none.",
+		func(stats *BackendStatistics) float64 { return float64(stats.LastWrite) / 1e9 }},
+	{"influxproxy_backend_row_limit", "gauge", "Current rows limit of a batch, adapted to the backend health.",
+		func(stats *BackendStatistics) float64 { return float64(stats.RowLimit) }},
+	{"influxproxy_backend_write_retries_total", "counter", "Number of in-line retries of failed batches.",
+		func(stats *BackendStatistics) float64 { return float64(stats.WriteRetries) }},
+	{"influxproxy_backend_write_retry_success_total", "counter", "Number of batches sent by in-line retry instead of spooled.",
+		func(stats *BackendStatistics) float64 { return float64(stats.WriteRetrySuccess) }},
+	{"influxproxy_backend_bad_lines_total", "counter", "Number of lines rejected by the backend and dropped.",
+		func(stats *BackendStatistics) float64 { return float64(stats.BadLines) }},
+	{"influxproxy_backend_too_large_splits_total", "counter", "Number of batches split in half because the backend rejected them with 413.",
+		func(stats *BackendStatistics) float64 { return float64(stats.TooLargeSplits) }},
+	{"influxproxy_backend_too_large_lines_total", "counter", "Number of lines too large for the backend even alone and dropped.",
+		func(stats *BackendStatistics) float64 { return float64(stats.TooLargeLines) }},
+	{"influxproxy_backend_duplicate_points_total", "counter", "Number of points merged into a point of the same series and timestamp in a batch.",
+		func(stats *BackendStatistics) float64 { return float64(stats.DuplicatePoints) }},
+	{"influxproxy_backend_capped_points_total", "counter", "Number of lines spooled instead of written because of the replication cap.",
+		func(stats *BackendStatistics) float64 { return float64(stats.CappedPoints) }},
+	{"influxproxy_backend_refused_points_total", "counter", "Number of lines refused because the backend was inactive and spoolonfailure is -1.",
+		func(stats *BackendStatistics) float64 { return float64(stats.RefusedPoints) }},
+	{"influxproxy_backend_shadow_dropped_total", "counter", "Number of lines dropped by a shadow backend whose queue is full.",
+		func(stats *BackendStatistics) float64 { return float64(stats.ShadowDropped) }},
+	{"influxproxy_backend_shadow_write_fail_total", "counter", "Number of batches failed to write to a shadow backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.ShadowWriteFail) }},
+	{"influxproxy_backend_failovers_total", "counter", "Number of batches spooled because the backend was unavailable.",
+		func(stats *BackendStatistics) float64 { return float64(stats.Failovers) }},
+	{"influxproxy_backend_failover", "gauge", "Whether writes of the backend are spooled, 1 until a write succeeds again.",
+		func(stats *BackendStatistics) float64 { return float64(stats.Failover) }},
+	{"influxproxy_backend_spool_writes_total", "counter", "Number of writes to the spool file, each holds one or more frames.",
+		func(stats *BackendStatistics) float64 { return float64(stats.SpoolWrites) }},
+	{"influxproxy_backend_spool_frames_total", "counter", "Number of batches spooled to the file.",
+		func(stats *BackendStatistics) float64 { return float64(stats.SpoolFrames) }},
+	{"influxproxy_backend_spool_bytes_total", "counter", "Number of bytes written to the spool file.",
+		func(stats *BackendStatistics) float64 { return float64(stats.SpoolBytes) }},
+	{"influxproxy_backend_expired_points_total", "counter", "Number of buffered points dropped by max buffer age.",
+		func(stats *BackendStatistics) float64 { return float64(stats.ExpiredPoints) }},
+	{"influxproxy_backend_expired_bytes_total", "counter", "Number of buffered bytes dropped by max buffer age.",
+		func(stats *BackendStatistics) float64 { return float64(stats.ExpiredBytes) }},
+	{"influxproxy_backend_new_conns_total", "counter", "Number of connections established to the backend.",
+		func(stats *BackendStatistics) float64 { return float64(stats.NewConns) }},
+	{"influxproxy_backend_reused_conns_total", "counter", "Number of requests sent on a reused connection.",
+		func(stats *BackendStatistics) float64 { return float64(stats.ReusedConns) }},
+}
+
+func average(total, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper 转义 prometheus 文本格式的 label 值, 只有 \, " 和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel 返回加上引号并转义的 label 值, %q 会把非 ASCII 字符转成 \u, prometheus 不认
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+type runtimeMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(stats *monitor.RuntimeStats) float64
+}
+
+var runtimeMetrics = []runtimeMetric{
+	{"influxproxy_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.HeapAlloc) }},
+	{"influxproxy_heap_sys_bytes", "gauge", "Bytes of heap memory obtained from the OS.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.HeapSys) }},
+	{"influxproxy_heap_objects", "gauge", "Number of allocated heap objects.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.HeapObjects) }},
+	{"influxproxy_gc_total", "counter", "Number of completed GC cycles.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.GCCount) }},
+	{"influxproxy_gc_pause_seconds_total", "counter", "Total time of GC pauses.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.GCPauseTotalNs) / 1e9 }},
+	{"influxproxy_goroutines", "gauge", "Number of goroutines.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.Goroutines) }},
+	{"influxproxy_open_fds", "gauge", "Number of open file descriptors, -1 if unknown.",
+		func(stats *monitor.RuntimeStats) float64 { return float64(stats.OpenFDs) }},
+}
+
+// WriteMetrics 以prometheus文本格式输出进程和各后端的统计
+func (ic *InfluxCluster) WriteMetrics(w io.Writer) {
+	rs := monitor.ReadRuntimeStats()
+	for _, m := range runtimeMetrics {
+		writeMetricHeader(w, m.name, m.typ, m.help)
+		fmt.Fprintf(w, "%s %g\n", m.name, m.value(&rs))
+	}
+
+	ic.keyMetrics.writeMetrics(w)
+
+	ic.lock.RLock()
+	names := make([]string, 0, len(ic.backends))
+	stats := make(map[string]BackendStatistics, len(ic.backends))
+	for name, bs := range ic.backends {
+		names = append(names, name)
+		stats[name] = bs.GetStats()
+	}
+	ic.lock.RUnlock()
+	sort.Strings(names)
+
+	writeMetricHeader(w, "influxproxy_backend_flush_total", "counter", "Number of buffer flushes by trigger reason.")
+	for _, name := range names {
+		s := stats[name]
+		fmt.Fprintf(w, "influxproxy_backend_flush_total{backend=%q,reason=%q} %d\n", name, FLUSH_COUNT, s.FlushByCount)
+		fmt.Fprintf(w, "influxproxy_backend_flush_total{backend=%q,reason=%q} %d\n", name, FLUSH_TIMER, s.FlushByTimer)
+		fmt.Fprintf(w, "influxproxy_backend_flush_total{backend=%q,reason=%q} %d\n", name, FLUSH_CLOSE, s.FlushByClose)
+		fmt.Fprintf(w, "influxproxy_backend_flush_total{backend=%q,reason=%q} %d\n", name, FLUSH_PRECISION, s.FlushByPrecision)
+		fmt.Fprintf(w, "influxproxy_backend_flush_total{backend=%q,reason=%q} %d\n", name, FLUSH_BYTES, s.FlushByBytes)
+	}
+
+	for _, m := range backendMetrics {
+		writeMetricHeader(w, m.name, m.typ, m.help)
+		for _, name := range names {
+			s := stats[name]
+			fmt.Fprintf(w, "%s{backend=%q} %g\n", m.name, name, m.value(&s))
+		}
+	}
+}
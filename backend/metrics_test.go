@@ -0,0 +1,46 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	cfg, ts := CreateTestBackendConfig("test")
+	defer ts.Close()
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs.Close()
+	bs.stats.FlushByCount = 2
+	bs.stats.FlushByTimer = 2
+	bs.stats.FlushRows = 40
+	ic.backends = map[string]BackendAPI{"test": bs}
+
+	var buf bytes.Buffer
+	ic.WriteMetrics(&buf)
+	for _, line := range []string{
+		`influxproxy_backend_flush_total{backend="test",reason="count"} 2`,
+		`influxproxy_backend_flush_total{backend="test",reason="timer"} 2`,
+		`influxproxy_backend_flush_rows_total{backend="test"} 40`,
+		`influxproxy_backend_flush_rows_avg{backend="test"} 10`,
+		`influxproxy_backend_write_queue{backend="test"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metric not found: %s", line)
+		}
+	}
+	for _, name := range []string{"influxproxy_heap_alloc_bytes", "influxproxy_gc_pause_seconds_total", "influxproxy_goroutines", "influxproxy_open_fds"} {
+		if !strings.Contains(buf.String(), "\n"+name+" ") {
+			t.Errorf("runtime metric not found: %s", name)
+		}
+	}
+}
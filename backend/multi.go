@@ -0,0 +1,143 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+var ErrSpanBackends = errors.New("measurements span multiple backends")
+
+// sameBackends a 和 b 是否是同一组后端, 不管顺序
+func sameBackends(a, b []BackendAPI) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[BackendAPI]bool, len(a))
+	for _, api := range a {
+		set[api] = true
+	}
+	for _, api := range b {
+		if !set[api] {
+			return false
+		}
+	}
+	return true
+}
+
+// multiQuery 处理 FROM 中有多个 measurement 的 select. 都在 apis 上时返回 false, 照常查询.
+// 否则开启 SplitMultiMeasurement 时拆成每个 measurement 一个查询, 分别查询后合并, 没有开启时返回 400.
+func (ic *InfluxCluster) multiQuery(w http.ResponseWriter, req *http.Request, db string, apis []BackendAPI) (handled bool, err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	members, start, end, err := scanFromList(q)
+	if err != nil || len(members) < 2 {
+		return false, nil
+	}
+
+	parts := make([][]BackendAPI, len(members))
+	same, sharded := true, false
+	for i, member := range members {
+		mdb, _, key := memberSource(member)
+		if mdb != "" && mdb != db {
+			writeError(w, 409, ErrDBConflict)
+			return true, ErrDBConflict
+		}
+		bs, ok := ic.GetBackends(key, db)
+		if !ok {
+			logs.Errorf("unknown measurement: %s,the query is %s\n", key, q)
+			w.WriteHeader(400)
+			w.Write([]byte("unknown measurement\n"))
+			return true, ErrUnknownMeasurement
+		}
+		recordAccess(req.Context(), key)
+		parts[i] = bs
+		same = same && sameBackends(bs, apis)
+		sharded = sharded || ic.isSharded(key)
+	}
+	if same {
+		return false, nil
+	}
+	// a sharded one can't be answered by a single backend.
+	if !ic.splitMulti || sharded {
+		writeError(w, 400, ErrSpanBackends)
+		return true, ErrSpanBackends
+	}
+
+	var header http.Header
+	var series []seri
+	var served []BackendAPI
+	for i, member := range members {
+		r := req.Clone(req.Context())
+		r.Body = nil
+		r.Form.Set("q", q[:start]+member+q[end:])
+		r.Form.Del("chunked")
+		r.Form.Del("chunk_size")
+		api, h, status, body, Err := ic.queryOne(r, parts[i])
+		if Err != nil {
+			writeError(w, 502, fmt.Errorf("query of %s failed: %s", memberMeasurement(member), Err))
+			return true, Err
+		}
+		// errors of the query are the same as InfluxDB's.
+		if status/100 != 2 {
+			writeResp(w, h, status, body)
+			return true, ErrUnknown
+		}
+		var resp statementArray
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		Err = dec.Decode(&resp)
+		if Err == nil && resp.Error != "" {
+			Err = errors.New(resp.Error)
+		}
+		if Err == nil && len(resp.Results) > 0 && resp.Results[0].Error != "" {
+			Err = errors.New(resp.Results[0].Error)
+		}
+		if Err != nil {
+			writeError(w, 400, Err)
+			return true, Err
+		}
+		if len(resp.Results) > 0 {
+			series = append(series, resp.Results[0].Series...)
+		}
+		if header == nil {
+			header = h
+		}
+		served = append(served, api)
+	}
+
+	body, err := GetJsonBodyfromSeries(series)
+	if err != nil {
+		writeError(w, 500, err)
+		return true, err
+	}
+	ic.servedBy(w, req, served...)
+	writeResp(w, header, 200, body)
+	return true, nil
+}
+
+// queryOne 同 Query, 先本 zone 后其他 zone, 返回第一个查询成功的后端和它的响应
+func (ic *InfluxCluster) queryOne(req *http.Request, apis []BackendAPI) (api BackendAPI, header http.Header, status int, body []byte, err error) {
+	local, remote := ic.queryBackends(apis)
+	local = ic.sticky(req, local)
+	err = ErrBackendNotExist
+	for _, api = range append(local, remote...) {
+		if req.Context().Err() != nil {
+			return api, nil, 0, nil, req.Context().Err()
+		}
+		recordAccess(req.Context(), "", api)
+		header, status, body, err = api.QueryResp(req)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
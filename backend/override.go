@@ -0,0 +1,156 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// BackendState 后端当前生效的状态, Override 表示由 admin 接口设置而不是配置文件
+type BackendState struct {
+	Name              string `json:"name"`
+	Active            bool   `json:"active"`
+	WriteOnly         bool   `json:"writeOnly"`
+	WriteOnlyOverride bool   `json:"writeOnlyOverride"`
+	Disabled          bool   `json:"disabled"`
+	DisabledOverride  bool   `json:"disabledOverride"`
+}
+
+// StateOverride 要修改的状态, 为 nil 的不变
+type StateOverride struct {
+	WriteOnly *bool `json:"writeOnly"`
+	// no queries, writes are spooled until enabled again.
+	Disabled *bool `json:"disabled"`
+}
+
+type backendOverride struct {
+	writeOnly *bool
+	// write only in the config when overridden, changed on reload means the config takes over.
+	cfgWriteOnly int
+	disabled     *bool
+}
+
+// backendOverrides admin 接口设置的后端状态, 重新加载配置后仍然生效
+type backendOverrides struct {
+	lock sync.Mutex
+	m    map[string]*backendOverride
+}
+
+func newBackendOverrides() *backendOverrides {
+	return &backendOverrides{m: make(map[string]*backendOverride)}
+}
+
+func (o *backendOverride) applyTo(hb *HttpBackend) {
+	var writeOnly, disabled int32
+	if o != nil && o.writeOnly != nil {
+		writeOnly = -1
+		if *o.writeOnly {
+			writeOnly = 1
+		}
+	}
+	if o != nil && o.disabled != nil && *o.disabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&hb.writeOnlyOverride, writeOnly)
+	atomic.StoreInt32(&hb.disabled, disabled)
+}
+
+// apply 给重新创建的后端加上 override, 配置文件改了 write only 时去掉这个 override
+func (bo *backendOverrides) apply(name string, cfg *BackendConfig, hb *HttpBackend) {
+	bo.lock.Lock()
+	defer bo.lock.Unlock()
+	o, ok := bo.m[name]
+	if !ok {
+		return
+	}
+	if o.writeOnly != nil && o.cfgWriteOnly != cfg.WriteOnly {
+		logs.Infof("write only of backend %s changed in config, override dropped", name)
+		o.writeOnly = nil
+	}
+	if o.writeOnly == nil && o.disabled == nil {
+		delete(bo.m, name)
+	}
+	o.applyTo(hb)
+}
+
+func (bo *backendOverrides) state(name string, hb *HttpBackend) (state BackendState) {
+	bo.lock.Lock()
+	defer bo.lock.Unlock()
+	o := bo.m[name]
+	return BackendState{
+		Name:              name,
+		Active:            hb.isHealthy(),
+		WriteOnly:         hb.IsWriteOnly(),
+		WriteOnlyOverride: o != nil && o.writeOnly != nil,
+		Disabled:          atomic.LoadInt32(&hb.disabled) != 0,
+		DisabledOverride:  o != nil && o.disabled != nil,
+	}
+}
+
+func (ic *InfluxCluster) httpBackend(name string) (hb *HttpBackend, err error) {
+	ic.lock.RLock()
+	api, ok := ic.backends[name]
+	ic.lock.RUnlock()
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	bs, ok := api.(*Backends)
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	return bs.HttpBackend, nil
+}
+
+// BackendState 返回后端 name 当前生效的状态
+func (ic *InfluxCluster) BackendState(name string) (state BackendState, err error) {
+	hb, err := ic.httpBackend(name)
+	if err != nil {
+		return
+	}
+	return ic.overrides.state(name, hb), nil
+}
+
+// SetBackendState 修改后端 name 的状态, addr 为请求方地址, 记在日志中
+func (ic *InfluxCluster) SetBackendState(name string, so StateOverride, addr string) (state BackendState, err error) {
+	hb, err := ic.httpBackend(name)
+	if err != nil {
+		return
+	}
+	ic.overrides.lock.Lock()
+	o, ok := ic.overrides.m[name]
+	if !ok {
+		o = &backendOverride{}
+		ic.overrides.m[name] = o
+	}
+	if so.WriteOnly != nil {
+		o.writeOnly = so.WriteOnly
+		o.cfgWriteOnly = hb.WriteOnly
+		logs.Warningf("write only of backend %s set to %v by %s", name, *so.WriteOnly, addr)
+	}
+	if so.Disabled != nil {
+		o.disabled = so.Disabled
+		logs.Warningf("disabled of backend %s set to %v by %s", name, *so.Disabled, addr)
+	}
+	o.applyTo(hb)
+	ic.overrides.lock.Unlock()
+	return ic.overrides.state(name, hb), nil
+}
+
+// ClearBackendState 去掉后端 name 的 override, 回到配置文件的状态
+func (ic *InfluxCluster) ClearBackendState(name string, addr string) (state BackendState, err error) {
+	hb, err := ic.httpBackend(name)
+	if err != nil {
+		return
+	}
+	ic.overrides.lock.Lock()
+	delete(ic.overrides.m, name)
+	(*backendOverride)(nil).applyTo(hb)
+	ic.overrides.lock.Unlock()
+	logs.Warningf("overrides of backend %s cleared by %s", name, addr)
+	return ic.overrides.state(name, hb), nil
+}
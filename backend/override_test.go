@@ -0,0 +1,86 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInfluxdbClusterBackendState(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(writeOnly int) {
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {"b1": {"url": %q, "db": "test", "writeonly": %d}},
+	"KEYMAPS": {"test": {"cpu": ["b1"]}},
+	"NODES": {"l1": {}}
+}`, ts.URL, writeOnly)
+		err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(0)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	reload := func() BackendAPI {
+		err := ic.LoadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ic.backends["b1"]
+	}
+	b1 := reload()
+
+	on, off := true, false
+	state, err := ic.SetBackendState("b1", StateOverride{WriteOnly: &on, Disabled: &on}, "127.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.WriteOnly || !state.WriteOnlyOverride || !state.Disabled || !state.DisabledOverride ||
+		!b1.IsWriteOnly() || b1.IsActive() {
+		t.Errorf("override should take effect: %+v", state)
+	}
+
+	// kept by reload with the same config.
+	b1 = reload()
+	if !b1.IsWriteOnly() || b1.IsActive() {
+		t.Errorf("override should survive reload")
+	}
+
+	ic.SetBackendState("b1", StateOverride{Disabled: &off}, "127.0.0.1:1234")
+	// the config changes write only, it takes over.
+	writeConfig(1)
+	b1 = reload()
+	state, _ = ic.BackendState("b1")
+	if !state.WriteOnly || state.WriteOnlyOverride || state.Disabled || !state.DisabledOverride || !b1.IsActive() {
+		t.Errorf("config should take over the changed setting: %+v", state)
+	}
+
+	ic.SetBackendState("b1", StateOverride{WriteOnly: &off}, "127.0.0.1:1234")
+	if b1.IsWriteOnly() {
+		t.Errorf("override should turn write only off")
+	}
+	state, _ = ic.ClearBackendState("b1", "127.0.0.1:1234")
+	if !state.WriteOnly || state.WriteOnlyOverride || state.DisabledOverride {
+		t.Errorf("clear should restore the config: %+v", state)
+	}
+
+	if _, err = ic.BackendState("nope"); err != ErrBackendNotExist {
+		t.Errorf("unknown backend: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// normalPrecision 返回写入接口接受的精度, 空表示纳秒, 不认识的精度返回 false
+func normalPrecision(precision string) (string, bool) {
+	switch precision {
+	case "", "n", "ns":
+		return "", true
+	case "u", "ms", "s", "m", "h":
+		return precision, true
+	}
+	return "", false
+}
+
+// convertPrecision 把 p 中每行的时间戳从 from 精度转换为 to 精度, 多余的位数被截断. 没有时间戳的行不变.
+func convertPrecision(p []byte, from, to string) []byte {
+	fm := models.GetPrecisionMultiplier(from)
+	tm := models.GetPrecisionMultiplier(to)
+	if fm == tm {
+		return p
+	}
+
+	buf := bytes.Buffer{}
+	buf.Grow(len(p))
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i+1], p[i+1:]
+		} else {
+			p = nil
+		}
+		buf.Write(convertLine(line, fm, tm))
+	}
+	return buf.Bytes()
+}
+
+func convertLine(line []byte, fm, tm int64) []byte {
+	body := bytes.TrimRight(line, " \t\r\n")
+	series, fields, ts := splitLine(body)
+	if len(fields) == 0 || len(ts) == 0 {
+		return line
+	}
+	n, err := strconv.ParseInt(string(ts), 10, 64)
+	if err != nil {
+		return line
+	}
+	if fm > tm {
+		n *= fm / tm
+	} else {
+		n /= tm / fm
+	}
+
+	out := make([]byte, 0, len(line))
+	out = append(out, series...)
+	out = append(out, ' ')
+	out = append(out, fields...)
+	out = append(out, ' ')
+	out = strconv.AppendInt(out, n, 10)
+	return append(out, line[len(body):]...)
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConvertPrecision(t *testing.T) {
+	tests := []struct {
+		p        string
+		from, to string
+		want     string
+	}{
+		{"cpu value=1 1434055562123456789\n", "", "ms", "cpu value=1 1434055562123\n"},
+		{"cpu value=1 1434055562123\n", "ms", "s", "cpu value=1 1434055562\n"},
+		{"cpu value=1 1434055562\n", "s", "ns", "cpu value=1 1434055562000000000\n"},
+		{"cpu value=1 1434055562123\n", "ms", "ms", "cpu value=1 1434055562123\n"},
+		{"cpu value=1\n", "", "s", "cpu value=1\n"},
+		{"cpu,host=a\\ b msg=\"x 1\" 1434055562000000000\ncpu value=2 1434055563000000000", "", "s",
+			"cpu,host=a\\ b msg=\"x 1\" 1434055562\ncpu value=2 1434055563"},
+	}
+	for _, tt := range tests {
+		if got := string(convertPrecision([]byte(tt.p), tt.from, tt.to)); got != tt.want {
+			t.Errorf("%q %s -> %s: got %q, want %q", tt.p, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxdbClusterForcePrecision(t *testing.T) {
+	type write struct {
+		precision string
+		body      string
+	}
+	var lock sync.Mutex
+	written := make(map[string]write)
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/write" {
+				body := req.Body
+				if req.Header.Get("Content-Encoding") == "gzip" {
+					body, _ = gzip.NewReader(req.Body)
+				}
+				p, _ := io.ReadAll(body)
+				lock.Lock()
+				written[name] = write{req.URL.Query().Get("precision"), string(p)}
+				lock.Unlock()
+			}
+			w.WriteHeader(204)
+		}))
+	}
+	ts1 := server("ms")
+	defer ts1.Close()
+	ts2 := server("ns")
+	defer ts2.Close()
+
+	var apis []BackendAPI
+	for _, tt := range []struct{ url, precision string }{{ts1.URL, "ms"}, {ts2.URL, ""}} {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = tt.url
+		cfg.ForcePrecision = tt.precision
+		bs, err := NewBackends(cfg, "force"+tt.precision, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		apis = append(apis, bs)
+	}
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis}}
+
+	err := ic.Write([]byte("cpu value=1 1434055562123456789\n"), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		lock.Lock()
+		n := len(written)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if w := written["ms"]; w.precision != "ms" || w.body != "cpu value=1 1434055562123\n" {
+		t.Errorf("backend forcing ms got %+v", w)
+	}
+	if w := written["ns"]; w.precision != "" || w.body != "cpu value=1 1434055562123456789\n" {
+		t.Errorf("other backend got %+v", w)
+	}
+}
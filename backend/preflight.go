@@ -0,0 +1,101 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	// lenient logs the problems of new backends, strict also fails the load.
+	PREFLIGHT_LENIENT = "lenient"
+	PREFLIGHT_STRICT  = "strict"
+)
+
+var ErrPreflight = errors.New("preflight of new backends failed")
+
+// checkPreflight 检查 preflight 的配置, 空表示不检查
+func checkPreflight(nodecfg *NodeConfig) (err error) {
+	switch nodecfg.Preflight {
+	case "", PREFLIGHT_LENIENT, PREFLIGHT_STRICT:
+		return
+	}
+	logs.Errorf("unknown preflight %s", nodecfg.Preflight)
+	return ErrIllegalConfig
+}
+
+// preflight 并发检查新加入或者 URL, db 改变了的后端: ping 后端, 并确认 db 存在.
+// 返回有问题的后端的描述
+func (ic *InfluxCluster) preflight(backends map[string]BackendAPI) (problems []string) {
+	ic.lock.RLock()
+	orig := ic.backends
+	ic.lock.RUnlock()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, api := range backends {
+		bs, ok := api.(*Backends)
+		if !ok {
+			continue
+		}
+		if o, ok := orig[name].(*Backends); ok && o.URL == bs.URL && o.DB == bs.DB {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, bs *Backends) {
+			defer wg.Done()
+			err := checkBackend(bs.HttpBackend)
+			if err == nil {
+				return
+			}
+			lock.Lock()
+			problems = append(problems, fmt.Sprintf("backend %s: %s", name, err))
+			lock.Unlock()
+		}(name, bs)
+	}
+	wg.Wait()
+	return
+}
+
+// checkBackend ping 后端并用 SHOW DATABASES 确认 db 存在
+func checkBackend(hb *HttpBackend) (err error) {
+	_, err = hb.Ping()
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %s", hb.URL, err)
+	}
+
+	form := url.Values{}
+	form.Set("q", "SHOW DATABASES")
+	req, err := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	if err != nil {
+		return
+	}
+	req.Form = form
+	_, status, body, err := hb.QueryResp(req)
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %s", hb.URL, err)
+	}
+	if status != 200 {
+		return fmt.Errorf("show databases on %s got status %d", hb.URL, status)
+	}
+	series, err := GetSeriesArray(body)
+	if err != nil {
+		return fmt.Errorf("show databases on %s: %s", hb.URL, err)
+	}
+	for _, s := range series {
+		for _, v := range s.Values {
+			if len(v) > 0 && v[0] == hb.DB {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("database %s does not exist on %s", hb.DB, hb.URL)
+}
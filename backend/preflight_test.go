@@ -0,0 +1,89 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInfluxdbClusterPreflight(t *testing.T) {
+	newServer := func(dbs string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				w.WriteHeader(200)
+				w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[` + dbs + `]}]}]}`))
+				return
+			}
+			w.WriteHeader(204)
+		}))
+	}
+	good := newServer(`["_internal"],["test"]`)
+	defer good.Close()
+	nodb := newServer(`["_internal"]`)
+	defer nodb.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, mode := range []string{PREFLIGHT_LENIENT, PREFLIGHT_STRICT} {
+		dir := t.TempDir()
+		cfgfile := filepath.Join(dir, "proxy.json")
+		writeConfig := func(url string) {
+			cfg := fmt.Sprintf(`{
+	"BACKENDS": {"good": {"url": %q, "db": "test"}, "new": {"url": %q, "db": "test"}},
+	"KEYMAPS": {"test": {"cpu": ["good", "new"]}},
+	"NODES": {"l1": {"preflight": %q}}
+}`, good.URL, url, mode)
+			err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writeConfig(good.URL)
+		fcs := NewFileConfigSource(cfgfile, "l1")
+		nodecfg, _ := fcs.LoadNode()
+		ic := NewInfluxCluster(fcs, &nodecfg, dir)
+		if err := ic.LoadConfig(); err != nil {
+			t.Fatalf("%s: healthy backends should pass: %s", mode, err)
+		}
+
+		for _, url := range []string{down.URL, nodb.URL} {
+			writeConfig(url)
+			err := ic.LoadConfig()
+			ic.lock.RLock()
+			loaded := ic.backends["new"].(*Backends).URL
+			ic.lock.RUnlock()
+			if mode == PREFLIGHT_STRICT {
+				if err != ErrPreflight || loaded != good.URL {
+					t.Errorf("%s: %s should fail the load: %v %s", mode, url, err, loaded)
+				}
+				continue
+			}
+			if err != nil || loaded != url {
+				t.Errorf("%s: %s should only be warned: %v %s", mode, url, err, loaded)
+			}
+		}
+		ic.Close()
+	}
+
+	for _, tt := range []struct {
+		url string
+		err string
+	}{
+		{good.URL, ""},
+		{nodb.URL, "database test does not exist on " + nodb.URL},
+	} {
+		hb := &HttpBackend{URL: tt.url, DB: "test", client: &http.Client{}, transport: newTransport(false, "")}
+		err := checkBackend(hb)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("check of %s wrong: %v", tt.url, err)
+		}
+	}
+}
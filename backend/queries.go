@@ -0,0 +1,138 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// activeBackends 返回所有可用的后端, 按名字排序
+func (ic *InfluxCluster) activeBackends() (apis []BackendAPI) {
+	ic.lock.RLock()
+	for _, api := range ic.backends {
+		if api.IsActive() {
+			apis = append(apis, api)
+		}
+	}
+	ic.lock.RUnlock()
+	sort.Slice(apis, func(i, j int) bool { return apis[i].GetName() < apis[j].GetName() })
+	return
+}
+
+// showQueries 把 SHOW QUERIES 发给所有可用的后端, 合并各后端的结果, 最后一列 backend 是查询所在的后端.
+// 失败的后端在 messages 中列出.
+func (ic *InfluxCluster) showQueries(w http.ResponseWriter, req *http.Request) (err error) {
+	apis := ic.activeBackends()
+	if len(apis) == 0 {
+		return ErrAllInactive
+	}
+
+	series := make([][]seri, len(apis))
+	errs := make([]error, len(apis))
+	var wg sync.WaitGroup
+	recordAccess(req.Context(), "", apis...)
+	for i, api := range apis {
+		wg.Add(1)
+		go func(i int, api BackendAPI) {
+			defer wg.Done()
+			// QueryResp sets the form and headers of the request, one per backend.
+			r := req.Clone(req.Context())
+			r.Body = nil
+			_, status, body, err := api.QueryResp(r)
+			switch {
+			case err != nil:
+			case status/100 != 2:
+				err = fmt.Errorf("status %d: %s", status, bytes.TrimSpace(body))
+			case statementError(body) != "":
+				err = errors.New(statementError(body))
+			default:
+				series[i], err = GetSeriesArray(body)
+			}
+			errs[i] = err
+		}(i, api)
+	}
+	wg.Wait()
+
+	var merged []seri
+	var messages []message
+	var served []BackendAPI
+	for i, api := range apis {
+		if errs[i] != nil {
+			logs.Errorf("show queries of backend %s error: %s", api.GetName(), errs[i])
+			messages = append(messages, message{Level: "warning", Text: fmt.Sprintf("backend %s: %s", api.GetName(), errs[i])})
+			continue
+		}
+		served = append(served, api)
+		for _, s := range series[i] {
+			if len(merged) == 0 {
+				merged = []seri{{Name: s.Name, Columns: append(append([]string(nil), s.Columns...), "backend"), Values: [][]interface{}{}}}
+			}
+			for _, v := range s.Values {
+				merged[0].Values = append(merged[0].Values, append(v, api.GetName()))
+			}
+		}
+	}
+	if len(served) == 0 {
+		writeError(w, 502, errs[0])
+		return errs[0]
+	}
+
+	body, err := GetJsonBodyfromSeries(merged, messages...)
+	if err != nil {
+		return
+	}
+	ic.servedBy(w, req, served...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+	return
+}
+
+// killQuery 把 KILL QUERY 发给 ON 或者 backend 参数指定的后端, query id 只在一个后端内唯一.
+// m 为 KillQueryCmds 匹配的结果.
+func (ic *InfluxCluster) killQuery(w http.ResponseWriter, req *http.Request, m []string) (err error) {
+	name := req.FormValue("backend")
+	if m[2] != "" {
+		name = strings.Trim(m[2], `"`)
+	}
+	if name == "" {
+		writeError(w, 400, ErrKillBackend)
+		return ErrKillBackend
+	}
+	ic.lock.RLock()
+	api, ok := ic.backends[name]
+	ic.lock.RUnlock()
+	if !ok {
+		writeError(w, 400, fmt.Errorf("unknown backend %s", name))
+		return ErrBackendNotExist
+	}
+	if !api.IsActive() {
+		writeError(w, 503, fmt.Errorf("backend %s is not active", name))
+		return ErrUnavailable
+	}
+
+	r := req.Clone(req.Context())
+	r.Body = nil
+	r.Form.Set("q", "KILL QUERY "+m[1])
+	r.Form.Del("backend")
+	logs.Infof("kill query %s on backend %s, the client is %s", m[1], name, req.RemoteAddr)
+	recordAccess(req.Context(), "", api)
+	header, status, body, err := api.QueryResp(r)
+	if err != nil {
+		writeError(w, 502, err)
+		return
+	}
+	ic.servedBy(w, req, api)
+	writeResp(w, header, status, body)
+	return
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInfluxdbClusterShowKillQueries(t *testing.T) {
+	var lock sync.Mutex
+	killed := make(map[string][]string)
+	newBackend := func(name string, qids ...int) *Backends {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			q := req.FormValue("q")
+			switch {
+			case req.URL.Path != "/query":
+				w.WriteHeader(204)
+			case strings.HasPrefix(q, "KILL QUERY "):
+				lock.Lock()
+				killed[name] = append(killed[name], q)
+				lock.Unlock()
+				w.WriteHeader(200)
+				w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			case q == "SHOW QUERIES" && qids == nil:
+				w.WriteHeader(500)
+				w.Write([]byte("melting down"))
+			default:
+				var values []string
+				for _, qid := range qids {
+					values = append(values, fmt.Sprintf(`[%d,"SELECT * FROM cpu","db1","%ds","running"]`, qid, qid))
+				}
+				w.WriteHeader(200)
+				fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"columns":["qid","query","database","duration","status"],"values":[%s]}]}]}`,
+					strings.Join(values, ","))
+			}
+		}))
+		t.Cleanup(ts.Close)
+		cfg, _ := CreateTestBackendConfig("db1")
+		cfg.URL = ts.URL
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{AllowQueryAdmin: 1}, ".")
+	defer ic.Close()
+	ic.backends = map[string]BackendAPI{
+		"b1":       newBackend("b1", 36, 37),
+		"b2":       newBackend("b2", 36),
+		"broken":   newBackend("broken"),
+		"inactive": newBackend("inactive", 99),
+	}
+	atomic.StoreInt32(&ic.backends["inactive"].(*Backends).disabled, 1)
+
+	query := func(q string, params ...string) *DummyResponseWriter {
+		v := url.Values{}
+		v.Set("q", q)
+		for i := 0; i+1 < len(params); i += 2 {
+			v.Set(params[i], params[i+1])
+		}
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+v.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		return w
+	}
+
+	w := query("SHOW QUERIES")
+	var resp statementArray
+	if err := json.Unmarshal(w.buffer.Bytes(), &resp); err != nil || w.status != 200 || len(resp.Results) != 1 {
+		t.Fatalf("show queries failed: %d %s", w.status, w.buffer.String())
+	}
+	result := resp.Results[0]
+	if len(result.Series) != 1 || strings.Join(result.Series[0].Columns, ",") != "qid,query,database,duration,status,backend" {
+		t.Fatalf("columns wrong: %s", w.buffer.String())
+	}
+	var rows []string
+	for _, v := range result.Series[0].Values {
+		rows = append(rows, fmt.Sprintf("%v@%v", v[0], v[5]))
+	}
+	if strings.Join(rows, " ") != "36@b1 37@b1 36@b2" {
+		t.Errorf("queries of the active backends should be merged: %v", rows)
+	}
+	if len(result.Messages) != 1 || !strings.Contains(result.Messages[0].Text, "backend broken: status 500: melting down") {
+		t.Errorf("failed backend should be listed: %v", result.Messages)
+	}
+
+	// query ids are per backend.
+	if w = query(`KILL QUERY 36 ON "b2"`); w.status != 200 {
+		t.Errorf("kill failed: %d %s", w.status, w.buffer.String())
+	}
+	if w = query("kill query 37", "backend", "b1"); w.status != 200 {
+		t.Errorf("kill failed: %d %s", w.status, w.buffer.String())
+	}
+	lock.Lock()
+	if len(killed) != 2 || strings.Join(killed["b2"], ",") != "KILL QUERY 36" || strings.Join(killed["b1"], ",") != "KILL QUERY 37" {
+		t.Errorf("kill should go to the backend: %v", killed)
+	}
+	lock.Unlock()
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"KILL QUERY 36", 400},
+		{"KILL QUERY 36 ON unknown", 400},
+		{"KILL QUERY 99 ON inactive", 503},
+	}
+	for _, tt := range tests {
+		if w = query(tt.query); w.status != tt.status {
+			t.Errorf("%s: %d %s", tt.query, w.status, w.buffer.String())
+		}
+	}
+
+	// gated by the forbidden rules.
+	rules, err := loadQueryRules(&NodeConfig{ForbidCmds: []string{"(?i:^\\s*(show\\s+queries|kill\\s))"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.setQueryRules(rules)
+	if w = query("SHOW QUERIES"); w.status != 400 {
+		t.Errorf("show queries should be forbidden: %d", w.status)
+	}
+	if w = query(`KILL QUERY 36 ON "b2"`); w.status != 400 {
+		t.Errorf("kill should be forbidden: %d", w.status)
+	}
+	// forbidden by default without auth tokens.
+	for _, cfg := range []NodeConfig{{}, {AuthTokens: map[string]string{"a-secret": "admin"}}} {
+		rules, err = loadQueryRules(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ic.setQueryRules(rules)
+		forbidden := len(cfg.AuthTokens) == 0
+		if w = query("SHOW QUERIES"); (w.status == 400) != forbidden {
+			t.Errorf("%+v: show queries %d", cfg, w.status)
+		}
+		if w = query(`KILL QUERY 36 ON "b2"`); (w.status == 400) != forbidden {
+			t.Errorf("%+v: kill %d", cfg, w.status)
+		}
+	}
+	if QueryPermission("SHOW QUERIES") != PERM_ADMIN || QueryPermission("KILL QUERY 1 ON b1") != PERM_ADMIN {
+		t.Errorf("queries should need the admin permission")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	// statistics of the proxy itself, never limited.
+	MONITOR_DB          = "influxproxy"
+	MONITOR_MEASUREMENT = "statistics"
+
+	QUOTA_WINDOW = 10 * time.Second
+)
+
+var (
+	ErrQuotaExceeded = errors.New("write quota exceeded")
+)
+
+// loadWriteQuotas 检查每个 db 每秒最多写入的点数, 0 表示不限制
+func loadWriteQuotas(nodecfg *NodeConfig) (quotas map[string]float64, err error) {
+	for db, quota := range nodecfg.WriteQuotas {
+		if quota < 0 || math.IsNaN(quota) {
+			logs.Errorf("write quota %v of db %s is negative", quota, db)
+			return nil, ErrIllegalConfig
+		}
+	}
+	return nodecfg.WriteQuotas, nil
+}
+
+// quotaWindow 滑动窗口, 用上一个窗口按剩余比例加上当前窗口估计最近 QUOTA_WINDOW 内的点数
+type quotaWindow struct {
+	start     time.Time
+	prev      float64
+	cur       float64
+	throttled int64
+}
+
+func (qw *quotaWindow) slide(now time.Time) {
+	elapsed := now.Sub(qw.start)
+	switch {
+	case elapsed < QUOTA_WINDOW:
+		return
+	case elapsed < 2*QUOTA_WINDOW:
+		qw.prev = qw.cur
+	default:
+		qw.prev = 0
+	}
+	qw.cur = 0
+	qw.start = now.Truncate(QUOTA_WINDOW)
+}
+
+func (qw *quotaWindow) count(now time.Time) float64 {
+	weight := 1 - float64(now.Sub(qw.start))/float64(QUOTA_WINDOW)
+	return qw.prev*weight + qw.cur
+}
+
+type QuotaInfo struct {
+	Quota float64 `json:"quota"`
+	// points per second in the recent window.
+	Rate      float64 `json:"rate"`
+	Throttled int64   `json:"throttled"`
+}
+
+// writeQuotas 各 db 的写入配额, 重新加载配置时保留窗口
+type writeQuotas struct {
+	lock    sync.Mutex
+	quotas  map[string]float64
+	windows map[string]*quotaWindow
+	// the stats db is never limited.
+	exempt string
+}
+
+func newWriteQuotas(quotas map[string]float64) *writeQuotas {
+	return &writeQuotas{
+		quotas:  quotas,
+		windows: make(map[string]*quotaWindow),
+		exempt:  MONITOR_DB,
+	}
+}
+
+func (wq *writeQuotas) setQuotas(quotas map[string]float64) {
+	wq.lock.Lock()
+	defer wq.lock.Unlock()
+	wq.quotas = quotas
+}
+
+// take 记录 db 写入的 n 个点, 超过配额时整个请求被拒绝
+func (wq *writeQuotas) take(db string, n int) bool {
+	if db == wq.exempt {
+		return true
+	}
+	wq.lock.Lock()
+	defer wq.lock.Unlock()
+	quota := wq.quotas[db]
+	if quota <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	qw, ok := wq.windows[db]
+	if !ok {
+		qw = &quotaWindow{start: now.Truncate(QUOTA_WINDOW)}
+		wq.windows[db] = qw
+	}
+	qw.slide(now)
+	if qw.count(now)+float64(n) > quota*QUOTA_WINDOW.Seconds() {
+		qw.throttled += int64(n)
+		return false
+	}
+	qw.cur += float64(n)
+	return true
+}
+
+func (wq *writeQuotas) infos() (infos map[string]QuotaInfo) {
+	wq.lock.Lock()
+	defer wq.lock.Unlock()
+	now := time.Now()
+	infos = make(map[string]QuotaInfo)
+	for db, quota := range wq.quotas {
+		if quota <= 0 || db == wq.exempt {
+			continue
+		}
+		info := QuotaInfo{Quota: quota}
+		if qw, ok := wq.windows[db]; ok {
+			qw.slide(now)
+			info.Rate = qw.count(now) / QUOTA_WINDOW.Seconds()
+			info.Throttled = qw.throttled
+		}
+		infos[db] = info
+	}
+	return
+}
+
+type ProxyStats struct {
+	Quotas           map[string]QuotaInfo `json:"quotas"`
+	AccessLogDropped int64                `json:"access_log_dropped"`
+	// state events not delivered to the webhook.
+	StateWebhookDropped int64 `json:"state_webhook_dropped"`
+	// connections of each backend.
+	Connections map[string]ConnStats `json:"connections"`
+	// write backlog of each backend.
+	Queues map[string]QueueStats `json:"queues"`
+}
+
+// Stats 代理的状态, 包括各 db 的写入配额
+func (ic *InfluxCluster) Stats() (stats ProxyStats) {
+	stats.Quotas = ic.quotas.infos()
+	if ic.accessLog != nil {
+		stats.AccessLogDropped = ic.accessLog.Dropped()
+	}
+	stats.StateWebhookDropped = ic.events.Dropped()
+	stats.Connections = ic.connStats()
+	stats.Queues = ic.queueStats()
+	return
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteQuotas(t *testing.T) {
+	// 10 points per second, 100 in a window.
+	wq := newWriteQuotas(map[string]float64{"teamA": 10, MONITOR_DB: 1})
+	if !wq.take("teamA", 60) {
+		t.Errorf("points in the quota should pass")
+	}
+	if wq.take("teamA", 50) {
+		t.Errorf("points over the quota should be throttled")
+	}
+	if !wq.take("teamA", 40) {
+		t.Errorf("points in the quota should pass")
+	}
+	if !wq.take("teamB", 1000) || !wq.take(MONITOR_DB, 1000) {
+		t.Errorf("db without quota should not be limited")
+	}
+
+	// window is kept when quotas are reloaded.
+	wq.setQuotas(map[string]float64{"teamA": 10})
+	if wq.take("teamA", 1) {
+		t.Errorf("window should be kept after reload")
+	}
+	infos := wq.infos()
+	if len(infos) != 1 || infos["teamA"].Throttled != 51 || infos["teamA"].Rate <= 0 {
+		t.Errorf("quota infos wrong: %+v", infos)
+	}
+}
+
+func TestInfluxdbClusterWriteQuota(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(quota int) {
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {"b1": {"url": %q, "db": "test", "rewriteinterval": 60000}},
+	"KEYMAPS": {"teamA": {"cpu": ["b1"]}},
+	"NODES": {"l1": {"writequotas": {"teamA": %d}}}
+}`, ts.URL, quota)
+		err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(1)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Repeat("cpu value=1\n", 8)
+	if err = ic.Write([]byte(lines), "ns", "teamA"); err != nil {
+		t.Errorf("write in the quota should pass: %v", err)
+	}
+	if err = ic.Write([]byte(lines), "ns", "teamA"); err != ErrQuotaExceeded {
+		t.Errorf("write over the quota should be throttled: %v", err)
+	}
+
+	writeConfig(2)
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ic.Write([]byte(lines+lines), "ns", "teamA"); err != ErrQuotaExceeded {
+		t.Errorf("window should survive reload: %v", err)
+	}
+	if err = ic.Write([]byte(lines), "ns", "teamA"); err != nil {
+		t.Errorf("write in the new quota should pass: %v", err)
+	}
+	if info := ic.Stats().Quotas["teamA"]; info.Quota != 2 || info.Throttled != 24 {
+		t.Errorf("quota stats wrong: %+v", info)
+	}
+}
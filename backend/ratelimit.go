@@ -0,0 +1,229 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_RATE_LIMIT_CLIENTS = 10000
+)
+
+// kinds of rate limits
+const (
+	RATE_WRITE = iota
+	RATE_POINTS
+	RATE_QUERY
+	rateKinds
+)
+
+type rateLimits struct {
+	// per second of a client, 0 means no limit.
+	rates          [rateKinds]float64
+	trustForwarded bool
+	maxClients     int
+}
+
+func loadRateLimits(nodecfg *NodeConfig) (limits rateLimits, err error) {
+	limits.rates = [rateKinds]float64{nodecfg.WriteRateLimit, nodecfg.WritePointsLimit, nodecfg.QueryRateLimit}
+	for _, rate := range limits.rates {
+		if rate < 0 || math.IsNaN(rate) {
+			return limits, ErrIllegalConfig
+		}
+	}
+	limits.trustForwarded = nodecfg.TrustForwarded != 0
+	limits.maxClients = nodecfg.RateLimitClients
+	if limits.maxClients <= 0 {
+		limits.maxClients = DEFAULT_RATE_LIMIT_CLIENTS
+	}
+	return
+}
+
+// tokenBucket 每秒补充 rate 个 token, 最多 rate 个.
+// 一次可以取超过容量的 token, 欠下的在之后补上.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) take(n, rate float64, now time.Time) (wait time.Duration, ok bool) {
+	capacity := math.Max(rate, 1)
+	if tb.last.IsZero() {
+		tb.tokens = capacity
+	} else {
+		tb.tokens = math.Min(capacity, tb.tokens+now.Sub(tb.last).Seconds()*rate)
+	}
+	tb.last = now
+
+	need := math.Min(n, capacity)
+	if tb.tokens < need {
+		return time.Duration((need - tb.tokens) / rate * float64(time.Second)), false
+	}
+	tb.tokens -= n
+	return 0, true
+}
+
+type rateClient struct {
+	addr    string
+	buckets [rateKinds]tokenBucket
+	limited [rateKinds]int64
+}
+
+type RateLimitInfo struct {
+	Client        string `json:"client"`
+	WriteLimited  int64  `json:"write_limited"`
+	PointsLimited int64  `json:"points_limited"`
+	QueryLimited  int64  `json:"query_limited"`
+}
+
+// rateLimiter 按客户端地址限流, 只记录最近的 maxClients 个客户端
+type rateLimiter struct {
+	lock    sync.Mutex
+	limits  rateLimits
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+func newRateLimiter(limits rateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		clients: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (rl *rateLimiter) setLimits(limits rateLimits) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.limits = limits
+	for rl.lru.Len() > limits.maxClients {
+		rl.evict()
+	}
+}
+
+func (rl *rateLimiter) evict() {
+	e := rl.lru.Back()
+	rl.lru.Remove(e)
+	delete(rl.clients, e.Value.(*rateClient).addr)
+}
+
+// addr 同 clientAddr, 在锁外调用
+func (rl *rateLimiter) addr(req *http.Request) string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.clientAddr(req)
+}
+
+// clientAddr 客户端地址, 信任代理时取 X-Forwarded-For 的第一个地址
+func (rl *rateLimiter) clientAddr(req *http.Request) string {
+	if rl.limits.trustForwarded {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (rl *rateLimiter) take(req *http.Request, kind int, n int) (wait time.Duration, ok bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rate := rl.limits.rates[kind]
+	if rate <= 0 {
+		return 0, true
+	}
+
+	addr := rl.clientAddr(req)
+	e, found := rl.clients[addr]
+	if found {
+		rl.lru.MoveToFront(e)
+	} else {
+		e = rl.lru.PushFront(&rateClient{addr: addr})
+		rl.clients[addr] = e
+		if rl.lru.Len() > rl.limits.maxClients {
+			rl.evict()
+		}
+	}
+	client := e.Value.(*rateClient)
+	wait, ok = client.buckets[kind].take(float64(n), rate, time.Now())
+	if !ok {
+		client.limited[kind]++
+	}
+	return
+}
+
+func (rl *rateLimiter) infos() (infos []RateLimitInfo) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	infos = make([]RateLimitInfo, 0)
+	for e := rl.lru.Front(); e != nil; e = e.Next() {
+		client := e.Value.(*rateClient)
+		if client.limited == [rateKinds]int64{} {
+			continue
+		}
+		infos = append(infos, RateLimitInfo{
+			Client:        client.addr,
+			WriteLimited:  client.limited[RATE_WRITE],
+			PointsLimited: client.limited[RATE_POINTS],
+			QueryLimited:  client.limited[RATE_QUERY],
+		})
+	}
+	total := func(info RateLimitInfo) int64 {
+		return info.WriteLimited + info.PointsLimited + info.QueryLimited
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return total(infos[i]) > total(infos[j])
+	})
+	return
+}
+
+// RateLimit 检查客户端的 n 个请求或者点是否超过 kind 的限制, 超过时应答 429 并返回 false
+func (ic *InfluxCluster) RateLimit(w http.ResponseWriter, req *http.Request, kind int, n int) bool {
+	wait, ok := ic.limiter.take(req, kind, n)
+	if ok {
+		return true
+	}
+	atomic.AddInt64(&ic.stats.RateLimited, 1)
+	w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(429)
+	w.Write([]byte("{\"error\":\"rate limit exceeded\"}\n"))
+	return false
+}
+
+// CountRows 统计未压缩数据中的行数, 最后一行可以没有换行, 空行不计
+func CountRows(p []byte) (n int) {
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			p = nil
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// RateLimitInfos 最近被限流的客户端, 按被限流的次数排序
+func (ic *InfluxCluster) RateLimitInfos() []RateLimitInfo {
+	return ic.limiter.infos()
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var tb tokenBucket
+	now := time.Unix(1434055562, 0)
+	for i := 0; i < 10; i++ {
+		if _, ok := tb.take(1, 10, now); !ok {
+			t.Fatalf("take %d should be allowed", i)
+		}
+	}
+	wait, ok := tb.take(1, 10, now)
+	if ok || wait != 100*time.Millisecond {
+		t.Errorf("bucket should be empty: %v %v", wait, ok)
+	}
+	if _, ok = tb.take(1, 10, now.Add(100*time.Millisecond)); !ok {
+		t.Errorf("bucket should be refilled")
+	}
+
+	// a batch larger than the capacity is allowed on a full bucket, then paid back.
+	tb = tokenBucket{}
+	if _, ok = tb.take(30, 10, now); !ok {
+		t.Errorf("large batch should be allowed on a full bucket")
+	}
+	wait, ok = tb.take(1, 10, now.Add(time.Second))
+	if ok || wait != 1100*time.Millisecond {
+		t.Errorf("debt should be paid back: %v %v", wait, ok)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{QueryRateLimit: 2, TrustForwarded: 1, RateLimitClients: 2}, ".")
+	query := func(addr, forwarded string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query", nil)
+		req.RemoteAddr = addr
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		if ic.RateLimit(w, req, RATE_QUERY, 1) {
+			w.WriteHeader(204)
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := query("10.0.0.1:1234", ""); w.Code != 204 {
+			t.Errorf("query %d should be allowed: %d", i, w.Code)
+		}
+	}
+	w := query("10.0.0.1:1235", "")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("query should be limited: %d %v", w.Code, w.Header())
+	}
+	if w := query("10.0.0.2:1234", ""); w.Code != 204 {
+		t.Errorf("other client should be allowed: %d", w.Code)
+	}
+	// behind a trusted proxy.
+	query("10.0.0.3:1234", "192.168.0.1, 10.0.0.3")
+	query("10.0.0.4:1234", "192.168.0.1")
+	if w := query("10.0.0.5:1234", "192.168.0.1"); w.Code != 429 {
+		t.Errorf("forwarded client should be limited: %d", w.Code)
+	}
+	// writes are not limited.
+	req, _ := http.NewRequest("POST", "http://localhost:8086/write", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if !ic.RateLimit(httptest.NewRecorder(), req, RATE_WRITE, 1) {
+		t.Errorf("writes should not be limited")
+	}
+
+	// 10.0.0.1 is evicted by the newer clients.
+	infos := ic.RateLimitInfos()
+	if len(infos) != 1 || infos[0].Client != "192.168.0.1" || infos[0].QueryLimited != 1 {
+		t.Errorf("limited clients wrong: %+v", infos)
+	}
+	if len(ic.limiter.clients) != 2 || ic.limiter.lru.Len() != 2 {
+		t.Errorf("clients should be bounded: %d", len(ic.limiter.clients))
+	}
+	if ic.stats.RateLimited != 2 {
+		t.Errorf("rate limited counter wrong: %d", ic.stats.RateLimited)
+	}
+
+	// reloaded without limits.
+	limits, _ := loadRateLimits(&NodeConfig{})
+	ic.limiter.setLimits(limits)
+	if w := query("10.0.0.1:1234", ""); w.Code != 204 {
+		t.Errorf("limit should be removed by reload: %d", w.Code)
+	}
+}
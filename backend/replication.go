@@ -0,0 +1,102 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+var ErrIllegalCap = errors.New("replication cap should not be negative")
+
+// ReplicationCap 写入复制的上限, 一个点最多直接写入 KEYMAPS 中的前 Default 个后端,
+// 其余的后端写到备份文件, 由重放协程补发. Measurements 为单个 measurement 的上限, 0 为不限制.
+// 影子后端不受限制, 也不计数.
+type ReplicationCap struct {
+	Default      int            `json:"default"`
+	Measurements map[string]int `json:"measurements,omitempty"`
+}
+
+// capOf 返回 measurement key 的上限
+func (rc *ReplicationCap) capOf(key string) int {
+	if n, ok := rc.Measurements[key]; ok {
+		return n
+	}
+	return rc.Default
+}
+
+// replicationCap 当前的上限, 每个写入的点都要读取
+type replicationCap struct {
+	v atomic.Value
+}
+
+func newReplicationCap() *replicationCap {
+	r := &replicationCap{}
+	r.v.Store(&ReplicationCap{})
+	return r
+}
+
+func (r *replicationCap) load() *ReplicationCap {
+	return r.v.Load().(*ReplicationCap)
+}
+
+// split 按上限分开 bs, direct 照常写入, spooled 写到备份文件. 没有超过上限时直接返回 bs
+func (r *replicationCap) split(key string, bs []BackendAPI) (direct []BackendAPI, spooled []BackendAPI) {
+	n := r.load().capOf(key)
+	if n <= 0 || len(bs) <= n {
+		return bs, nil
+	}
+	direct = make([]BackendAPI, 0, len(bs))
+	for _, b := range bs {
+		if b.IsShadow() {
+			direct = append(direct, b)
+			continue
+		}
+		if n > 0 {
+			n--
+			direct = append(direct, b)
+			continue
+		}
+		// a backend without spool can't be written later.
+		if _, ok := b.(*Backends); !ok {
+			direct = append(direct, b)
+			continue
+		}
+		spooled = append(spooled, b)
+	}
+	return
+}
+
+// spoolCapped 把 line 写到超过上限的后端的备份文件
+func spoolCapped(spooled []BackendAPI, line []byte, precision string) {
+	for _, b := range spooled {
+		err := b.(*Backends).Spool(line, precision)
+		if err != nil {
+			logs.Errorf("spool of backend %s error: %s\n", b.GetName(), err)
+		}
+	}
+}
+
+// ReplicationCap 返回当前的写入复制上限
+func (ic *InfluxCluster) ReplicationCap() ReplicationCap {
+	return *ic.replication.load()
+}
+
+// SetReplicationCap 修改写入复制上限, 立即生效, 重新加载配置后仍然生效. addr 为请求方地址, 记在日志中
+func (ic *InfluxCluster) SetReplicationCap(rc ReplicationCap, addr string) (err error) {
+	if rc.Default < 0 {
+		return ErrIllegalCap
+	}
+	for _, n := range rc.Measurements {
+		if n < 0 {
+			return ErrIllegalCap
+		}
+	}
+	ic.replication.v.Store(&rc)
+	logs.Warningf("replication cap set to %d, measurements %v by %s", rc.Default, rc.Measurements, addr)
+	return
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInfluxdbClusterReplicationCap(t *testing.T) {
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	var sis []*strictInflux
+	var apis []BackendAPI
+	for _, name := range []string{"b1", "b2"} {
+		si := &strictInflux{}
+		ts := httptest.NewServer(si)
+		defer ts.Close()
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		cfg.RewriteInterval = 60000
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sis = append(sis, si)
+		apis = append(apis, bs)
+	}
+	ic.backends = map[string]BackendAPI{"b1": apis[0], "b2": apis[1]}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": apis, "mem": apis}}
+	b1, b2 := apis[0].(*Backends), apis[1].(*Backends)
+	flush := func() {
+		for _, bs := range []*Backends{b1, b2} {
+			bs.FlushBuffer()
+			bs.wg.Wait()
+		}
+	}
+
+	if err := ic.SetReplicationCap(ReplicationCap{Default: -1}, "test"); err != ErrIllegalCap {
+		t.Errorf("negative cap should be rejected: %v", err)
+	}
+	err := ic.SetReplicationCap(ReplicationCap{Default: 1, Measurements: map[string]int{"mem": 0}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cpu is written to b1 only and spooled for b2.
+	err = ic.Write([]byte("cpu value=1 1434055562000000000\ncpu value=2 1434055562000000001\ncpu value=3 1434055562000000002\n"), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	if len(sis[0].lines) != 3 || len(sis[1].lines) != 0 {
+		t.Errorf("only b1 should get the direct write: %d %d", len(sis[0].lines), len(sis[1].lines))
+	}
+	frames, _, lines, _ := b2.fb.Contents(true)
+	if frames != 1 || lines != 3 || b2.GetStats().CappedPoints != 3 || b1.GetStats().CappedPoints != 0 {
+		t.Errorf("b2 should spool the lines: %d %d %d", frames, lines, b2.GetStats().CappedPoints)
+	}
+
+	// mem is not capped.
+	err = ic.Write([]byte("mem value=1 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	if len(sis[0].lines) != 4 || len(sis[1].lines) != 1 {
+		t.Errorf("mem should be written to both: %d %d", len(sis[0].lines), len(sis[1].lines))
+	}
+
+	// the spooled lines are replayed.
+	if err = b2.Rewrite(); err != nil || len(sis[1].lines) != 4 || b2.fb.IsData() {
+		t.Errorf("spooled lines should be replayed: %d %v", len(sis[1].lines), err)
+	}
+}
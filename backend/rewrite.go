@@ -0,0 +1,136 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// replayItem 备份文件中的一帧, 等 after 中的帧写完后才写入
+type replayItem struct {
+	p         []byte
+	enqueued  time.Time
+	precision string
+	// nil if the frame can't be decompressed, ordered with all frames.
+	series map[string]bool
+	after  []*replayItem
+	done   chan struct{}
+	err    error
+}
+
+// frameSeries 返回压缩数据中所有行的 series, 解压失败时返回 nil
+func frameSeries(p []byte) map[string]bool {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil
+	}
+	defer zip.Close()
+	raw, err := ioutil.ReadAll(zip)
+	if err != nil {
+		return nil
+	}
+
+	series := make(map[string]bool)
+	for _, line := range bytes.Split(raw, []byte{'\n'}) {
+		if len(line) > 0 {
+			series[string(canonicalSeries(line))] = true
+		}
+	}
+	return series
+}
+
+// conflicts 两帧有相同的 series 时需要按顺序写入
+func (item *replayItem) conflicts(other *replayItem) bool {
+	if item.series == nil || other.series == nil {
+		return true
+	}
+	a, b := item.series, other.series
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for s := range a {
+		if b[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteFrames 同时重放至多 RewriteConcurrency 帧, 有相同 series 的帧按备份的顺序写入.
+// 任一帧失败时回滚整个窗口, 已经写入的帧会再写一次, 重复写入相同的点是无害的
+func (bs *Backends) rewriteFrames() (err error) {
+	var items []*replayItem
+	for len(items) < bs.RewriteConcurrency {
+		p, enqueued, precision, rerr := bs.fb.ReadFrame()
+		if rerr != nil {
+			// replay the frames read, then let the caller wait before retry.
+			err = rerr
+			break
+		}
+		if p == nil {
+			break
+		}
+
+		item := &replayItem{
+			p:         p,
+			enqueued:  enqueued,
+			precision: precision,
+			series:    frameSeries(p),
+			done:      make(chan struct{}),
+		}
+		for _, prev := range items {
+			if item.conflicts(prev) {
+				item.after = append(item.after, prev)
+			}
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, item := range items {
+		wg.Add(1)
+		go func(item *replayItem) {
+			defer wg.Done()
+			defer close(item.done)
+			for _, prev := range item.after {
+				<-prev.done
+				if prev.err != nil {
+					// keep the order, retried with the window.
+					item.err = prev.err
+					return
+				}
+			}
+			item.err = bs.replayFrame(item.p, item.enqueued, item.precision)
+		}(item)
+	}
+	wg.Wait()
+
+	for _, item := range items {
+		if item.err != nil {
+			bs.setFailover(true)
+			rerr := bs.fb.RollbackMeta()
+			if rerr != nil {
+				logs.Errorf("rollback meta error: %s\n", rerr)
+			}
+			return item.err
+		}
+	}
+
+	uerr := bs.fb.UpdateMeta()
+	if uerr != nil {
+		logs.Errorf("update meta error: %s\n", uerr)
+		return uerr
+	}
+	return
+}
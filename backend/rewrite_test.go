@@ -0,0 +1,187 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// spoolFrames 把每组 lines 作为一帧写入备份文件
+func spoolFrames(t *testing.T, bs *Backends, frames []string) {
+	for _, lines := range frames {
+		var buf bytes.Buffer
+		Compress(&buf, []byte(lines))
+		if err := bs.fb.WritePrecision(buf.Bytes(), "ms"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func drainSpool(t *testing.T, bs *Backends) {
+	for i := 0; bs.fb.IsData(); i++ {
+		if i > 1000 {
+			t.Fatal("spool not drained")
+		}
+		if err := bs.Rewrite(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRewriteConcurrency(t *testing.T) {
+	var written int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			time.Sleep(20 * time.Millisecond)
+			zip, _ := gzip.NewReader(req.Body)
+			p, _ := ioutil.ReadAll(zip)
+			atomic.AddInt64(&written, int64(bytes.Count(p, []byte{'\n'})))
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	var frames []string
+	for i := 0; i < 16; i++ {
+		frames = append(frames, fmt.Sprintf("cpu,host=h%d value=1 %d\ncpu,host=h%d value=2 %d\n", i, i, i, i+1))
+	}
+	drain := func(concurrency int) time.Duration {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = ts.URL
+		cfg.RewriteInterval = 60000
+		cfg.RewriteConcurrency = concurrency
+		bs, err := NewBackends(cfg, "test", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bs.Close()
+		spoolFrames(t, bs, frames)
+
+		atomic.StoreInt64(&written, 0)
+		start := time.Now()
+		drainSpool(t, bs)
+		if n := atomic.LoadInt64(&written); n != 32 {
+			t.Errorf("%d lines written with concurrency %d", n, concurrency)
+		}
+		return time.Since(start)
+	}
+
+	sequential, parallel := drain(1), drain(8)
+	if parallel*2 > sequential {
+		t.Errorf("parallel replay should be faster: %s vs %s", parallel, sequential)
+	}
+}
+
+func TestRewriteConcurrencyOrder(t *testing.T) {
+	var lock sync.Mutex
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			// out of order if the frames were sent together.
+			time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+			zip, _ := gzip.NewReader(req.Body)
+			p, _ := ioutil.ReadAll(zip)
+			lock.Lock()
+			lines = append(lines, strings.Split(strings.TrimSpace(string(p)), "\n")...)
+			lock.Unlock()
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.RewriteConcurrency = 4
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// one series with tags in any order, mixed with frames of others.
+	var frames []string
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			frames = append(frames, fmt.Sprintf("cpu,host=a,zone=x value=%d %d\n", i, i))
+		} else {
+			frames = append(frames, fmt.Sprintf("mem,host=b value=1 %d\ncpu,zone=x,host=a value=%d %d\n", i, i, i))
+		}
+		frames = append(frames, fmt.Sprintf("disk,host=h%d value=1 %d\n", i, i))
+	}
+	spoolFrames(t, bs, frames)
+	drainSpool(t, bs)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(lines) != 50 {
+		t.Errorf("%d lines written", len(lines))
+	}
+	next := 0
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "cpu,") {
+			continue
+		}
+		if !strings.HasSuffix(line, fmt.Sprintf(" %d", next)) {
+			t.Fatalf("series out of order, want %d: %s", next, line)
+		}
+		next++
+	}
+	if next != 20 {
+		t.Errorf("%d points of the series written", next)
+	}
+}
+
+func TestRewriteConcurrencyRollback(t *testing.T) {
+	si := &strictInflux{limit: 2}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	cfg.RewriteConcurrency = 4
+	bs, err := NewBackends(cfg, "test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	spoolFrames(t, bs, []string{
+		"cpu,host=a value=1 1\n",
+		"cpu,host=b value=1 1\n",
+		"cpu,host=c value=1 1\n",
+		"cpu,host=d value=1 1\n",
+	})
+	if err = bs.Rewrite(); err == nil {
+		t.Errorf("failed window should return error")
+	}
+	if !bs.fb.IsData() || bs.GetStats().Failover != 1 {
+		t.Errorf("failed window should be kept")
+	}
+
+	// the whole window is replayed.
+	atomic.StoreInt32(&si.limit, 0)
+	si.lock.Lock()
+	si.lines = nil
+	si.lock.Unlock()
+	drainSpool(t, bs)
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	if len(si.lines) != 4 {
+		t.Errorf("window not replayed: %v", si.lines)
+	}
+}
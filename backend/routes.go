@@ -0,0 +1,68 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+const (
+	// the key of the measurement, also matched as a prefix of the measurement.
+	ROUTE_MEASUREMENT = "measurement"
+	// the catch-all key, _default_ unless DefaultMeasurementKey is set, used if no other key matches.
+	ROUTE_DEFAULT = "default"
+)
+
+// RouteBackend 路由表中的后端
+type RouteBackend struct {
+	Name      string `json:"name"`
+	Zone      string `json:"zone"`
+	Active    bool   `json:"active"`
+	WriteOnly bool   `json:"writeOnly"`
+}
+
+// Route KEYMAPS 中一个 key 当前生效的路由
+type Route struct {
+	Match   string `json:"match"`
+	Hashed  bool   `json:"hashed,omitempty"`
+	Sharded bool   `json:"sharded,omitempty"`
+	Sync    bool   `json:"sync,omitempty"`
+	// queried from the backend last answered the client, StickyMeasurements.
+	Sticky bool `json:"sticky,omitempty"`
+	// field key -> the key whose backends get the field.
+	Fields   map[string]string `json:"fields,omitempty"`
+	Backends []RouteBackend    `json:"backends"`
+}
+
+// Routes 返回当前的路由表, db -> key -> 后端. _default_ db 用于没有配置的 db
+func (ic *InfluxCluster) Routes() (routes map[string]map[string]Route) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	routes = make(map[string]map[string]Route, len(ic.m2bs))
+	for db, keyMap := range ic.m2bs {
+		dbRoutes := make(map[string]Route, len(keyMap))
+		for key, apis := range keyMap {
+			route := Route{
+				Match:    ROUTE_MEASUREMENT,
+				Hashed:   ic.hashed[key],
+				Sharded:  ic.sharded[key],
+				Sync:     ic.syncs[key],
+				Sticky:   ic.stickyKeys[key],
+				Fields:   ic.fieldMaps[key],
+				Backends: make([]RouteBackend, 0, len(apis)),
+			}
+			if key == ic.defaultKey {
+				route.Match = ROUTE_DEFAULT
+			}
+			for _, api := range apis {
+				route.Backends = append(route.Backends, RouteBackend{
+					Name:      api.GetName(),
+					Zone:      api.GetZone(),
+					Active:    api.IsActive(),
+					WriteOnly: api.IsWriteOnly(),
+				})
+			}
+			dbRoutes[key] = route
+		}
+		routes[db] = dbRoutes
+	}
+	return
+}
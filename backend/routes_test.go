@@ -0,0 +1,63 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInfluxdbClusterRoutes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	cfg := fmt.Sprintf(`{
+	"BACKENDS": {
+		"b1": {"url": %q, "db": "test", "zone": "z1"},
+		"b2": {"url": %q, "db": "test", "zone": "z2", "writeonly": 1}
+	},
+	"KEYMAPS": {
+		"test": {"cpu": ["b1", "b2"], "_default_": ["b1"]},
+		"_default_": {"_default_": ["b2"]}
+	},
+	"NODES": {"l1": {"hashedmeasurements": ["_default_"]}}
+}`, ts.URL, ts.URL)
+	err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1 := RouteBackend{Name: "b1", Zone: "z1", Active: true}
+	b2 := RouteBackend{Name: "b2", Zone: "z2", Active: true, WriteOnly: true}
+	want := map[string]map[string]Route{
+		"test": {
+			"cpu":       {Match: ROUTE_MEASUREMENT, Backends: []RouteBackend{b1, b2}},
+			"_default_": {Match: ROUTE_DEFAULT, Hashed: true, Backends: []RouteBackend{b1}},
+		},
+		"_default_": {
+			"_default_": {Match: ROUTE_DEFAULT, Hashed: true, Backends: []RouteBackend{b2}},
+		},
+	}
+	if routes := ic.Routes(); !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes should reflect the KEYMAPS:\n%+v\n%+v", routes, want)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// loadSampleRates 检查每个 measurement 保留的比例, 必须在 [0, 1] 之间
+func loadSampleRates(nodecfg *NodeConfig) (rates map[string]float64, err error) {
+	for measurement, rate := range nodecfg.SampleRates {
+		if rate < 0 || rate > 1 || math.IsNaN(rate) {
+			logs.Errorf("sample rate %v of measurement %s is not in [0, 1]", rate, measurement)
+			return nil, ErrIllegalConfig
+		}
+	}
+	return nodecfg.SampleRates, nil
+}
+
+// splitLine 把一行 line protocol 分成 series key, fields 和时间戳, 处理转义和带引号的字符串字段
+func splitLine(line []byte) (series, fields, ts []byte) {
+	i := 0
+	for ; i < len(line) && line[i] != ' '; i++ {
+		if line[i] == '\\' {
+			i++
+		}
+	}
+	if i >= len(line) {
+		return line, nil, nil
+	}
+	series = line[:i]
+
+	start := i + 1
+	quoted := false
+	j := start
+	for ; j < len(line); j++ {
+		if line[j] == '\\' {
+			j++
+			continue
+		}
+		if line[j] == '"' {
+			quoted = !quoted
+		}
+		if line[j] == ' ' && !quoted {
+			break
+		}
+	}
+	if j > len(line) {
+		j = len(line)
+	}
+	fields = line[start:j]
+	if j < len(line) {
+		ts = bytes.TrimSpace(line[j+1:])
+	}
+	return
+}
+
+// sampled 判断 line 是否保留. 由 series key 和时间戳的哈希决定, 同一个点在各个节点上结果相同.
+// 没有时间戳的点按收到的秒计算.
+func sampled(line []byte, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	series, _, ts := splitLine(line)
+	if len(ts) == 0 {
+		ts = strconv.AppendInt(nil, time.Now().Unix(), 10)
+	}
+	h := fnv.New64a()
+	h.Write(series)
+	h.Write([]byte{' '})
+	h.Write(ts)
+	return float64(mix64(h.Sum64()))/math.MaxUint64 < rate
+}
+
+// mix64 打散 fnv 的高位, 相邻时间戳的哈希值只有低位不同
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
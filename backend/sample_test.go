@@ -0,0 +1,87 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line, series, fields, ts string
+	}{
+		{"cpu,host=a value=1 1434055562000000000", "cpu,host=a", "value=1", "1434055562000000000"},
+		{"cpu value=1", "cpu", "value=1", ""},
+		{"cpu\\ load,host=a\\ b value=1 10", "cpu\\ load,host=a\\ b", "value=1", "10"},
+		{"cpu msg=\"a b \\\" c\",value=1 10", "cpu", "msg=\"a b \\\" c\",value=1", "10"},
+		{"cpu msg=\"a b\"", "cpu", "msg=\"a b\"", ""},
+		{"cpu", "cpu", "", ""},
+	}
+	for _, tt := range tests {
+		series, fields, ts := splitLine([]byte(tt.line))
+		if string(series) != tt.series || string(fields) != tt.fields || string(ts) != tt.ts {
+			t.Errorf("split %s wrong: %q %q %q", tt.line, series, fields, ts)
+		}
+	}
+}
+
+func TestInfluxdbClusterSample(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cpu := &countBackend{BackendAPI: ic.backends["test1"]}
+	mem := &countBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{cpu}
+	ic.m2bs["test"]["mem"] = []BackendAPI{mem}
+	ic.sampleRates = map[string]float64{"cpu": 0.5}
+
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&buf, "cpu,host=server%02d value=%d %d\n", i%10, i, 1434055562000000000+int64(i)*1000000000)
+		fmt.Fprintf(&buf, "mem,host=server%02d value=%d %d\n", i%10, i, 1434055562000000000+int64(i)*1000000000)
+	}
+	err = ic.Write(buf.Bytes(), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := atomic.LoadInt64(&cpu.writes)
+	if kept < 900 || kept > 1100 {
+		t.Errorf("about half of cpu should be kept: %d", kept)
+	}
+	if atomic.LoadInt64(&mem.writes) != 2000 {
+		t.Errorf("mem should be intact: %d", mem.writes)
+	}
+	if sampled := atomic.LoadInt64(&ic.stats.PointsSampled); sampled != 2000-kept {
+		t.Errorf("sampled counter wrong: %d", sampled)
+	}
+
+	// the same points are sampled the same way.
+	err = ic.Write(buf.Bytes(), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&cpu.writes) != 2*kept {
+		t.Errorf("sampling should be deterministic: %d %d", cpu.writes, kept)
+	}
+}
+
+func TestLoadSampleRates(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1.5} {
+		_, err := loadSampleRates(&NodeConfig{SampleRates: map[string]float64{"cpu": rate}})
+		if err != ErrIllegalConfig {
+			t.Errorf("rate %v should be illegal: %v", rate, err)
+		}
+	}
+	_, err := loadSampleRates(&NodeConfig{SampleRates: map[string]float64{"cpu": 0, "mem": 1}})
+	if err != nil {
+		t.Error(err)
+	}
+}
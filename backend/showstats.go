@@ -0,0 +1,64 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// statsSeri 把统计字段转换为一个 series, 列按名字排序
+func statsSeri(name string, tags map[string]string, fields map[string]interface{}) seri {
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	values := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		values = append(values, fields[column])
+	}
+	return seri{Name: name, Tags: tags, Columns: columns, Values: [][]interface{}{values}}
+}
+
+// backendFields 返回后端统计的全部字段, 以字段名为列名
+func backendFields(stats BackendStatistics) map[string]interface{} {
+	fields := make(map[string]interface{})
+	v := reflect.ValueOf(stats)
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Name] = v.Field(i).Int()
+	}
+	return fields
+}
+
+// showProxyStats 回答 SHOW PROXY STATS, 返回当前周期的计数和各后端的累计计数, 不经过后端
+func (ic *InfluxCluster) showProxyStats(w http.ResponseWriter) (err error) {
+	series := []seri{statsSeri("proxy", ic.defaultTags, ic.stats.Fields())}
+
+	ic.lock.RLock()
+	names := make([]string, 0, len(ic.backends))
+	stats := make(map[string]BackendStatistics, len(ic.backends))
+	for name, bs := range ic.backends {
+		names = append(names, name)
+		stats[name] = bs.GetStats()
+	}
+	ic.lock.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		series = append(series, statsSeri("backend", map[string]string{"backend": name}, backendFields(stats[name])))
+	}
+
+	body, err := GetJsonBodyfromSeries(series)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(200)
+	w.Write(body)
+	return
+}
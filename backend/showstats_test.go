@@ -0,0 +1,62 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInfluxdbClusterShowProxyStats(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&ic.stats.PointsWritten, 42)
+	atomic.StoreInt64(&ic.backends["test1"].(*Backends).stats.WriteRetries, 7)
+
+	q := url.Values{}
+	q.Set("q", "show proxy stats;")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := NewDummyResponseWriter()
+	ic.Query(w, req)
+	if w.status != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("show proxy stats failed: %d %s", w.status, w.buffer.String())
+	}
+
+	var resp statementArray
+	dec := json.NewDecoder(&w.buffer)
+	dec.UseNumber()
+	if err = dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 {
+		t.Fatalf("results wrong: %+v", resp)
+	}
+	values := make(map[string]map[string]interface{})
+	for _, s := range resp.Results[0].Series {
+		key := s.Name + "/" + s.Tags["backend"]
+		if len(s.Values) != 1 || len(s.Values[0]) != len(s.Columns) {
+			t.Fatalf("series %s wrong: %+v", key, s)
+		}
+		values[key] = make(map[string]interface{})
+		for i, column := range s.Columns {
+			values[key][column] = s.Values[0][i]
+		}
+	}
+	// proxy and the three backends.
+	if len(values) != 4 {
+		t.Errorf("series wrong: %v", values)
+	}
+	if values["proxy/"]["statPointsWritten"] != json.Number("42") || values["proxy/"]["statQueryRequest"] != json.Number("1") {
+		t.Errorf("proxy stats wrong: %v", values["proxy/"])
+	}
+	if values["backend/test1"]["WriteRetries"] != json.Number("7") || values["backend/test1"]["QueryRequests"] != json.Number("0") {
+		t.Errorf("backend stats wrong: %v", values["backend/test1"])
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io"
+	"os"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	SINK_INFLUXDB = "influxdb"
+	SINK_STDOUT   = "stdout"
+	SINK_NONE     = "none"
+)
+
+// MetricSink 接收自监控的统计, p 为一批纳秒精度的 line protocol
+type MetricSink interface {
+	Send(p []byte) (err error)
+}
+
+// influxSink 写回集群的 statsDatabase, 或者 statsBackend
+type influxSink struct {
+	ic *InfluxCluster
+}
+
+func (s influxSink) Send(p []byte) error {
+	return s.ic.sendStatistics(p)
+}
+
+// writerSink 写到 w, 如标准输出, 由日志收集转发
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Send(p []byte) (err error) {
+	_, err = s.w.Write(p)
+	return
+}
+
+// discardSink 丢弃统计, 不往集群里写
+type discardSink struct{}
+
+func (discardSink) Send(p []byte) error {
+	return nil
+}
+
+// newMetricSink 按 statssink 配置新建, 默认写回 InfluxDB
+func newMetricSink(ic *InfluxCluster, name string) (sink MetricSink, err error) {
+	switch name {
+	case "", SINK_INFLUXDB:
+		return influxSink{ic}, nil
+	case SINK_STDOUT:
+		return writerSink{os.Stdout}, nil
+	case SINK_NONE:
+		return discardSink{}, nil
+	}
+	logs.Errorf("unknown stats sink %s", name)
+	return nil, ErrIllegalConfig
+}
+
+// SetMetricSink 替换自监控统计的去处, 如发到其他的监控系统
+func (ic *InfluxCluster) SetMetricSink(sink MetricSink) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.sink = sink
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type recordSink struct {
+	batches []string
+}
+
+func (s *recordSink) Send(p []byte) error {
+	s.batches = append(s.batches, string(p))
+	return nil
+}
+
+func TestInfluxdbClusterMetricSink(t *testing.T) {
+	si := &strictInflux{}
+	ts := httptest.NewServer(si)
+	defer ts.Close()
+	cfg, _ := CreateTestBackendConfig("influxproxy")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	written := func() int {
+		bs.FlushBuffer()
+		bs.wg.Wait()
+		si.lock.Lock()
+		defer si.lock.Unlock()
+		n := len(si.lines)
+		si.lines = nil
+		return n
+	}
+
+	newCluster := func(sink string) *InfluxCluster {
+		ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{StatsSink: sink}, ".")
+		ic.backends = map[string]BackendAPI{"b1": bs}
+		ic.m2bs = map[string]map[string][]BackendAPI{"influxproxy": {"_default_": {bs}}}
+		return ic
+	}
+
+	// written back to the cluster by default.
+	if err = newCluster("").WriteStatistics(); err != nil || written() < 3 {
+		t.Errorf("stats should be written to influxdb: %v", err)
+	}
+
+	ic := newCluster(SINK_NONE)
+	if err = ic.WriteStatistics(); err != nil || written() != 0 {
+		t.Errorf("none sink should write nothing: %v", err)
+	}
+
+	var buf bytes.Buffer
+	ic = newCluster(SINK_STDOUT)
+	ic.SetMetricSink(writerSink{&buf})
+	if err = ic.WriteStatistics(); err != nil || written() != 0 {
+		t.Errorf("stdout sink should not write to influxdb: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "statistics,") || !strings.Contains(buf.String(), "\nruntime,") {
+		t.Errorf("stats should be printed: %s", buf.String())
+	}
+
+	sink := &recordSink{}
+	ic.SetMetricSink(sink)
+	if err = ic.WriteStatistics(); err != nil || len(sink.batches) != 1 || !strings.Contains(sink.batches[0], "statPointsWritten=") {
+		t.Errorf("custom sink should get the stats: %v %v", err, sink.batches)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("unknown sink should be rejected")
+		}
+	}()
+	newCluster("kafka")
+}
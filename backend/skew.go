@@ -0,0 +1,96 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	SKEW_DROP  = "drop"
+	SKEW_CLAMP = "clamp"
+)
+
+var ErrTimestampSkew = errors.New("timestamp is out of the allowed skew")
+
+// timestampSkew 写入的时间戳允许的范围, future 和 past 为 0 时不限制, clamp 时把超出的时间戳换成边界
+type timestampSkew struct {
+	future time.Duration
+	past   time.Duration
+	clamp  bool
+}
+
+// newTimestampSkew 加载 MaxFutureSkew, MaxPastSkew 和 SkewPolicy, 非法的配置返回 ErrIllegalConfig
+func newTimestampSkew(nodecfg *NodeConfig) (skew timestampSkew, err error) {
+	for _, c := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"maxfutureskew", nodecfg.MaxFutureSkew, &skew.future},
+		{"maxpastskew", nodecfg.MaxPastSkew, &skew.past},
+	} {
+		if c.value == "" {
+			continue
+		}
+		*c.d, err = parseDuration(c.value)
+		if err != nil || *c.d < 0 {
+			logs.Errorf("illegal %s %s", c.name, c.value)
+			return skew, ErrIllegalConfig
+		}
+	}
+	switch nodecfg.SkewPolicy {
+	case "", SKEW_DROP:
+	case SKEW_CLAMP:
+		skew.clamp = true
+	default:
+		logs.Errorf("unknown skew policy %s", nodecfg.SkewPolicy)
+		return skew, ErrIllegalConfig
+	}
+	return
+}
+
+// check 检查 line 的时间戳, precision 为写入的精度. 超出范围时 skewed 为 true,
+// clamp 时 out 为换成边界的行, 否则为 nil. 没有时间戳或者时间戳无法解析的行不检查.
+func (skew timestampSkew) check(line []byte, precision string, now time.Time) (out []byte, skewed bool) {
+	if skew.future == 0 && skew.past == 0 {
+		return line, false
+	}
+	_, _, ts := splitLine(line)
+	if len(ts) == 0 {
+		return line, false
+	}
+	v, err := strconv.ParseInt(string(ts), 10, 64)
+	if err != nil {
+		return line, false
+	}
+
+	mult := models.GetPrecisionMultiplier(precision)
+	var bound int64
+	switch {
+	case skew.future > 0 && (v > math.MaxInt64/mult || v*mult > now.Add(skew.future).UnixNano()):
+		// truncated, stays in the bound.
+		bound = now.Add(skew.future).UnixNano() / mult
+	case skew.past > 0 && (v < math.MinInt64/mult || v*mult < now.Add(-skew.past).UnixNano()):
+		// rounded up, stays in the bound.
+		bound = (now.Add(-skew.past).UnixNano() + mult - 1) / mult
+	default:
+		return line, false
+	}
+	if !skew.clamp {
+		return nil, true
+	}
+
+	prefix := line[:len(line)-len(ts)]
+	out = make([]byte, 0, len(prefix)+20)
+	out = append(out, prefix...)
+	return strconv.AppendInt(out, bound, 10), true
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampSkew(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	drop, err := newTimestampSkew(&NodeConfig{MaxFutureSkew: "1h", MaxPastSkew: "8760h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clamp := drop
+	clamp.clamp = true
+
+	future := now.Add(2 * time.Hour).UnixNano()
+	past := now.Add(-10 * 8760 * time.Hour).UnixNano()
+	tests := []struct {
+		line      string
+		precision string
+		clamped   string
+	}{
+		{fmt.Sprintf("cpu value=1 %d", future), "ns", fmt.Sprintf("cpu value=1 %d", now.Add(time.Hour).UnixNano())},
+		{fmt.Sprintf("cpu value=1 %d", future/1e9), "s", fmt.Sprintf("cpu value=1 %d", now.Add(time.Hour).Unix())},
+		{fmt.Sprintf("cpu value=1 %d", past), "ns", fmt.Sprintf("cpu value=1 %d", now.Add(-8760*time.Hour).UnixNano())},
+		{fmt.Sprintf("cpu value=1 %d", past/1e6), "ms", fmt.Sprintf("cpu value=1 %d", now.Add(-8760*time.Hour).UnixNano()/1e6)},
+		// overflows in ns.
+		{"cpu value=1 9000000000000000000", "s", fmt.Sprintf("cpu value=1 %d", now.Add(time.Hour).Unix())},
+		{`cpu,host=a\ b msg="x y" 0`, "h", fmt.Sprintf(`cpu,host=a\ b msg="x y" %d`, now.Add(-8760*time.Hour).Add(time.Hour-1).Unix()/3600)},
+	}
+	for _, tt := range tests {
+		out, skewed := drop.check([]byte(tt.line), tt.precision, now)
+		if !skewed || out != nil {
+			t.Errorf("%s should be dropped: %v %s", tt.line, skewed, out)
+		}
+		out, skewed = clamp.check([]byte(tt.line), tt.precision, now)
+		if !skewed || string(out) != tt.clamped {
+			t.Errorf("%s clamped to %s, want %s", tt.line, out, tt.clamped)
+		}
+	}
+
+	for _, tt := range []struct {
+		line      string
+		precision string
+	}{
+		{fmt.Sprintf("cpu value=1 %d", now.Add(30*time.Minute).UnixNano()), "ns"},
+		{fmt.Sprintf("cpu value=1 %d", now.Add(-100*24*time.Hour).Unix()*1000), "ms"},
+		{"cpu value=1", "ns"},
+	} {
+		if out, skewed := clamp.check([]byte(tt.line), tt.precision, now); skewed || string(out) != tt.line {
+			t.Errorf("%s should be kept: %s", tt.line, out)
+		}
+	}
+
+	for _, cfg := range []NodeConfig{{MaxFutureSkew: "soon"}, {MaxPastSkew: "-1h"}, {SkewPolicy: "fix"}} {
+		if _, err = newTimestampSkew(&cfg); err != ErrIllegalConfig {
+			t.Errorf("%+v should be illegal", cfg)
+		}
+	}
+}
+
+func TestInfluxdbClusterTimestampSkew(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &lineBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"]["cpu"] = []BackendAPI{lb}
+	ic.skew, _ = newTimestampSkew(&NodeConfig{MaxFutureSkew: "1h", MaxPastSkew: "8760h"})
+
+	now := time.Now()
+	good := now.UnixNano()
+	p := fmt.Sprintf("cpu value=1 %d\ncpu value=2 %d\ncpu value=3 %d\n", good, now.Add(24*365*time.Hour).UnixNano(), int64(1))
+	err = ic.WriteStrict(context.Background(), []byte(p), "ns", "test", false)
+	lineErrs, ok := err.(*LineErrors)
+	if !ok || lineErrs.Total != 3 || len(lineErrs.Lines) != 2 || lineErrs.Lines[0].Line != 2 || lineErrs.Lines[1].Error != ErrTimestampSkew.Error() {
+		t.Fatalf("skewed lines should fail: %v", err)
+	}
+	if ic.stats.PointsSkewed != 2 || len(lb.lines) != 1 || !strings.HasPrefix(lb.lines[0], "cpu value=1 ") {
+		t.Errorf("only the good line should be written: %d %v", ic.stats.PointsSkewed, lb.lines)
+	}
+
+	lb.lines = nil
+	ic.skew.clamp = true
+	if err = ic.Write([]byte(p), "ns", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if ic.stats.PointsSkewed != 4 || len(lb.lines) != 3 {
+		t.Fatalf("skewed lines should be clamped: %d %v", ic.stats.PointsSkewed, lb.lines)
+	}
+	for _, line := range lb.lines[1:] {
+		_, _, ts := splitLine([]byte(strings.TrimSpace(line)))
+		var v int64
+		fmt.Sscan(string(ts), &v)
+		if d := time.Duration(v - now.UnixNano()); d < -8761*time.Hour || d > time.Hour+time.Minute {
+			t.Errorf("not clamped: %s", line)
+		}
+	}
+}
+
+func TestInfluxdbClusterReloadSkew(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	writeConfig := func(node string) {
+		cfg := fmt.Sprintf(`{
+	"BACKENDS": {"b1": {"url": %q, "db": "test", "rewriteinterval": 60000}},
+	"KEYMAPS": {"test": {"cpu": ["b1"]}},
+	"NODES": {"l1": {%s}}
+}`, ts.URL, node)
+		if err := os.WriteFile(cfgfile, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`"maxfutureskew": "1h"`)
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	if err := ic.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ic.skew.future != time.Hour || ic.skew.clamp {
+		t.Fatalf("skew wrong: %+v", ic.skew)
+	}
+
+	writeConfig(`"maxfutureskew": "2h", "maxpastskew": "24h", "skewpolicy": "clamp"`)
+	if err := ic.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ic.skew.future != 2*time.Hour || ic.skew.past != 24*time.Hour || !ic.skew.clamp {
+		t.Errorf("skew should be reloaded: %+v", ic.skew)
+	}
+
+	// the illegal config is refused, the loaded one stays.
+	writeConfig(`"skewpolicy": "fix"`)
+	if err := ic.LoadConfig(); err != ErrIllegalConfig {
+		t.Errorf("illegal skew should be refused: %v", err)
+	}
+	if ic.skew.future != 2*time.Hour || !ic.skew.clamp {
+		t.Errorf("skew should be kept: %+v", ic.skew)
+	}
+}
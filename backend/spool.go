@@ -0,0 +1,54 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+var ErrRewriteActive = errors.New("a rewrite of the spool is in progress, try again later")
+
+// SpoolStatus 备份文件中还没有重放的数据, Points 只在清空时统计
+type SpoolStatus struct {
+	Backend string `json:"backend"`
+	Chunks  int64  `json:"chunks"`
+	Bytes   int64  `json:"bytes"`
+	Points  int64  `json:"discarded_points,omitempty"`
+}
+
+// SpoolStatus 返回后端 name 的备份文件状态
+func (ic *InfluxCluster) SpoolStatus(name string) (status SpoolStatus, err error) {
+	bs, err := ic.spoolBackend(name)
+	if err != nil {
+		return
+	}
+	status.Backend = name
+	status.Chunks, status.Bytes, _, err = bs.fb.Contents(false)
+	return
+}
+
+// PurgeSpool 清空后端 name 的备份文件, 正在重放一批数据时返回 ErrRewriteActive.
+// addr 为请求方地址, 记在日志中
+func (ic *InfluxCluster) PurgeSpool(name string, addr string) (status SpoolStatus, err error) {
+	bs, err := ic.spoolBackend(name)
+	if err != nil {
+		return
+	}
+	// the rewrite would update the meta of the purged file.
+	if !bs.rewriting.TryLock() {
+		return status, ErrRewriteActive
+	}
+	defer bs.rewriting.Unlock()
+
+	status.Backend = name
+	status.Chunks, status.Bytes, status.Points, err = bs.fb.Purge()
+	if err != nil {
+		return
+	}
+	logs.Warningf("spool of backend %s purged by %s, %d chunks, %d bytes, %d points", name, addr, status.Chunks, status.Bytes, status.Points)
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInfluxdbClusterSpool(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts.URL
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackends(cfg, "b1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	defer ic.Close()
+	ic.backends = map[string]BackendAPI{"b1": bs}
+
+	for _, p := range []string{
+		"cpu value=1 1434055562000010000\ncpu value=2 1434055562000020000\n",
+		"cpu value=3 1434055562000030000\ncpu value=4 1434055562000040000\ncpu value=5 1434055562000050000\n",
+	} {
+		var buf bytes.Buffer
+		Compress(&buf, []byte(p))
+		if err = bs.fb.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := ic.SpoolStatus("b1")
+	if err != nil || status.Chunks != 2 || status.Bytes != bs.fb.Backlog() || status.Points != 0 {
+		t.Errorf("spool status wrong: %+v %v", status, err)
+	}
+
+	// no purge while a chunk is being replayed.
+	done := make(chan error)
+	go func() { done <- bs.Rewrite() }()
+	<-entered
+	if _, err = ic.PurgeSpool("b1", "test"); err != ErrRewriteActive {
+		t.Errorf("purge should be refused during a rewrite: %v", err)
+	}
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = ic.SpoolStatus("b1"); status.Chunks != 1 {
+		t.Errorf("the first chunk should be replayed: %+v", status)
+	}
+
+	status, err = ic.PurgeSpool("b1", "test")
+	if err != nil || status.Chunks != 1 || status.Points != 3 || status.Bytes == 0 {
+		t.Errorf("the rest should be purged: %+v %v", status, err)
+	}
+	if status, _ = ic.SpoolStatus("b1"); status.Chunks != 0 || status.Bytes != 0 || bs.fb.IsData() {
+		t.Errorf("spool should be empty: %+v", status)
+	}
+
+	if _, err = ic.SpoolStatus("b2"); err != ErrBackendNotExist {
+		t.Errorf("unknown backend should fail: %v", err)
+	}
+}
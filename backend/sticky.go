@@ -0,0 +1,199 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the client id of sticky queries, the header first.
+	STICKY_HEADER = "X-Influx-Proxy-Client"
+	STICKY_COOKIE = "influxproxy_client"
+
+	// milliseconds.
+	DEFAULT_STICKY_TTL     = 300000
+	DEFAULT_STICKY_ENTRIES = 10000
+)
+
+// clientID 返回查询的客户端标识, 没有时为空
+func clientID(req *http.Request) string {
+	if id := req.Header.Get(STICKY_HEADER); id != "" {
+		return id
+	}
+	if c, err := req.Cookie(STICKY_COOKIE); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// sticky 开启 StickyQuery 时, 按客户端标识和后端名的哈希给 apis 排序 (rendezvous hashing),
+// 同一个客户端总是先查询同一个后端, 它失败或不可用时查询下一个, 恢复后又回到它.
+// 没有客户端标识时保持原来的顺序.
+func (ic *InfluxCluster) sticky(req *http.Request, apis []BackendAPI) []BackendAPI {
+	ic.lock.RLock()
+	enabled := ic.stickyQuery
+	ic.lock.RUnlock()
+	if !enabled || len(apis) < 2 {
+		return apis
+	}
+	id := clientID(req)
+	if id == "" {
+		return apis
+	}
+	weights := make(map[BackendAPI]uint64, len(apis))
+	for _, api := range apis {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+		h.Write([]byte(api.GetName()))
+		weights[api] = h.Sum64()
+	}
+	sorted := append([]BackendAPI(nil), apis...)
+	// backends of weight 0 are still the last.
+	sort.SliceStable(sorted, func(i, j int) bool {
+		zi, zj := sorted[i].GetQueryWeight() <= 0, sorted[j].GetQueryWeight() <= 0
+		if zi != zj {
+			return zj
+		}
+		return weights[sorted[i]] > weights[sorted[j]]
+	})
+	return sorted
+}
+
+// stickyEntry 客户端地址, db 和 measurement 上次查询成功的后端
+type stickyEntry struct {
+	key     string
+	backend string
+	expires time.Time
+}
+
+// stickyCache 最近的 size 个 stickyEntry, 在 ttl 内同一个客户端查询同一个 measurement 时
+// 先查上次的后端, 避免副本之间的延迟让数据看起来倒退
+type stickyCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newStickyCache(nodecfg *NodeConfig) *stickyCache {
+	sc := &stickyCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	sc.configure(nodecfg)
+	return sc
+}
+
+// configure 加载 StickyTTL 和 StickyEntries, 已有的记录保留, 超过新的 size 时淘汰最久没用的.
+// 新的 ttl 在记录下次查询成功时生效.
+func (sc *stickyCache) configure(nodecfg *NodeConfig) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.ttl = time.Millisecond * time.Duration(nodecfg.StickyTTL)
+	if sc.ttl <= 0 {
+		sc.ttl = time.Millisecond * DEFAULT_STICKY_TTL
+	}
+	sc.size = nodecfg.StickyEntries
+	if sc.size <= 0 {
+		sc.size = DEFAULT_STICKY_ENTRIES
+	}
+	sc.evict()
+}
+
+// evict 淘汰超过 size 的记录, 必须持有 lock
+func (sc *stickyCache) evict() {
+	for sc.lru.Len() > sc.size {
+		e := sc.lru.Back()
+		sc.lru.Remove(e)
+		delete(sc.entries, e.Value.(*stickyEntry).key)
+	}
+}
+
+func stickyKey(addr, db, measurement string) string {
+	return addr + "\x00" + db + "\x00" + measurement
+}
+
+// get 返回 key 没有过期的后端, 没有时为空
+func (sc *stickyCache) get(key string, now time.Time) string {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	e, ok := sc.entries[key]
+	if !ok {
+		return ""
+	}
+	entry := e.Value.(*stickyEntry)
+	if now.After(entry.expires) {
+		sc.lru.Remove(e)
+		delete(sc.entries, key)
+		return ""
+	}
+	sc.lru.MoveToFront(e)
+	return entry.backend
+}
+
+// set 记录 key 查询成功的后端, 重新计算过期时间, 超过 size 时淘汰最久没用的
+func (sc *stickyCache) set(key, backend string, now time.Time) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if e, ok := sc.entries[key]; ok {
+		entry := e.Value.(*stickyEntry)
+		entry.backend, entry.expires = backend, now.Add(sc.ttl)
+		sc.lru.MoveToFront(e)
+		return
+	}
+	sc.entries[key] = sc.lru.PushFront(&stickyEntry{key: key, backend: backend, expires: now.Add(sc.ttl)})
+	sc.evict()
+}
+
+func loadStickyMeasurements(nodecfg *NodeConfig) (sticky map[string]bool) {
+	sticky = make(map[string]bool, len(nodecfg.StickyMeasurements))
+	for _, key := range nodecfg.StickyMeasurements {
+		sticky[key] = true
+	}
+	return
+}
+
+// stickyBackends 给本 zone 的 apis 排序, 返回查询成功后要记录的 stickyCache key, 不记录时为空.
+// 开启 StickyQuery 并且请求带有客户端标识时按标识哈希, 不用 stickyCache;
+// 否则 KEYMAPS 的 key 在 StickyMeasurements 中时, 先查同一个客户端地址上次的后端; 都不是时保持原来的顺序.
+func (ic *InfluxCluster) stickyBackends(req *http.Request, mapped, db, measurement string, apis []BackendAPI) ([]BackendAPI, string) {
+	ic.lock.RLock()
+	byID, byAddr := ic.stickyQuery, ic.stickyKeys[mapped]
+	ic.lock.RUnlock()
+	if byID && clientID(req) != "" {
+		return ic.sticky(req, apis), ""
+	}
+	if !byAddr {
+		return apis, ""
+	}
+	key := stickyKey(ic.limiter.addr(req), db, measurement)
+	return ic.stickTo(key, apis), key
+}
+
+// stickTo 把 key 上次查询成功的后端排到 apis 的最前面, 它不可用时不在 apis 中, 保持原来的顺序
+func (ic *InfluxCluster) stickTo(key string, apis []BackendAPI) []BackendAPI {
+	if key == "" {
+		return apis
+	}
+	name := ic.stickyCache.get(key, time.Now())
+	for i, api := range apis {
+		if api.GetName() != name {
+			continue
+		}
+		sorted := make([]BackendAPI, 0, len(apis))
+		sorted = append(sorted, api)
+		sorted = append(sorted, apis[:i]...)
+		return append(sorted, apis[i+1:]...)
+	}
+	return apis
+}
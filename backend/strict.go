@@ -0,0 +1,32 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "fmt"
+
+// LineError 写入失败的行, Line 从 1 开始
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// LineErrors strict 写入中失败的行, 其他的行照常写入
+type LineErrors struct {
+	Total int         `json:"total"`
+	Lines []LineError `json:"lines"`
+}
+
+func (e *LineErrors) Error() string {
+	return fmt.Sprintf("%d of %d lines failed", len(e.Lines), e.Total)
+}
+
+// add 记录第 n 行的错误, e 为 nil 时新建
+func (e *LineErrors) add(n int, err error) *LineErrors {
+	if e == nil {
+		e = &LineErrors{}
+	}
+	e.Lines = append(e.Lines, LineError{Line: n, Error: err.Error()})
+	return e
+}
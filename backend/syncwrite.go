@@ -0,0 +1,110 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+// SyncWriteError 同步写入失败的后端, Status 为后端的状态码, 后端不可用时为 0
+type SyncWriteError struct {
+	Backend string
+	Status  int
+	Body    []byte
+	Err     error
+}
+
+func (e *SyncWriteError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("sync write of backend %s error: %s", e.Backend, e.Err)
+	}
+	return fmt.Sprintf("sync write of backend %s status %d: %s", e.Backend, e.Status, bytes.TrimSpace(e.Body))
+}
+
+// loadSyncMeasurements KEYMAPS 中同步写入的 key, 写入请求等后端返回后才响应
+func loadSyncMeasurements(nodecfg *NodeConfig) (syncs map[string]bool) {
+	syncs = make(map[string]bool, len(nodecfg.SyncMeasurements))
+	for _, key := range nodecfg.SyncMeasurements {
+		syncs[key] = true
+	}
+	return
+}
+
+func (ic *InfluxCluster) isSync(key string) bool {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.syncs[key]
+}
+
+// syncBatch 一个写入请求中要同步写入的行, 按后端分开
+type syncBatch struct {
+	precision string
+	order     []*Backends
+	lines     map[*Backends]*bytes.Buffer
+}
+
+func newSyncBatch() *syncBatch {
+	return &syncBatch{lines: make(map[*Backends]*bytes.Buffer)}
+}
+
+// add 加入后端 b 的一行, 影子后端和没有缓冲的后端照常异步写入, 返回 false
+func (sb *syncBatch) add(b BackendAPI, line []byte, precision string) bool {
+	bs, ok := b.(*Backends)
+	if !ok || bs.IsShadow() {
+		return false
+	}
+	buf, ok := sb.lines[bs]
+	if !ok {
+		buf = &bytes.Buffer{}
+		sb.lines[bs] = buf
+		sb.order = append(sb.order, bs)
+	}
+	sb.precision = precision
+	buf.Write(line)
+	if len(line) > 0 && line[len(line)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	return true
+}
+
+// writeSync 同时写入 batch 中的后端, 返回第一个失败的后端
+func (ic *InfluxCluster) writeSync(sb *syncBatch, fallback bool) (err error) {
+	if len(sb.order) == 0 {
+		return
+	}
+	atomic.AddInt64(&ic.stats.SyncWrites, 1)
+	defer func(start time.Time) {
+		atomic.AddInt64(&ic.stats.SyncWriteDuration, time.Since(start).Nanoseconds())
+	}(time.Now())
+
+	errs := make([]*SyncWriteError, len(sb.order))
+	var wg sync.WaitGroup
+	for i, bs := range sb.order {
+		wg.Add(1)
+		go func(i int, bs *Backends) {
+			defer wg.Done()
+			status, body, err := bs.WriteSync(sb.lines[bs].Bytes(), sb.precision, fallback)
+			if err != nil || (status != 204 && !fallback) {
+				errs[i] = &SyncWriteError{Backend: bs.GetName(), Status: status, Body: body, Err: err}
+			}
+		}(i, bs)
+	}
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			logs.Errorf("%s", e)
+			atomic.AddInt64(&ic.stats.SyncWritesFail, 1)
+			return e
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInfluxdbClusterSyncWrite(t *testing.T) {
+	var status int32 = 204
+	var lock sync.Mutex
+	var written []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		code := int(atomic.LoadInt32(&status))
+		if code != 204 {
+			w.WriteHeader(code)
+			w.Write([]byte(`{"error":"engine: cache-max-memory-size exceeded"}`))
+			return
+		}
+		body, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(body)
+		lock.Lock()
+		written = append(written, string(p))
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	cfgfile := filepath.Join(dir, "proxy.json")
+	cfg := fmt.Sprintf(`{
+	"BACKENDS": {
+		"b1": {"url": %q, "db": "test", "interval": 60000, "writeretries": -1}
+	},
+	"KEYMAPS": {"test": {"cpu": ["b1"], "mem": ["b1"]}},
+	"NODES": {"l1": {"syncmeasurements": ["cpu"]}}
+}`, ts.URL)
+	err := os.WriteFile(cfgfile, []byte(cfg), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcs := NewFileConfigSource(cfgfile, "l1")
+	nodecfg, _ := fcs.LoadNode()
+	ic := NewInfluxCluster(fcs, &nodecfg, dir)
+	defer ic.Close()
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := ic.backends["b1"].(*Backends)
+
+	// the sync measurement is on the backend when Write returns, the other one is buffered.
+	err = ic.Write([]byte("cpu value=1\nmem value=1 1434055562000000000\ncpu value=2 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	got := strings.Join(written, "")
+	lock.Unlock()
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "cpu value=1 ") || len(lines[0]) <= len("cpu value=1 ") ||
+		lines[1] != "cpu value=2 1434055562000000000" {
+		t.Errorf("sync lines should be written with timestamps at once: %q", got)
+	}
+	if ic.stats.SyncWrites != 1 || ic.stats.SyncWriteDuration == 0 {
+		t.Errorf("sync write stats wrong: %d %d", ic.stats.SyncWrites, ic.stats.SyncWriteDuration)
+	}
+
+	// the backend status is returned, nothing spooled.
+	atomic.StoreInt32(&status, 500)
+	err = ic.Write([]byte("cpu value=3 1434055562000000000\n"), "ns", "test")
+	se, ok := err.(*SyncWriteError)
+	if !ok || se.Backend != "b1" || se.Status != 500 || !strings.Contains(string(se.Body), "cache-max-memory-size") {
+		t.Fatalf("sync write should return the backend status: %v", err)
+	}
+	if b1.fb.Backlog() != 0 || ic.stats.SyncWritesFail != 1 || ic.stats.WriteRequestsFail != 1 {
+		t.Errorf("failed sync write should not be spooled: %d %d", b1.fb.Backlog(), ic.stats.SyncWritesFail)
+	}
+
+	// spooled if the client allows.
+	err = ic.WriteSyncFallback(context.Background(), []byte("cpu value=4 1434055562000000000\n"), "ns", "test")
+	if err != nil || b1.fb.Backlog() == 0 {
+		t.Errorf("failed sync write should be spooled with fallback: %v %d", err, b1.fb.Backlog())
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+var ErrUnboundedQuery = errors.New("select without a lower time bound is not allowed, add WHERE time > ...")
+
+// timeBound 没有时间下限的 select 的处理, window 不为 0 时加上 time > now() - window, reject 时拒绝
+type timeBound struct {
+	window time.Duration
+	reject bool
+}
+
+func newTimeBound(nodecfg *NodeConfig) (tb timeBound) {
+	tb.reject = nodecfg.RejectUnboundedQuery == 1
+	if nodecfg.UnboundedQueryRange == "" {
+		return
+	}
+	d, err := parseDuration(nodecfg.UnboundedQueryRange)
+	if err != nil || d <= 0 {
+		logs.Errorf("illegal unboundedqueryrange %s, ignored", nodecfg.UnboundedQueryRange)
+		return
+	}
+	tb.window = d
+	return
+}
+
+// bound 返回加上时间范围的查询, 没有改动时原样返回 q. 解析失败的查询原样返回, 由后端报错
+func (tb timeBound) bound(q string) (string, error) {
+	if tb.window == 0 && !tb.reject {
+		return q, nil
+	}
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return q, nil
+	}
+	now := &influxql.NowValuer{Now: time.Now()}
+	changed := false
+	for _, stmt := range query.Statements {
+		sel, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			continue
+		}
+		// the time range of the outer select applies to the subqueries.
+		_, tr, err := influxql.ConditionExpr(sel.Condition, now)
+		if err != nil || !tr.Min.IsZero() {
+			continue
+		}
+		if tb.reject {
+			return q, ErrUnboundedQuery
+		}
+		sel.Condition = withTimeWindow(sel.Condition, tb.window)
+		changed = true
+	}
+	if !changed {
+		return q, nil
+	}
+	return query.String(), nil
+}
+
+// withTimeWindow 返回 cond AND time > now() - window
+func withTimeWindow(cond influxql.Expr, window time.Duration) influxql.Expr {
+	bound := &influxql.BinaryExpr{
+		Op:  influxql.GT,
+		LHS: &influxql.VarRef{Val: "time"},
+		RHS: &influxql.BinaryExpr{
+			Op:  influxql.SUB,
+			LHS: &influxql.Call{Name: "now"},
+			RHS: &influxql.DurationLiteral{Val: window},
+		},
+	}
+	if cond == nil {
+		return bound
+	}
+	return &influxql.BinaryExpr{Op: influxql.AND, LHS: &influxql.ParenExpr{Expr: cond}, RHS: bound}
+}
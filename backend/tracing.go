@@ -0,0 +1,124 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "github.com/zxf0089216/influx-proxy"
+	// at most so many measurements of a write listed on the span.
+	TRACE_MEASUREMENTS = 100
+)
+
+// NewOtlpTracerProvider 创建上报到 otlp http 端点的 TracerProvider,
+// endpoint 可以是 host:port 或者 http(s)://host:port/path.
+func NewOtlpTracerProvider(endpoint string) (tp *sdktrace.TracerProvider, err error) {
+	opts := []otlptracehttp.Option{}
+	if strings.Contains(endpoint, "://") {
+		var u *url.URL
+		u, err = url.Parse(endpoint)
+		if err != nil {
+			return
+		}
+		opts = append(opts, otlptracehttp.WithEndpoint(u.Host))
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+		}
+	} else {
+		opts = append(opts, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return
+	}
+	tp = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "influx-proxy"),
+		)),
+	)
+	return
+}
+
+// SetTracerProvider 替换 cluster 使用的 TracerProvider, nil 表示关闭.
+func (ic *InfluxCluster) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	ic.tracer = tp.Tracer(TRACER_NAME)
+}
+
+// ExtractContext 从请求头中提取上游的 trace context.
+func (ic *InfluxCluster) ExtractContext(req *http.Request) context.Context {
+	return propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// startSpan 创建继承上游 trace context 的 span.
+func (ic *InfluxCluster) startSpan(req *http.Request, name string) (*http.Request, trace.Span) {
+	ctx, span := ic.tracer.Start(ic.ExtractContext(req), name, trace.WithSpanKind(trace.SpanKindServer))
+	return req.WithContext(ctx), span
+}
+
+func backendNames(apis []BackendAPI) (names []string) {
+	names = make([]string, 0, len(apis))
+	for _, api := range apis {
+		names = append(names, api.GetName())
+	}
+	return
+}
+
+// writeTraceKey 写入请求的 *writeTrace, span 不记录时没有
+type writeTraceKey struct{}
+
+// writeTrace 一次写入的 measurement, 后端和失败的行数, 结束时记在 influxproxy.write span 上
+type writeTrace struct {
+	measurements []string
+	backends     []string
+	failed       int
+}
+
+// traceRow 记录一行的 measurement 和后端
+func traceRow(ctx context.Context, measurement string, apis []BackendAPI) {
+	wt, ok := ctx.Value(writeTraceKey{}).(*writeTrace)
+	if !ok {
+		return
+	}
+	if len(wt.measurements) < TRACE_MEASUREMENTS {
+		wt.measurements = appendUnique(wt.measurements, measurement)
+	}
+	for _, api := range apis {
+		wt.backends = appendUnique(wt.backends, api.GetName())
+	}
+}
+
+func (wt *writeTrace) end(span trace.Span, rows int) {
+	span.SetAttributes(
+		attribute.Int("rows", rows),
+		attribute.Int("failed_rows", wt.failed),
+		attribute.StringSlice("measurements", wt.measurements),
+		attribute.StringSlice("backends", wt.backends),
+	)
+	if wt.failed > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d of %d rows failed", wt.failed, rows))
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWriteSpan(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ic.SetTracerProvider(tp)
+
+	req, _ := http.NewRequest("POST", "http://localhost:8086/write?db=test", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	var p bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&p, "cpu,host=server%d value=1 1434055562000000000\n", i)
+	}
+	p.WriteString("unknown value=1 1434055562000000000\n")
+	err = ic.WriteContext(ic.ExtractContext(req), p.Bytes(), "ns", "test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// one span for the whole batch.
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "influxproxy.write" {
+		t.Fatalf("spans wrong: %d", len(spans))
+	}
+	span := spans[0]
+	if span.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace context not propagated: %s", span.SpanContext.TraceID())
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["db"].AsString() != "test" {
+		t.Errorf("db attribute wrong: %v", attrs["db"])
+	}
+	if m := attrs["measurements"].AsStringSlice(); len(m) != 2 || m[0] != "cpu" || m[1] != "unknown" {
+		t.Errorf("measurements attribute wrong: %v", m)
+	}
+	if attrs["zone"].AsString() != ic.Zone {
+		t.Errorf("zone attribute wrong: %v", attrs["zone"])
+	}
+	if attrs["rows"].AsInt64() != 1001 || attrs["failed_rows"].AsInt64() != 1 || span.Status.Code != codes.Error {
+		t.Errorf("rows wrong: %v %v %v", attrs["rows"], attrs["failed_rows"], span.Status)
+	}
+	backends := attrs["backends"].AsStringSlice()
+	if len(backends) != 2 || backends[0] != "write_only" || backends[1] != "test1" {
+		t.Errorf("backends attribute wrong: %v", backends)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// WriteTransformer 在路由之前修改一个点, e.g. 去掉敏感的 tag.
+// 返回空表示丢弃这个点, 返回错误时这个点写入失败.
+type WriteTransformer func(measurement string, line []byte) ([]byte, error)
+
+// AddTransformer 注册一个 WriteTransformer, 按注册的顺序执行
+func (ic *InfluxCluster) AddTransformer(t WriteTransformer) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	ic.transformers = append(ic.transformers, t)
+}
+
+// transform 依次执行 transformer, 返回新的行和 measurement, 行为 nil 表示被丢弃
+func (ic *InfluxCluster) transform(key string, line []byte) ([]byte, string, error) {
+	ic.lock.RLock()
+	transformers := ic.transformers
+	ic.lock.RUnlock()
+
+	for _, t := range transformers {
+		out, err := t(key, line)
+		if err != nil {
+			return nil, key, err
+		}
+		out = bytes.TrimRight(out, " \t\r\n")
+		if len(out) == 0 {
+			atomic.AddInt64(&ic.stats.PointsDropped, 1)
+			return nil, key, nil
+		}
+		// the measurement may be renamed.
+		key, err = ScanKey(out)
+		if err != nil {
+			return nil, key, err
+		}
+		line = out
+	}
+	return line, key, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// lineBackend 记录写入的行
+type lineBackend struct {
+	BackendAPI
+	lock  sync.Mutex
+	lines []string
+}
+
+func (lb *lineBackend) Write(p []byte) (err error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	lb.lines = append(lb.lines, string(p))
+	return
+}
+
+func TestInfluxdbClusterTransform(t *testing.T) {
+	ic, err := CreateTestInfluxCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &lineBackend{BackendAPI: ic.backends["test1"]}
+	ic.m2bs["test"] = map[string][]BackendAPI{"cpu": {lb}, "secret": {lb}, "mem": {lb}}
+
+	// drop the user tag.
+	ic.AddTransformer(func(measurement string, line []byte) ([]byte, error) {
+		series, fields, ts := splitLine(line)
+		var tags [][]byte
+		for _, tag := range bytes.Split(series, []byte{','}) {
+			if !bytes.HasPrefix(tag, []byte("user=")) {
+				tags = append(tags, tag)
+			}
+		}
+		out := bytes.Join(tags, []byte{','})
+		out = append(append(out, ' '), fields...)
+		if len(ts) > 0 {
+			out = append(append(out, ' '), ts...)
+		}
+		return out, nil
+	})
+	// drop the secret points, runs after the first one.
+	ic.AddTransformer(func(measurement string, line []byte) ([]byte, error) {
+		if measurement == "secret" {
+			return nil, nil
+		}
+		if bytes.Contains(line, []byte("user=")) {
+			return nil, errors.New("user tag should be dropped first")
+		}
+		if measurement == "mem" {
+			return nil, errors.New("bad point")
+		}
+		return line, nil
+	})
+
+	err = ic.Write([]byte("cpu,host=a,user=bob value=1 1434055562000000000\n"+
+		"secret,user=bob value=2 1434055562000000000\n"+
+		"mem,user=bob value=3 1434055562000000000\n"+
+		"cpu,user=eve,host=b value=4 1434055562000000000\n"), "ns", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"cpu,host=a value=1 1434055562000000000",
+		"cpu,host=b value=4 1434055562000000000",
+	}
+	if len(lb.lines) != len(want) {
+		t.Fatalf("transformed lines wrong: %q", lb.lines)
+	}
+	for i, line := range lb.lines {
+		if line != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, line, want[i])
+		}
+	}
+	if ic.stats.PointsDropped != 1 || ic.stats.PointsWrittenFail != 1 {
+		t.Errorf("dropped %d, failed %d", ic.stats.PointsDropped, ic.stats.PointsWrittenFail)
+	}
+}
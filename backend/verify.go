@@ -0,0 +1,390 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/zxf0089216/influx-proxy/logs"
+)
+
+const (
+	VERIFY_JOBS = 100
+)
+
+var (
+	ErrNoReplica = errors.New("less than two active replicas")
+)
+
+// VerifyDiff 两个副本之间某个series的差异
+type VerifyDiff struct {
+	Backends [2]string   `json:"backends"`
+	Series   string      `json:"series"`
+	Points   int         `json:"points"`
+	Start    interface{} `json:"start"`
+	End      interface{} `json:"end"`
+}
+
+// VerifyJob 后台副本一致性检查任务
+type VerifyJob struct {
+	Id          int64        `json:"id"`
+	DB          string       `json:"db"`
+	Measurement string       `json:"measurement"`
+	Start       string       `json:"start"`
+	End         string       `json:"end"`
+	Status      string       `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	Backends    []string     `json:"backends"`
+	Diffs       []VerifyDiff `json:"diffs"`
+	StartAt     time.Time    `json:"start_at"`
+	FinishAt    *time.Time   `json:"finish_at,omitempty"` // nil while the job is running
+}
+
+type verifyJobs struct {
+	lock   sync.Mutex
+	lastId int64
+	jobs   []*VerifyJob
+}
+
+func seriesKey(s seri) string {
+	if len(s.Tags) == 0 {
+		return s.Name
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := s.Name
+	for _, k := range keys {
+		key += "," + k + "=" + s.Tags[k]
+	}
+	return key
+}
+
+// seriesPoints 按time索引series的点, 列名到值, 与列顺序无关.
+func seriesPoints(s seri) (points map[string]map[string]interface{}, times map[string]interface{}) {
+	points = make(map[string]map[string]interface{}, len(s.Values))
+	times = make(map[string]interface{}, len(s.Values))
+	timeIdx := -1
+	for i, c := range s.Columns {
+		if c == "time" {
+			timeIdx = i
+			break
+		}
+	}
+	for n, row := range s.Values {
+		var t interface{} = n
+		if timeIdx >= 0 && timeIdx < len(row) {
+			t = row[timeIdx]
+		}
+		key := fmt.Sprint(t)
+		point := make(map[string]interface{}, len(s.Columns))
+		for i, c := range s.Columns {
+			if i < len(row) && row[i] != nil {
+				point[c] = row[i]
+			}
+		}
+		points[key] = point
+		times[key] = t
+	}
+	return
+}
+
+func lessTime(a, b interface{}) bool {
+	na, oka := a.(json.Number)
+	nb, okb := b.(json.Number)
+	if oka && okb {
+		if ia, err := na.Int64(); err == nil {
+			if ib, err := nb.Int64(); err == nil {
+				return ia < ib
+			}
+		}
+		fa, _ := na.Float64()
+		fb, _ := nb.Float64()
+		return fa < fb
+	}
+	ia, oka := a.(int)
+	ib, okb := b.(int)
+	if oka && okb {
+		return ia < ib
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// decodeSeries 同 GetSeriesArray, 数字解码为 json.Number, ns 时间戳和大整数不丢精度
+func decodeSeries(body []byte) (ss []seri, err error) {
+	var tmp statementArray
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err = dec.Decode(&tmp); err != nil {
+		return
+	}
+	if len(tmp.Results) > 0 && len(tmp.Results[0].Series) > 0 {
+		ss = tmp.Results[0].Series
+	}
+	return
+}
+
+// CompareResults compares two query responses point by point.
+// Column order doesn't matter, missing columns equal to null. Numbers are compared as written.
+func CompareResults(a, b []byte) (diffs []VerifyDiff, err error) {
+	sa, err := decodeSeries(a)
+	if err != nil {
+		return
+	}
+	sb, err := decodeSeries(b)
+	if err != nil {
+		return
+	}
+
+	ma := make(map[string]seri, len(sa))
+	for _, s := range sa {
+		ma[seriesKey(s)] = s
+	}
+	mb := make(map[string]seri, len(sb))
+	for _, s := range sb {
+		mb[seriesKey(s)] = s
+	}
+	keys := make([]string, 0, len(ma)+len(mb))
+	for k := range ma {
+		keys = append(keys, k)
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pa, ta := seriesPoints(ma[key])
+		pb, tb := seriesPoints(mb[key])
+		for k, t := range tb {
+			ta[k] = t
+		}
+
+		var diff []interface{}
+		for k, t := range ta {
+			if !reflect.DeepEqual(pa[k], pb[k]) {
+				diff = append(diff, t)
+			}
+		}
+		if len(diff) == 0 {
+			continue
+		}
+		sort.Slice(diff, func(i, j int) bool { return lessTime(diff[i], diff[j]) })
+		diffs = append(diffs, VerifyDiff{
+			Series: key,
+			Points: len(diff),
+			Start:  diff[0],
+			End:    diff[len(diff)-1],
+		})
+	}
+	return
+}
+
+// verifyReplicas queries every api and compares the others to the first response.
+func (ic *InfluxCluster) verifyReplicas(req *http.Request, apis []BackendAPI) (header http.Header, status int, body []byte, names []string, diffs []VerifyDiff, err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	recordAccess(req.Context(), "", apis...)
+	for _, api := range apis {
+		h, s, b, Err := api.QueryResp(req)
+		if Err != nil {
+			logs.Errorf("verify query (%s) on %s error: %s", q, api.GetName(), Err)
+			continue
+		}
+		names = append(names, api.GetName())
+		if header == nil {
+			header, status, body = h, s, b
+			continue
+		}
+
+		ds, Err := CompareResults(body, b)
+		if Err != nil {
+			logs.Errorf("verify query (%s) on %s compare error: %s", q, api.GetName(), Err)
+			continue
+		}
+		for _, d := range ds {
+			d.Backends = [2]string{names[0], api.GetName()}
+			logs.Warningf("replica diverged, backends: %s %s, series: %s, points: %d, from %v to %v, the query is %s",
+				d.Backends[0], d.Backends[1], d.Series, d.Points, d.Start, d.End, q)
+			diffs = append(diffs, d)
+		}
+	}
+	if header == nil {
+		err = ErrNoReplica
+		return
+	}
+	return
+}
+
+// VerifyQuery 查询所有可用副本并比较结果, 返回第一个副本的结果
+func (ic *InfluxCluster) VerifyQuery(w http.ResponseWriter, req *http.Request, apis []BackendAPI) (err error) {
+	header, status, body, _, diffs, err := ic.verifyReplicas(req, queryableBackends(apis))
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&ic.stats.QueryVerifyDiffs, int64(len(diffs)))
+	writeResp(w, header, status, body)
+	return
+}
+
+// readRepair 按 ReadRepairRate 抽样, 在后台比较两个随机副本的结果, 记录差异.
+func (ic *InfluxCluster) readRepair(req *http.Request, apis []BackendAPI) {
+	if ic.ReadRepairRate <= 0 || rand.Float64() >= ic.ReadRepairRate {
+		return
+	}
+	apis = queryableBackends(apis)
+	if len(apis) < 2 || !readOnlySelect(req.FormValue("q")) {
+		return
+	}
+	perm := rand.Perm(len(apis))
+	pair := []BackendAPI{apis[perm[0]], apis[perm[1]]}
+
+	// the original request is gone when the handler returns.
+	form := url.Values{}
+	for k, v := range req.Form {
+		form[k] = append([]string(nil), v...)
+	}
+	r, err := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	if err != nil {
+		return
+	}
+	r.Form = form
+
+	atomic.AddInt64(&ic.stats.ReadRepairs, 1)
+	go func() {
+		_, _, _, names, diffs, err := ic.verifyReplicas(r, pair)
+		if err != nil || len(names) < 2 {
+			return
+		}
+		if len(diffs) > 0 {
+			atomic.AddInt64(&ic.stats.ReadRepairDiffs, 1)
+		}
+	}()
+}
+
+// readOnlySelect 是否只有不带 INTO 的 SELECT, 只有它们可以再发给副本比较
+func readOnlySelect(q string) bool {
+	if !selectQuery.MatchString(q) {
+		return false
+	}
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return false
+	}
+	for _, stmt := range query.Statements {
+		sel, ok := stmt.(*influxql.SelectStatement)
+		if !ok || sel.Target != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func queryableBackends(apis []BackendAPI) (actives []BackendAPI) {
+	for _, api := range apis {
+		if api.IsActive() && !api.IsWriteOnly() {
+			actives = append(actives, api)
+		}
+	}
+	return
+}
+
+func timeCond(t string) string {
+	if _, err := strconv.ParseInt(t, 10, 64); err == nil {
+		return t
+	}
+	return "'" + strings.Replace(t, "'", "\\'", -1) + "'"
+}
+
+// StartVerify 后台比较measurement在[start, end)之间各副本的数据
+func (ic *InfluxCluster) StartVerify(db, measurement, start, end string) (job VerifyJob, err error) {
+	apis, ok := ic.GetBackends(measurement, db)
+	if !ok {
+		err = ErrBackendNotExist
+		return
+	}
+	apis = queryableBackends(apis)
+	if len(apis) < 2 {
+		err = ErrNoReplica
+		return
+	}
+
+	j := &VerifyJob{
+		Id:          atomic.AddInt64(&ic.verifies.lastId, 1),
+		DB:          db,
+		Measurement: measurement,
+		Start:       start,
+		End:         end,
+		Status:      "running",
+		StartAt:     time.Now(),
+	}
+	ic.verifies.lock.Lock()
+	ic.verifies.jobs = append(ic.verifies.jobs, j)
+	job = *j
+	if len(ic.verifies.jobs) > VERIFY_JOBS {
+		ic.verifies.jobs = ic.verifies.jobs[len(ic.verifies.jobs)-VERIFY_JOBS:]
+	}
+	ic.verifies.lock.Unlock()
+
+	q := fmt.Sprintf("SELECT * FROM %s WHERE time >= %s AND time < %s GROUP BY *",
+		quoteIdent(measurement), timeCond(start), timeCond(end))
+	form := url.Values{}
+	form.Set("q", q)
+	form.Set("db", db)
+	form.Set("epoch", "ns")
+	req, err := http.NewRequest("GET", "/query?"+form.Encode(), nil)
+	if err != nil {
+		return
+	}
+	req.Form = form
+
+	go func() {
+		_, _, _, names, diffs, err := ic.verifyReplicas(req, apis)
+		atomic.AddInt64(&ic.stats.QueryVerifyDiffs, int64(len(diffs)))
+		ic.verifies.lock.Lock()
+		defer ic.verifies.lock.Unlock()
+		j.Backends = names
+		j.Diffs = diffs
+		finish := time.Now()
+		j.FinishAt = &finish
+		j.Status = "done"
+		if err != nil {
+			j.Status = "failed"
+			j.Error = err.Error()
+		} else if len(names) < 2 {
+			j.Status = "failed"
+			j.Error = ErrNoReplica.Error()
+		}
+		logs.Infof("verify job %d done, db: %s, measurement: %s, diffs: %d", j.Id, db, measurement, len(diffs))
+	}()
+	return
+}
+
+// VerifyJobs 返回最近的检查任务
+func (ic *InfluxCluster) VerifyJobs() (jobs []VerifyJob) {
+	ic.verifies.lock.Lock()
+	defer ic.verifies.lock.Unlock()
+	for _, job := range ic.verifies.jobs {
+		jobs = append(jobs, *job)
+	}
+	return
+}
@@ -0,0 +1,245 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompareResults(t *testing.T) {
+	a := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value","idle"],"values":[[1,1,2],[2,3,4],[3,5,6]]}]}]}`)
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["idle","time","value"],"values":[[2,1,1],[4,2,3],[6,3,5]]}]}]}`)
+	c := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value","idle"],"values":[[1,1,2],[2,9,4]]}]}]}`)
+
+	diffs, err := CompareResults(a, b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(diffs) != 0 {
+		t.Errorf("column order should not matter: %v", diffs)
+	}
+
+	diffs, err = CompareResults(a, c)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(diffs) != 1 {
+		t.Errorf("diffs wrong: %v", diffs)
+		return
+	}
+	d := diffs[0]
+	if d.Series != "cpu,host=a" || d.Points != 2 || d.Start != json.Number("2") || d.End != json.Number("3") {
+		t.Errorf("diff wrong: %v", d)
+	}
+
+	// ns timestamps and large integers aren't rounded.
+	e := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1600000000000000001,9007199254740993],[1600000000000000002,1]]}]}]}`)
+	f := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1600000000000000001,9007199254740992],[1600000000000000002,2]]}]}]}`)
+	diffs, err = CompareResults(e, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Points != 2 || diffs[0].Start != json.Number("1600000000000000001") || diffs[0].End != json.Number("1600000000000000002") {
+		t.Errorf("points 1ns apart should be compared: %v", diffs)
+	}
+}
+
+func CreateReplicaServer(body []byte, gzip bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			w.WriteHeader(204)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if gzip {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(200)
+			var buf bytes.Buffer
+			Compress(&buf, body)
+			w.Write(buf.Bytes())
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(body)
+	}))
+}
+
+func TestVerifyQuery(t *testing.T) {
+	a := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,3]]}]}]}`)
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["value","time"],"values":[[1,1]]}]}]}`)
+	ts1 := CreateReplicaServer(a, false)
+	defer ts1.Close()
+	ts2 := CreateReplicaServer(b, true)
+	defer ts2.Close()
+
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	cfg, _ := CreateTestBackendConfig("test")
+	cfg.URL = ts1.URL
+	bs1, err := NewBackends(cfg, "replica1", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs1.Close()
+	cfg, _ = CreateTestBackendConfig("test")
+	cfg.URL = ts2.URL
+	bs2, err := NewBackends(cfg, "replica2", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bs2.Close()
+	ic.backends = map[string]BackendAPI{"replica1": bs1, "replica2": bs2}
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs1, bs2}}}
+
+	q := url.Values{}
+	q.Set("db", "test")
+	q.Set("q", "select value from cpu")
+	q.Set("verify", "true")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := NewDummyResponseWriter()
+	ic.Query(w, req)
+	if w.status != 200 || !bytes.Equal(w.buffer.Bytes(), a) {
+		t.Errorf("response wrong: %d %s", w.status, w.buffer.Bytes())
+	}
+	if atomic.LoadInt64(&ic.stats.QueryVerifyDiffs) != 1 {
+		t.Errorf("diff counter wrong: %d", ic.stats.QueryVerifyDiffs)
+	}
+
+	job, err := ic.StartVerify("test", "cpu", "0", "10")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if p, _ := json.Marshal(job); bytes.Contains(p, []byte("finish_at")) {
+		t.Errorf("running job should have no finish time: %s", p)
+	}
+	for i := 0; i < 50 && ic.VerifyJobs()[0].Status == "running"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	jobs := ic.VerifyJobs()
+	if len(jobs) != 1 || jobs[0].Id != job.Id || jobs[0].Status != "done" || len(jobs[0].Diffs) != 1 {
+		t.Errorf("verify job wrong: %v", jobs)
+		return
+	}
+	if jobs[0].FinishAt == nil || jobs[0].FinishAt.Before(jobs[0].StartAt) {
+		t.Errorf("finish time wrong: %v", jobs[0].FinishAt)
+	}
+	if jobs[0].Diffs[0].Backends != [2]string{"replica1", "replica2"} {
+		t.Errorf("diff backends wrong: %v", jobs[0].Diffs[0].Backends)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	a := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,3]]}]}]}`)
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]]}]}]}`)
+	ts1 := CreateReplicaServer(a, false)
+	defer ts1.Close()
+	ts2 := CreateReplicaServer(b, false)
+	defer ts2.Close()
+	ts3 := CreateReplicaServer(a, false)
+	defer ts3.Close()
+
+	newBackends := func(url, name string) *Backends {
+		cfg, _ := CreateTestBackendConfig("test")
+		cfg.URL = url
+		bs, err := NewBackends(cfg, name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+	bs1 := newBackends(ts1.URL, "replica1")
+	defer bs1.Close()
+	bs2 := newBackends(ts2.URL, "replica2")
+	defer bs2.Close()
+	bs3 := newBackends(ts3.URL, "replica3")
+	defer bs3.Close()
+
+	query := func(ic *InfluxCluster) {
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", "select value from cpu")
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		ic.Query(w, req)
+		if w.status != 200 {
+			t.Errorf("query wrong: %d %s", w.status, w.buffer.Bytes())
+		}
+	}
+	wait := func(ic *InfluxCluster, diffs int64) {
+		for i := 0; i < 100 && atomic.LoadInt64(&ic.stats.ReadRepairDiffs) < diffs; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// divergent replicas.
+	ic := NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ReadRepairRate: 1}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs1, bs2}}}
+	query(ic)
+	wait(ic, 1)
+	if atomic.LoadInt64(&ic.stats.ReadRepairs) != 1 || atomic.LoadInt64(&ic.stats.ReadRepairDiffs) != 1 {
+		t.Errorf("read repair counter wrong: %d %d", ic.stats.ReadRepairs, ic.stats.ReadRepairDiffs)
+	}
+
+	// consistent replicas.
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ReadRepairRate: 1}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs1, bs3}}}
+	query(ic)
+	wait(ic, 1)
+	if atomic.LoadInt64(&ic.stats.ReadRepairs) != 1 || atomic.LoadInt64(&ic.stats.ReadRepairDiffs) != 0 {
+		t.Errorf("read repair counter wrong: %d %d", ic.stats.ReadRepairs, ic.stats.ReadRepairDiffs)
+	}
+
+	// statements writing or deleting data are never sent again.
+	var hits int64
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/query" {
+			atomic.AddInt64(&hits, 1)
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer counting.Close()
+	bs4 := newBackends(counting.URL, "replica4")
+	defer bs4.Close()
+	bs5 := newBackends(counting.URL, "replica5")
+	defer bs5.Close()
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{ReadRepairRate: 1}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs4, bs5}}}
+	for _, stmt := range []string{"DROP MEASUREMENT cpu", "SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h)"} {
+		atomic.StoreInt64(&hits, 0)
+		q := url.Values{}
+		q.Set("db", "test")
+		q.Set("q", stmt)
+		req, _ := http.NewRequest("POST", "http://localhost:8086/query?"+q.Encode(), nil)
+		ic.Query(NewDummyResponseWriter(), req)
+		time.Sleep(50 * time.Millisecond)
+		if n := atomic.LoadInt64(&hits); n != 1 {
+			t.Errorf("%s should be sent once: %d", stmt, n)
+		}
+	}
+	if atomic.LoadInt64(&ic.stats.ReadRepairs) != 0 {
+		t.Errorf("only selects should be repaired: %d", ic.stats.ReadRepairs)
+	}
+
+	// disabled.
+	ic = NewInfluxCluster(&FileConfigSource{}, &NodeConfig{}, ".")
+	ic.m2bs = map[string]map[string][]BackendAPI{"test": {"cpu": {bs1, bs2}}}
+	query(ic)
+	if atomic.LoadInt64(&ic.stats.ReadRepairs) != 0 {
+		t.Errorf("read repair should be off: %d", ic.stats.ReadRepairs)
+	}
+}
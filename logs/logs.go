@@ -8,7 +8,7 @@ import (
 )
 
 var (
-	log *logrus.Logger
+	log = logrus.New()
 )
 
 func InitLog(ravenDSN string) {
@@ -39,49 +39,49 @@ func InitLog(ravenDSN string) {
 }
 
 func Fatal(args ...interface{}) {
-	log.Fatal(args)
+	log.Fatal(args...)
 }
 
 func Error(args ...interface{}) {
-	log.Error(args)
+	log.Error(args...)
 }
 
 func Warning(args ...interface{}) {
-	log.Warning(args)
+	log.Warning(args...)
 }
 
 func Panic(args ...interface{}) {
-	log.Panic(args)
+	log.Panic(args...)
 }
 
 func Info(args ...interface{}) {
-	log.Info(args)
+	log.Info(args...)
 }
 
 func Debug(args ...interface{}) {
-	log.Debug(args)
+	log.Debug(args...)
 }
 
 func Fatalf(format string, args ...interface{}) {
-	log.Fatalf(format, args)
+	log.Fatalf(format, args...)
 }
 
 func Errorf(format string, args ...interface{}) {
-	log.Errorf(format, args)
+	log.Errorf(format, args...)
 }
 
 func Warningf(format string, args ...interface{}) {
-	log.Warningf(format, args)
+	log.Warningf(format, args...)
 }
 
 func Panicf(format string, args ...interface{}) {
-	log.Panicf(format, args)
+	log.Panicf(format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	log.Infof(format, args)
+	log.Infof(format, args...)
 }
 
 func Debugf(format string, args ...interface{}) {
-	log.Debugf(format, args)
+	log.Debugf(format, args...)
 }
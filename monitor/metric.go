@@ -1,9 +1,25 @@
 package monitor
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+)
+
+var (
+	ErrEmptyName   = errors.New("metric has no name")
+	ErrEmptyFields = errors.New("metric has no fields")
+)
 
-	"github.com/influxdata/influxdb/client/v2"
+// line protocol 中需要转义的字符
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
 )
 
 type Metric struct {
@@ -13,12 +29,110 @@ type Metric struct {
 	Time   time.Time              `json:"time"`
 }
 
+// ParseToLine 按 line protocol 输出, 时间戳为纳秒, tag 和 field 按 key 排序.
+// 空的 tag value 被忽略, 整数带 i 后缀, 无符号整数超过 int64 时出错, NaN 和 Inf 出错.
 func (m *Metric) ParseToLine() (line string, err error) {
-	p, err := client.NewPoint(m.Name, m.Tags, m.Fields, m.Time)
-	if err != nil {
-		return "", err
+	if m.Name == "" {
+		return "", ErrEmptyName
+	}
+	if len(m.Fields) == 0 {
+		return "", ErrEmptyFields
+	}
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(m.Name))
+
+	keys := make([]string, 0, len(m.Tags))
+	for k, v := range m.Tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(tagEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(tagEscaper.Replace(m.Tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range m.Fields {
+		keys = append(keys, k)
 	}
-	line = p.PrecisionString("ns")
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		value, err := formatField(m.Fields[k])
+		if err != nil {
+			return "", fmt.Errorf("field %s: %s", k, err)
+		}
+		b.WriteString(tagEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(m.Time.UnixNano(), 10))
+	return b.String(), nil
+}
+
+// formatField 按 field 的类型输出 value
+func formatField(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int8:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", nil
+	case uint:
+		return formatUint(uint64(v))
+	case uint8:
+		return formatUint(uint64(v))
+	case uint16:
+		return formatUint(uint64(v))
+	case uint32:
+		return formatUint(uint64(v))
+	case uint64:
+		return formatUint(v)
+	case float32:
+		return formatFloat(float64(v))
+	case float64:
+		return formatFloat(v)
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, nil
+	case []byte:
+		return `"` + stringEscaper.Replace(string(v)) + `"`, nil
+	case time.Duration:
+		return strconv.FormatInt(int64(v), 10) + "i", nil
+	case nil:
+		return "", errors.New("nil value")
+	}
+	return "", fmt.Errorf("unsupported type %T", v)
+}
 
-	return
+// formatUint InfluxDB 1.x 默认不接受 u 后缀, 写成整数
+func formatUint(v uint64) (string, error) {
+	if v > math.MaxInt64 {
+		return "", fmt.Errorf("%d overflows int64", v)
+	}
+	return strconv.FormatUint(v, 10) + "i", nil
+}
+
+func formatFloat(v float64) (string, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "", fmt.Errorf("invalid float %v", v)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64), nil
 }
@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestMetricParseToLine(t *testing.T) {
+	now := time.Unix(1434055562, 5)
+	m := &Metric{
+		Name: "stat istics,proxy",
+		Tags: map[string]string{
+			"host":      "web 01,zone=a",
+			"addr":      ":7076",
+			"tag key":   "v=1",
+			"empty":     "",
+			"line\nbrk": "a\nb",
+		},
+		Fields: map[string]interface{}{
+			"int":       int64(-42),
+			"uint":      uint32(7),
+			"float":     1.5,
+			"whole":     float64(3),
+			"bool":      true,
+			"str":       `say "hi" \ bye`,
+			"multiline": "a\nb",
+			"field,key": 1,
+			"duration":  time.Second,
+		},
+		Time: now,
+	}
+	line, err := m.ParseToLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := models.ParsePointsString(line)
+	if err != nil || len(points) != 1 {
+		t.Fatalf("line should be parsed: %s %v", line, err)
+	}
+	p := points[0]
+	if string(p.Name()) != m.Name || !p.Time().Equal(now) {
+		t.Errorf("name or time wrong: %s %s", p.Name(), p.Time())
+	}
+	tags := p.Tags().Map()
+	if len(tags) != 4 || tags["host"] != "web 01,zone=a" || tags["tag key"] != "v=1" || tags["addr"] != ":7076" {
+		t.Errorf("tags wrong: %v", tags)
+	}
+	fields, err := p.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"int":       int64(-42),
+		"uint":      int64(7),
+		"float":     1.5,
+		"whole":     float64(3),
+		"bool":      true,
+		"str":       `say "hi" \ bye`,
+		"multiline": `a\nb`,
+		"field,key": int64(1),
+		"duration":  int64(time.Second),
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("field %s wrong: %#v, want %#v", k, fields[k], v)
+		}
+	}
+	if len(fields) != len(want) {
+		t.Errorf("fields wrong: %v", fields)
+	}
+
+	// hostnames seen in the wild.
+	for _, host := range []string{"ip-10-0-0-1 (eu-west-1)", "a,b", "x=y", `back\slash`, "tab\there"} {
+		m := &Metric{Name: "statistics", Tags: map[string]string{"host": host}, Fields: map[string]interface{}{"v": 1}, Time: now}
+		line, err := m.ParseToLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		points, err := models.ParsePointsString(line)
+		if err != nil || len(points) != 1 || points[0].Tags().GetString("host") != host {
+			t.Errorf("host %q should round trip: %s %v", host, line, err)
+		}
+	}
+
+	for _, m := range []*Metric{
+		{Name: "", Fields: map[string]interface{}{"v": 1}},
+		{Name: "statistics"},
+		{Name: "statistics", Fields: map[string]interface{}{"v": math.NaN()}},
+		{Name: "statistics", Fields: map[string]interface{}{"v": uint64(math.MaxUint64)}},
+		{Name: "statistics", Fields: map[string]interface{}{"v": []int{1}}},
+	} {
+		if line, err := m.ParseToLine(); err == nil {
+			t.Errorf("invalid metric should fail: %s", line)
+		}
+	}
+}
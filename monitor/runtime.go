@@ -0,0 +1,60 @@
+package monitor
+
+import (
+	"os"
+	"runtime"
+)
+
+// RuntimeStats Go 运行时和进程的状态, 字段名是写入监控库的 field 名, 保持不变:
+//
+//	heapAlloc       已分配的堆对象字节数
+//	heapSys         从系统申请的堆内存字节数
+//	heapObjects     已分配的堆对象个数
+//	gcCount         完成的 GC 次数
+//	gcPauseTotalNs  GC 暂停的总纳秒数
+//	goroutines      当前的 goroutine 数
+//	openFDs         打开的文件描述符数, 取不到时 (非 linux) 为 -1
+type RuntimeStats struct {
+	HeapAlloc      int64
+	HeapSys        int64
+	HeapObjects    int64
+	GCCount        int64
+	GCPauseTotalNs int64
+	Goroutines     int64
+	OpenFDs        int64
+}
+
+// ReadRuntimeStats 读取当前的运行时状态, ReadMemStats 会短暂停止所有 goroutine, 不要频繁调用
+func ReadRuntimeStats() (stats RuntimeStats) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats.HeapAlloc = int64(ms.HeapAlloc)
+	stats.HeapSys = int64(ms.HeapSys)
+	stats.HeapObjects = int64(ms.HeapObjects)
+	stats.GCCount = int64(ms.NumGC)
+	stats.GCPauseTotalNs = int64(ms.PauseTotalNs)
+	stats.Goroutines = int64(runtime.NumGoroutine())
+	stats.OpenFDs = openFDs()
+	return
+}
+
+// Fields 返回写入监控库的字段
+func (stats *RuntimeStats) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"heapAlloc":      stats.HeapAlloc,
+		"heapSys":        stats.HeapSys,
+		"heapObjects":    stats.HeapObjects,
+		"gcCount":        stats.GCCount,
+		"gcPauseTotalNs": stats.GCPauseTotalNs,
+		"goroutines":     stats.Goroutines,
+		"openFDs":        stats.OpenFDs,
+	}
+}
+
+func openFDs() int64 {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return int64(len(entries))
+}
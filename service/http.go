@@ -5,11 +5,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"github.com/zxf0089216/influx-proxy/logs"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
 
 	"github.com/zxf0089216/influx-proxy/backend"
@@ -26,20 +32,77 @@ func NewHttpService(ic *backend.InfluxCluster) (hs *HttpService) {
 	return
 }
 
-// Register 注册http方法
+var ErrUnknownEndpoint = errors.New("unknown endpoint")
+
+// Register 注册 InfluxDB 兼容的http方法
 func (hs *HttpService) Register(mux *http.ServeMux) {
-	mux.HandleFunc("/reload", hs.HandlerReload)
-	mux.HandleFunc("/ping", hs.HandlerPing)
-	mux.HandleFunc("/query", hs.HandlerQuery)
-	mux.HandleFunc("/write", hs.HandlerWrite)
+	hs.RegisterEndpoints(mux, nil)
+}
+
+// RegisterEndpoints 只注册 endpoints 中的方法, 如 /write, 为空时注册全部
+func (hs *HttpService) RegisterEndpoints(mux *http.ServeMux, endpoints []string) (err error) {
+	handlers := map[string]http.HandlerFunc{
+		"/reload": hs.HandlerReload,
+		"/ping":   hs.cors(hs.HandlerPing),
+		"/query":  hs.ic.AccessLogHandler(hs.cors(hs.HandlerQuery)),
+		"/write":  hs.ic.AccessLogHandler(hs.cors(hs.HandlerWrite)),
+	}
+	if len(endpoints) == 0 {
+		for path, handler := range handlers {
+			mux.HandleFunc(path, handler)
+		}
+		return
+	}
+	for _, path := range endpoints {
+		handler, ok := handlers[path]
+		if !ok {
+			logs.Errorf("unknown endpoint %s", path)
+			return ErrUnknownEndpoint
+		}
+		mux.HandleFunc(path, handler)
+	}
+	return
+}
+
+// RegisterAdmin 注册管理接口, 只在 AdminListenAddr 上提供
+func (hs *HttpService) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/verify", hs.HandlerVerify)
+	mux.HandleFunc("/admin/import", hs.HandlerImport)
+	mux.HandleFunc("/admin/export", hs.HandlerExport)
+	mux.HandleFunc("/admin/deadletter", hs.HandlerDeadLetter)
+	mux.HandleFunc("/admin/ratelimit", hs.HandlerRateLimit)
+	mux.HandleFunc("/admin/stats", hs.HandlerStats)
+	mux.HandleFunc("/admin/events", hs.HandlerEvents)
+	mux.HandleFunc("/admin/backends/", hs.HandlerBackends)
+	mux.HandleFunc("/admin/routes", hs.HandlerRoutes)
+	mux.HandleFunc("/admin/replication", hs.HandlerReplication)
+	mux.HandleFunc("/metrics", hs.HandlerMetrics)
+	mux.HandleFunc("/health", hs.HandlerHealth)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// cors 处理浏览器的 CORS 预检请求, 并给允许的 Origin 加上 CORS 头
+func (hs *HttpService) cors(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if hs.ic.CORS(w, req) {
+			req.Body.Close()
+			return
+		}
+		handler(w, req)
+	}
 }
 
 // HandlerReload reload方法入口
 func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	w.Header().Add("X-Influxdb-Version", hs.ic.InfluxdbVersion)
+	if !hs.ic.Authorize(w, req, backend.PERM_ADMIN) {
+		return
+	}
 
 	err := hs.ic.LoadConfig()
 	if err != nil {
@@ -55,23 +118,23 @@ func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
 // HandlerPing ping方法入口
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	version, err := hs.ic.Ping()
-	if err != nil {
-		panic("WTF")
-		return
-	}
-	w.Header().Add("X-Influxdb-Version", version)
-	w.WriteHeader(204)
+	hs.ic.WritePing(w, req)
 	return
 }
 
 // HandlerQuery query方法入口
 func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	w.Header().Add("X-Influxdb-Version", hs.ic.InfluxdbVersion)
+	q := strings.TrimSpace(req.FormValue("q"))
+	if !hs.ic.Authorize(w, req, backend.QueryPermission(q)) {
+		return
+	}
+	if !hs.ic.RateLimit(w, req, backend.RATE_QUERY, 1) {
+		return
+	}
 	//db := req.FormValue("db")
 
-	q := strings.TrimSpace(req.FormValue("q"))
 	err := hs.ic.Query(w, req)
 	if err != nil {
 		logs.Infof("query error: %v,the query is %v,the client is %s ", err, req.Form, req.RemoteAddr)
@@ -87,12 +150,28 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 // HandlerWrite write方法入口
 func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	w.Header().Add("X-Influxdb-Version", hs.ic.InfluxdbVersion)
 	if req.Method != "POST" {
 		w.WriteHeader(405)
 		w.Write([]byte("method not allow."))
 		return
 	}
+	// writes always go to all backends of the measurement.
+	if req.Header.Get(backend.BACKEND_HEADER) != "" {
+		w.WriteHeader(400)
+		w.Write([]byte(backend.BACKEND_HEADER + " is not allowed for writes"))
+		return
+	}
+	if !hs.ic.Authorize(w, req, backend.PERM_WRITE) {
+		return
+	}
+	if !hs.ic.RateLimit(w, req, backend.RATE_WRITE, 1) {
+		return
+	}
+	if !hs.ic.Acquire(w, req, backend.CONCURRENT_WRITE) {
+		return
+	}
+	defer hs.ic.Release(backend.CONCURRENT_WRITE)
 
 	precision := req.URL.Query().Get("precision")
 	if precision == "" {
@@ -120,14 +199,421 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !hs.ic.RateLimit(w, req, backend.RATE_POINTS, backend.CountRows(p)) {
+		return
+	}
+
 	db := req.FormValue("db")
 
-	err = hs.ic.Write(p, precision, db)
-	if err == nil {
+	// failed sync writes are spooled instead only if the client allows it.
+	fallback := req.FormValue("syncfallback") == "true"
+	if req.FormValue("strict") == "true" || req.Header.Get(backend.STRICT_WRITE_HEADER) == "true" {
+		err = hs.ic.WriteStrict(hs.ic.ExtractContext(req), p, precision, db, fallback)
+	} else if fallback {
+		err = hs.ic.WriteSyncFallback(hs.ic.ExtractContext(req), p, precision, db)
+	} else {
+		err = hs.ic.WriteContext(hs.ic.ExtractContext(req), p, precision, db)
+	}
+	switch e := err.(type) {
+	case nil:
 		w.WriteHeader(204)
+	case *backend.LineErrors:
+		writeJson(w, 400, map[string]interface{}{"error": e.Error(), "total": e.Total, "lines": e.Lines})
+	case *backend.SyncWriteError:
+		// the status and body of the backend are passed through.
+		if e.Status == 0 {
+			writeJson(w, 503, map[string]string{"error": e.Error()})
+			break
+		}
+		w.WriteHeader(e.Status)
+		w.Write(e.Body)
+	default:
+		if err == backend.ErrAllUnavailable {
+			w.Header().Set("Retry-After", "1")
+			writeJson(w, 503, map[string]string{"error": err.Error()})
+		}
+		if err == backend.ErrQuotaExceeded {
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(429)
+			w.Write([]byte("{\"error\":\"write quota exceeded\"}\n"))
+		}
 	}
 	if hs.ic.WriteTracing != 0 {
 		logs.Errorf("Write body received by handler: %s,the client is %s\n", p, req.RemoteAddr)
 	}
 	return
 }
+
+// HandlerHealth 后端的可用情况, 有不可用的后端时 status 为 degraded
+func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	writeJson(w, 200, hs.ic.Health())
+}
+
+// HandlerMetrics prometheus格式的统计
+func (hs *HttpService) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	hs.ic.WriteMetrics(w)
+}
+
+// HandlerVerify 副本一致性检查, POST 启动后台任务, GET 查看任务结果
+func (hs *HttpService) HandlerVerify(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	switch req.Method {
+	case "GET":
+		writeJson(w, 200, hs.ic.VerifyJobs())
+	case "POST":
+		db := req.FormValue("db")
+		measurement := req.FormValue("measurement")
+		start := req.FormValue("start")
+		end := req.FormValue("end")
+		if measurement == "" || start == "" || end == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("measurement, start and end are required\n"))
+			return
+		}
+		job, err := hs.ic.StartVerify(db, measurement, start, end)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		logs.Infof("verify job %d started by %s", job.Id, req.RemoteAddr)
+		writeJson(w, 202, job)
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+	}
+}
+
+// HandlerImport 批量导入 line protocol 文件, POST 导入并返回汇总, GET 查看导入任务
+func (hs *HttpService) HandlerImport(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	switch req.Method {
+	case "GET":
+		writeJson(w, 200, hs.ic.ImportJobs())
+		return
+	case "POST":
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+
+	db := req.URL.Query().Get("db")
+	precision := req.URL.Query().Get("precision")
+	if precision == "" {
+		precision = "ns"
+	}
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+
+	// gzip by header or by magic number, for curl --data-binary @file.gz.
+	body := bufio.NewReader(req.Body)
+	magic, _ := body.Peek(2)
+	var r io.Reader = body
+	if req.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		b, err := gzip.NewReader(body)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("unable to decode gzip body"))
+			return
+		}
+		defer b.Close()
+		r = b
+	}
+
+	logs.Infof("import started by %s, db: %s, dry run: %t", req.RemoteAddr, db, dryRun)
+	job, err := hs.ic.Import(r, db, precision, dryRun)
+	if err != nil {
+		writeJson(w, 400, job)
+		return
+	}
+	writeJson(w, 200, job)
+}
+
+// HandlerExport 把 measurement 的数据导出为 line protocol
+func (hs *HttpService) HandlerExport(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+
+	db := req.FormValue("db")
+	measurement := req.FormValue("measurement")
+	if measurement == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("measurement is required\n"))
+		return
+	}
+	api, err := hs.ic.ExportBackend(db, measurement, req.FormValue("backend"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	var out io.Writer = w
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if req.FormValue("gzip") == "true" || strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		zip := gzip.NewWriter(w)
+		defer zip.Close()
+		out = zip
+	}
+	w.WriteHeader(200)
+
+	// status is sent, errors can only be logged.
+	lines, err := hs.ic.Export(out, api, db, measurement, req.FormValue("start"), req.FormValue("end"))
+	if err != nil {
+		logs.Errorf("export %s.%s from %s error: %s", db, measurement, api.GetName(), err)
+		return
+	}
+	logs.Infof("export %s.%s from %s by %s, %d lines", db, measurement, api.GetName(), req.RemoteAddr, lines)
+}
+
+// HandlerDeadLetter GET 查看各后端 dead letter 文件大小, 带 backend 时下载, DELETE 清空
+func (hs *HttpService) HandlerDeadLetter(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	name := req.FormValue("backend")
+	if req.Method == "GET" && name == "" {
+		writeJson(w, 200, hs.ic.DeadLetters())
+		return
+	}
+	if req.Method != "GET" && req.Method != "DELETE" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	if name == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("backend is required\n"))
+		return
+	}
+	dl, err := hs.ic.DeadLetter(name)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if req.Method == "DELETE" {
+		err = dl.Truncate()
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		logs.Infof("dead letter of %s truncated by %s", name, req.RemoteAddr)
+		w.WriteHeader(204)
+		return
+	}
+
+	r, size, err := dl.Reader()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	defer r.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(200)
+	io.Copy(w, r)
+}
+
+// HandlerRateLimit 查看最近被限流的客户端
+func (hs *HttpService) HandlerRateLimit(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	writeJson(w, 200, hs.ic.RateLimitInfos())
+}
+
+// HandlerStats 查看代理的状态
+func (hs *HttpService) HandlerStats(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	writeJson(w, 200, hs.ic.Stats())
+}
+
+// HandlerEvents 查看最近的后端状态事件
+func (hs *HttpService) HandlerEvents(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	writeJson(w, 200, hs.ic.Events())
+}
+
+// HandlerReplication GET 查看写入复制上限, PUT 修改, DELETE 取消
+func (hs *HttpService) HandlerReplication(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	var rc backend.ReplicationCap
+	switch req.Method {
+	case "GET":
+		writeJson(w, 200, hs.ic.ReplicationCap())
+		return
+	case "PUT":
+		err := json.NewDecoder(req.Body).Decode(&rc)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+	case "DELETE":
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	err := hs.ic.SetReplicationCap(rc, req.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	writeJson(w, 200, hs.ic.ReplicationCap())
+}
+
+// HandlerRoutes 查看当前的路由表
+func (hs *HttpService) HandlerRoutes(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	writeJson(w, 200, hs.ic.Routes())
+}
+
+// HandlerBackends /admin/backends/<name>/state 和 /admin/backends/<name>/drain
+func (hs *HttpService) HandlerBackends(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	path := strings.TrimPrefix(req.URL.Path, "/admin/backends/")
+	switch {
+	case strings.HasSuffix(path, "/state"):
+		hs.handlerBackendState(w, req, strings.TrimSuffix(path, "/state"))
+	case strings.HasSuffix(path, "/drain"):
+		hs.handlerBackendDrain(w, req, strings.TrimSuffix(path, "/drain"))
+	case strings.HasSuffix(path, "/spool"):
+		hs.handlerBackendSpool(w, req, strings.TrimSuffix(path, "/spool"))
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("not found\n"))
+	}
+}
+
+// handlerBackendState GET 查看后端状态, PUT 修改, DELETE 回到配置文件的状态
+func (hs *HttpService) handlerBackendState(w http.ResponseWriter, req *http.Request, name string) {
+	var state backend.BackendState
+	var err error
+	switch req.Method {
+	case "GET":
+		state, err = hs.ic.BackendState(name)
+	case "PUT":
+		var so backend.StateOverride
+		err = json.NewDecoder(req.Body).Decode(&so)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		state, err = hs.ic.SetBackendState(name, so, req.RemoteAddr)
+	case "DELETE":
+		state, err = hs.ic.ClearBackendState(name, req.RemoteAddr)
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	writeJson(w, 200, state)
+}
+
+// handlerBackendDrain POST 开始下线, force=true 时丢弃剩下的数据, GET 查看进度, DELETE 重新开始写入
+func (hs *HttpService) handlerBackendDrain(w http.ResponseWriter, req *http.Request, name string) {
+	var status backend.DrainStatus
+	var err error
+	switch req.Method {
+	case "GET":
+		status, err = hs.ic.DrainStatus(name)
+	case "POST":
+		force := req.FormValue("force") == "true"
+		status, err = hs.ic.StartDrain(name, force, req.RemoteAddr)
+	case "DELETE":
+		err = hs.ic.StopDrain(name, req.RemoteAddr)
+		if err == nil {
+			w.WriteHeader(204)
+			return
+		}
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	writeJson(w, 200, status)
+}
+
+// handlerBackendSpool GET 查看备份文件中的数据量, DELETE 清空备份文件
+func (hs *HttpService) handlerBackendSpool(w http.ResponseWriter, req *http.Request, name string) {
+	var status backend.SpoolStatus
+	var err error
+	switch req.Method {
+	case "GET":
+		status, err = hs.ic.SpoolStatus(name)
+	case "DELETE":
+		status, err = hs.ic.PurgeSpool(name, req.RemoteAddr)
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+	switch err {
+	case nil:
+		writeJson(w, 200, status)
+	case backend.ErrRewriteActive:
+		w.Header().Set("Retry-After", "1")
+		writeJson(w, 409, map[string]string{"error": err.Error()})
+	case backend.ErrBackendNotExist, backend.ErrNotSpoolable:
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error() + "\n"))
+	default:
+		writeJson(w, 500, map[string]string{"error": err.Error()})
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
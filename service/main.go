@@ -8,8 +8,10 @@ import (
 	"errors"
 	"flag"
 	"github.com/zxf0089216/influx-proxy/logs"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/zxf0089216/influx-proxy/backend"
@@ -25,7 +27,7 @@ var (
 
 func init() {
 
-	flag.StringVar(&ConfigFile, "config", "proxy.json", "proxy config file")
+	flag.StringVar(&ConfigFile, "config", "proxy.json", "proxy config files separated by commas, later ones take precedence")
 	flag.StringVar(&NodeName, "node", "l1", "node name")
 	flag.StringVar(&RavenDSN, "raven-dsn", "", "the sentry dsn, leave it empty if you not use sentry.")
 	flag.StringVar(&StoreDir, "data-dir", "data", "dir to store .dat .rec")
@@ -60,7 +62,7 @@ func main() {
 		}
 	}
 
-	fcs := backend.NewFileConfigSource(ConfigFile, NodeName)
+	fcs := backend.NewMultiFileConfigSource(strings.Split(ConfigFile, ","), NodeName)
 	nodecfg, err := fcs.LoadNode()
 	if err != nil {
 		logs.Errorf("config source load failed.")
@@ -70,21 +72,89 @@ func main() {
 	ic := backend.NewInfluxCluster(fcs, &nodecfg, StoreDir)
 	ic.LoadConfig()
 
-	mux := http.NewServeMux()
-	NewHttpService(ic).Register(mux)
-	logs.Info("http service start.")
-	server := &http.Server{
-		Addr:        nodecfg.ListenAddr,
-		Handler:     mux,
-		IdleTimeout: time.Duration(nodecfg.IdleTimeout) * time.Second,
+	hs := NewHttpService(ic)
+	if nodecfg.AdminListenAddr != "" {
+		admin := http.NewServeMux()
+		hs.RegisterAdmin(admin)
+		adminServer := &http.Server{
+			Addr:    nodecfg.AdminListenAddr,
+			Handler: admin,
+		}
+		ln, err := backend.Listen(nodecfg.AdminListenAddr, nodecfg.SocketMode)
+		if err != nil {
+			logs.Errorf("admin listen error: %s", err)
+			return
+		}
+		ic.OnClose(func() { adminServer.Close() })
+		go func() {
+			err := adminServer.Serve(ln)
+			if err != nil && err != http.ErrServerClosed {
+				logs.Errorf("admin server error: %s", err)
+			}
+		}()
+		logs.Infof("admin service start on %s.", nodecfg.AdminListenAddr)
 	}
-
+	idleTimeout := time.Duration(nodecfg.IdleTimeout) * time.Second
 	if nodecfg.IdleTimeout <= 0 {
-		server.IdleTimeout = 10 * time.Second
+		idleTimeout = 10 * time.Second
 	}
-	err = server.ListenAndServe()
-	if err != nil {
+
+	// one server for each address, all closed when one of them stops.
+	addrs := backend.ListenAddrs(nodecfg.ListenAddr)
+	servers := make([]*http.Server, 0, len(addrs))
+	listeners := make([]net.Listener, 0, len(addrs))
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		mux := http.NewServeMux()
+		err = hs.RegisterEndpoints(mux, nodecfg.ListenEndpoints[addr])
+		if err != nil {
+			return
+		}
+		ln, err := backend.Listen(addr, nodecfg.SocketMode)
+		if err != nil {
+			logs.Error(err)
+			return
+		}
+		listeners = append(listeners, ln)
+		server := &http.Server{
+			Addr:        addr,
+			Handler:     mux,
+			IdleTimeout: idleTimeout,
+		}
+		ic.OnClose(func() { server.Close() })
+		servers = append(servers, server)
+	}
+	for addr := range nodecfg.ListenEndpoints {
+		if !contains(addrs, addr) {
+			logs.Warningf("listenendpoints of %s is not in listenaddr", addr)
+		}
+	}
+
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, ln net.Listener) {
+			errs <- server.Serve(ln)
+		}(server, listeners[i])
+		logs.Infof("http service start on %s.", server.Addr)
+	}
+	err = <-errs
+	if err != nil && err != http.ErrServerClosed {
 		logs.Error(err)
-		return
 	}
 }
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}